@@ -0,0 +1,363 @@
+// Copyright 2024 The Cockroach Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package swiss
+
+import (
+	"bytes"
+	"context"
+	"flag"
+	"fmt"
+	"go/ast"
+	"go/build"
+	"go/parser"
+	"go/printer"
+	"go/token"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+var rewriteAPI = flag.Bool("rewrite-api", false, "rewrite testdata/api.txt")
+
+// TestAPI verifies that the exported API of the package matches
+// testdata/api.txt. A change to the exported API must be accompanied by an
+// update to the golden file (using -rewrite-api) so that it is visible in
+// review, and any removal or incompatible change to an existing declaration
+// requires a new major version. See the Compatibility section of README.md.
+func TestAPI(t *testing.T) {
+	// The API is the same regardless of the version of Go the test is run
+	// with, including the declarations only built by newer versions (e.g.
+	// WeakMap), so the release tags are fixed.
+	ctx := build.Default
+	ctx.ReleaseTags = nil
+	for i := 1; i <= 24; i++ {
+		ctx.ReleaseTags = append(ctx.ReleaseTags, fmt.Sprintf("go1.%d", i))
+	}
+	pkg, err := ctx.ImportDir(".", 0)
+	require.NoError(t, err)
+
+	fset := token.NewFileSet()
+	var lines []string
+	for _, name := range pkg.GoFiles {
+		f, err := parser.ParseFile(fset, name, nil, parser.SkipObjectResolution)
+		require.NoError(t, err)
+		lines = append(lines, apiDecls(fset, f)...)
+	}
+	sort.Strings(lines)
+	actual := strings.Join(lines, "\n") + "\n"
+
+	const golden = "testdata/api.txt"
+	if *rewriteAPI {
+		require.NoError(t, os.MkdirAll(filepath.Dir(golden), 0755))
+		require.NoError(t, os.WriteFile(golden, []byte(actual), 0644))
+		return
+	}
+	expected, err := os.ReadFile(golden)
+	require.NoError(t, err)
+	require.Equal(t, string(expected), actual,
+		"the exported API has changed: rerun with -rewrite-api if the change is intended")
+}
+
+// apiDecls returns a line for each exported declaration in f: functions,
+// methods on exported types, types along with their exported fields and
+// interface methods, constants, and variables.
+func apiDecls(fset *token.FileSet, f *ast.File) []string {
+	format := func(n ast.Node) string {
+		var buf bytes.Buffer
+		if err := printer.Fprint(&buf, fset, n); err != nil {
+			panic(err)
+		}
+		return strings.Join(strings.Fields(buf.String()), " ")
+	}
+
+	var lines []string
+	for _, decl := range f.Decls {
+		switch d := decl.(type) {
+		case *ast.FuncDecl:
+			if !d.Name.IsExported() {
+				continue
+			}
+			if d.Recv != nil && !ast.IsExported(recvTypeName(d.Recv.List[0].Type)) {
+				continue
+			}
+			fn := *d
+			fn.Doc, fn.Body = nil, nil
+			lines = append(lines, format(&fn))
+
+		case *ast.GenDecl:
+			for _, spec := range d.Specs {
+				switch s := spec.(type) {
+				case *ast.TypeSpec:
+					if !s.Name.IsExported() {
+						continue
+					}
+					lines = append(lines, apiTypeDecls(s, format)...)
+				case *ast.ValueSpec:
+					for _, name := range s.Names {
+						if !name.IsExported() {
+							continue
+						}
+						line := d.Tok.String() + " " + name.Name
+						if s.Type != nil {
+							line += " " + format(s.Type)
+						}
+						lines = append(lines, line)
+					}
+				}
+			}
+		}
+	}
+	return lines
+}
+
+// apiTypeDecls returns the lines for an exported type declaration.
+func apiTypeDecls(s *ast.TypeSpec, format func(ast.Node) string) []string {
+	name := s.Name.Name
+	decl := "type " + name
+	if s.TypeParams != nil {
+		decl = typeParamList(name, s.TypeParams, format)
+	}
+
+	switch t := s.Type.(type) {
+	case *ast.StructType:
+		lines := []string{decl + " struct"}
+		for _, field := range t.Fields.List {
+			for _, n := range field.Names {
+				if n.IsExported() {
+					lines = append(lines, fmt.Sprintf("field %s.%s %s", name, n.Name, format(field.Type)))
+				}
+			}
+			if len(field.Names) == 0 && ast.IsExported(recvTypeName(field.Type)) {
+				lines = append(lines, fmt.Sprintf("embedded %s.%s", name, format(field.Type)))
+			}
+		}
+		return lines
+	case *ast.InterfaceType:
+		lines := []string{decl + " interface"}
+		for _, method := range t.Methods.List {
+			for _, n := range method.Names {
+				// Unexported methods prevent implementations outside of the
+				// package, so they are part of the API as well.
+				lines = append(lines, fmt.Sprintf("method %s.%s%s", name, n.Name,
+					strings.TrimPrefix(format(method.Type), "func")))
+			}
+		}
+		return lines
+	default:
+		return []string{decl + " " + format(s.Type)}
+	}
+}
+
+// typeParamList formats the declaration of a generic type, e.g.
+// "type Map[K comparable, V any]".
+func typeParamList(name string, params *ast.FieldList, format func(ast.Node) string) string {
+	var parts []string
+	for _, field := range params.List {
+		var names []string
+		for _, n := range field.Names {
+			names = append(names, n.Name)
+		}
+		parts = append(parts, strings.Join(names, ", ")+" "+format(field.Type))
+	}
+	return "type " + name + "[" + strings.Join(parts, ", ") + "]"
+}
+
+// recvTypeName returns the name of the type of a method receiver or embedded
+// field, stripping any pointer and type parameters.
+func recvTypeName(expr ast.Expr) string {
+	for {
+		switch e := expr.(type) {
+		case *ast.StarExpr:
+			expr = e.X
+		case *ast.IndexExpr:
+			expr = e.X
+		case *ast.IndexListExpr:
+			expr = e.X
+		case *ast.SelectorExpr:
+			return e.Sel.Name
+		case *ast.Ident:
+			return e.Name
+		default:
+			return ""
+		}
+	}
+}
+
+// TestAPIGuarantees verifies the behavioral guarantees which users of the
+// package rely on beyond the signatures checked by TestAPI. A failure here
+// indicates a change in semantics which must be treated as a breaking change
+// (or the guarantee explicitly relaxed in the documentation).
+func TestAPIGuarantees(t *testing.T) {
+	t.Run("init-zero-value", func(t *testing.T) {
+		// A zero value Map (e.g. embedded in another struct) is usable after
+		// Init, and Init resets a map which is in use.
+		var m Map[int, int]
+		m.Init(0)
+		m.Put(1, 1)
+		require.Equal(t, 1, m.Len())
+		m.Init(0)
+		require.Equal(t, 0, m.Len())
+		_, ok := m.Get(1)
+		require.False(t, ok)
+	})
+
+	t.Run("get-put-delete", func(t *testing.T) {
+		m := New[int, string](0)
+		v, ok := m.Get(1)
+		require.False(t, ok)
+		require.Equal(t, "", v)
+		m.Put(1, "a")
+		m.Put(1, "b")
+		require.Equal(t, 1, m.Len())
+		v, ok = m.Get(1)
+		require.True(t, ok)
+		require.Equal(t, "b", v)
+		require.True(t, m.Delete(1))
+		require.False(t, m.Delete(1))
+		require.Equal(t, 0, m.Len())
+	})
+
+	t.Run("iteration-visits-each-entry-once", func(t *testing.T) {
+		m := New[int, int](0, WithMaxBucketCapacity[int, int](64))
+		for i := 0; i < 1000; i++ {
+			m.Put(i, i)
+		}
+		seen := make(map[int]int)
+		m.All(func(k, v int) bool {
+			seen[k]++
+			return true
+		})
+		require.Equal(t, 1000, len(seen))
+		for _, n := range seen {
+			require.Equal(t, 1, n)
+		}
+	})
+
+	t.Run("iteration-order-is-randomized", func(t *testing.T) {
+		// Users must not depend on the iteration order, which differs between
+		// iterations even if the map is not mutated.
+		m := New[int, int](0)
+		for i := 0; i < 100; i++ {
+			m.Put(i, i)
+		}
+		firsts := make(map[int]bool)
+		for i := 0; i < 100; i++ {
+			m.All(func(k, v int) bool {
+				firsts[k] = true
+				return false
+			})
+		}
+		require.Greater(t, len(firsts), 1)
+	})
+
+	t.Run("iteration-stops-early", func(t *testing.T) {
+		m := New[int, int](0)
+		for i := 0; i < 100; i++ {
+			m.Put(i, i)
+		}
+		var n int
+		m.All(func(k, v int) bool {
+			n++
+			return false
+		})
+		require.Equal(t, 1, n)
+	})
+
+	t.Run("all-live-skips-deleted-entries", func(t *testing.T) {
+		// All permits mutation during iteration without guaranteeing the
+		// mutations are visible, but AllLive never yields an entry which was
+		// deleted before it was reached.
+		m := New[int, int](0, WithMaxBucketCapacity[int, int](groupSize))
+		for i := 0; i < 1000; i++ {
+			m.Put(i, i)
+		}
+		deleted := make(map[int]bool)
+		m.AllLive(func(k, v int) bool {
+			require.False(t, deleted[k])
+			for j := 0; j < 1000; j += 7 {
+				if j != k && m.Delete(j) {
+					deleted[j] = true
+				}
+			}
+			return true
+		})
+	})
+
+	t.Run("clear", func(t *testing.T) {
+		m := New[int, int](0)
+		for i := 0; i < 100; i++ {
+			m.Put(i, i)
+		}
+		m.Clear()
+		require.Equal(t, 0, m.Len())
+		m.All(func(k, v int) bool {
+			t.Fatalf("unexpected entry %d after Clear", k)
+			return true
+		})
+		m.Put(1, 1)
+		require.Equal(t, 1, m.Len())
+	})
+
+	t.Run("close", func(t *testing.T) {
+		// Close returns all memory to the allocator and is idempotent. It is
+		// not required when using the default allocator.
+		a := &countingAllocator[int, int]{}
+		m := New[int, int](0, WithAllocator[int, int](a))
+		for i := 0; i < 1000; i++ {
+			m.Put(i, i)
+		}
+		m.Close()
+		require.Equal(t, a.alloc, a.free)
+		m.Close()
+		require.Equal(t, a.alloc, a.free)
+	})
+
+	t.Run("snapshot-independence", func(t *testing.T) {
+		m := New[int, int](0)
+		for i := 0; i < 100; i++ {
+			m.Put(i, i)
+		}
+		s := m.Snapshot()
+		m.Put(0, -1)
+		s.Delete(1)
+		v, _ := s.Get(0)
+		require.Equal(t, 0, v)
+		_, ok := m.Get(1)
+		require.True(t, ok)
+	})
+
+	t.Run("chan-closed-on-cancel", func(t *testing.T) {
+		m := New[int, int](0)
+		for i := 0; i < 100; i++ {
+			m.Put(i, i)
+		}
+		var n int
+		for range m.Chan(context.Background(), 0) {
+			n++
+		}
+		require.Equal(t, 100, n)
+
+		ctx, cancel := context.WithCancel(context.Background())
+		ch := m.Chan(ctx, 0)
+		<-ch
+		cancel()
+		for range ch {
+		}
+	})
+}
@@ -0,0 +1,291 @@
+// Copyright 2024 The Cockroach Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package swiss
+
+import (
+	"fmt"
+	"unsafe"
+)
+
+// Batch stages a set of mutations to a Map which are applied together by
+// Commit or discarded by Rollback. The map is not modified until Commit is
+// called. A Batch is created by Map.Batch.
+//
+// A Batch is intended for a small number of mutations relative to the size
+// of the map, such as applying a reloaded configuration: the mutations are
+// staged in a separate (Go) map rather than cloning the entire Map. Like Map,
+// a Batch is NOT goroutine-safe.
+type Batch[K comparable, V any] struct {
+	m *Map[K, V]
+	// ops holds the last mutation staged for each key.
+	ops map[K]batchOp[V]
+}
+
+type batchOp[V any] struct {
+	value V
+	del   bool
+}
+
+// Batch returns a new, empty Batch for staging mutations to the map.
+func (m *Map[K, V]) Batch() *Batch[K, V] {
+	return &Batch[K, V]{m: m}
+}
+
+// Put stages the insertion of an entry into the map, overwriting an existing
+// value if an entry with the same key already exists. A Put replaces any
+// mutation previously staged for key.
+func (tx *Batch[K, V]) Put(key K, value V) {
+	if tx.ops == nil {
+		tx.ops = make(map[K]batchOp[V])
+	}
+	tx.ops[key] = batchOp[V]{value: value}
+}
+
+// Delete stages the deletion of the entry corresponding to the specified key
+// from the map. A Delete replaces any mutation previously staged for key.
+func (tx *Batch[K, V]) Delete(key K) {
+	if tx.ops == nil {
+		tx.ops = make(map[K]batchOp[V])
+	}
+	tx.ops[key] = batchOp[V]{del: true}
+}
+
+// Get retrieves the value for the specified key as it would be after the
+// batch is committed, returning ok=false if the key would not be present.
+func (tx *Batch[K, V]) Get(key K) (value V, ok bool) {
+	if op, staged := tx.ops[key]; staged {
+		if op.del {
+			return value, false
+		}
+		return op.value, true
+	}
+	return tx.m.Get(key)
+}
+
+// Len returns the number of mutations staged in the batch.
+func (tx *Batch[K, V]) Len() int {
+	return len(tx.ops)
+}
+
+// Commit applies the staged mutations to the map and resets the batch so
+// that it may be reused. Every key is hashed and looked up, and the buckets
+// receiving new entries are grown (once) or split to hold all of their new
+// entries, before any entry in the map is modified. A panic from the hash
+// function or the allocator (e.g. an allocator which has run out of space)
+// therefore leaves the entries of the map unchanged, though some buckets may
+// have been copied from a snapshot, grown, or split. The batch is not reset
+// if Commit panics.
+func (tx *Batch[K, V]) Commit() {
+	if len(tx.ops) == 0 {
+		return
+	}
+	m := tx.m
+
+	// Determine which mutations modify the map and which of those insert new
+	// entries. The map is not modified.
+	var mutated, inserted []uintptr
+	for key, op := range tx.ops {
+		loc := m.find(key)
+		if loc.found || !op.del {
+			mutated = append(mutated, loc.h)
+		}
+		if !loc.found && !op.del {
+			inserted = append(inserted, loc.h)
+		}
+	}
+
+	// Perform all of the allocations needed to apply the mutations: copy the
+	// buckets shared with a snapshot, and pre-size the buckets so that
+	// inserting the new entries performs at most one resize per bucket
+	// rather than repeatedly doubling.
+	for _, h := range mutated {
+		m.mutableBucket(h)
+	}
+	m.reserve(inserted)
+
+	// Apply the mutations, none of which can allocate.
+	for key, op := range tx.ops {
+		loc := m.find(key)
+		switch {
+		case loc.found && op.del:
+			m.deleteAt(loc)
+		case loc.found:
+			*m.mutableLocation(loc).value() = op.value
+			if m.counters() != nil {
+				m.counters().overwrites++
+			}
+			if m.opLog() != nil {
+				m.opLog().put(m, key, op.value)
+			}
+		case !op.del:
+			m.insert(loc, key, op.value)
+		}
+	}
+	clear(tx.ops)
+}
+
+// Rollback discards the staged mutations, leaving the map unmodified, and
+// resets the batch so that it may be reused.
+func (tx *Batch[K, V]) Rollback() {
+	clear(tx.ops)
+}
+
+// putBatchPrefetchDistance is the number of entries ahead of the entry being
+// inserted by PutBatch whose memory is prefetched.
+const putBatchPrefetchDistance = 8
+
+// PutBatch inserts the entries (keys[i], values[i]) into the map, overwriting
+// the values of existing entries, with the same result as calling Put for
+// each pair in order. PutBatch panics if keys and values have different
+// lengths. It is intended for bulk loads: the keys are hashed and looked up
+// up front, and the buckets receiving new entries are grown (once) or split
+// to hold all of their new entries before any entry is inserted, rather than
+// repeatedly doubling. The entries are then inserted grouped by bucket. A
+// key which is repeated in keys is counted once when sizing its bucket.
+//
+// For a map configured with WithBucketLocks, WithMemoryLimit, or
+// WithOpLog, PutBatch calls Put for each pair.
+func (m *Map[K, V]) PutBatch(keys []K, values []V) {
+	if len(keys) != len(values) {
+		panic(fmt.Sprintf("PutBatch: len(keys)=%d does not equal len(values)=%d",
+			len(keys), len(values)))
+	}
+	if m.locks() != nil || m.memLimit() != nil || m.opLog() != nil {
+		for i := range keys {
+			m.Put(keys[i], values[i])
+		}
+		return
+	}
+	if len(keys) == 0 {
+		return
+	}
+	m.lazyInit()
+	if concurrentChecks {
+		m.startWrite()
+		defer m.endWrite()
+	}
+
+	// Hash the keys and determine which of them insert new entries. The map
+	// is not modified. Every key inserts a new entry into an empty map.
+	hashes := make([]uintptr, len(keys))
+	for i := range keys {
+		hashes[i] = m.hash(noescape(unsafe.Pointer(&keys[i])), m.seed)
+	}
+	inserted := hashes
+	if m.used > 0 {
+		inserted = nil
+		for i, h := range hashes {
+			if !m.findHashed(keys[i], h).found {
+				inserted = append(inserted, h)
+			}
+		}
+	}
+
+	// Copy the buckets receiving new entries which are shared with a
+	// snapshot, and pre-size them.
+	for _, h := range inserted {
+		m.mutableBucket(h)
+	}
+	m.reserve(inserted)
+
+	// Insert the entries grouped by bucket. The order of the entries in the
+	// same bucket is preserved so that the last value for a repeated key
+	// wins.
+	order := m.orderByBucket(hashes)
+	for k, i := range order {
+		// The keys are visited out of order, and a bucket of a large map
+		// does not fit in the CPU caches, so the key and the first group
+		// probed by the insertion putBatchPrefetchDistance entries ahead
+		// are prefetched (see GetBatch).
+		if j := k + putBatchPrefetchDistance; j < len(order) {
+			j = order[j]
+			b := m.bucket(hashes[j])
+			g := b.groups.At(uintptr(b.probe(hashes[j]).offset))
+			prefetchRange(unsafe.Pointer(g), unsafe.Sizeof(*g))
+			prefetchRange(unsafe.Pointer(&keys[j]), unsafe.Sizeof(keys[j]))
+		}
+		loc := m.findHashed(keys[i], hashes[i])
+		if !loc.found {
+			m.insert(loc, keys[i], values[i])
+			continue
+		}
+		*m.mutableLocation(loc).value() = values[i]
+		if m.counters() != nil {
+			m.counters().overwrites++
+		}
+	}
+}
+
+// DeleteBatch deletes the entries for the specified keys from the map in a
+// single pass, returning the number of entries deleted. Deleting entries can
+// leave tombstones behind which lengthen probe sequences. Rather than leaving
+// them to be dropped when an insertion finds the bucket has no room left to
+// grow, each bucket in which a significant fraction of the slots are
+// tombstones after the pass is rehashed in place, once (see DeleteFunc).
+//
+// For a map configured with WithBucketLocks or WithOpLog, DeleteBatch calls
+// Delete for each key.
+func (m *Map[K, V]) DeleteBatch(keys []K) int {
+	var deleted int
+	if m.locks() != nil || m.opLog() != nil {
+		for _, key := range keys {
+			if m.Delete(key) {
+				deleted++
+			}
+		}
+		return deleted
+	}
+	if len(keys) == 0 {
+		return 0
+	}
+	m.lazyInit()
+	if concurrentChecks {
+		m.startWrite()
+		defer m.endWrite()
+	}
+
+	// The directory indexes of the buckets in which a tombstone was left.
+	// Deleting never splits a bucket or grows the directory, so the indexes
+	// remain valid for the pass.
+	var tombstoned []uint32
+	for _, key := range keys {
+		loc := m.find(key)
+		if !loc.found {
+			continue
+		}
+		// See the comment in Delete for why a tombstone is only needed if
+		// the group is full.
+		tombstone := loc.g.ctrls.matchEmpty() == 0
+		m.deleteAt(loc)
+		deleted++
+		if index := loc.b.index; tombstone && (len(tombstoned) == 0 || tombstoned[len(tombstoned)-1] != index) {
+			tombstoned = append(tombstoned, index)
+		}
+	}
+
+	// Use the same threshold as rehash for dropping tombstones. A bucket
+	// which appears more than once is no longer over the threshold after it
+	// is first rehashed.
+	for _, index := range tombstoned {
+		b := m.dir.At(uintptr(index))
+		if b.capacity > groupSize && b.tombstones() >= b.capacity/3 {
+			b.rehashInPlace(m)
+		}
+	}
+	if invariants {
+		m.checkUsedInvariants()
+	}
+	return deleted
+}
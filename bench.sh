@@ -3,5 +3,7 @@
 go test -c
 ./swiss.test -test.v -test.run - -test.bench . -test.count 10 -test.benchmem -test.timeout 10h | tee out
 grep -v swissMap out | sed 's,/runtimeMap,,g' > out.runtime
-grep -v runtimeMap out | sed 's,/swissMap,,g' > out.swiss
+grep -v 'runtimeMap\|swissMapFlat' out | sed 's,/swissMap,,g' > out.swiss
+grep swissMapFlat out | sed 's,impl=swissMapFlat,impl=swissMap,g;s,/swissMap,,g' > out.flat
 benchstat out.runtime out.swiss
+benchstat out.swiss out.flat
@@ -17,8 +17,12 @@ package swiss
 import (
 	"fmt"
 	"io"
+	"math/rand"
+	"runtime"
 	"strconv"
+	"sync/atomic"
 	"testing"
+	"unsafe"
 
 	"github.com/aclements/go-perfevent/perfbench"
 )
@@ -28,8 +32,45 @@ func BenchmarkMapIter(b *testing.B) {
 		b.Run("t=Int", benchSizes(benchmarkRuntimeMapIter[int64], genKeys[int64]))
 	})
 	b.Run("impl=swissMap", func(b *testing.B) {
-		b.Run("t=Int", benchSizes(benchmarkSwissMapIter[int64], genKeys[int64]))
+		b.Run("t=Int", benchSizes(benchmarkSwissMapIter[int64](), genKeys[int64]))
 	})
+	b.Run("impl=swissMapFlat", func(b *testing.B) {
+		b.Run("t=Int", benchSizes(benchmarkSwissMapIter[int64](WithFlatTable[int64, int64]()), genKeys[int64]))
+	})
+}
+
+// BenchmarkMapIterLargeValues measures iterating over maps whose values are
+// large enough that loading them dominates the cost of iteration.
+func BenchmarkMapIterLargeValues(b *testing.B) {
+	b.Run("v=64B", benchmarkMapIterLargeValues[[8]int64])
+	b.Run("v=256B", benchmarkMapIterLargeValues[[32]int64])
+}
+
+func benchmarkMapIterLargeValues[V ~[8]int64 | ~[32]int64](b *testing.B) {
+	for _, n := range []int{1024, 1 << 14, 1 << 18} {
+		b.Run("len="+strconv.Itoa(n), func(b *testing.B) {
+			c := perfbench.Open(b)
+
+			m := New[int64, V](n)
+			for _, k := range genKeys[int64](0, n) {
+				var v V
+				v[0] = k
+				m.Put(k, v)
+			}
+			b.ResetTimer()
+			c.Reset()
+			var tmp int64
+			for i := 0; i < b.N; i++ {
+				m.All(func(k int64, v V) bool {
+					tmp += v[0]
+					return true
+				})
+			}
+			c.Stop()
+			b.StopTimer()
+			fmt.Fprint(io.Discard, tmp)
+		})
+	}
 }
 
 func BenchmarkMapGetHit(b *testing.B) {
@@ -39,10 +80,32 @@ func BenchmarkMapGetHit(b *testing.B) {
 		b.Run("t=String", benchSizes(benchmarkRuntimeMapGetHit[string], genKeys[string]))
 	})
 	b.Run("impl=swissMap", func(b *testing.B) {
-		b.Run("t=Int64", benchSizes(benchmarkSwissMapGetHit[int64], genKeys[int64]))
-		b.Run("t=Int32", benchSizes(benchmarkSwissMapGetHit[int32], genKeys[int32]))
-		b.Run("t=String", benchSizes(benchmarkSwissMapGetHit[string], genKeys[string]))
+		b.Run("t=Int64", benchSizes(benchmarkSwissMapGetHit[int64](), genKeys[int64]))
+		b.Run("t=Int32", benchSizes(benchmarkSwissMapGetHit[int32](), genKeys[int32]))
+		b.Run("t=String", benchSizes(benchmarkSwissMapGetHit[string](), genKeys[string]))
 	})
+	b.Run("impl=swissMapFlat", func(b *testing.B) {
+		b.Run("t=Int64", benchSizes(benchmarkSwissMapGetHit[int64](WithFlatTable[int64, int64]()), genKeys[int64]))
+	})
+	b.Run("impl=swissSmallMap", func(b *testing.B) {
+		b.Run("t=Int64", benchSizes(benchmarkSwissSmallMapGetHit[int64], genKeys[int64]))
+		b.Run("t=String", benchSizes(benchmarkSwissSmallMapGetHit[string], genKeys[string]))
+	})
+}
+
+// BenchmarkMapGetBatch compares looking up batches of 64 keys with Get and
+// with GetBatch. Each op is the lookup of one key.
+func BenchmarkMapGetBatch(b *testing.B) {
+	for _, batch := range []bool{false, true} {
+		impl := "Get"
+		if batch {
+			impl = "GetBatch"
+		}
+		b.Run("impl="+impl, func(b *testing.B) {
+			b.Run("t=Int64", benchSizes(benchmarkSwissMapGetBatch[int64](batch), genKeys[int64]))
+			b.Run("t=String", benchSizes(benchmarkSwissMapGetBatch[string](batch), genKeys[string]))
+		})
+	}
 }
 
 func BenchmarkMapGetMiss(b *testing.B) {
@@ -52,9 +115,12 @@ func BenchmarkMapGetMiss(b *testing.B) {
 		b.Run("t=String", benchSizes(benchmarkRuntimeMapGetMiss[string], genKeys[string]))
 	})
 	b.Run("impl=swissMap", func(b *testing.B) {
-		b.Run("t=Int64", benchSizes(benchmarkSwissMapGetMiss[int64], genKeys[int64]))
-		b.Run("t=Int32", benchSizes(benchmarkSwissMapGetMiss[int32], genKeys[int32]))
-		b.Run("t=String", benchSizes(benchmarkSwissMapGetMiss[string], genKeys[string]))
+		b.Run("t=Int64", benchSizes(benchmarkSwissMapGetMiss[int64](), genKeys[int64]))
+		b.Run("t=Int32", benchSizes(benchmarkSwissMapGetMiss[int32](), genKeys[int32]))
+		b.Run("t=String", benchSizes(benchmarkSwissMapGetMiss[string](), genKeys[string]))
+	})
+	b.Run("impl=swissMapFlat", func(b *testing.B) {
+		b.Run("t=Int64", benchSizes(benchmarkSwissMapGetMiss[int64](WithFlatTable[int64, int64]()), genKeys[int64]))
 	})
 }
 
@@ -65,9 +131,19 @@ func BenchmarkMapPutGrow(b *testing.B) {
 		b.Run("t=String", benchSizes(benchmarkRuntimeMapPutGrow[string], genKeys[string]))
 	})
 	b.Run("impl=swissMap", func(b *testing.B) {
-		b.Run("t=Int64", benchSizes(benchmarkSwissMapPutGrow[int64], genKeys[int64]))
-		b.Run("t=Int32", benchSizes(benchmarkSwissMapPutGrow[int32], genKeys[int32]))
-		b.Run("t=String", benchSizes(benchmarkSwissMapPutGrow[string], genKeys[string]))
+		b.Run("t=Int64", benchSizes(benchmarkSwissMapPutGrow[int64](), genKeys[int64]))
+		b.Run("t=Int32", benchSizes(benchmarkSwissMapPutGrow[int32](), genKeys[int32]))
+		b.Run("t=String", benchSizes(benchmarkSwissMapPutGrow[string](), genKeys[string]))
+	})
+	b.Run("impl=swissMapFlat", func(b *testing.B) {
+		b.Run("t=Int64", benchSizes(benchmarkSwissMapPutGrow[int64](WithFlatTable[int64, int64]()), genKeys[int64]))
+	})
+	b.Run("impl=swissMapCachedHash", func(b *testing.B) {
+		b.Run("t=String", benchSizes(benchmarkSwissMapPutGrow[string](WithCachedHash[string, string]()), genKeys[string]))
+	})
+	b.Run("impl=swissMapPutBatch", func(b *testing.B) {
+		b.Run("t=Int64", benchSizes(benchmarkSwissMapPutBatchGrow[int64], genKeys[int64]))
+		b.Run("t=String", benchSizes(benchmarkSwissMapPutBatchGrow[string], genKeys[string]))
 	})
 }
 
@@ -78,9 +154,12 @@ func BenchmarkMapPutPreAllocate(b *testing.B) {
 		b.Run("t=String", benchSizes(benchmarkRuntimeMapPutPreAllocate[string], genKeys[string]))
 	})
 	b.Run("impl=swissMap", func(b *testing.B) {
-		b.Run("t=Int64", benchSizes(benchmarkSwissMapPutPreAllocate[int64], genKeys[int64]))
-		b.Run("t=Int32", benchSizes(benchmarkSwissMapPutPreAllocate[int32], genKeys[int32]))
-		b.Run("t=String", benchSizes(benchmarkSwissMapPutPreAllocate[string], genKeys[string]))
+		b.Run("t=Int64", benchSizes(benchmarkSwissMapPutPreAllocate[int64](), genKeys[int64]))
+		b.Run("t=Int32", benchSizes(benchmarkSwissMapPutPreAllocate[int32](), genKeys[int32]))
+		b.Run("t=String", benchSizes(benchmarkSwissMapPutPreAllocate[string](), genKeys[string]))
+	})
+	b.Run("impl=swissMapFlat", func(b *testing.B) {
+		b.Run("t=Int64", benchSizes(benchmarkSwissMapPutPreAllocate[int64](WithFlatTable[int64, int64]()), genKeys[int64]))
 	})
 }
 
@@ -91,12 +170,30 @@ func BenchmarkMapPutReuse(b *testing.B) {
 		b.Run("t=String", benchSizes(benchmarkRuntimeMapPutReuse[string], genKeys[string]))
 	})
 	b.Run("impl=swissMap", func(b *testing.B) {
-		b.Run("t=Int64", benchSizes(benchmarkSwissMapPutReuse[int64], genKeys[int64]))
-		b.Run("t=Int32", benchSizes(benchmarkSwissMapPutReuse[int32], genKeys[int32]))
-		b.Run("t=String", benchSizes(benchmarkSwissMapPutReuse[string], genKeys[string]))
+		b.Run("t=Int64", benchSizes(benchmarkSwissMapPutReuse[int64](), genKeys[int64]))
+		b.Run("t=Int32", benchSizes(benchmarkSwissMapPutReuse[int32](), genKeys[int32]))
+		b.Run("t=String", benchSizes(benchmarkSwissMapPutReuse[string](), genKeys[string]))
+	})
+	b.Run("impl=swissMapFlat", func(b *testing.B) {
+		b.Run("t=Int64", benchSizes(benchmarkSwissMapPutReuse[int64](WithFlatTable[int64, int64]()), genKeys[int64]))
 	})
 }
 
+// BenchmarkMapPutReuseVarying measures a map reused for batches of varying
+// sizes (e.g. a pooled scratch map), cycling between batches of n, n/64, n/8,
+// and n/512 entries, which is the work performed by each iteration. The map
+// is emptied between batches with Clear, which retains the capacity of the
+// largest batch, with ClearWithHint given the size of the next batch, or
+// with Reset. The map-B/batch metric is the average size of the map (see
+// Map.SizeInBytes) holding a batch.
+func BenchmarkMapPutReuseVarying(b *testing.B) {
+	for _, impl := range []string{"Clear", "ClearWithHint", "Reset"} {
+		b.Run("impl="+impl, func(b *testing.B) {
+			b.Run("t=Int64", benchSizes(benchmarkSwissMapPutReuseVarying[int64](impl), genKeys[int64]))
+		})
+	}
+}
+
 func BenchmarkMapPutDelete(b *testing.B) {
 	b.Run("impl=runtimeMap", func(b *testing.B) {
 		b.Run("t=Int64", benchSizes(benchmarkRuntimeMapPutDelete[int64], genKeys[int64]))
@@ -104,10 +201,325 @@ func BenchmarkMapPutDelete(b *testing.B) {
 		b.Run("t=String", benchSizes(benchmarkRuntimeMapPutDelete[string], genKeys[string]))
 	})
 	b.Run("impl=swissMap", func(b *testing.B) {
-		b.Run("t=Int64", benchSizes(benchmarkSwissMapPutDelete[int64], genKeys[int64]))
-		b.Run("t=Int32", benchSizes(benchmarkSwissMapPutDelete[int32], genKeys[int32]))
-		b.Run("t=String", benchSizes(benchmarkSwissMapPutDelete[string], genKeys[string]))
+		b.Run("t=Int64", benchSizes(benchmarkSwissMapPutDelete[int64](), genKeys[int64]))
+		b.Run("t=Int32", benchSizes(benchmarkSwissMapPutDelete[int32](), genKeys[int32]))
+		b.Run("t=String", benchSizes(benchmarkSwissMapPutDelete[string](), genKeys[string]))
+	})
+	b.Run("impl=swissMapFlat", func(b *testing.B) {
+		b.Run("t=Int64", benchSizes(benchmarkSwissMapPutDelete[int64](WithFlatTable[int64, int64]()), genKeys[int64]))
+	})
+}
+
+// BenchmarkMatchH2 compares the SWAR and exact routines (and the NEON routine
+// when built with the "swiss_neon" build tag on arm64) for matching control
+// bytes against h2, reporting the false positive rate of each routine for the
+// groups probed when looking up real keys.
+func BenchmarkMatchH2(b *testing.B) {
+	impls := []string{"swar", "exact"}
+	if neonMatch {
+		impls = append(impls, "neon")
+	}
+	for _, impl := range impls {
+		b.Run("impl="+impl, func(b *testing.B) {
+			b.Run("t=Int64", benchSizes(benchmarkMatchH2[int64](impl), genKeys[int64]))
+			b.Run("t=String", benchSizes(benchmarkMatchH2[string](impl), genKeys[string]))
+		})
+	}
+}
+
+// BenchmarkBucket0 compares the inline and indirect (see WithIndirectBucket0)
+// representations of the bucket of a map containing a single bucket.
+func BenchmarkBucket0(b *testing.B) {
+	for _, impl := range []struct {
+		name    string
+		options []Option[int64, int64]
+	}{
+		{"inline", nil},
+		{"indirect", []Option[int64, int64]{WithIndirectBucket0[int64, int64]()}},
+	} {
+		b.Run("impl="+impl.name, func(b *testing.B) {
+			b.Run("op=GetHit", benchSizes(benchmarkBucket0GetHit(impl.options), genKeys[int64]))
+			b.Run("op=PutGrow", benchSizes(benchmarkBucket0PutGrow(impl.options), genKeys[int64]))
+		})
+	}
+}
+
+func benchmarkBucket0GetHit[T benchTypes](
+	options []Option[T, T],
+) func(b *testing.B, n int, genKeys func(start, end int) []T) {
+	return func(b *testing.B, n int, genKeys func(start, end int) []T) {
+		c := perfbench.Open(b)
+
+		m := New[T, T](n, options...)
+		keys := genKeys(0, n)
+		for _, k := range keys {
+			m.Put(k, k)
+		}
+		b.ResetTimer()
+		c.Reset()
+		var ok bool
+		for i := 0; i < b.N; i++ {
+			_, ok = m.Get(keys[i%n])
+		}
+		c.Stop()
+		b.StopTimer()
+		fmt.Fprint(io.Discard, ok)
+	}
+}
+
+func benchmarkBucket0PutGrow[T benchTypes](
+	options []Option[T, T],
+) func(b *testing.B, n int, genKeys func(start, end int) []T) {
+	return func(b *testing.B, n int, genKeys func(start, end int) []T) {
+		c := perfbench.Open(b)
+
+		var m Map[T, T]
+		keys := genKeys(0, n)
+		b.ResetTimer()
+		c.Reset()
+		for i := 0; i < b.N; i++ {
+			m.Init(0, options...)
+			for _, k := range keys {
+				m.Put(k, k)
+			}
+		}
+	}
+}
+
+// BenchmarkDirectory measures operations on maps composed of hundreds of
+// buckets, where locating a bucket requires indexing into the directory and,
+// for mutations, an additional indirection to the bucket at dir[b.index] (see
+// Map.mutableBucket).
+func BenchmarkDirectory(b *testing.B) {
+	for _, n := range []int{1 << 13, 1 << 15, 1 << 17} {
+		b.Run("len="+strconv.Itoa(n), func(b *testing.B) {
+			m := New[int64, int64](n, WithMaxBucketCapacity[int64, int64](64))
+			keys := genKeys[int64](0, n)
+			for _, k := range keys {
+				m.Put(k, k)
+			}
+			b.ReportMetric(float64(m.bucketCount()), "dir-entries")
+
+			b.Run("op=GetHit", func(b *testing.B) {
+				c := perfbench.Open(b)
+				var ok bool
+				for i := 0; i < b.N; i++ {
+					_, ok = m.Get(keys[i%n])
+				}
+				c.Stop()
+				b.StopTimer()
+				fmt.Fprint(io.Discard, ok)
+			})
+			b.Run("op=PutDelete", func(b *testing.B) {
+				c := perfbench.Open(b)
+				for i := 0; i < b.N; i++ {
+					j := i % n
+					m.Delete(keys[j])
+					m.Put(keys[j], keys[j])
+				}
+				c.Stop()
+			})
+		})
+	}
+}
+
+// BenchmarkClone compares Clone against copying a map by iterating over it and
+// inserting each entry into a new map of the same size.
+func BenchmarkClone(b *testing.B) {
+	b.Run("impl=putAll", benchSizes(benchmarkCopyPutAll[int64], genKeys[int64]))
+	b.Run("impl=clone", benchSizes(benchmarkCopyClone[int64], genKeys[int64]))
+}
+
+func benchmarkCopyPutAll[T benchTypes](b *testing.B, n int, genKeys func(start, end int) []T) {
+	c := perfbench.Open(b)
+
+	m := New[T, T](n)
+	for _, k := range genKeys(0, n) {
+		m.Put(k, k)
+	}
+	b.ResetTimer()
+	c.Reset()
+	for i := 0; i < b.N; i++ {
+		dst := New[T, T](m.Len())
+		m.All(func(k, v T) bool {
+			dst.Put(k, v)
+			return true
+		})
+	}
+}
+
+func benchmarkCopyClone[T benchTypes](b *testing.B, n int, genKeys func(start, end int) []T) {
+	c := perfbench.Open(b)
+
+	m := New[T, T](n)
+	for _, k := range genKeys(0, n) {
+		m.Put(k, k)
+	}
+	b.ResetTimer()
+	c.Reset()
+	for i := 0; i < b.N; i++ {
+		_ = m.Clone()
+	}
+}
+
+// BenchmarkClear measures clearing a map sized for n entries which holds few
+// or no entries, as is common for request-scoped maps which are cleared
+// unconditionally.
+func BenchmarkClear(b *testing.B) {
+	b.Run("fill=0", benchSizes(benchmarkClear[int64](0), genKeys[int64]))
+	b.Run("fill=1", benchSizes(benchmarkClear[int64](1), genKeys[int64]))
+}
+
+func benchmarkClear[T benchTypes](
+	fill int,
+) func(b *testing.B, n int, genKeys func(start, end int) []T) {
+	return func(b *testing.B, n int, genKeys func(start, end int) []T) {
+		c := perfbench.Open(b)
+
+		m := New[T, T](n)
+		keys := genKeys(0, fill)
+		b.ResetTimer()
+		c.Reset()
+		for i := 0; i < b.N; i++ {
+			for _, k := range keys {
+				m.Put(k, k)
+			}
+			m.Clear()
+		}
+	}
+}
+
+// BenchmarkMoveToFront measures the effect of WithMoveToFront on lookups of
+// keys with a Zipfian (skewed) distribution.
+func BenchmarkMoveToFront(b *testing.B) {
+	b.Run("impl=swissMap", benchSizes(benchmarkZipfGetHit[int64](), genKeys[int64]))
+	b.Run("impl=moveToFront", benchSizes(benchmarkZipfGetHit[int64](WithMoveToFront[int64, int64]()), genKeys[int64]))
+}
+
+func benchmarkZipfGetHit[T benchTypes](
+	options ...Option[T, T],
+) func(b *testing.B, n int, genKeys func(start, end int) []T) {
+	return func(b *testing.B, n int, genKeys func(start, end int) []T) {
+		c := perfbench.Open(b)
+
+		m := New[T, T](n, options...)
+		keys := genKeys(0, n)
+		for _, k := range keys {
+			m.Put(k, k)
+		}
+		rng := rand.New(rand.NewSource(1))
+		zipf := rand.NewZipf(rng, 1.1, 1, uint64(n-1))
+		order := make([]T, 1<<16)
+		for i := range order {
+			order[i] = keys[zipf.Uint64()]
+		}
+		b.ResetTimer()
+		c.Reset()
+		var ok bool
+		for i := 0; i < b.N; i++ {
+			_, ok = m.Get(order[i&(len(order)-1)])
+		}
+		c.Stop()
+		b.StopTimer()
+		fmt.Fprint(io.Discard, ok)
+	}
+}
+
+// BenchmarkConcurrentMap compares selecting the shard of a ConcurrentMap by
+// the hash of the key against selecting it by a hint. Each goroutine looks up
+// and (for 1 in 8 operations) overwrites keys of its own, and with hints uses
+// its worker id as the hint, so that every worker operates on its own shard.
+func BenchmarkConcurrentMap(b *testing.B) {
+	for _, hint := range []bool{false, true} {
+		impl := "hash"
+		if hint {
+			impl = "hint"
+		}
+		b.Run("impl="+impl, func(b *testing.B) {
+			const keysPerWorker = 1024
+			workers := runtime.GOMAXPROCS(0)
+			c := NewConcurrentMap[int64, int64](workers*keysPerWorker, WithShards[int64, int64](workers))
+			for w := 0; w < workers; w++ {
+				for i := 0; i < keysPerWorker; i++ {
+					k := int64(w*keysPerWorker + i)
+					if hint {
+						c.PutHint(uint(w), k, k)
+					} else {
+						c.Put(k, k)
+					}
+				}
+			}
+			var nextWorker atomic.Int64
+			b.ResetTimer()
+			b.RunParallel(func(pb *testing.PB) {
+				// RunParallel may start more goroutines than GOMAXPROCS if
+				// SetParallelism is used, so wrap around the workers.
+				w := int(nextWorker.Add(1)-1) % workers
+				base := int64(w * keysPerWorker)
+				var i int64
+				for pb.Next() {
+					k := base + i&(keysPerWorker-1)
+					if hint {
+						if i&7 == 0 {
+							c.PutHint(uint(w), k, i)
+						} else {
+							c.GetHint(uint(w), k)
+						}
+					} else {
+						if i&7 == 0 {
+							c.Put(k, i)
+						} else {
+							c.Get(k)
+						}
+					}
+					i++
+				}
+			})
+		})
+	}
+}
+
+// BenchmarkFixedKeyGetHit compares the runtime's hasher against the
+// specialized hash functions for fixed size byte array keys.
+func BenchmarkFixedKeyGetHit(b *testing.B) {
+	b.Run("impl=runtimeHasher", func(b *testing.B) {
+		b.Run("t=Bytes16", benchmarkFixedKeyGetHit[[16]byte](true))
+		b.Run("t=Bytes32", benchmarkFixedKeyGetHit[[32]byte](true))
 	})
+	b.Run("impl=fixedHasher", func(b *testing.B) {
+		b.Run("t=Bytes16", benchmarkFixedKeyGetHit[[16]byte](false))
+		b.Run("t=Bytes32", benchmarkFixedKeyGetHit[[32]byte](false))
+	})
+}
+
+func benchmarkFixedKeyGetHit[K comparable](runtimeHasher bool) func(*testing.B) {
+	return func(b *testing.B) {
+		for _, n := range []int{64, 4096, 1 << 16, 1 << 20} {
+			b.Run("len="+strconv.Itoa(n), func(b *testing.B) {
+				c := perfbench.Open(b)
+
+				rng := rand.New(rand.NewSource(1))
+				m := New[K, int](n)
+				if runtimeHasher {
+					m.hash = getRuntimeHasher[K](newHashSeed())
+				}
+				keys := make([]K, n)
+				for i := range keys {
+					rng.Read(unsafe.Slice((*byte)(unsafe.Pointer(&keys[i])), unsafe.Sizeof(keys[i])))
+					m.Put(keys[i], i)
+				}
+				b.ResetTimer()
+				c.Reset()
+				var ok bool
+				for i := 0; i < b.N; i++ {
+					_, ok = m.Get(keys[i%n])
+				}
+				c.Stop()
+				b.StopTimer()
+				fmt.Fprint(io.Discard, ok)
+			})
+		}
+	}
 }
 
 type benchTypes interface {
@@ -118,7 +530,8 @@ func benchSizes[T benchTypes](
 	f func(b *testing.B, n int, genKeys func(start, end int) []T), genKeys func(start, end int) []T,
 ) func(*testing.B) {
 	var cases = []int{
-		6, 12, 18, 24, 30,
+		1, 2, 3, 4, 5, 6, 7,
+		12, 18, 24, 30,
 		64,
 		128,
 		256,
@@ -184,22 +597,26 @@ func benchmarkRuntimeMapIter[T benchTypes](b *testing.B, n int, genKeys func(sta
 	}
 }
 
-func benchmarkSwissMapIter[T benchTypes](b *testing.B, n int, genKeys func(start, end int) []T) {
-	c := perfbench.Open(b)
+func benchmarkSwissMapIter[T benchTypes](
+	options ...Option[T, T],
+) func(b *testing.B, n int, genKeys func(start, end int) []T) {
+	return func(b *testing.B, n int, genKeys func(start, end int) []T) {
+		c := perfbench.Open(b)
 
-	m := New[T, T](n)
-	keys := genKeys(0, n)
-	for _, k := range keys {
-		m.Put(k, k)
-	}
-	b.ResetTimer()
-	c.Reset()
-	var tmp T
-	for i := 0; i < b.N; i++ {
-		m.All(func(k, v T) bool {
-			tmp += k + v
-			return true
-		})
+		m := New[T, T](n, options...)
+		keys := genKeys(0, n)
+		for _, k := range keys {
+			m.Put(k, k)
+		}
+		b.ResetTimer()
+		c.Reset()
+		var tmp T
+		for i := 0; i < b.N; i++ {
+			m.All(func(k, v T) bool {
+				tmp += k + v
+				return true
+			})
+		}
 	}
 }
 
@@ -221,35 +638,39 @@ func benchmarkRuntimeMapGetMiss[T benchTypes](
 	}
 }
 
-func benchmarkSwissMapGetMiss[T comparable](b *testing.B, n int, genKeys func(start, end int) []T) {
-	c := perfbench.Open(b)
+func benchmarkSwissMapGetMiss[T comparable](
+	options ...Option[T, T],
+) func(b *testing.B, n int, genKeys func(start, end int) []T) {
+	return func(b *testing.B, n int, genKeys func(start, end int) []T) {
+		c := perfbench.Open(b)
 
-	m := New[T, T](0)
-	keys := genKeys(0, n)
-	miss := genKeys(-n, 0)
-	for j := range keys {
-		m.Put(keys[j], keys[j])
-	}
-	b.ResetTimer()
-	c.Reset()
-	var ok bool
-	for i := 0; i < b.N; i++ {
-		_, ok = m.Get(miss[i%len(miss)])
-	}
-	c.Stop()
-	b.StopTimer()
-	fmt.Fprint(io.Discard, ok)
+		m := New[T, T](0, options...)
+		keys := genKeys(0, n)
+		miss := genKeys(-n, 0)
+		for j := range keys {
+			m.Put(keys[j], keys[j])
+		}
+		b.ResetTimer()
+		c.Reset()
+		var ok bool
+		for i := 0; i < b.N; i++ {
+			_, ok = m.Get(miss[i%len(miss)])
+		}
+		c.Stop()
+		b.StopTimer()
+		fmt.Fprint(io.Discard, ok)
 
-	b.ReportMetric(float64(m.Len())/float64(m.capacity()), "load")
+		b.ReportMetric(float64(m.Len())/float64(m.capacity()), "load")
 
-	var fullGroups uint32
-	var groupsCount uint32
-	m.buckets(0, func(b *bucket[T, T]) bool {
-		fullGroups += b.fullGroups()
-		groupsCount += b.groupMask + 1
-		return true
-	})
-	b.ReportMetric(100*float64(fullGroups)/float64(groupsCount), "%fullgrp")
+		var fullGroups uint32
+		var groupsCount uint32
+		m.buckets(0, func(b *bucket[T, T]) bool {
+			fullGroups += b.fullGroups()
+			groupsCount += b.groupCount()
+			return true
+		})
+		b.ReportMetric(100*float64(fullGroups)/float64(groupsCount), "%fullgrp")
+	}
 }
 
 func benchmarkRuntimeMapGetHit[T benchTypes](
@@ -277,10 +698,35 @@ func benchmarkRuntimeMapGetHit[T benchTypes](
 	}
 }
 
-func benchmarkSwissMapGetHit[T benchTypes](b *testing.B, n int, genKeys func(start, end int) []T) {
+func benchmarkSwissMapGetHit[T benchTypes](
+	options ...Option[T, T],
+) func(b *testing.B, n int, genKeys func(start, end int) []T) {
+	return func(b *testing.B, n int, genKeys func(start, end int) []T) {
+		c := perfbench.Open(b)
+
+		m := New[T, T](n, options...)
+		keys := genKeys(0, n)
+		for _, k := range keys {
+			m.Put(k, k)
+		}
+		b.ResetTimer()
+		c.Reset()
+		var ok bool
+		for i := 0; i < b.N; i++ {
+			_, ok = m.Get(keys[i%n])
+		}
+		c.Stop()
+		b.StopTimer()
+		fmt.Fprint(io.Discard, ok)
+	}
+}
+
+func benchmarkSwissSmallMapGetHit[T benchTypes](
+	b *testing.B, n int, genKeys func(start, end int) []T,
+) {
 	c := perfbench.Open(b)
 
-	m := New[T, T](n)
+	var m SmallMap[T, T]
 	keys := genKeys(0, n)
 	for _, k := range keys {
 		m.Put(k, k)
@@ -296,6 +742,42 @@ func benchmarkSwissMapGetHit[T benchTypes](b *testing.B, n int, genKeys func(sta
 	fmt.Fprint(io.Discard, ok)
 }
 
+func benchmarkSwissMapGetBatch[T benchTypes](
+	batch bool,
+) func(b *testing.B, n int, genKeys func(start, end int) []T) {
+	return func(b *testing.B, n int, genKeys func(start, end int) []T) {
+		c := perfbench.Open(b)
+
+		const batchSize = 64
+		m := New[T, T](n)
+		keys := genKeys(0, n)
+		for _, k := range keys {
+			m.Put(k, k)
+		}
+		for len(keys) < batchSize {
+			keys = append(keys, keys...)
+		}
+		values := make([]T, batchSize)
+		found := make([]bool, batchSize)
+		b.ResetTimer()
+		c.Reset()
+		for i := 0; i < b.N; i += batchSize {
+			j := i % (len(keys) - batchSize + 1)
+			batchKeys := keys[j : j+batchSize]
+			if batch {
+				m.GetBatch(batchKeys, values, found)
+			} else {
+				for k, key := range batchKeys {
+					values[k], found[k] = m.Get(key)
+				}
+			}
+		}
+		c.Stop()
+		b.StopTimer()
+		fmt.Fprint(io.Discard, found[0])
+	}
+}
+
 func benchmarkRuntimeMapPutGrow[T benchTypes](
 	b *testing.B, n int, genKeys func(start, end int) []T,
 ) {
@@ -312,7 +794,11 @@ func benchmarkRuntimeMapPutGrow[T benchTypes](
 	}
 }
 
-func benchmarkSwissMapPutGrow[T benchTypes](b *testing.B, n int, genKeys func(start, end int) []T) {
+// benchmarkSwissMapPutBatchGrow is benchmarkSwissMapPutGrow with the keys
+// inserted by a single call to PutBatch.
+func benchmarkSwissMapPutBatchGrow[T benchTypes](
+	b *testing.B, n int, genKeys func(start, end int) []T,
+) {
 	c := perfbench.Open(b)
 
 	var m Map[T, T]
@@ -321,8 +807,25 @@ func benchmarkSwissMapPutGrow[T benchTypes](b *testing.B, n int, genKeys func(st
 	c.Reset()
 	for i := 0; i < b.N; i++ {
 		m.Init(0)
-		for _, k := range keys {
-			m.Put(k, k)
+		m.PutBatch(keys, keys)
+	}
+}
+
+func benchmarkSwissMapPutGrow[T benchTypes](
+	options ...Option[T, T],
+) func(b *testing.B, n int, genKeys func(start, end int) []T) {
+	return func(b *testing.B, n int, genKeys func(start, end int) []T) {
+		c := perfbench.Open(b)
+
+		var m Map[T, T]
+		keys := genKeys(0, n)
+		b.ResetTimer()
+		c.Reset()
+		for i := 0; i < b.N; i++ {
+			m.Init(0, options...)
+			for _, k := range keys {
+				m.Put(k, k)
+			}
 		}
 	}
 }
@@ -344,18 +847,20 @@ func benchmarkRuntimeMapPutPreAllocate[T benchTypes](
 }
 
 func benchmarkSwissMapPutPreAllocate[T benchTypes](
-	b *testing.B, n int, genKeys func(start, end int) []T,
-) {
-	c := perfbench.Open(b)
+	options ...Option[T, T],
+) func(b *testing.B, n int, genKeys func(start, end int) []T) {
+	return func(b *testing.B, n int, genKeys func(start, end int) []T) {
+		c := perfbench.Open(b)
 
-	var m Map[T, T]
-	keys := genKeys(0, n)
-	b.ResetTimer()
-	c.Reset()
-	for i := 0; i < b.N; i++ {
-		m.Init(n)
-		for _, k := range keys {
-			m.Put(k, k)
+		var m Map[T, T]
+		keys := genKeys(0, n)
+		b.ResetTimer()
+		c.Reset()
+		for i := 0; i < b.N; i++ {
+			m.Init(n, options...)
+			for _, k := range keys {
+				m.Put(k, k)
+			}
 		}
 	}
 }
@@ -380,19 +885,55 @@ func benchmarkRuntimeMapPutReuse[T benchTypes](
 }
 
 func benchmarkSwissMapPutReuse[T benchTypes](
-	b *testing.B, n int, genKeys func(start, end int) []T,
-) {
-	c := perfbench.Open(b)
+	options ...Option[T, T],
+) func(b *testing.B, n int, genKeys func(start, end int) []T) {
+	return func(b *testing.B, n int, genKeys func(start, end int) []T) {
+		c := perfbench.Open(b)
 
-	m := New[T, T](n)
-	keys := genKeys(0, n)
-	b.ResetTimer()
-	c.Reset()
-	for i := 0; i < b.N; i++ {
-		for _, k := range keys {
-			m.Put(k, k)
+		m := New[T, T](n, options...)
+		keys := genKeys(0, n)
+		b.ResetTimer()
+		c.Reset()
+		for i := 0; i < b.N; i++ {
+			for _, k := range keys {
+				m.Put(k, k)
+			}
+			m.Clear()
+		}
+	}
+}
+
+func benchmarkSwissMapPutReuseVarying[T benchTypes](
+	impl string,
+) func(b *testing.B, n int, genKeys func(start, end int) []T) {
+	return func(b *testing.B, n int, genKeys func(start, end int) []T) {
+		c := perfbench.Open(b)
+
+		var batches [][]T
+		for _, shift := range []int{0, 6, 3, 9} {
+			batches = append(batches, genKeys(0, max(n>>shift, 1)))
+		}
+		m := New[T, T](0)
+		var size int64
+		b.ResetTimer()
+		c.Reset()
+		for i := 0; i < b.N; i++ {
+			for j, keys := range batches {
+				for _, k := range keys {
+					m.Put(k, k)
+				}
+				size += m.SizeInBytes()
+				switch impl {
+				case "Clear":
+					m.Clear()
+				case "ClearWithHint":
+					m.ClearWithHint(len(batches[(j+1)%len(batches)]))
+				case "Reset":
+					m.Reset()
+				}
+			}
 		}
-		m.Clear()
+		b.ReportMetric(float64(size)/float64(b.N*len(batches)), "map-B/batch")
 	}
 }
 
@@ -416,20 +957,72 @@ func benchmarkRuntimeMapPutDelete[T benchTypes](
 }
 
 func benchmarkSwissMapPutDelete[T benchTypes](
-	b *testing.B, n int, genKeys func(start, end int) []T,
-) {
-	c := perfbench.Open(b)
+	options ...Option[T, T],
+) func(b *testing.B, n int, genKeys func(start, end int) []T) {
+	return func(b *testing.B, n int, genKeys func(start, end int) []T) {
+		c := perfbench.Open(b)
 
-	m := New[T, T](n)
-	keys := genKeys(0, n)
-	for _, k := range keys {
-		m.Put(k, k)
+		m := New[T, T](n, options...)
+		keys := genKeys(0, n)
+		for _, k := range keys {
+			m.Put(k, k)
+		}
+		b.ResetTimer()
+		c.Reset()
+		for i := 0; i < b.N; i++ {
+			j := i % n
+			m.Delete(keys[j])
+			m.Put(keys[j], keys[j])
+		}
 	}
-	b.ResetTimer()
-	c.Reset()
-	for i := 0; i < b.N; i++ {
-		j := i % n
-		m.Delete(keys[j])
-		m.Put(keys[j], keys[j])
+}
+
+func benchmarkMatchH2[T benchTypes](
+	impl string,
+) func(b *testing.B, n int, genKeys func(start, end int) []T) {
+	return func(b *testing.B, n int, genKeys func(start, end int) []T) {
+		c := perfbench.Open(b)
+
+		m := New[T, T](n)
+		keys := genKeys(0, n)
+		for _, k := range keys {
+			m.Put(k, k)
+		}
+		s := probeH2Stats(m, keys)
+
+		// Capture the control bytes of the first group probed for each key.
+		ctrls := make([]ctrlGroup, n)
+		h2s := make([]uintptr, n)
+		for i := range keys {
+			h := m.hash(noescape(unsafe.Pointer(&keys[i])), m.seed)
+			bucket := m.bucket(h)
+			ctrls[i] = bucket.groups.At(uintptr(bucket.probe(h).offset)).ctrls
+			h2s[i] = h2(h)
+		}
+
+		b.ResetTimer()
+		c.Reset()
+		var match bitset
+		for i := 0; i < b.N; i++ {
+			j := i % n
+			switch impl {
+			case "swar":
+				match |= ctrls[j].matchH2SWAR(h2s[j])
+			case "exact":
+				match |= ctrls[j].matchH2Exact(h2s[j])
+			case "neon":
+				match |= matchH2NEON(&ctrls[j], h2s[j])
+			}
+		}
+		c.Stop()
+		b.StopTimer()
+		fmt.Fprint(io.Discard, match)
+
+		falsePositives := s.FalsePositives
+		if impl != "swar" {
+			falsePositives = 0
+		}
+		b.ReportMetric(float64(falsePositives)/float64(s.Matches), "falsepos/match")
+		b.ReportMetric(float64(s.Groups)/float64(s.Keys), "groups/key")
 	}
 }
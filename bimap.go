@@ -0,0 +1,123 @@
+// Copyright 2024 The Cockroach Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package swiss
+
+import "fmt"
+
+// BiMap is a bidirectional map in which each key maps to a unique value,
+// allowing entries to be looked up and deleted by either their key or their
+// value. A BiMap is composed of two Maps, from keys to values and from values
+// to keys, which are kept synchronized by every mutation.
+//
+// The zero value for a BiMap is an empty map ready to use. Like Map, a BiMap
+// is NOT goroutine-safe.
+type BiMap[K, V comparable] struct {
+	forward Map[K, V]
+	reverse Map[V, K]
+}
+
+// NewBiMap constructs a new BiMap with the specified initial capacity (see
+// New).
+func NewBiMap[K, V comparable](initialCapacity int) *BiMap[K, V] {
+	bm := &BiMap[K, V]{}
+	bm.forward.Init(initialCapacity)
+	bm.reverse.Init(initialCapacity)
+	return bm
+}
+
+// Put inserts an entry into the map, replacing both the entry with the same
+// key and the entry with the same value, if either exists.
+func (bm *BiMap[K, V]) Put(key K, value V) {
+	if k, ok := bm.reverse.Get(value); ok {
+		if k == key {
+			return
+		}
+		bm.forward.Delete(k)
+	}
+	if v, ok := bm.forward.Get(key); ok {
+		bm.reverse.Delete(v)
+	}
+	bm.forward.Put(key, value)
+	bm.reverse.Put(value, key)
+	bm.checkInvariants()
+}
+
+// PutEnforcingUniqueness is like Put, but if value is already associated with
+// a different key the map is left unchanged and false is returned. An entry
+// with the same key (and a different value) is replaced.
+func (bm *BiMap[K, V]) PutEnforcingUniqueness(key K, value V) bool {
+	if k, ok := bm.reverse.Get(value); ok {
+		return k == key
+	}
+	if v, ok := bm.forward.Get(key); ok {
+		bm.reverse.Delete(v)
+	}
+	bm.forward.Put(key, value)
+	bm.reverse.Put(value, key)
+	bm.checkInvariants()
+	return true
+}
+
+// Get retrieves the value for the specified key, returning ok=false if the
+// key is not present.
+func (bm *BiMap[K, V]) Get(key K) (value V, ok bool) {
+	return bm.forward.Get(key)
+}
+
+// GetByValue retrieves the key for the specified value, returning ok=false if
+// the value is not present.
+func (bm *BiMap[K, V]) GetByValue(value V) (key K, ok bool) {
+	return bm.reverse.Get(value)
+}
+
+// Delete deletes the entry with the specified key, returning true if the key
+// was present.
+func (bm *BiMap[K, V]) Delete(key K) bool {
+	v, ok := bm.forward.Pop(key)
+	if ok {
+		bm.reverse.Delete(v)
+		bm.checkInvariants()
+	}
+	return ok
+}
+
+// DeleteByValue deletes the entry with the specified value, returning true if
+// the value was present.
+func (bm *BiMap[K, V]) DeleteByValue(value V) bool {
+	k, ok := bm.reverse.Pop(value)
+	if ok {
+		bm.forward.Delete(k)
+		bm.checkInvariants()
+	}
+	return ok
+}
+
+// Len returns the number of entries in the map.
+func (bm *BiMap[K, V]) Len() int {
+	return bm.forward.Len()
+}
+
+// All calls yield sequentially for each key and value present in the map
+// (see Map.All).
+func (bm *BiMap[K, V]) All(yield func(key K, value V) bool) {
+	bm.forward.All(yield)
+}
+
+func (bm *BiMap[K, V]) checkInvariants() {
+	if invariants && bm.forward.Len() != bm.reverse.Len() {
+		panic(fmt.Sprintf("invariant failed: forward map has %d entries, but reverse map has %d",
+			bm.forward.Len(), bm.reverse.Len()))
+	}
+}
@@ -0,0 +1,232 @@
+// Copyright 2024 The Cockroach Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package swiss
+
+import (
+	"fmt"
+	"math/bits"
+	"runtime"
+	"sync"
+	"sync/atomic"
+	"unsafe"
+)
+
+// bucketLocks is the state of the WithBucketLocks option.
+//
+// Every key maps to exactly one bucket, so operations on keys in different
+// buckets may proceed in parallel. The directory is guarded by dir, and each
+// bucket by one of the stripes, selected by the bucket's index in the
+// directory (see bucket.index). Get, Put, and Delete hold dir for reading and
+// the stripe of the key's bucket while they look up, insert, overwrite, or
+// delete the entry in place. Inserting an entry into a bucket without room
+// left to grow rehashes the bucket, which may split the bucket and grow the
+// directory, and installs the rehashed bucket into (possibly several entries
+// of) the directory, so it is performed holding dir for writing. As the
+// directory is only mutated with dir held for writing, the index of the
+// bucket for a key is stable while dir is held for reading.
+//
+// The entries of the map are counted by Map.used, which is updated
+// atomically when dir is held for reading.
+type bucketLocks struct {
+	dir     sync.RWMutex
+	stripes []lockStripe
+	// shift is 32 minus log2 of the number of stripes.
+	shift uint32
+}
+
+// lockStripe is a mutex guarding the buckets whose index maps to it.
+type lockStripe struct {
+	mu sync.Mutex
+	// Pad the stripe so that adjacent stripes do not share a cache line.
+	_ [64]byte
+}
+
+// newBucketLocks returns bucket locks with n stripes, rounded up to a power
+// of 2. If n <= 0, the number of stripes defaults to 4 times GOMAXPROCS.
+func newBucketLocks(n int) *bucketLocks {
+	if n <= 0 {
+		n = 4 * runtime.GOMAXPROCS(0)
+	}
+	stripeBits := uint32(bits.Len(uint(n - 1)))
+	return &bucketLocks{
+		stripes: make([]lockStripe, 1<<stripeBits),
+		shift:   32 - stripeBits,
+	}
+}
+
+// stripe returns the stripe guarding the bucket at the specified index.
+func (l *bucketLocks) stripe(index uint32) *lockStripe {
+	// Mix the index, as the indexes of buckets with a local depth less than
+	// the global depth share their low bits.
+	return &l.stripes[(index*0x9e3779b9)>>l.shift]
+}
+
+// checkBucketLocks panics if m was configured with an option which mutates
+// the map during lookups, or which invokes a callback that may access the
+// map, as neither can be performed safely holding a stripe.
+func (m *Map[K, V]) checkBucketLocks() {
+	var unsupported string
+	switch {
+	case m.moveToFront():
+		unsupported = "WithMoveToFront"
+	case m.negCache() != nil:
+		unsupported = "WithNegativeCache"
+	case m.counters() != nil:
+		unsupported = "WithOperationCounters"
+	case m.hashTiming() != nil:
+		unsupported = "WithHashTiming"
+	case m.opLog() != nil:
+		unsupported = "WithOpLog"
+	case m.memLimit() != nil:
+		unsupported = "WithMemoryLimit"
+	case m.loadWatch() != nil:
+		unsupported = "WithLoadFactorWatch"
+	case m.cachedHash():
+		unsupported = "WithCachedHash"
+	default:
+		return
+	}
+	panic(fmt.Sprintf("%s is not supported with WithBucketLocks", unsupported))
+}
+
+// addUsed atomically adds delta to m.used. An int has the size of a uintptr
+// on every platform supported by Go.
+func (m *Map[K, V]) addUsed(delta int) {
+	atomic.AddUintptr((*uintptr)(unsafe.Pointer(&m.used)), uintptr(delta))
+}
+
+// lockedLen implements Len for a map with bucket locks. dir is locked for
+// reading, as m.used is updated non-atomically with dir locked for writing.
+func (m *Map[K, V]) lockedLen() int {
+	m.locks().dir.RLock()
+	n := atomic.LoadUintptr((*uintptr)(unsafe.Pointer(&m.used)))
+	m.locks().dir.RUnlock()
+	return int(n)
+}
+
+// lockBucket locks dir for reading and the stripe of the bucket for the key
+// with hash h, which it returns.
+func (m *Map[K, V]) lockBucket(h uintptr) *lockStripe {
+	m.locks().dir.RLock()
+	s := m.locks().stripe(m.bucket(h).index)
+	s.mu.Lock()
+	return s
+}
+
+// unlockBucket unlocks the stripe returned by lockBucket, and dir.
+func (m *Map[K, V]) unlockBucket(s *lockStripe) {
+	s.mu.Unlock()
+	m.locks().dir.RUnlock()
+}
+
+// lockedGet implements Get for a map with bucket locks.
+func (m *Map[K, V]) lockedGet(key K) (value V, ok bool) {
+	h := m.hash(noescape(unsafe.Pointer(&key)), m.seed)
+	s := m.lockBucket(h)
+	if loc := m.findHashed(key, h); loc.found {
+		value, ok = *loc.value(), true
+	}
+	m.unlockBucket(s)
+	return value, ok
+}
+
+// getInAll is Get for use by the yield function of All. All holds dir of a
+// map with bucket locks for writing, so the key is looked up without locking,
+// as Get would deadlock.
+func (m *Map[K, V]) getInAll(key K) (value V, ok bool) {
+	if m.locks() == nil {
+		return m.Get(key)
+	}
+	if loc := m.find(key); loc.found {
+		value, ok = *loc.value(), true
+	}
+	return value, ok
+}
+
+// lockedPut implements Put for a map with bucket locks. The entry is
+// inserted or overwritten in place unless the bucket is shared with a
+// snapshot or has no room left to grow, in which case dir is locked for
+// writing in order to copy or rehash the bucket.
+func (m *Map[K, V]) lockedPut(key K, value V) {
+	h := m.hash(noescape(unsafe.Pointer(&key)), m.seed)
+	s := m.lockBucket(h)
+	loc := m.findHashed(key, h)
+	b := loc.b
+	if !b.shared {
+		if loc.found {
+			*loc.value() = value
+			m.unlockBucket(s)
+			return
+		}
+		if c := loc.g.ctrls.Get(loc.i); b.growthLeft > 0 || c == ctrlDeleted {
+			loc.g.slots.Set(loc.i, key, value)
+			if c == ctrlEmpty {
+				b.growthLeft--
+			}
+			loc.g.ctrls.Set(loc.i, ctrl(h2(b.slotHash(m, (*K)(noescape(unsafe.Pointer(&key))), h))))
+			b.used++
+			m.addUsed(1)
+			b.checkInvariants(m)
+			m.unlockBucket(s)
+			return
+		}
+	}
+	m.unlockBucket(s)
+
+	m.locks().dir.Lock()
+	defer m.locks().dir.Unlock()
+	if loc := m.findHashed(key, h); loc.found {
+		*m.mutableLocation(loc).value() = value
+	} else {
+		m.insert(loc, key, value)
+	}
+}
+
+// lockedDelete implements Delete for a map with bucket locks. Like
+// lockedPut, the entry is deleted in place unless the bucket is shared with
+// a snapshot.
+func (m *Map[K, V]) lockedDelete(key K) bool {
+	h := m.hash(noescape(unsafe.Pointer(&key)), m.seed)
+	s := m.lockBucket(h)
+	loc := m.findHashed(key, h)
+	if !loc.found || !loc.b.shared {
+		if loc.found {
+			b, g := loc.b, loc.g
+			b.used--
+			m.addUsed(-1)
+			g.slots.Clear(loc.i)
+			// See the comment in Delete for why a tombstone is only needed if
+			// the group is full.
+			if g.ctrls.matchEmpty() != 0 {
+				g.ctrls.Set(loc.i, ctrlEmpty)
+				b.growthLeft++
+			} else {
+				g.ctrls.Set(loc.i, ctrlDeleted)
+			}
+			b.checkInvariants(m)
+		}
+		m.unlockBucket(s)
+		return loc.found
+	}
+	m.unlockBucket(s)
+
+	m.locks().dir.Lock()
+	defer m.locks().dir.Unlock()
+	loc = m.findHashed(key, h)
+	if loc.found {
+		m.deleteAt(loc)
+	}
+	return loc.found
+}
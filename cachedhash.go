@@ -0,0 +1,108 @@
+// Copyright 2024 The Cockroach Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package swiss
+
+import (
+	"reflect"
+	"sync"
+	"unsafe"
+)
+
+// The groups of a map configured with WithCachedHash are allocated along
+// with the hashes of the keys in their slots, so that the keys need not be
+// hashed again when their bucket is resized, split, or rehashed in place.
+// The slots of a Group are laid out by the compiler for the key and value
+// types, leaving no room for a hash, so each allocation of n groups is
+// instead followed by n*groupSize hashes, indexed by the index of the slot
+// within the allocation. The groups and hashes are allocated as a single
+// object, of a type constructed with reflection so that the garbage
+// collector scans the groups but not the hashes. The hash of an empty or
+// deleted slot is meaningless.
+
+// cachedGroupsKey identifies the type of an allocation of n groups of type
+// group and their hashes.
+type cachedGroupsKey struct {
+	group reflect.Type
+	n     int
+}
+
+// cachedGroupsTypes caches the types of allocations of groups and their
+// hashes, as constructing a type is much slower than looking it up.
+var cachedGroupsTypes sync.Map // map[cachedGroupsKey]reflect.Type
+
+// allocCachedGroups allocates n groups, followed by the hashes of their
+// slots.
+func allocCachedGroups[K comparable, V any](n int) []Group[K, V] {
+	key := cachedGroupsKey{group: reflect.TypeOf((*Group[K, V])(nil)).Elem(), n: n}
+	t, ok := cachedGroupsTypes.Load(key)
+	if !ok {
+		t, _ = cachedGroupsTypes.LoadOrStore(key, reflect.StructOf([]reflect.StructField{
+			{Name: "Groups", Type: reflect.ArrayOf(n, key.group)},
+			{Name: "Hashes", Type: reflect.ArrayOf(n*groupSize, reflect.TypeOf(uintptr(0)))},
+		}))
+	}
+	return unsafe.Slice((*Group[K, V])(reflect.New(t.(reflect.Type)).UnsafePointer()), n)
+}
+
+// slotIndex returns the index of slot i of group g within the allocation of
+// groups starting at groups.
+func slotIndex[K comparable, V any](groups unsafe.Pointer, g *Group[K, V], i uint32) uintptr {
+	return (uintptr(unsafe.Pointer(g))-uintptr(groups))/unsafe.Sizeof(*g)*groupSize + uintptr(i)
+}
+
+// cachedHashes returns the cached hashes of the slots of the allocation of n
+// groups, or nil if the map does not cache hashes. A Group is at least as
+// aligned as a uintptr, as its control bytes are a uint64, so the hashes
+// directly follow the groups.
+func (m *Map[K, V]) cachedHashes(groups unsafeSlice[Group[K, V]], n uint32) []uintptr {
+	if !m.cachedHash() {
+		return nil
+	}
+	return unsafe.Slice((*uintptr)(unsafe.Add(groups.ptr, uintptr(n)*unsafe.Sizeof(Group[K, V]{}))), n*groupSize)
+}
+
+// cacheHash records h as the hash of the key in slot i of group g of bucket
+// b. The map must cache hashes.
+func (m *Map[K, V]) cacheHash(b *bucket[K, V], g *Group[K, V], i uint32, h uintptr) {
+	m.cachedHashes(b.groups, b.groupCount())[slotIndex(b.groups.ptr, g, i)] = h
+}
+
+// copyCachedHashes copies the cached hashes of the slots of the groups src
+// to dst, whose slots are a copy of src's.
+func (m *Map[K, V]) copyCachedHashes(dst, src []Group[K, V]) {
+	if m.cachedHash() {
+		copy(m.cachedHashes(makeUnsafeSlice(dst), uint32(len(dst))),
+			m.cachedHashes(makeUnsafeSlice(src), uint32(len(src))))
+	}
+}
+
+// reinsertCached is bucket.reinsert for a map which caches hashes: the
+// entries in the first n of the groups are inserted into the bucket using
+// their cached hashes, which are cached for their new slots.
+func (m *Map[K, V]) reinsertCached(b *bucket[K, V], groups unsafeSlice[Group[K, V]], n uint32) {
+	old := m.cachedHashes(groups, n)
+	hashes := m.cachedHashes(b.groups, b.groupCount())
+	for i := uint32(0); i < n; i++ {
+		g := groups.At(uintptr(i))
+		for j := uint32(0); j < groupSize; j++ {
+			if (g.ctrls.Get(j) & ctrlEmpty) == ctrlEmpty {
+				continue
+			}
+			h := old[i*groupSize+j]
+			ng, k := b.placeNew(b.slotHash(m, g.slots.Key(j), h), *g.slots.Key(j), *g.slots.Value(j))
+			hashes[slotIndex(b.groups.ptr, ng, k)] = h
+		}
+	}
+}
@@ -0,0 +1,179 @@
+// Copyright 2024 The Cockroach Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package dolthub provides a Map with the same API as the Map in
+// github.com/dolthub/swiss, implemented on top of
+// github.com/cockroachdb/swiss. Code using github.com/dolthub/swiss can be
+// migrated by changing its import to:
+//
+//	import swiss "github.com/cockroachdb/swiss/compat/dolthub"
+//
+// The two implementations differ in a few semantic details which are listed
+// by Differences and rendered as a migration guide by MigrationGuide. Once
+// migrated, the underlying swiss.Map can be accessed using Map.Unwrap to
+// incrementally adopt the native API.
+package dolthub
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/cockroachdb/swiss"
+)
+
+// Map is an unordered map from keys to values with the API of
+// github.com/dolthub/swiss.Map.
+//
+// A Map is NOT goroutine-safe.
+type Map[K comparable, V any] struct {
+	m swiss.Map[K, V]
+}
+
+// NewMap constructs a Map with capacity for sz elements.
+func NewMap[K comparable, V any](sz uint32) *Map[K, V] {
+	m := &Map[K, V]{}
+	m.m.Init(int(sz))
+	return m
+}
+
+// Has returns true if key is present in the map.
+func (m *Map[K, V]) Has(key K) bool {
+	_, ok := m.m.Get(key)
+	return ok
+}
+
+// Get returns the value mapped by key if one exists.
+func (m *Map[K, V]) Get(key K) (value V, ok bool) {
+	return m.m.Get(key)
+}
+
+// Put inserts key and value into the map, overwriting an existing value if
+// an entry with the same key already exists.
+func (m *Map[K, V]) Put(key K, value V) {
+	m.m.Put(key, value)
+}
+
+// Delete removes key from the map, returning true if the key was present.
+func (m *Map[K, V]) Delete(key K) bool {
+	return m.m.Delete(key)
+}
+
+// Iter calls cb sequentially for each key and value present in the map. If
+// cb returns true, iteration stops.
+func (m *Map[K, V]) Iter(cb func(k K, v V) (stop bool)) {
+	m.m.All(func(k K, v V) bool {
+		return !cb(k, v)
+	})
+}
+
+// Clear removes all elements from the map.
+func (m *Map[K, V]) Clear() {
+	m.m.Clear()
+}
+
+// Count returns the number of elements in the map.
+func (m *Map[K, V]) Count() int {
+	return m.m.Len()
+}
+
+// Capacity returns the number of additional elements that can be added to
+// the map before a bucket needs to grow. See Differences for how this
+// relates to the github.com/dolthub/swiss definition.
+func (m *Map[K, V]) Capacity() int {
+	var n int
+	m.m.ForEachBucketStats(func(s swiss.BucketStats) bool {
+		n += int(s.GrowthLeft)
+		return true
+	})
+	return n
+}
+
+// Unwrap returns the underlying swiss.Map.
+func (m *Map[K, V]) Unwrap() *swiss.Map[K, V] {
+	return &m.m
+}
+
+// Difference describes a semantic difference between
+// github.com/dolthub/swiss and github.com/cockroachdb/swiss.
+type Difference struct {
+	// API is the affected method or behavior.
+	API string
+	// Dolthub describes the behavior of github.com/dolthub/swiss.
+	Dolthub string
+	// Cockroach describes the behavior of github.com/cockroachdb/swiss (and
+	// of this package).
+	Cockroach string
+	// Action describes what, if anything, a caller needs to change.
+	Action string
+}
+
+// Differences returns the known semantic differences between
+// github.com/dolthub/swiss and this package.
+func Differences() []Difference {
+	return []Difference{
+		{
+			API:       "Iter",
+			Dolthub:   "Each key is visited at most once, even if the map is mutated during iteration.",
+			Cockroach: "Mutations during iteration are allowed, but inserted keys may or may not be visited and keys deleted during iteration may still be visited.",
+			Action:    "Use swiss.Map.AllLive (via Unwrap) if keys deleted during iteration must not be visited.",
+		},
+		{
+			API:       "Iter",
+			Dolthub:   "The callback returns stop=true to end iteration.",
+			Cockroach: "swiss.Map.All's callback returns false to end iteration.",
+			Action:    "None when using this package. Invert the callback result when switching to swiss.Map.All.",
+		},
+		{
+			API:       "Capacity",
+			Dolthub:   "The number of elements that can be added before the table is resized.",
+			Cockroach: "The map is composed of independently growing buckets; Capacity is the sum of the remaining growth capacity of every bucket, so a bucket may grow before Capacity reaches zero.",
+			Action:    "Avoid relying on Capacity to predict when allocation occurs.",
+		},
+		{
+			API:       "NewMap",
+			Dolthub:   "The hash function is seeded once at construction.",
+			Cockroach: "The hash seed is also changed by Clear, and the hash function can be replaced using swiss.WithHash.",
+			Action:    "None.",
+		},
+		{
+			API:       "Close",
+			Dolthub:   "Memory is always managed by the Go garbage collector.",
+			Cockroach: "A swiss.Map may use a custom swiss.Allocator, in which case swiss.Map.Close must be called to release memory.",
+			Action:    "None when using this package, which always uses the default allocator.",
+		},
+		{
+			API:       "Map",
+			Dolthub:   "Resizing rehashes the entire table at once.",
+			Cockroach: "The map uses extendible hashing to split buckets incrementally, bounding the latency of an individual Put.",
+			Action:    "None.",
+		},
+	}
+}
+
+// MigrationGuide renders Differences as a markdown document describing how
+// to migrate from github.com/dolthub/swiss.
+func MigrationGuide() string {
+	var buf strings.Builder
+	buf.WriteString("# Migrating from github.com/dolthub/swiss\n\n")
+	buf.WriteString("Replace the import of `github.com/dolthub/swiss` with:\n\n")
+	buf.WriteString("```go\nimport swiss \"github.com/cockroachdb/swiss/compat/dolthub\"\n```\n\n")
+	buf.WriteString("## Semantic differences\n")
+	for _, d := range Differences() {
+		fmt.Fprintf(&buf, "\n### %s\n\n", d.API)
+		fmt.Fprintf(&buf, "- dolthub/swiss: %s\n", d.Dolthub)
+		fmt.Fprintf(&buf, "- cockroachdb/swiss: %s\n", d.Cockroach)
+		fmt.Fprintf(&buf, "- Action: %s\n", d.Action)
+	}
+	return buf.String()
+}
@@ -0,0 +1,70 @@
+// Copyright 2024 The Cockroach Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package dolthub
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestMap(t *testing.T) {
+	m := NewMap[int, int](10)
+	require.Greater(t, m.Capacity(), 0)
+	for i := 0; i < 100; i++ {
+		m.Put(i, -i)
+	}
+	require.Equal(t, 100, m.Count())
+	require.True(t, m.Has(7))
+	require.False(t, m.Has(100))
+	v, ok := m.Get(7)
+	require.True(t, ok)
+	require.Equal(t, -7, v)
+
+	require.True(t, m.Delete(7))
+	require.False(t, m.Delete(7))
+	require.False(t, m.Has(7))
+	require.Equal(t, 99, m.Count())
+
+	seen := make(map[int]int)
+	m.Iter(func(k, v int) bool {
+		seen[k] = v
+		return false
+	})
+	require.Len(t, seen, 99)
+
+	count := 0
+	m.Iter(func(k, v int) bool {
+		count++
+		return count == 3
+	})
+	require.Equal(t, 3, count)
+
+	require.Equal(t, 99, m.Unwrap().Len())
+	m.Clear()
+	require.Equal(t, 0, m.Count())
+}
+
+func TestMigrationGuide(t *testing.T) {
+	guide := MigrationGuide()
+	for _, d := range Differences() {
+		require.NotEmpty(t, d.API)
+		require.NotEmpty(t, d.Dolthub)
+		require.NotEmpty(t, d.Cockroach)
+		require.NotEmpty(t, d.Action)
+		require.True(t, strings.Contains(guide, d.Cockroach))
+	}
+}
@@ -0,0 +1,224 @@
+// Copyright 2024 The Cockroach Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package swiss
+
+import (
+	"math/bits"
+	"runtime"
+	"sync"
+	"unsafe"
+)
+
+// concurrentShard is a shard of a ConcurrentMap.
+type concurrentShard[K comparable, V any] struct {
+	mu sync.Mutex
+	m  Map[K, V]
+	// Pad the shard so that the mutex of a shard does not share a cache line
+	// with the map of the preceding shard.
+	_ [64]byte
+}
+
+// ConcurrentMap is a map which is safe for concurrent use by multiple
+// goroutines. The entries are partitioned across a power of 2 number of
+// shards, each of which is a Map guarded by its own mutex, so that operations
+// on different shards do not contend. The shards share a hash function and
+// seed, allowing a key to be hashed once both to select its shard and to
+// locate it within the shard's map.
+//
+// A ConcurrentMap must be constructed with NewConcurrentMap.
+type ConcurrentMap[K comparable, V any] struct {
+	shards []concurrentShard[K, V]
+	hash   hashFn
+	seed   uintptr
+	// mask is the number of shards minus 1.
+	mask uint64
+}
+
+// NewConcurrentMap constructs a new ConcurrentMap with the specified initial
+// capacity, which is divided evenly between the shards. The options other
+// than WithShards are applied to the map of each shard. WithOpLog is not
+// supported, and NewConcurrentMap panics if it is specified.
+func NewConcurrentMap[K comparable, V any](
+	initialCapacity int, options ...Option[K, V],
+) *ConcurrentMap[K, V] {
+	n := 4 * runtime.GOMAXPROCS(0)
+	for _, op := range options {
+		switch op := op.(type) {
+		case shardsOption[K, V]:
+			if op.n > 0 {
+				n = op.n
+			}
+		case opLogOption[K, V]:
+			panic("WithOpLog is not supported by ConcurrentMap")
+		}
+	}
+	shardBits := uint(bits.Len(uint(n - 1)))
+	c := &ConcurrentMap[K, V]{
+		shards: make([]concurrentShard[K, V], 1<<shardBits),
+		mask:   1<<shardBits - 1,
+	}
+	perShard := (initialCapacity + len(c.shards) - 1) / len(c.shards)
+	c.shards[0].m.Init(perShard, options...)
+	first := &c.shards[0].m
+	c.hash, c.seed = first.hash, first.seed
+	if ht := first.hashTiming(); ht != nil {
+		// The wrapped hash function records its samples in the shard and may
+		// only be called with the shard locked.
+		c.hash = ht.hash
+	}
+	options = append(options[:len(options):len(options)], seedOption[K, V]{c.hash, c.seed})
+	for i := 1; i < len(c.shards); i++ {
+		c.shards[i].m.Init(perShard, options...)
+	}
+	return c
+}
+
+// Put inserts an entry into the map, overwriting an existing value if an
+// entry with the same key already exists.
+func (c *ConcurrentMap[K, V]) Put(key K, value V) {
+	h := c.hash(noescape(unsafe.Pointer(&key)), c.seed)
+	c.put(c.shard(h), key, h, value)
+}
+
+// Get retrieves the value for the specified key, returning ok=false if the
+// key is not present.
+func (c *ConcurrentMap[K, V]) Get(key K) (value V, ok bool) {
+	h := c.hash(noescape(unsafe.Pointer(&key)), c.seed)
+	return c.get(c.shard(h), key, h)
+}
+
+// Delete deletes the entry with the specified key, returning true if the key
+// was present.
+func (c *ConcurrentMap[K, V]) Delete(key K) bool {
+	h := c.hash(noescape(unsafe.Pointer(&key)), c.seed)
+	return c.delete(c.shard(h), key, h)
+}
+
+// PutHint is like Put, but the entry is stored in the shard selected by hint
+// rather than by the hash of the key. The shard is hint modulo the number of
+// shards (see WithShards). Hints allow callers which partition their keys
+// between workers, and which configure at least as many shards as workers,
+// to give each worker a shard of its own, so that the cache lines holding a
+// shard's mutex and map are not bounced between the cores on which the
+// workers run. That benefit has not yet been measured on a multi-core
+// machine. A key stored with a hint must always be accessed using the
+// same hint: Put, Get, and Delete will not find it, and vice versa. All and
+// Len cover the entries of every shard.
+func (c *ConcurrentMap[K, V]) PutHint(hint uint, key K, value V) {
+	h := c.hash(noescape(unsafe.Pointer(&key)), c.seed)
+	c.put(c.hintShard(hint), key, h, value)
+}
+
+// GetHint is like Get, for a key stored using PutHint with the same hint.
+func (c *ConcurrentMap[K, V]) GetHint(hint uint, key K) (value V, ok bool) {
+	h := c.hash(noescape(unsafe.Pointer(&key)), c.seed)
+	return c.get(c.hintShard(hint), key, h)
+}
+
+// DeleteHint is like Delete, for a key stored using PutHint with the same
+// hint.
+func (c *ConcurrentMap[K, V]) DeleteHint(hint uint, key K) bool {
+	h := c.hash(noescape(unsafe.Pointer(&key)), c.seed)
+	return c.delete(c.hintShard(hint), key, h)
+}
+
+// put implements Put and PutHint for the key with hash h in shard s.
+func (c *ConcurrentMap[K, V]) put(s *concurrentShard[K, V], key K, h uintptr, value V) {
+	s.mu.Lock()
+	if loc := s.m.findHashed(key, h); loc.found {
+		*s.m.mutableLocation(loc).value() = value
+		if s.m.counters() != nil {
+			s.m.counters().overwrites++
+		}
+	} else {
+		s.m.insert(loc, key, value)
+	}
+	s.mu.Unlock()
+}
+
+// get implements Get and GetHint for the key with hash h in shard s.
+func (c *ConcurrentMap[K, V]) get(s *concurrentShard[K, V], key K, h uintptr) (value V, ok bool) {
+	s.mu.Lock()
+	if loc := s.m.findHashed(key, h); loc.found {
+		value, ok = *loc.value(), true
+	}
+	s.mu.Unlock()
+	return value, ok
+}
+
+// delete implements Delete and DeleteHint for the key with hash h in shard s.
+func (c *ConcurrentMap[K, V]) delete(s *concurrentShard[K, V], key K, h uintptr) bool {
+	s.mu.Lock()
+	loc := s.m.findHashed(key, h)
+	if loc.found {
+		s.m.deleteAt(loc)
+	}
+	s.mu.Unlock()
+	return loc.found
+}
+
+// Len returns the number of entries in the map. The shards are counted one at
+// a time, so the result may not reflect any single point in time if the map
+// is mutated concurrently.
+func (c *ConcurrentMap[K, V]) Len() int {
+	var n int
+	for i := range c.shards {
+		s := &c.shards[i]
+		s.mu.Lock()
+		n += s.m.Len()
+		s.mu.Unlock()
+	}
+	return n
+}
+
+// All calls yield sequentially for each key and value present in the map. If
+// yield returns false, the iteration stops. The shards are iterated over one
+// at a time with the shard locked, so yield must not access the map. Entries
+// in shards which have not been iterated over yet may be mutated
+// concurrently.
+func (c *ConcurrentMap[K, V]) All(yield func(key K, value V) bool) {
+	for i := range c.shards {
+		if !c.shards[i].all(yield) {
+			return
+		}
+	}
+}
+
+// all calls yield for each entry in the shard with the shard locked,
+// returning false if yield returned false.
+func (s *concurrentShard[K, V]) all(yield func(key K, value V) bool) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	ok := true
+	s.m.All(func(key K, value V) bool {
+		ok = yield(key, value)
+		return ok
+	})
+	return ok
+}
+
+// shard returns the shard for the key with hash h. The bits of h are all used
+// by the shard's map (the high bits index its directory, and the low bits
+// select the groups and slots probed), so h is mixed before selecting the
+// shard in order for the keys of a shard to remain evenly distributed within
+// its map.
+func (c *ConcurrentMap[K, V]) shard(h uintptr) *concurrentShard[K, V] {
+	return &c.shards[(uint64(h)*0x9e3779b97f4a7c15>>32)&c.mask]
+}
+
+// hintShard returns the shard selected by a hint (see PutHint).
+func (c *ConcurrentMap[K, V]) hintShard(hint uint) *concurrentShard[K, V] {
+	return &c.shards[uint64(hint)&c.mask]
+}
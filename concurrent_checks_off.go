@@ -0,0 +1,32 @@
+// Copyright 2024 The Cockroach Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+//go:build !swiss_concurrent_checks && !swiss_invariants && !swiss_invariants_exhaustive && !race
+
+package swiss
+
+// concurrentChecks is false if we were not built with the
+// "swiss_concurrent_checks" build tag, and without invariants enabled.
+const concurrentChecks = false
+
+// writeCheck is empty, as writes are not checked.
+type writeCheck struct{}
+
+func (m *Map[K, V]) isWriting() bool {
+	return false
+}
+
+func (m *Map[K, V]) startWrite() {}
+
+func (m *Map[K, V]) endWrite() {}
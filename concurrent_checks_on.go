@@ -0,0 +1,52 @@
+// Copyright 2024 The Cockroach Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+//go:build swiss_concurrent_checks || swiss_invariants || swiss_invariants_exhaustive || race
+
+package swiss
+
+// concurrentChecks is true if we were built with the "swiss_concurrent_checks"
+// build tag, or with invariants enabled (see invariants). When true, Put and
+// Delete mark the map as being written to, and a Get, iteration, Put, or
+// Delete which observes the mark panics. This detects some unsynchronized
+// concurrent uses of a map, which would otherwise return incorrect results or
+// corrupt the map, with a message like that of the Go runtime.
+const concurrentChecks = true
+
+// writeCheck records whether a Put or Delete is mutating the map.
+type writeCheck struct {
+	writing bool
+}
+
+// isWriting returns true if a Put or Delete is mutating the map.
+func (m *Map[K, V]) isWriting() bool {
+	return m.writeCheck.writing
+}
+
+// startWrite marks the map as being written to, panicking if it already is.
+func (m *Map[K, V]) startWrite() {
+	if m.writeCheck.writing {
+		m.panicf("concurrent map writes")
+	}
+	m.writeCheck.writing = true
+}
+
+// endWrite clears the mark set by startWrite, panicking if another write
+// cleared it first.
+func (m *Map[K, V]) endWrite() {
+	if !m.writeCheck.writing {
+		m.panicf("concurrent map writes")
+	}
+	m.writeCheck.writing = false
+}
@@ -0,0 +1,318 @@
+// Copyright 2024 The Cockroach Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package swiss
+
+import (
+	"fmt"
+	"math"
+	"runtime"
+	"slices"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+// The tests in this file are ported from the iteration tests of the Go
+// runtime's map implementation (runtime/map_test.go and
+// internal/runtime/maps/map_test.go). They exercise the requirements of the
+// Go spec for iterating over a map which is mutated during the iteration:
+//
+//   - An entry which is present for the entire iteration is produced exactly
+//     once.
+//   - No entry is produced more than once.
+//   - An entry which is deleted before it is reached is not produced.
+//   - An entry which is inserted during the iteration may or may not be
+//     produced.
+//
+// All iterates over a snapshot of each group and may produce an entry which
+// was deleted after the iteration started (see TestIterateDelete), so the
+// third requirement is only checked for AllLive. Each test is run with a
+// range of max bucket capacities so that the mutations during iteration
+// resize buckets, split buckets, and grow the directory.
+
+// conformanceIter is an iteration method under test.
+type conformanceIter struct {
+	name string
+	// live is true if the iteration never produces a deleted entry.
+	live bool
+}
+
+var conformanceIters = []conformanceIter{
+	{name: "All"},
+	{name: "AllLive", live: true},
+}
+
+// conformanceIterate calls yield for each entry of m using the iteration method.
+func conformanceIterate[K comparable, V any](
+	it conformanceIter, m *Map[K, V], yield func(key K, value V) bool,
+) {
+	if it.live {
+		m.AllLive(yield)
+	} else {
+		m.All(yield)
+	}
+}
+
+// runConformance runs f for each iteration method and max bucket capacity.
+func runConformance(t *testing.T, f func(t *testing.T, it conformanceIter, maxBucketCapacity uint32)) {
+	for _, it := range conformanceIters {
+		for _, maxBucketCapacity := range []uint32{groupSize, 64, defaultMaxBucketCapacity} {
+			t.Run(fmt.Sprintf("%s/%d", it.name, maxBucketCapacity), func(t *testing.T) {
+				f(t, it, maxBucketCapacity)
+			})
+		}
+	}
+}
+
+// Ported from TestMapIterOrder: the iteration order is randomized.
+func TestConformanceIterOrder(t *testing.T) {
+	runConformance(t, func(t *testing.T, it conformanceIter, maxBucketCapacity uint32) {
+		for _, n := range []int{3, 7, 9, 15} {
+			for i := 0; i < 100; i++ {
+				m := New[int, bool](0, WithMaxBucketCapacity[int, bool](maxBucketCapacity))
+				for j := 0; j < n; j++ {
+					m.Put(j, true)
+				}
+				order := func() []int {
+					var s []int
+					conformanceIterate(it, m, func(k int, _ bool) bool {
+						s = append(s, k)
+						return true
+					})
+					return s
+				}
+				first := order()
+				differs := false
+				for try := 0; try < 100 && !differs; try++ {
+					differs = !slices.Equal(first, order())
+				}
+				require.True(t, differs, "map with n=%d entries had consistent iteration order: %v", n, first)
+			}
+		}
+	})
+}
+
+// Ported from TestMapSparseIterOrder: the iteration order is randomized for a
+// map which has grown and then had most of its entries deleted.
+func TestConformanceSparseIterOrder(t *testing.T) {
+	runConformance(t, func(t *testing.T, it conformanceIter, maxBucketCapacity uint32) {
+	nextRound:
+		for round := 0; round < 10; round++ {
+			m := New[int, bool](0, WithMaxBucketCapacity[int, bool](maxBucketCapacity))
+			for i := 0; i < 1000; i++ {
+				m.Put(i, true)
+			}
+			for i := 20; i < 1000; i++ {
+				m.Delete(i)
+			}
+			var first []int
+			conformanceIterate(it, m, func(k int, _ bool) bool {
+				first = append(first, k)
+				return true
+			})
+			for n := 0; n < 800; n++ {
+				var s []int
+				conformanceIterate(it, m, func(k int, _ bool) bool {
+					s = append(s, k)
+					return true
+				})
+				if !slices.Equal(first, s) {
+					continue nextRound
+				}
+			}
+			t.Fatalf("constant iteration order on round %d: %v", round, first)
+		}
+	})
+}
+
+// Ported from TestIterGrowAndDelete: growing the map and deleting entries
+// during iteration.
+func TestConformanceIterGrowAndDelete(t *testing.T) {
+	runConformance(t, func(t *testing.T, it conformanceIter, maxBucketCapacity uint32) {
+		m := New[int, int](4, WithMaxBucketCapacity[int, int](maxBucketCapacity))
+		for i := 0; i < 100; i++ {
+			m.Put(i, i)
+		}
+		grown := false
+		seen := make(map[int]bool)
+		conformanceIterate(it, m, func(k, v int) bool {
+			require.False(t, seen[k], "key %d produced twice", k)
+			seen[k] = true
+			if !grown {
+				// Grow the map, then delete the odd keys.
+				for i := 100; i < 1000; i++ {
+					m.Put(i, i)
+				}
+				for i := 1; i < 1000; i += 2 {
+					m.Delete(i)
+				}
+				grown = true
+			} else if it.live {
+				require.Zero(t, k&1, "deleted key %d produced", k)
+			}
+			return true
+		})
+		for i := 0; i < 100; i += 2 {
+			require.True(t, seen[i], "key %d not produced", i)
+		}
+	})
+}
+
+// Ported from TestIterGrowWithGC: growing the map during iteration, with a
+// garbage collection while the iteration is in progress.
+func TestConformanceIterGrowWithGC(t *testing.T) {
+	runConformance(t, func(t *testing.T, it conformanceIter, maxBucketCapacity uint32) {
+		m := New[int, int](4, WithMaxBucketCapacity[int, int](maxBucketCapacity))
+		for i := 0; i < 16; i++ {
+			m.Put(i, i)
+		}
+		grown := false
+		var bitmask int
+		conformanceIterate(it, m, func(k, v int) bool {
+			if k < 16 {
+				require.Zero(t, bitmask&(1<<k), "key %d produced twice", k)
+				bitmask |= 1 << k
+			}
+			if !grown {
+				for i := 100; i < 1000; i++ {
+					m.Put(i, i)
+				}
+				runtime.GC()
+				grown = true
+			}
+			return true
+		})
+		require.Equal(t, 1<<16-1, bitmask, "missing keys")
+	})
+}
+
+// Ported from TestMapNanGrowIterator: NaN keys are never equal to each other,
+// so each insertion of a NaN key adds an entry which is produced once.
+func TestConformanceNaNGrowIterator(t *testing.T) {
+	runConformance(t, func(t *testing.T, it conformanceIter, maxBucketCapacity uint32) {
+		m := New[float64, int](0, WithMaxBucketCapacity[float64, int](maxBucketCapacity))
+		nan := math.NaN()
+		const nKeys = 16 * maxAvgGroupLoad
+		for i := 0; i < nKeys; i++ {
+			m.Put(nan, i)
+		}
+		// Trigger growth.
+		m.Put(1.0, 1)
+		m.Delete(1.0)
+
+		found := make(map[int]bool)
+		conformanceIterate(it, m, func(_ float64, v int) bool {
+			require.False(t, found[v], "value %d produced twice", v)
+			found[v] = true
+			if len(found) == nKeys/2 {
+				// Mutate the map halfway through the iteration.
+				for i := 0; i < 16; i++ {
+					m.Delete(1.0)
+				}
+			}
+			return true
+		})
+		require.Len(t, found, nKeys)
+	})
+}
+
+// Ported from TestMapIterDeleteReplace: deleting and reinserting each entry
+// as it is produced replaces every entry.
+func TestConformanceIterDeleteReplace(t *testing.T) {
+	inc := 3
+	if testing.Short() {
+		inc = 100
+	}
+	runConformance(t, func(t *testing.T, it conformanceIter, maxBucketCapacity uint32) {
+		for n := 0; n < 1000; n += inc {
+			m := New[int, bool](0, WithMaxBucketCapacity[int, bool](maxBucketCapacity))
+			for i := 0; i < n; i++ {
+				m.Put(i, false)
+			}
+			conformanceIterate(it, m, func(k int, _ bool) bool {
+				m.Delete(k)
+				m.Put(k, true)
+				return true
+			})
+			require.Equal(t, n, m.Len())
+			m.All(func(k int, v bool) bool {
+				require.True(t, v, "n=%d: key %d was not replaced", n, k)
+				return true
+			})
+		}
+	})
+}
+
+// Ported from TestTableIterationGrowDuplicate: growing the map during
+// iteration does not produce any entry twice.
+func TestConformanceIterGrowDuplicate(t *testing.T) {
+	runConformance(t, func(t *testing.T, it conformanceIter, maxBucketCapacity uint32) {
+		m := New[uint32, uint64](8, WithMaxBucketCapacity[uint32, uint64](maxBucketCapacity))
+		for i := uint32(1); i <= 31; i++ {
+			m.Put(i, 256+uint64(i))
+		}
+		got := make(map[uint32]uint64)
+		conformanceIterate(it, m, func(k uint32, v uint64) bool {
+			_, ok := got[k]
+			require.False(t, ok, "key %d produced twice", k)
+			got[k] = v
+			// Grow the map, forcing the entries to be moved.
+			for i := uint32(100); i < 200; i++ {
+				m.Put(i, 256+uint64(i))
+			}
+			return true
+		})
+		for i := uint32(1); i <= 31; i++ {
+			require.Equal(t, 256+uint64(i), got[i])
+		}
+	})
+}
+
+// Ported from TestTableIterationGrowDelete: growing the map during iteration
+// and then deleting the entries which have not been produced.
+func TestConformanceIterGrowDelete(t *testing.T) {
+	runConformance(t, func(t *testing.T, it conformanceIter, maxBucketCapacity uint32) {
+		m := New[uint32, uint64](8, WithMaxBucketCapacity[uint32, uint64](maxBucketCapacity))
+		for i := uint32(1); i <= 31; i++ {
+			m.Put(i, 256+uint64(i))
+		}
+		got := make(map[uint32]uint64)
+		first := true
+		conformanceIterate(it, m, func(k uint32, v uint64) bool {
+			_, ok := got[k]
+			require.False(t, ok, "key %d produced twice", k)
+			got[k] = v
+			if first {
+				for i := uint32(100); i < 200; i++ {
+					m.Put(i, 256+uint64(i))
+				}
+				for i := uint32(1); i <= 31; i++ {
+					if i != k {
+						m.Delete(i)
+					}
+				}
+				first = false
+			}
+			return true
+		})
+		if it.live {
+			for i := uint32(1); i <= 31; i++ {
+				_, produced := got[i]
+				_, present := m.Get(i)
+				require.Equal(t, present, produced, "key %d", i)
+			}
+		}
+	})
+}
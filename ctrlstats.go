@@ -0,0 +1,94 @@
+// Copyright 2024 The Cockroach Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package swiss
+
+import "math/bits"
+
+// H2Histogram returns the number of entries in the map with each h2 value,
+// the low bits of an entry's hash which are stored in its control byte.
+// Only the first 1<<h2Bits counts are used (all 128 by default; 64 when
+// built with the "swiss_h2_bits_6" build tag). The histogram is computed from
+// the control bytes alone, without accessing the keys, and is a compact
+// sketch of the map's contents: for a good hash function the counts are
+// approximately uniform, and a skewed histogram indicates a weak hash (see
+// CtrlSummary.H2ChiSquare). The map must not be mutated concurrently.
+func (m *Map[K, V]) H2Histogram() [128]int {
+	var hist [128]int
+	m.buckets(0, func(b *bucket[K, V]) bool {
+		for i, n := uint32(0), b.groupCount(); i < n; i++ {
+			ctrls := b.groups.At(uintptr(i)).ctrls
+			for match := ctrls.matchFull(); match != 0; match = match.removeFirst() {
+				hist[ctrls.Get(match.first())]++
+			}
+		}
+		return true
+	})
+	return hist
+}
+
+// CtrlSummary summarizes the control bytes of a Map. See Map.CtrlSummary.
+type CtrlSummary struct {
+	// Full, Empty, and Deleted are the number of slots whose control byte is
+	// full, empty, or a tombstone. Full is equal to the number of entries in
+	// the map.
+	Full    int
+	Empty   int
+	Deleted int
+	// Groups is the number of groups in the map, and FullGroups the number of
+	// groups without an empty slot. A probe sequence continues past a full
+	// group, so the fraction of full groups bounds the cost of a lookup of a
+	// missing key.
+	Groups     int
+	FullGroups int
+	// H2ChiSquare is Pearson's chi-squared statistic of the h2 histogram (see
+	// Map.H2Histogram) against a uniform distribution, with 1<<h2Bits - 1
+	// degrees of freedom. For a good hash function it is close to the degrees
+	// of freedom (127 by default); a value many times larger indicates that
+	// the hash is not uniformly distributing the keys. H2ChiSquare is zero
+	// for an empty map.
+	H2ChiSquare float64
+}
+
+// CtrlSummary returns a summary of the control bytes of the map. Like
+// H2Histogram, it is computed from the control bytes alone, a group at a
+// time, without accessing the keys. The map must not be mutated
+// concurrently.
+func (m *Map[K, V]) CtrlSummary() CtrlSummary {
+	var s CtrlSummary
+	m.buckets(0, func(b *bucket[K, V]) bool {
+		for i, n := uint32(0), b.groupCount(); i < n; i++ {
+			ctrls := &b.groups.At(uintptr(i)).ctrls
+			full := bits.OnesCount64(uint64(ctrls.matchFull()))
+			empty := bits.OnesCount64(uint64(ctrls.matchEmpty()))
+			s.Full += full
+			s.Empty += empty
+			s.Deleted += groupSize - full - empty
+			if empty == 0 {
+				s.FullGroups++
+			}
+		}
+		s.Groups += int(b.groupCount())
+		return true
+	})
+	if s.Full > 0 {
+		hist := m.H2Histogram()
+		expected := float64(s.Full) / (1 << h2Bits)
+		for _, n := range hist[:1<<h2Bits] {
+			d := float64(n) - expected
+			s.H2ChiSquare += d * d / expected
+		}
+	}
+	return s
+}
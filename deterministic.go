@@ -0,0 +1,204 @@
+// Copyright 2024 The Cockroach Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package swiss
+
+import (
+	"bytes"
+	"cmp"
+	"encoding/binary"
+	"fmt"
+	"math/bits"
+	"reflect"
+	"sort"
+	"strings"
+	"unsafe"
+)
+
+// deterministicHasher returns the hash function used by WithDeterministicHash
+// for keys of type K, along with a function which totally orders keys of type
+// K. The hash of a key depends only on the key's value and the seed: unlike
+// the runtime's hasher it does not depend on a per-process random value, the
+// key's representation in memory (e.g. its byte order), or the availability
+// of AES instructions. Integer keys are hashed by value so that, for example,
+// an int hashes identically on 32-bit and 64-bit architectures. An error is
+// returned if K is not a string, an integer, or a byte array (or a type
+// defined as one of those).
+func deterministicHasher[K comparable]() (hashFn, func(a, b unsafe.Pointer) int, error) {
+	t := reflect.TypeOf((*K)(nil)).Elem()
+	switch t.Kind() {
+	case reflect.String:
+		return hashDeterministicString, compareString, nil
+	case reflect.Int:
+		return deterministicInt[int]()
+	case reflect.Int8:
+		return deterministicInt[int8]()
+	case reflect.Int16:
+		return deterministicInt[int16]()
+	case reflect.Int32:
+		return deterministicInt[int32]()
+	case reflect.Int64:
+		return deterministicInt[int64]()
+	case reflect.Uint:
+		return deterministicUint[uint]()
+	case reflect.Uint8:
+		return deterministicUint[uint8]()
+	case reflect.Uint16:
+		return deterministicUint[uint16]()
+	case reflect.Uint32:
+		return deterministicUint[uint32]()
+	case reflect.Uint64:
+		return deterministicUint[uint64]()
+	case reflect.Uintptr:
+		return deterministicUint[uintptr]()
+	case reflect.Array:
+		if t.Elem().Kind() == reflect.Uint8 {
+			n := t.Len()
+			hash := func(key unsafe.Pointer, seed uintptr) uintptr {
+				return uintptr(hashDeterministicBytes(unsafe.Slice((*byte)(key), n), seed))
+			}
+			compare := func(a, b unsafe.Pointer) int {
+				return bytes.Compare(unsafe.Slice((*byte)(a), n), unsafe.Slice((*byte)(b), n))
+			}
+			return hash, compare, nil
+		}
+	}
+	return nil, nil, fmt.Errorf("deterministic hashing is not supported for keys of type %s", t)
+}
+
+type signed interface {
+	~int | ~int8 | ~int16 | ~int32 | ~int64
+}
+
+type unsigned interface {
+	~uint | ~uint8 | ~uint16 | ~uint32 | ~uint64 | ~uintptr
+}
+
+func deterministicInt[T signed]() (hashFn, func(a, b unsafe.Pointer) int, error) {
+	hash := func(key unsafe.Pointer, seed uintptr) uintptr {
+		return uintptr(hashDeterministicUint64(uint64(*(*T)(key)), seed))
+	}
+	compare := func(a, b unsafe.Pointer) int {
+		return cmp.Compare(*(*T)(a), *(*T)(b))
+	}
+	return hash, compare, nil
+}
+
+func deterministicUint[T unsigned]() (hashFn, func(a, b unsafe.Pointer) int, error) {
+	hash := func(key unsafe.Pointer, seed uintptr) uintptr {
+		return uintptr(hashDeterministicUint64(uint64(*(*T)(key)), seed))
+	}
+	compare := func(a, b unsafe.Pointer) int {
+		return cmp.Compare(*(*T)(a), *(*T)(b))
+	}
+	return hash, compare, nil
+}
+
+// hashDeterministicUint64 hashes the 64-bit value v. It is hashBytes8 applied
+// to the little-endian encoding of v.
+func hashDeterministicUint64(v uint64, seed uintptr) uint64 {
+	s := uint64(seed) ^ hashM1
+	t := bits.RotateLeft64(s, 32)
+	return hashMix(hashM5^8, hashMix(v^hashM2^s, t^hashM3))
+}
+
+func hashDeterministicString(key unsafe.Pointer, seed uintptr) uintptr {
+	s := *(*string)(key)
+	return uintptr(hashDeterministicBytes(unsafe.Slice(unsafe.StringData(s), len(s)), seed))
+}
+
+func compareString(a, b unsafe.Pointer) int {
+	return strings.Compare(*(*string)(a), *(*string)(b))
+}
+
+// hashDeterministicBytes hashes p, which may be of any length, in the manner
+// of wyhash: 16 bytes at a time, followed by the (possibly overlapping) final
+// bytes. See hashBytes8 for the use of the seed.
+func hashDeterministicBytes(p []byte, seed uintptr) uint64 {
+	s := uint64(seed) ^ hashM1
+	t := bits.RotateLeft64(s, 32)
+	n := uint64(len(p))
+	h := s
+	for ; len(p) > 16; p = p[16:] {
+		h = hashMix(binary.LittleEndian.Uint64(p)^hashM2^h,
+			binary.LittleEndian.Uint64(p[8:])^hashM3^t)
+	}
+	var a, b uint64
+	switch {
+	case len(p) > 8:
+		a = binary.LittleEndian.Uint64(p)
+		b = binary.LittleEndian.Uint64(p[len(p)-8:])
+	case len(p) >= 4:
+		a = uint64(binary.LittleEndian.Uint32(p))
+		b = uint64(binary.LittleEndian.Uint32(p[len(p)-4:]))
+	case len(p) > 0:
+		a = uint64(p[0])<<16 | uint64(p[len(p)>>1])<<8 | uint64(p[len(p)-1])
+	}
+	return hashMix(hashM5^n, hashMix(a^hashM2^h, b^hashM3^t))
+}
+
+// AllByHash calls yield sequentially for each key and value present in the
+// map in increasing order of the hash of the key (see Hash). If yield
+// returns false, AllByHash stops the iteration. For a map configured with
+// WithDeterministicHash, entries whose keys have the same hash are yielded
+// in increasing order of their keys, so two maps with the same contents
+// yield their entries in the same order, even in different processes or on
+// architectures with different byte orders (though not on architectures with
+// different pointer sizes, as the hash is the size of a pointer). This
+// allows the contents of maps to be compared by fingerprinting the ordered
+// stream of entries, without sorting the keys. For other maps, the order of
+// entries whose keys have the same hash is unspecified.
+//
+// The buckets of the map are partitioned by the high bits of the hash, so
+// AllByHash visits the buckets in order and sorts the entries of one bucket
+// at a time. The entries of a bucket are copied when the iteration reaches
+// the bucket, so an entry in that bucket which is deleted or overwritten
+// during iteration (including by the yield function) may still be yielded
+// with its previous value. Otherwise, mutations during iteration have the
+// same effect as for All.
+func (m *Map[K, V]) AllByHash(yield func(key K, value V) bool) {
+	type entry struct {
+		h     uintptr
+		key   K
+		value V
+	}
+	var entries []entry
+	m.buckets(0, func(b *bucket[K, V]) bool {
+		entries = entries[:0]
+		for i, n := uint32(0), b.groupCount(); i < n && b.used > 0; i++ {
+			g := b.groups.At(uintptr(i))
+			for j := uint32(0); j < groupSize; j++ {
+				if (g.ctrls.Get(j) & ctrlEmpty) == ctrlEmpty {
+					continue
+				}
+				k := g.slots.Key(j)
+				h := m.hash(noescape(unsafe.Pointer(k)), m.seed)
+				entries = append(entries, entry{h, *k, *g.slots.Value(j)})
+			}
+		}
+		sort.Slice(entries, func(i, j int) bool {
+			a, b := &entries[i], &entries[j]
+			if a.h != b.h || m.compareKeys() == nil {
+				return a.h < b.h
+			}
+			return m.compareKeys()(noescape(unsafe.Pointer(&a.key)), noescape(unsafe.Pointer(&b.key))) < 0
+		})
+		for i := range entries {
+			if !yield(entries[i].key, entries[i].value) {
+				return false
+			}
+		}
+		return true
+	})
+}
@@ -0,0 +1,24 @@
+// Copyright 2024 The Cockroach Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+//go:build armbe || arm64be || m68k || mips || mips64 || mips64p32 || ppc || ppc64 || s390 || s390x || shbe || sparc || sparc64
+
+package swiss
+
+// bigEndian is true if the CPU architecture is big endian. The SWAR routines
+// which match the control bytes of a group treat them as a uint64 holding the
+// control byte of slot i in bits [8i, 8i+8), which is how a little endian
+// CPU loads them, so on a big endian CPU the control bytes are byte swapped
+// when they are loaded and stored (see ctrlGroup.load).
+const bigEndian = true
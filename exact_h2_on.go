@@ -0,0 +1,22 @@
+// Copyright 2024 The Cockroach Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+//go:build swiss_exact_h2
+
+package swiss
+
+// exactH2Match is true if we were built with the "swiss_exact_h2" build tag.
+// When true, control bytes are matched against h2 using a routine which never
+// reports false positive matches (see ctrlGroup.matchH2).
+const exactH2Match = true
@@ -0,0 +1,381 @@
+// Copyright 2024 The Cockroach Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cache
+
+import (
+	"runtime"
+	"sync"
+	"unsafe"
+
+	"github.com/cockroachdb/swiss"
+)
+
+// Key identifies a block of a file.
+type Key struct {
+	FileNum uint64
+	Offset  uint64
+}
+
+// hashKey is the hash function of the maps of the shards. It ignores the
+// seed of the map, so the hash computed by the Cache to select a shard is
+// also the hash of the key in the shard's map (see swiss.Map.Hash).
+func hashKey(k *Key, _ uintptr) uintptr {
+	h := k.FileNum*0x9e3779b97f4a7c15 ^ k.Offset
+	h ^= h >> 32
+	h *= 0xd6e8feb86659fd93
+	h ^= h >> 32
+	return uintptr(h)
+}
+
+// entryOverhead is the memory charged for each block in addition to the
+// bytes of the block: its entry, and its slot in the shard's map.
+const entryOverhead = int64(unsafe.Sizeof(entry{})) + slotOverhead
+
+// slotOverhead is an estimate of the memory of the map slot of a block: its
+// key, the pointer to its entry, and its control byte, at the load factor of
+// a table which has just grown (7/16). The memory of the map itself is not
+// charged, as it is not reduced by evicting blocks (the map does not shrink)
+// and computing it visits every bucket of the map (see
+// swiss.Map.SizeInBytes).
+const slotOverhead = (int64(unsafe.Sizeof(Key{})+unsafe.Sizeof((*entry)(nil))) + 1) * 16 / 7
+
+// entry is a cached block. The map of a shard holds pointers to the entries
+// rather than the entries themselves, as the slots of a map are moved when
+// it grows, which would invalidate the links between entries.
+type entry struct {
+	key    Key
+	block  []byte
+	charge int64
+	// referenced is set when the block is accessed and cleared when the
+	// CLOCK hand passes over the entry, which evicts the entry if it was
+	// not set.
+	referenced bool
+	// pins is the number of calls to Pin for the block not yet matched by a
+	// call to Unpin. The hand passes over an entry with pins > 0 without
+	// evicting it.
+	pins       int32
+	prev, next *entry
+}
+
+// Cache is a block cache holding blocks up to a total amount of memory. A
+// Cache is safe for concurrent use.
+type Cache struct {
+	shards  []shard
+	onEvict func(k Key, block []byte)
+}
+
+// shard holds the blocks whose keys hash to the shard.
+type shard struct {
+	mu sync.Mutex
+	m  swiss.Map[Key, *entry]
+	// hand is the CLOCK hand: the entry which is next considered for
+	// eviction. The entries form a circular list in order of insertion, with
+	// a new entry inserted just behind the hand. hand is nil if the shard is
+	// empty.
+	hand *entry
+	// size is the total charge of the entries.
+	size int64
+	// pinned is the number of entries with pins > 0.
+	pinned    int
+	capacity  int64
+	hits      int64
+	misses    int64
+	evictions int64
+}
+
+// Option provides an interface for passing configuration parameters for
+// Cache initialization.
+type Option interface {
+	apply(c *Cache)
+}
+
+type shardsOption int
+
+func (op shardsOption) apply(c *Cache) {
+	if op > 0 {
+		c.shards = make([]shard, op)
+	}
+}
+
+// WithShards is an option to specify the number of shards the keys are
+// partitioned between. The capacity of the cache is divided evenly between
+// the shards. The default is runtime.GOMAXPROCS(0).
+func WithShards(n int) Option {
+	return shardsOption(n)
+}
+
+type evictionCallbackOption func(k Key, block []byte)
+
+func (op evictionCallbackOption) apply(c *Cache) {
+	c.onEvict = op
+}
+
+// WithEvictionCallback is an option to specify a function which is called
+// with each block evicted from the cache to make room for new blocks, e.g.
+// in order to reuse the memory of the block. It is not called for blocks
+// removed by Delete or EvictFile, or for blocks replaced by Set. onEvict is
+// called with the lock of a shard held and must not access the cache.
+func WithEvictionCallback(onEvict func(k Key, block []byte)) Option {
+	return evictionCallbackOption(onEvict)
+}
+
+// New constructs a new Cache holding blocks up to a total of capacity bytes.
+func New(capacity int64, options ...Option) *Cache {
+	c := &Cache{}
+	for _, op := range options {
+		op.apply(c)
+	}
+	if c.shards == nil {
+		c.shards = make([]shard, runtime.GOMAXPROCS(0))
+	}
+	for i := range c.shards {
+		s := &c.shards[i]
+		s.capacity = capacity / int64(len(c.shards))
+		s.m.Init(0, swiss.WithHash[Key, *entry](hashKey))
+	}
+	return c
+}
+
+// shard returns the shard of the key with hash h. The high bits of h select
+// the key's bucket within the shard's map, and the low bits its control
+// byte, so the shard is selected by bits taken from the middle of the hash
+// after mixing.
+func (c *Cache) shard(h uintptr) *shard {
+	x := (uint64(h) * 0x9e3779b97f4a7c15) >> 32
+	return &c.shards[(x*uint64(len(c.shards)))>>32]
+}
+
+// Get retrieves the block for the specified key, returning ok=false if the
+// block is not cached. The block must not be modified.
+func (c *Cache) Get(k Key) (block []byte, ok bool) {
+	h := hashKey(&k, 0)
+	s := c.shard(h)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	e, ok := s.m.GetWithHash(k, h)
+	if !ok {
+		s.misses++
+		return nil, false
+	}
+	s.hits++
+	e.referenced = true
+	return e.block, true
+}
+
+// Pin is like Get, but additionally pins the block, which prevents it from
+// being evicted (and so from being passed to the eviction callback, which
+// may reuse its memory) until a matching call to Unpin. This allows the
+// block to be read in place for as long as it is pinned. Pins are counted, so
+// a block pinned n times is evicted only after n calls to Unpin. Pinned
+// blocks are still charged against the capacity of the cache, which may
+// therefore be exceeded. Pinning does not prevent a block from being removed
+// by Delete or EvictFile, which discard its pins, or replaced by Set (which
+// also removes the block if the new block is too large to cache).
+func (c *Cache) Pin(k Key) (block []byte, ok bool) {
+	h := hashKey(&k, 0)
+	s := c.shard(h)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	e, ok := s.m.GetWithHash(k, h)
+	if !ok {
+		s.misses++
+		return nil, false
+	}
+	s.hits++
+	e.referenced = true
+	if e.pins == 0 {
+		s.pinned++
+	}
+	e.pins++
+	return e.block, true
+}
+
+// Unpin releases a pin of the block for the specified key taken by Pin. When
+// the last pin of a block is released, blocks are evicted (as by Set) if the
+// memory charged for the shard of the key exceeds its capacity. Unpin panics
+// if the block is cached but not pinned, and does nothing if the block is not
+// cached.
+func (c *Cache) Unpin(k Key) {
+	h := hashKey(&k, 0)
+	s := c.shard(h)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	e, ok := s.m.GetWithHash(k, h)
+	if !ok {
+		return
+	}
+	if e.pins == 0 {
+		panic("cache: Unpin of a block which is not pinned")
+	}
+	e.pins--
+	if e.pins == 0 {
+		s.pinned--
+		s.evict(c.onEvict)
+	}
+}
+
+// Set inserts a block into the cache, replacing the existing block for the
+// same key, and then evicts blocks until the memory charged for the shard of
+// the key is within its capacity. A block which is larger than the capacity
+// of a shard is not cached.
+func (c *Cache) Set(k Key, block []byte) {
+	h := hashKey(&k, 0)
+	s := c.shard(h)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	charge := int64(len(block)) + entryOverhead
+	e, ok := s.m.GetWithHash(k, h)
+	switch {
+	case charge > s.capacity:
+		if ok {
+			s.m.Delete(k)
+			s.remove(e)
+		}
+		return
+	case ok:
+		s.size += charge - e.charge
+		e.block, e.charge, e.referenced = block, charge, true
+	default:
+		e = &entry{key: k, block: block, charge: charge}
+		s.m.PutWithHash(k, h, e)
+		s.insert(e)
+	}
+	s.evict(c.onEvict)
+}
+
+// Delete deletes the block for the specified key, returning true if the
+// block was cached.
+func (c *Cache) Delete(k Key) bool {
+	s := c.shard(hashKey(&k, 0))
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	e, ok := s.m.Pop(k)
+	if ok {
+		s.remove(e)
+	}
+	return ok
+}
+
+// EvictFile deletes all of the blocks of the specified file, e.g. when the
+// file is deleted, returning the number of blocks deleted. The blocks of a
+// file are spread across the shards, so each shard is scanned.
+func (c *Cache) EvictFile(fileNum uint64) int {
+	var n int
+	for i := range c.shards {
+		s := &c.shards[i]
+		s.mu.Lock()
+		n += s.m.DeleteFunc(func(k Key, e *entry) bool {
+			if k.FileNum != fileNum {
+				return false
+			}
+			s.remove(e)
+			return true
+		})
+		s.mu.Unlock()
+	}
+	return n
+}
+
+// Metrics holds the metrics of a Cache.
+type Metrics struct {
+	// Count is the number of cached blocks.
+	Count int
+	// Size is the memory charged for the blocks, which is the size of the
+	// blocks plus a fixed overhead per block.
+	Size int64
+	// MapSize is the memory used by the maps of the shards. It is not
+	// charged against the capacity of the cache, which instead charges each
+	// block for an estimate of its slot in the map.
+	MapSize int64
+	// Hits and Misses are the number of calls to Get which found, and did not
+	// find, the block for the key.
+	Hits   int64
+	Misses int64
+	// Evictions is the number of blocks evicted to make room for new blocks.
+	Evictions int64
+}
+
+// Metrics returns the metrics of the cache, summed across its shards.
+func (c *Cache) Metrics() Metrics {
+	var m Metrics
+	for i := range c.shards {
+		s := &c.shards[i]
+		s.mu.Lock()
+		m.Count += s.m.Len()
+		m.Size += s.size
+		m.MapSize += s.m.SizeInBytes()
+		m.Hits += s.hits
+		m.Misses += s.misses
+		m.Evictions += s.evictions
+		s.mu.Unlock()
+	}
+	return m
+}
+
+// insert inserts e into the circular list of entries, just behind the hand
+// so that it is the last entry considered for eviction.
+func (s *shard) insert(e *entry) {
+	if s.hand == nil {
+		e.prev, e.next = e, e
+		s.hand = e
+	} else {
+		e.prev, e.next = s.hand.prev, s.hand
+		e.prev.next = e
+		e.next.prev = e
+	}
+	s.size += e.charge
+}
+
+// remove removes e, which has been deleted from the map, from the list of
+// entries.
+func (s *shard) remove(e *entry) {
+	if e.pins > 0 {
+		s.pinned--
+	}
+	if e.next == e {
+		s.hand = nil
+	} else {
+		if s.hand == e {
+			s.hand = e.next
+		}
+		e.prev.next = e.next
+		e.next.prev = e.prev
+	}
+	e.prev, e.next = nil, nil
+	s.size -= e.charge
+}
+
+// evict evicts entries until the memory charged for the shard is within its
+// capacity, or every remaining entry is pinned. The hand sweeps the list,
+// passing over pinned entries, giving an entry which was referenced since the
+// hand last passed it a second chance, and evicting the first entry which
+// was not.
+func (s *shard) evict(onEvict func(k Key, block []byte)) {
+	for s.pinned < s.m.Len() && s.size > s.capacity {
+		e := s.hand
+		if e.pins > 0 || e.referenced {
+			e.referenced = false
+			s.hand = e.next
+			continue
+		}
+		s.m.Delete(e.key)
+		s.remove(e)
+		s.evictions++
+		if onEvict != nil {
+			onEvict(e.key, e.block)
+		}
+	}
+}
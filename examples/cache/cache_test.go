@@ -0,0 +1,262 @@
+// Copyright 2024 The Cockroach Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cache
+
+import (
+	"fmt"
+	"math/rand"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+// checkShards verifies the consistency of the maps and lists of the shards.
+func checkShards(t *testing.T, c *Cache) {
+	for i := range c.shards {
+		s := &c.shards[i]
+		require.NoError(t, s.m.Validate())
+		var n, pinned int
+		var size int64
+		if e := s.hand; e != nil {
+			for {
+				m, ok := s.m.Get(e.key)
+				require.True(t, ok)
+				require.Equal(t, e, m)
+				require.Equal(t, e, e.next.prev)
+				n++
+				if e.pins > 0 {
+					pinned++
+				}
+				size += e.charge
+				if e = e.next; e == s.hand {
+					break
+				}
+			}
+		}
+		require.Equal(t, s.m.Len(), n)
+		require.Equal(t, s.pinned, pinned)
+		require.Equal(t, s.size, size)
+	}
+}
+
+func TestCache(t *testing.T) {
+	c := New(1<<20, WithShards(4))
+	for i := 0; i < 100; i++ {
+		c.Set(Key{FileNum: uint64(i % 3), Offset: uint64(i)}, []byte(fmt.Sprint(i)))
+	}
+	checkShards(t, c)
+	for i := 0; i < 200; i++ {
+		b, ok := c.Get(Key{FileNum: uint64(i % 3), Offset: uint64(i)})
+		require.Equal(t, i < 100, ok)
+		if ok {
+			require.Equal(t, fmt.Sprint(i), string(b))
+		}
+	}
+	m := c.Metrics()
+	require.Equal(t, Metrics{
+		Count:   100,
+		Size:    m.Size,
+		MapSize: m.MapSize,
+		Hits:    100,
+		Misses:  100,
+	}, m)
+
+	// Replacing a block updates its charge.
+	size := m.Size
+	c.Set(Key{FileNum: 0, Offset: 0}, make([]byte, 1000))
+	require.Equal(t, size+1000-1, c.Metrics().Size)
+
+	require.True(t, c.Delete(Key{FileNum: 1, Offset: 1}))
+	require.False(t, c.Delete(Key{FileNum: 1, Offset: 1}))
+	require.Equal(t, 33, c.EvictFile(2))
+	require.Equal(t, 66, c.Metrics().Count)
+	checkShards(t, c)
+
+	// A block larger than a shard is not cached.
+	c.Set(Key{FileNum: 0, Offset: 0}, make([]byte, 1<<20))
+	_, ok := c.Get(Key{FileNum: 0, Offset: 0})
+	require.False(t, ok)
+	checkShards(t, c)
+}
+
+func TestCacheClock(t *testing.T) {
+	const blockSize = 100
+	charge := blockSize + entryOverhead
+
+	// The cache holds 3 blocks.
+	var evicted []uint64
+	c := New(3*charge, WithShards(1),
+		WithEvictionCallback(func(k Key, _ []byte) {
+			evicted = append(evicted, k.Offset)
+		}))
+	for i := uint64(1); i <= 3; i++ {
+		c.Set(Key{Offset: i}, make([]byte, blockSize))
+	}
+	require.Empty(t, evicted)
+
+	// A referenced block is given a second chance.
+	_, ok := c.Get(Key{Offset: 1})
+	require.True(t, ok)
+	c.Set(Key{Offset: 4}, make([]byte, blockSize))
+	require.Equal(t, []uint64{2}, evicted)
+	c.Set(Key{Offset: 5}, make([]byte, blockSize))
+	require.Equal(t, []uint64{2, 3}, evicted)
+	// The hand cleared the reference of block 1 when passing it, and moved
+	// on to evict blocks 3 and then 4, which were inserted after block 1.
+	c.Set(Key{Offset: 6}, make([]byte, blockSize))
+	require.Equal(t, []uint64{2, 3, 4}, evicted)
+	c.Set(Key{Offset: 7}, make([]byte, blockSize))
+	require.Equal(t, []uint64{2, 3, 4, 1}, evicted)
+	require.Equal(t, int64(4), c.Metrics().Evictions)
+	checkShards(t, c)
+}
+
+func TestCachePin(t *testing.T) {
+	const blockSize = 100
+	charge := blockSize + entryOverhead
+
+	// The cache holds 2 blocks.
+	var evicted []uint64
+	c := New(2*charge, WithShards(1),
+		WithEvictionCallback(func(k Key, _ []byte) {
+			evicted = append(evicted, k.Offset)
+		}))
+	c.Set(Key{Offset: 1}, make([]byte, blockSize))
+	c.Set(Key{Offset: 2}, make([]byte, blockSize))
+	_, ok := c.Pin(Key{Offset: 3})
+	require.False(t, ok)
+
+	// The hand passes over a pinned block.
+	_, ok = c.Pin(Key{Offset: 1})
+	require.True(t, ok)
+	c.Pin(Key{Offset: 1})
+	c.Set(Key{Offset: 3}, make([]byte, blockSize))
+	require.Equal(t, []uint64{2}, evicted)
+	checkShards(t, c)
+
+	// If every block is pinned the capacity is exceeded, and the excess is
+	// evicted when the last pin of a block is released.
+	c.Pin(Key{Offset: 3})
+	c.Set(Key{Offset: 4}, make([]byte, blockSize))
+	require.Equal(t, []uint64{2, 4}, evicted)
+	c.Pin(Key{Offset: 3})
+	c.Unpin(Key{Offset: 3})
+	require.Equal(t, 2, c.Metrics().Count)
+	c.Unpin(Key{Offset: 3})
+	// Pinning block 3 referenced it, so it is given a second chance.
+	c.Set(Key{Offset: 5}, make([]byte, blockSize))
+	require.Equal(t, []uint64{2, 4, 5}, evicted)
+	c.Set(Key{Offset: 6}, make([]byte, blockSize))
+	require.Equal(t, []uint64{2, 4, 5, 3}, evicted)
+	c.Unpin(Key{Offset: 1})
+	c.Unpin(Key{Offset: 1})
+	require.Panics(t, func() { c.Unpin(Key{Offset: 1}) })
+	checkShards(t, c)
+
+	// Deleting a block discards its pins.
+	c.Pin(Key{Offset: 6})
+	require.True(t, c.Delete(Key{Offset: 6}))
+	c.Unpin(Key{Offset: 6})
+	checkShards(t, c)
+}
+
+func TestCacheCapacity(t *testing.T) {
+	const capacity = 1 << 20
+	c := New(capacity, WithShards(8))
+	rng := rand.New(rand.NewSource(1))
+	for i := 0; i < 100000; i++ {
+		k := Key{FileNum: uint64(rng.Intn(10)), Offset: uint64(rng.Intn(10000))}
+		switch rng.Intn(10) {
+		case 0:
+			c.Delete(k)
+		case 1, 2, 3:
+			c.Set(k, make([]byte, rng.Intn(4096)))
+		default:
+			c.Get(k)
+		}
+		if i%10000 == 0 {
+			c.EvictFile(uint64(rng.Intn(10)))
+		}
+	}
+	m := c.Metrics()
+	require.LessOrEqual(t, m.Size, int64(capacity))
+	require.Greater(t, m.Evictions, int64(0))
+	checkShards(t, c)
+
+	// The map of a shard does not shrink when blocks are evicted, but is
+	// not charged against the capacity: after the map has grown to hold
+	// many small blocks, the shard still holds large blocks up to its
+	// capacity.
+	c = New(capacity, WithShards(1))
+	for i := 0; i < capacity/int(entryOverhead); i++ {
+		c.Set(Key{Offset: uint64(i)}, nil)
+	}
+	const blockSize = capacity/4 - entryOverhead
+	for i := 0; i < 4; i++ {
+		c.Set(Key{FileNum: 1, Offset: uint64(i)}, make([]byte, blockSize))
+	}
+	for i := 0; i < 4; i++ {
+		_, ok := c.Get(Key{FileNum: 1, Offset: uint64(i)})
+		require.True(t, ok)
+	}
+	require.Equal(t, 4, c.Metrics().Count)
+	checkShards(t, c)
+}
+
+func TestCacheConcurrent(t *testing.T) {
+	c := New(1<<20, WithShards(4))
+	var wg sync.WaitGroup
+	for g := 0; g < 8; g++ {
+		wg.Add(1)
+		go func(g int) {
+			defer wg.Done()
+			rng := rand.New(rand.NewSource(int64(g)))
+			for i := 0; i < 10000; i++ {
+				k := Key{FileNum: uint64(g), Offset: uint64(rng.Intn(1000))}
+				if _, ok := c.Get(k); !ok {
+					c.Set(k, make([]byte, 512))
+				}
+			}
+		}(g)
+	}
+	wg.Wait()
+	checkShards(t, c)
+}
+
+func BenchmarkCache(b *testing.B) {
+	const blockSize = 4096
+	const blocks = 1 << 16
+	for _, shards := range []int{1, 16} {
+		b.Run(fmt.Sprintf("shards=%d", shards), func(b *testing.B) {
+			// The cache holds about a quarter of the blocks, which are
+			// accessed with a skewed distribution.
+			c := New(blocks/4*blockSize, WithShards(shards))
+			block := make([]byte, blockSize)
+			b.RunParallel(func(pb *testing.PB) {
+				rng := rand.New(rand.NewSource(rand.Int63()))
+				zipf := rand.NewZipf(rng, 1.1, 1, blocks-1)
+				for pb.Next() {
+					k := Key{FileNum: 1, Offset: zipf.Uint64() * blockSize}
+					if _, ok := c.Get(k); !ok {
+						c.Set(k, block)
+					}
+				}
+			})
+			m := c.Metrics()
+			b.ReportMetric(float64(m.Hits)/float64(m.Hits+m.Misses), "hit-ratio")
+		})
+	}
+}
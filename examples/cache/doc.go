@@ -0,0 +1,44 @@
+// Copyright 2024 The Cockroach Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package cache is an example of a block cache, such as the cache of file
+// blocks of a storage engine, built on swiss.Map. It is intended as
+// documentation of how the features of swiss.Map fit together in a realistic
+// workload, and as a target for integration tests and benchmarks.
+//
+// The cache holds the blocks of files, identified by a file number and an
+// offset, within a fixed amount of memory. The keys are partitioned between
+// shards, each protected by a mutex, and each shard evicts blocks using the
+// CLOCK algorithm (an approximation of LRU which does not reorder entries on
+// each access). The memory charged for a shard includes the blocks, the
+// per-block bookkeeping, and an estimate of the memory of each block's slot
+// in the shard's swiss.Map. A key is hashed once per operation: the hash is
+// used both to select the shard and, with swiss.Map.GetWithHash and
+// swiss.Map.PutWithHash, for the shard's map, whose hash function ignores
+// the map's seed. A block which is being read in place can be pinned (see
+// Cache.Pin) so that it is not evicted, and its memory not passed to the
+// eviction callback for reuse, until it is unpinned.
+//
+// Usage:
+//
+//	c := cache.New(64<<20,
+//	  cache.WithShards(16),
+//	  cache.WithEvictionCallback(func(k cache.Key, block []byte) {
+//	    ...
+//	  }))
+//	c.Set(cache.Key{FileNum: 1, Offset: 0}, block)
+//	block, ok := c.Get(cache.Key{FileNum: 1, Offset: 0})
+//	...
+//	c.EvictFile(1)
+package cache
@@ -0,0 +1,163 @@
+// Copyright 2024 The Cockroach Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package swiss
+
+import (
+	"fmt"
+	"math"
+	"time"
+)
+
+// expiringEntry is the value stored in the Map underlying an ExpiringMap.
+type expiringEntry[V any] struct {
+	value V
+	// expires is the monotonic time (see nanotime) at which the entry
+	// expires, or 0 if the entry never expires.
+	expires int64
+}
+
+func (e *expiringEntry[V]) expired(now int64) bool {
+	return e.expires != 0 && now >= e.expires
+}
+
+// ExpiringMap is a map in which each entry expires a fixed duration (its
+// time-to-live, or TTL) after it was last put, as is needed for caches of
+// authentication tokens or DNS lookups. An expired entry is treated as absent
+// by Get and All. Expired entries are reclaimed lazily: by Get when an
+// expired entry is looked up, by a sweep of the map performed once the
+// number of Puts since the previous sweep exceeds the number of entries
+// which remained after it (which keeps the amortized cost of a Put
+// constant), and by ExpireNow. Expiration uses a monotonic clock (see
+// WithClock), so it is unaffected by changes to the wall clock.
+//
+// The zero value for an ExpiringMap is an empty map ready to use in which
+// entries put with Put never expire. Like Map, an ExpiringMap is NOT
+// goroutine-safe.
+type ExpiringMap[K comparable, V any] struct {
+	m   Map[K, expiringEntry[V]]
+	ttl time.Duration
+	// putsSinceSweep is the number of Puts since expired entries were last
+	// swept from the map, and sweptLen is the number of entries which
+	// remained after that sweep.
+	putsSinceSweep int
+	sweptLen       int
+	// clock returns the current monotonic time in nanoseconds. It is nil
+	// (i.e. nanotime) unless the WithClock option was specified.
+	clock func() int64
+}
+
+// NewExpiringMap constructs a new ExpiringMap with the specified initial
+// capacity (see New) in which entries put with Put expire after ttl. A ttl
+// <= 0 means such entries never expire. WithClock is the only option
+// supported by an ExpiringMap, and NewExpiringMap panics if passed another.
+func NewExpiringMap[K comparable, V any](
+	initialCapacity int, ttl time.Duration, options ...Option[K, V],
+) *ExpiringMap[K, V] {
+	em := &ExpiringMap[K, V]{ttl: ttl}
+	for _, op := range options {
+		c, ok := op.(clockOption[K, V])
+		if !ok {
+			panic(fmt.Sprintf("option %T is not supported by ExpiringMap", op))
+		}
+		em.clock = c.clock
+	}
+	em.m.Init(initialCapacity)
+	return em
+}
+
+// Put inserts an entry into the map which expires after the TTL of the map,
+// overwriting an existing value (and its expiration) if an entry with the
+// same key already exists.
+func (em *ExpiringMap[K, V]) Put(key K, value V) {
+	em.PutWithTTL(key, value, em.ttl)
+}
+
+// PutWithTTL is like Put, but the entry expires after the specified ttl
+// rather than the TTL of the map. A ttl <= 0 means the entry never expires,
+// as does a ttl so large that the expiration is not representable.
+func (em *ExpiringMap[K, V]) PutWithTTL(key K, value V, ttl time.Duration) {
+	now := em.now()
+	e := expiringEntry[V]{value: value}
+	if ttl > 0 && (now <= 0 || int64(ttl) <= math.MaxInt64-now) {
+		e.expires = now + int64(ttl)
+	}
+	em.m.Put(key, e)
+
+	em.putsSinceSweep++
+	if em.putsSinceSweep > em.sweptLen {
+		em.expire(now)
+	}
+}
+
+// Get retrieves the value for the specified key, returning ok=false if the
+// key is not present or its entry has expired. An expired entry is deleted.
+func (em *ExpiringMap[K, V]) Get(key K) (value V, ok bool) {
+	loc := em.m.find(key)
+	if !loc.found {
+		return value, false
+	}
+	e := loc.value()
+	if e.expired(em.now()) {
+		em.m.deleteAt(loc)
+		return value, false
+	}
+	return e.value, true
+}
+
+// Delete deletes the entry with the specified key, returning true if the key
+// was present and its entry had not expired.
+func (em *ExpiringMap[K, V]) Delete(key K) bool {
+	e, ok := em.m.Pop(key)
+	return ok && !e.expired(em.now())
+}
+
+// ExpireNow deletes all of the expired entries from the map, returning the
+// number of entries deleted.
+func (em *ExpiringMap[K, V]) ExpireNow() int {
+	return em.expire(em.now())
+}
+
+// Len returns the number of entries in the map, including expired entries
+// which have not yet been reclaimed. Call ExpireNow first for an exact count.
+func (em *ExpiringMap[K, V]) Len() int {
+	return em.m.Len()
+}
+
+// All calls yield sequentially for each key and value present in the map
+// whose entry has not expired (see Map.All).
+func (em *ExpiringMap[K, V]) All(yield func(key K, value V) bool) {
+	now := em.now()
+	em.m.All(func(key K, e expiringEntry[V]) bool {
+		if e.expired(now) {
+			return true
+		}
+		return yield(key, e.value)
+	})
+}
+
+func (em *ExpiringMap[K, V]) expire(now int64) int {
+	deleted := em.m.DeleteFunc(func(_ K, e expiringEntry[V]) bool {
+		return e.expired(now)
+	})
+	em.putsSinceSweep, em.sweptLen = 0, em.m.Len()
+	return deleted
+}
+
+func (em *ExpiringMap[K, V]) now() int64 {
+	if em.clock != nil {
+		return em.clock()
+	}
+	return nanotime()
+}
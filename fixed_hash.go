@@ -0,0 +1,107 @@
+// Copyright 2024 The Cockroach Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package swiss
+
+import (
+	"encoding/binary"
+	"math/bits"
+	"reflect"
+	"unsafe"
+)
+
+// newHasher returns the default hash function for keys of type K bound to a
+// new seed, along with the integer seed derived from it which is passed to
+// the hash function.
+func newHasher[K comparable]() (hashFn, uintptr) {
+	s := newHashSeed()
+	return getHasher[K](s), seedBits(s)
+}
+
+// getHasher returns the default hash function for keys of type K. Fixed size
+// byte arrays such as [16]byte UUIDs and [32]byte digests are common keys in
+// storage systems, and for those sizes we use a specialized hash function
+// which loads the key a word at a time and is simpler than the runtime's
+// generic memory hasher, and which is seeded by the integer seed passed to it.
+// All other key types use the runtime's hasher bound to seed s (see
+// getRuntimeHasher).
+//
+// Note that no specialization is needed for comparing keys: the compiler
+// instantiates Map once per GC shape, and for a byte array the shape is the
+// array type itself so key comparisons are already compiled to word-wise
+// loads and compares for the array's size.
+func getHasher[K comparable](s hashSeed) hashFn {
+	if t := reflect.TypeOf((*K)(nil)).Elem(); t.Kind() == reflect.Array && t.Elem().Kind() == reflect.Uint8 {
+		switch t.Len() {
+		case 8:
+			return hashBytes8
+		case 16:
+			return hashBytes16
+		case 32:
+			return hashBytes32
+		}
+	}
+	return getRuntimeHasher[K](s)
+}
+
+// The multiplicative constants used by wyhash, which is also the basis of
+// the runtime's fallback memory hasher.
+const (
+	hashM1 = 0xa0761d6478bd642f
+	hashM2 = 0xe7037ed1a0b428db
+	hashM3 = 0x8ebc6af09c88c6e3
+	hashM4 = 0x589965cc75374cc3
+	hashM5 = 0x1d8e4e27c47d124f
+)
+
+// hashMix folds the 128-bit product of a and b into 64 bits.
+func hashMix(a, b uint64) uint64 {
+	hi, lo := bits.Mul64(a, b)
+	return hi ^ lo
+}
+
+// hashLoad loads the 8 bytes at p, which need not be aligned.
+func hashLoad(p unsafe.Pointer) uint64 {
+	return binary.LittleEndian.Uint64((*[8]byte)(p)[:])
+}
+
+// The seed is mixed into both multiplicands of every hashMix of key material,
+// and in different forms (s and t) so that the operands can't be exchanged by
+// choosing the key. Otherwise a key whose bytes cancel the constant in one
+// multiplicand would zero the product for every seed, and keys which swap the
+// operands of a (commutative) multiplication would collide for every seed.
+
+func hashBytes8(key unsafe.Pointer, seed uintptr) uintptr {
+	s := uint64(seed) ^ hashM1
+	t := bits.RotateLeft64(s, 32)
+	return uintptr(hashMix(hashM5^8, hashMix(hashLoad(key)^hashM2^s, t^hashM3)))
+}
+
+func hashBytes16(key unsafe.Pointer, seed uintptr) uintptr {
+	s := uint64(seed) ^ hashM1
+	t := bits.RotateLeft64(s, 32)
+	a := hashLoad(key)
+	b := hashLoad(unsafe.Add(key, 8))
+	return uintptr(hashMix(hashM5^16, hashMix(a^hashM2^s, b^t)))
+}
+
+func hashBytes32(key unsafe.Pointer, seed uintptr) uintptr {
+	// The two halves of the key are mixed independently so that the
+	// multiplications can proceed in parallel.
+	s := uint64(seed) ^ hashM1
+	t := bits.RotateLeft64(s, 32)
+	a := hashMix(hashLoad(key)^hashM2^s, hashLoad(unsafe.Add(key, 8))^t)
+	b := hashMix(hashLoad(unsafe.Add(key, 16))^hashM3^t, hashLoad(unsafe.Add(key, 24))^hashM4^s)
+	return uintptr(hashMix(hashM5^32, a^b))
+}
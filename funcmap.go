@@ -0,0 +1,115 @@
+// Copyright 2024 The Cockroach Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package swiss
+
+import "unsafe"
+
+// funcKey is the key stored in the Map underlying a FuncMap. It points to the
+// key, which need not be comparable, and is hashed and compared by the
+// functions passed to NewFunc.
+type funcKey[K any] struct {
+	p *K
+}
+
+// FuncMap is a map whose keys are hashed and compared by functions provided
+// by the caller rather than by the Go runtime, which lifts the requirement
+// that keys are comparable. For example, a FuncMap may be keyed by structs
+// containing slices, or by values which are grouped into user-defined
+// equivalence classes. A FuncMap is composed of a Map from pointers to keys
+// configured with WithHash and WithKeyEqual, so each key inserted into the
+// map is copied into a separate allocation. The copy is shallow: memory
+// reachable from the key, such as the elements of a slice, is shared with
+// the caller and must not be mutated while the key is in the map, as that
+// would change the key's hash and the keys it is equal to. For comparable
+// keys, use a Map with those options instead.
+//
+// Like Map, a FuncMap is NOT goroutine-safe.
+type FuncMap[K, V any] struct {
+	m Map[funcKey[K], V]
+}
+
+// NewFunc constructs a new FuncMap with the specified initial capacity (see
+// New), which hashes keys with hash and compares them with equal. Keys which
+// are equal must have the same hash. Memory reachable from a key inserted
+// into the map must not be mutated while the key is in the map (see
+// FuncMap). The pointers passed to hash and equal are only valid for the
+// duration of the call and must not be retained.
+func NewFunc[K, V any](
+	initialCapacity int, hash func(key *K, seed uintptr) uintptr, equal func(a, b *K) bool,
+) *FuncMap[K, V] {
+	if hash == nil || equal == nil {
+		panic("NewFunc requires a hash function and an equality function")
+	}
+	f := &FuncMap[K, V]{}
+	f.m.Init(initialCapacity,
+		WithHash[funcKey[K], V](func(key *funcKey[K], seed uintptr) uintptr {
+			return hash(key.p, seed)
+		}),
+		WithKeyEqual[funcKey[K], V](func(a, b *funcKey[K]) bool {
+			return equal(a.p, b.p)
+		}))
+	return f
+}
+
+// lookupKey returns the funcKey for key, which is used to look up an entry
+// without copying key to the heap. The funcKey must not be stored in the map.
+func lookupKey[K any](key *K) funcKey[K] {
+	return funcKey[K]{p: (*K)(noescape(unsafe.Pointer(key)))}
+}
+
+// Put inserts an entry into the map, overwriting an existing value if an
+// entry with an equal key already exists. In that case the existing key is
+// retained.
+func (f *FuncMap[K, V]) Put(key K, value V) {
+	loc := f.m.find(lookupKey(&key))
+	if loc.found {
+		*f.m.mutableLocation(loc).value() = value
+		return
+	}
+	p := new(K)
+	*p = key
+	f.m.insert(loc, funcKey[K]{p: p}, value)
+}
+
+// Get retrieves the value for the specified key, returning ok=false if the
+// key is not present.
+func (f *FuncMap[K, V]) Get(key K) (value V, ok bool) {
+	return f.m.Get(lookupKey(&key))
+}
+
+// Delete deletes the entry with the specified key, returning true if the key
+// was present.
+func (f *FuncMap[K, V]) Delete(key K) bool {
+	return f.m.Delete(lookupKey(&key))
+}
+
+// Clear deletes all entries from the map, and returns the number of entries
+// deleted (see Map.Clear).
+func (f *FuncMap[K, V]) Clear() int {
+	return f.m.Clear()
+}
+
+// Len returns the number of entries in the map.
+func (f *FuncMap[K, V]) Len() int {
+	return f.m.Len()
+}
+
+// All calls yield sequentially for each key and value present in the map
+// (see Map.All).
+func (f *FuncMap[K, V]) All(yield func(key K, value V) bool) {
+	f.m.All(func(key funcKey[K], value V) bool {
+		return yield(*key.p, value)
+	})
+}
@@ -0,0 +1,97 @@
+// Copyright 2024 The Cockroach Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package swiss
+
+import (
+	"hash/fnv"
+	"slices"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+// sliceKey is not comparable, and so can only be used as the key of a
+// FuncMap.
+type sliceKey struct {
+	name string
+	path []int
+}
+
+func hashSliceKey(key *sliceKey, seed uintptr) uintptr {
+	h := fnv.New64a()
+	var buf [8]byte
+	for i := range buf {
+		buf[i] = byte(seed >> (8 * i))
+	}
+	h.Write(buf[:])
+	h.Write([]byte(key.name))
+	for _, v := range key.path {
+		h.Write([]byte{byte(v), byte(v >> 8), byte(v >> 16), byte(v >> 24)})
+	}
+	return uintptr(h.Sum64())
+}
+
+func equalSliceKey(a, b *sliceKey) bool {
+	return a.name == b.name && slices.Equal(a.path, b.path)
+}
+
+func TestFuncMap(t *testing.T) {
+	f := NewFunc[sliceKey, int](0, hashSliceKey, equalSliceKey)
+	const n = 1000
+	for i := 0; i < n; i++ {
+		f.Put(sliceKey{name: "k", path: []int{i, i + 1}}, i)
+	}
+	require.Equal(t, n, f.Len())
+	require.NoError(t, f.m.Validate())
+
+	// Keys are compared by value, not by the identity of their slices.
+	path := []int{7, 8}
+	f.Put(sliceKey{name: "k", path: path}, -7)
+	require.Equal(t, n, f.Len())
+	path[0] = 0
+	v, ok := f.Get(sliceKey{name: "k", path: []int{7, 8}})
+	require.True(t, ok)
+	require.Equal(t, -7, v)
+	_, ok = f.Get(sliceKey{name: "j", path: []int{7, 8}})
+	require.False(t, ok)
+
+	for i := 0; i < n; i += 2 {
+		require.True(t, f.Delete(sliceKey{name: "k", path: []int{i, i + 1}}))
+	}
+	require.False(t, f.Delete(sliceKey{name: "k", path: []int{0, 1}}))
+	require.Equal(t, n/2, f.Len())
+
+	var count int
+	f.All(func(key sliceKey, value int) bool {
+		require.Equal(t, 1, key.path[0]%2)
+		count++
+		return true
+	})
+	require.Equal(t, n/2, count)
+
+	require.Equal(t, n/2, f.Clear())
+	require.Equal(t, 0, f.Len())
+	require.Panics(t, func() { NewFunc[sliceKey, int](0, nil, equalSliceKey) })
+}
+
+func TestFuncMapGetDoesNotAllocate(t *testing.T) {
+	f := NewFunc[sliceKey, int](0, hashSliceKey, equalSliceKey)
+	key := sliceKey{name: "k", path: []int{1, 2}}
+	f.Put(key, 1)
+	allocs := testing.AllocsPerRun(100, func() {
+		f.Get(key)
+	})
+	require.Zero(t, allocs)
+}
@@ -5,11 +5,11 @@ go 1.21
 require (
 	github.com/aclements/go-perfevent v0.0.0-20240301234650-f7843625020f
 	github.com/stretchr/testify v1.8.4
+	golang.org/x/sys v0.17.0
 )
 
 require (
 	github.com/davecgh/go-spew v1.1.1 // indirect
 	github.com/pmezard/go-difflib v1.0.0 // indirect
-	golang.org/x/sys v0.17.0 // indirect
 	gopkg.in/yaml.v3 v3.0.1 // indirect
 )
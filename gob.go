@@ -0,0 +1,87 @@
+// Copyright 2024 The Cockroach Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package swiss
+
+import (
+	"bytes"
+	"encoding/gob"
+	"fmt"
+)
+
+// GobEncode implements the gob.GobEncoder interface, allowing a Map to be
+// persisted with encoding/gob without first converting it to a builtin map.
+// The map is encoded as a gob stream holding the number of entries followed
+// by each key and its value in turn, in an unspecified order. The format is
+// stable: a map encoded by one version of this package can be decoded by any
+// later version. Only the entries of the map are encoded, not the options it
+// was constructed with.
+func (m *Map[K, V]) GobEncode() ([]byte, error) {
+	var buf bytes.Buffer
+	enc := gob.NewEncoder(&buf)
+	if err := enc.Encode(m.Len()); err != nil {
+		return nil, err
+	}
+	var err error
+	m.iterate(0, func(key K, value V) bool {
+		if err = enc.Encode(key); err != nil {
+			return false
+		}
+		err = enc.Encode(value)
+		return err == nil
+	}, nil)
+	if err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// GobDecode implements the gob.GobDecoder interface, replacing the entries of
+// the map with those encoded by GobEncode. The map is sized to hold the
+// decoded entries before they are inserted. A zero value map is initialized
+// with the default options, so a map requiring options (e.g. WithHash) must
+// be initialized with them (see Map.Init) before decoding into it.
+func (m *Map[K, V]) GobDecode(data []byte) error {
+	dec := gob.NewDecoder(bytes.NewReader(data))
+	var n int
+	if err := dec.Decode(&n); err != nil {
+		return err
+	}
+	// Every entry requires at least one byte of data, which bounds the size
+	// the map is presized to when decoding corrupt data.
+	if n < 0 || n > len(data) {
+		return fmt.Errorf("invalid encoded length %d", n)
+	}
+
+	if m.hash == nil {
+		m.Init(n)
+	} else {
+		m.Clear()
+		m.Reserve(n)
+	}
+	for i := 0; i < n; i++ {
+		// NB: gob does not zero the fields of a struct which are missing from
+		// the encoded value, so each entry is decoded into zero values.
+		var key K
+		var value V
+		if err := dec.Decode(&key); err != nil {
+			return err
+		}
+		if err := dec.Decode(&value); err != nil {
+			return err
+		}
+		m.Put(key, value)
+	}
+	return nil
+}
@@ -0,0 +1,151 @@
+// Copyright 2024 The Cockroach Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+//go:build swiss_sse2
+
+package swiss
+
+import (
+	"math/bits"
+	"strings"
+)
+
+// A Group holds groupSize slots, of which an average of maxAvgGroupLoad may
+// be full before the bucket holding it grows (see bucket.resetGrowthLeft).
+// As we were built with the "swiss_sse2" build tag, a Group holds 16 slots
+// whose control bytes are matched with SSE2 instructions, as in Abseil. A
+// probe sequence visits half as many groups as with the default 8 slot
+// groups, at the cost of a function call per match, as Go does not inline
+// assembly (see BenchmarkMatchH2 and the README).
+const (
+	groupSize       = 16
+	maxAvgGroupLoad = 14
+)
+
+// bitset represents a set of slots within a group.
+//
+// The underlying representation uses one bit per slot, the result of the
+// PMOVMSKB instruction, where bit i is set if slot i is part of the set.
+type bitset uint16
+
+// first returns the index of the first slot in the set.
+//
+// Returns groupSize if the bitset is empty.
+func (b bitset) first() uint32 {
+	return uint32(bits.TrailingZeros16(uint16(b)))
+}
+
+// removeFirst removes the first set bit (that is, resets the least significant set bit to 0).
+func (b bitset) removeFirst() bitset {
+	return b & (b - 1)
+}
+
+func (b bitset) String() string {
+	var buf strings.Builder
+	buf.Grow(groupSize)
+	for i := 0; i < groupSize; i++ {
+		if (b & (1 << i)) != 0 {
+			buf.WriteString("1")
+		} else {
+			buf.WriteString("0")
+		}
+	}
+	return buf.String()
+}
+
+// ctrlGroup is a fixed size array of groupSize control bytes stored in two
+// uint64s, each holding the control bytes of 8 slots in the same manner as
+// the default 8 slot ctrlGroup.
+type ctrlGroup struct {
+	lo, hi uint64
+}
+
+// Set sets the i-th control byte. The update is performed as a 64-bit store
+// of the word holding the control byte (see with).
+func (g *ctrlGroup) Set(i uint32, c ctrl) {
+	*g = g.with(i, c)
+}
+
+// SetEmpty sets all the control bytes to empty.
+func (g *ctrlGroup) SetEmpty() {
+	*g = ctrlGroup{bitsetEmpty, bitsetEmpty}
+}
+
+// with returns a copy of the control group with the i-th control byte set to
+// c.
+func (g ctrlGroup) with(i uint32, c ctrl) ctrlGroup {
+	shift := (i & 7) << 3
+	if i&8 == 0 {
+		g.lo = (g.lo &^ (0xff << shift)) | (uint64(c) << shift)
+	} else {
+		g.hi = (g.hi &^ (0xff << shift)) | (uint64(c) << shift)
+	}
+	return g
+}
+
+// matchH2 returns the set of slots which are full and for which the h2 hash
+// matches the given value. The SSE2 byte comparison never produces false
+// positive matches.
+func (g *ctrlGroup) matchH2(h uintptr) bitset {
+	return matchCtrlSSE2(g, bitsetLSB*uint64(h))
+}
+
+// matchH2SWAR and matchH2Exact are the same as matchH2, which is exact. They
+// exist for the tests and benchmarks which compare the 8 slot routines.
+func (g *ctrlGroup) matchH2SWAR(h uintptr) bitset {
+	return g.matchH2(h)
+}
+
+func (g *ctrlGroup) matchH2Exact(h uintptr) bitset {
+	return g.matchH2(h)
+}
+
+// matchEmpty returns the set of slots in the group that are empty.
+func (g *ctrlGroup) matchEmpty() bitset {
+	return matchCtrlSSE2(g, bitsetEmpty)
+}
+
+// matchFull returns the set of slots in the group that are full.
+func (g *ctrlGroup) matchFull() bitset {
+	// A slot is full iff the high bit of its control byte is not set.
+	return ^matchEmptyOrDeletedSSE2(g)
+}
+
+// matchEmptyOrDeleted returns the set of slots in the group that are empty or
+// deleted.
+func (g *ctrlGroup) matchEmptyOrDeleted() bitset {
+	return matchEmptyOrDeletedSSE2(g)
+}
+
+// convertNonFullToEmptyAndFullToDeleted converts deleted control bytes in a
+// group to empty control bytes, and control bytes indicating full slots to
+// deleted control bytes. See the default 8 slot ctrlGroup for the
+// derivation, which is applied to each half of the group.
+func (g *ctrlGroup) convertNonFullToEmptyAndFullToDeleted() {
+	lo, hi := g.lo&bitsetMSB, g.hi&bitsetMSB
+	g.lo = (^lo + (lo >> 7)) &^ bitsetLSB
+	g.hi = (^hi + (hi >> 7)) &^ bitsetLSB
+}
+
+// matchCtrlSSE2 returns the set of control bytes in ctrls equal to the low
+// byte of v, which holds the byte repeated 8 times.
+//
+//go:noescape
+func matchCtrlSSE2(ctrls *ctrlGroup, v uint64) bitset
+
+// matchEmptyOrDeletedSSE2 returns the set of control bytes in ctrls which
+// have their high bit set.
+//
+//go:noescape
+func matchEmptyOrDeletedSSE2(ctrls *ctrlGroup) bitset
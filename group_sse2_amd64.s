@@ -0,0 +1,36 @@
+// Copyright 2024 The Cockroach Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+//go:build swiss_sse2
+
+#include "textflag.h"
+
+// func matchCtrlSSE2(ctrls *ctrlGroup, v uint64) bitset
+TEXT ·matchCtrlSSE2(SB), NOSPLIT|NOFRAME, $0-18
+	MOVQ       ctrls+0(FP), AX
+	MOVQ       v+8(FP), X0
+	PUNPCKLQDQ X0, X0
+	MOVOU      (AX), X1
+	PCMPEQB    X1, X0
+	PMOVMSKB   X0, AX
+	MOVW       AX, ret+16(FP)
+	RET
+
+// func matchEmptyOrDeletedSSE2(ctrls *ctrlGroup) bitset
+TEXT ·matchEmptyOrDeletedSSE2(SB), NOSPLIT|NOFRAME, $0-10
+	MOVQ     ctrls+0(FP), AX
+	MOVOU    (AX), X0
+	PMOVMSKB X0, AX
+	MOVW     AX, ret+8(FP)
+	RET
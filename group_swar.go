@@ -0,0 +1,223 @@
+// Copyright 2024 The Cockroach Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+//go:build !amd64 || !swiss_sse2
+
+package swiss
+
+import (
+	"math/bits"
+	"strings"
+)
+
+// A Group holds groupSize slots, of which an average of maxAvgGroupLoad may
+// be full before the bucket holding it grows (see bucket.resetGrowthLeft).
+// Building with the "swiss_sse2" build tag on amd64 selects 16 slot groups
+// (see group_sse2_amd64.go).
+const (
+	groupSize       = 8
+	maxAvgGroupLoad = 7
+)
+
+// bitset represents a set of slots within a group.
+//
+// The underlying representation uses one byte per slot, where each byte is
+// either 0x80 if the slot is part of the set or 0x00 otherwise. This makes it
+// convenient to calculate for an entire group at once (e.g. see matchEmpty).
+type bitset uint64
+
+// first assumes that only the MSB of each control byte can be set (e.g. bitset
+// is the result of matchEmpty or similar) and returns the relative index of the
+// first control byte in the group that has the MSB set.
+//
+// Returns 8 if the bitset is 0.
+// Returns groupSize if the bitset is empty.
+func (b bitset) first() uint32 {
+	return uint32(bits.TrailingZeros64(uint64(b))) >> 3
+}
+
+// removeFirst removes the first set bit (that is, resets the least significant set bit to 0).
+func (b bitset) removeFirst() bitset {
+	return b & (b - 1)
+}
+
+func (b bitset) String() string {
+	var buf strings.Builder
+	buf.Grow(groupSize)
+	for i := 0; i < groupSize; i++ {
+		if (b & (bitset(0x80) << (i << 3))) != 0 {
+			buf.WriteString("1")
+		} else {
+			buf.WriteString("0")
+		}
+	}
+	return buf.String()
+}
+
+// ctrlGroup is a fixed size array of groupSize control bytes stored in a
+// uint64. The control bytes are accessed as a uint64 through load and store,
+// which place the control byte of slot i in bits [8i, 8i+8) regardless of
+// the byte order of the CPU, so that the bitsets computed from them are
+// indexed by slot.
+type ctrlGroup uint64
+
+// load returns the control bytes of the group, with the control byte of slot
+// i in bits [8i, 8i+8).
+func (g *ctrlGroup) load() uint64 {
+	if bigEndian {
+		return bits.ReverseBytes64(uint64(*g))
+	}
+	return uint64(*g)
+}
+
+// store sets the control bytes of the group to v, which is laid out as
+// returned by load.
+func (g *ctrlGroup) store(v uint64) {
+	if bigEndian {
+		v = bits.ReverseBytes64(v)
+	}
+	*g = ctrlGroup(v)
+}
+
+// Set sets the i-th control byte. The update is performed as a single 64-bit
+// store of the entire group (see with) rather than a byte store so that a
+// group's control bytes are always published together, which allows the
+// store to be replaced with an atomic store or CAS for concurrent readers.
+func (g *ctrlGroup) Set(i uint32, c ctrl) {
+	*g = g.with(i, c)
+}
+
+// SetEmpty sets all the control bytes to empty.
+func (g *ctrlGroup) SetEmpty() {
+	*g = ctrlGroup(bitsetEmpty)
+}
+
+// with returns a copy of the control group with the i-th control byte set to
+// c.
+func (g ctrlGroup) with(i uint32, c ctrl) ctrlGroup {
+	shift := (i & (groupSize - 1)) << 3
+	g.store((g.load() &^ (0xff << shift)) | (uint64(c) << shift))
+	return g
+}
+
+// matchH2 returns the set of slots which are full and for which the h2 hash
+// matches the given value. May return false positives unless built with the
+// "swiss_exact_h2" or "swiss_neon" build tags.
+func (g *ctrlGroup) matchH2(h uintptr) bitset {
+	if neonMatch {
+		return matchH2NEON(g, h)
+	}
+	if exactH2Match {
+		return g.matchH2Exact(h)
+	}
+	return g.matchH2SWAR(h)
+}
+
+// matchH2SWAR is the default implementation of matchH2.
+func (g *ctrlGroup) matchH2SWAR(h uintptr) bitset {
+	// NB: This generic matching routine produces false positive matches when
+	// h is 2^N and the control bytes have a seq of 2^N followed by 2^N+1. For
+	// example: if ctrls==0x0302 and h=02, we'll compute v as 0x0100. When we
+	// subtract off 0x0101 the first 2 bytes we'll become 0xffff and both be
+	// considered matches of h. The false positive matches are not a problem,
+	// just a rare inefficiency. Note that they only occur if there is a real
+	// match and never occur on ctrlEmpty, or ctrlDeleted. The subsequent key
+	// comparisons ensure that there is no correctness issue. See
+	// BenchmarkMatchH2 for measuring the false positive rate.
+	v := g.load() ^ (bitsetLSB * uint64(h))
+	return bitset(((v - bitsetLSB) &^ v) & bitsetMSB)
+}
+
+// matchH2Exact is an implementation of matchH2 which never produces false
+// positive matches at the cost of an additional arithmetic operation. It is
+// used when built with the "swiss_exact_h2" build tag.
+func (g *ctrlGroup) matchH2Exact(h uintptr) bitset {
+	// A byte of v is zero iff the control byte matches h. Adding 0x7f to the
+	// low 7 bits of a byte sets the high bit iff any of the low 7 bits are set,
+	// and cannot carry into the adjacent byte. Or'ing in v then sets the high
+	// bit if it was set in v. The high bit of the result is thus clear iff the
+	// byte is zero.
+	v := g.load() ^ (bitsetLSB * uint64(h))
+	return bitset(^(((v & bitsetLow7) + bitsetLow7) | v) & bitsetMSB)
+}
+
+// matchEmpty returns the set of slots in the group that are empty.
+func (g *ctrlGroup) matchEmpty() bitset {
+	if neonMatch {
+		return matchH2NEON(g, uintptr(ctrlEmpty))
+	}
+	// An empty slot is   1000 0000
+	// A deleted slot is  1111 1110
+	// A full slot is     0??? ????
+	//
+	// A slot is empty iff bit 7 is set and bit 1 is not. We could select any
+	// of the other bits here (e.g. v << 1 would also work).
+	v := g.load()
+	return bitset((v &^ (v << 6)) & bitsetMSB)
+}
+
+// matchFull returns the set of slots in the group that are full.
+func (g *ctrlGroup) matchFull() bitset {
+	// An empty slot is  1000 0000
+	// A deleted slot is 1111 1110
+	// A full slot is    0??? ????
+	//
+	// A slot is full iff bit 7 is not set.
+	return bitset(^g.load() & bitsetMSB)
+}
+
+// matchEmptyOrDeleted returns the set of slots in the group that are empty or
+// deleted.
+func (g *ctrlGroup) matchEmptyOrDeleted() bitset {
+	if neonMatch {
+		return matchEmptyOrDeletedNEON(g)
+	}
+	// An empty slot is  1000 0000
+	// A deleted slot is 1111 1110
+	// A full slot is    0??? ????
+	//
+	// A slot is empty or deleted iff bit 7 is set and bit 0 is not.
+	v := g.load()
+	return bitset((v &^ (v << 7)) & bitsetMSB)
+}
+
+// convertNonFullToEmptyAndFullToDeleted converts deleted control bytes in a
+// group to empty control bytes, and control bytes indicating full slots to
+// deleted control bytes.
+func (g *ctrlGroup) convertNonFullToEmptyAndFullToDeleted() {
+	// An empty slot is     1000 0000
+	// A deleted slot is    1111 1110
+	// A full slot is       0??? ????
+	//
+	// We select the MSB, invert, add 1 if the MSB was set and zero out the low
+	// bit.
+	//
+	//  - if the MSB was set (i.e. slot was empty, or deleted):
+	//     v:             1000 0000
+	//     ^v:            0111 1111
+	//     ^v + (v >> 7): 1000 0000
+	//     &^ bitsetLSB:  1000 0000 = empty slot.
+	//
+	// - if the MSB was not set (i.e. full slot):
+	//     v:             0000 0000
+	//     ^v:            1111 1111
+	//     ^v + (v >> 7): 1111 1111
+	//     &^ bitsetLSB:  1111 1110 = deleted slot.
+	//
+	//
+	// Each control byte is converted independently of the others, so the
+	// conversion does not depend on the byte order of the CPU.
+	v := uint64(*g) & bitsetMSB
+	*g = ctrlGroup((^v + (v >> 7)) &^ bitsetLSB)
+}
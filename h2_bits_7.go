@@ -0,0 +1,28 @@
+// Copyright 2024 The Cockroach Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+//go:build !swiss_h2_bits_6
+
+package swiss
+
+// h2Bits is the number of bits of the hash stored in the control byte of a
+// full slot (see h2). The width can be reduced to 6 bits with the
+// "swiss_h2_bits_6" build tag in order to measure the effect of a narrower h2
+// on the rate of false positive matches for a key distribution (see
+// BenchmarkMatchH2).
+//
+// Widths above 7 bits are not supported. The high bit of a control byte
+// distinguishes full slots from empty and deleted slots, so an 8-bit h2 would
+// require a different control byte encoding.
+const h2Bits = 7
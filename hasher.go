@@ -0,0 +1,96 @@
+// Copyright 2024 The Cockroach Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package swiss
+
+import "unsafe"
+
+// Hasher computes the hashes of keys for a particular Map, with the map's
+// hash function and seed. A Hasher is obtained from Map.Hasher, and may be
+// used concurrently with other Hashers and with reads of the map, which
+// allows keys to be hashed outside of a critical section protecting the map.
+type Hasher[K comparable] struct {
+	hash hashFn
+	seed uintptr
+}
+
+// Hash is a key together with its hash, computed once by a Hasher and
+// reusable across the GetHashed, PutHashed, and DeleteHashed operations on
+// the map which the Hasher was obtained from, e.g. when a key is first
+// looked up and then inserted by separate functions. The zero Hash holds the
+// zero key, which is hashed when the Hash is used.
+//
+// A Hash records the seed it was computed with. If the map's seed has since
+// changed (because the map was cleared, see Map.Clear) the key is hashed
+// again, so a stale Hash is slower to use but is never incorrect. A Hash
+// must not be used with a map other than the one its Hasher was obtained
+// from.
+type Hash[K comparable] struct {
+	key  K
+	h    uintptr
+	seed uintptr
+	ok   bool
+}
+
+// Key returns the key whose hash h holds.
+func (h Hash[K]) Key() K {
+	return h.key
+}
+
+// Hasher returns a Hasher which computes the hashes of keys for the map.
+func (m *Map[K, V]) Hasher() Hasher[K] {
+	m.lazyInit()
+	return Hasher[K]{hash: m.hash, seed: m.seed}
+}
+
+// Hash returns the Hash of key.
+func (h Hasher[K]) Hash(key K) Hash[K] {
+	return Hash[K]{
+		key:  key,
+		h:    h.hash(noescape(unsafe.Pointer(&key)), h.seed),
+		seed: h.seed,
+		ok:   true,
+	}
+}
+
+// hashed returns the hash held by h if it was computed with the map's
+// current seed, otherwise it hashes the key again.
+func (m *Map[K, V]) hashed(h *Hash[K]) uintptr {
+	m.lazyInit()
+	if !h.ok || h.seed != m.seed {
+		return m.hash(noescape(unsafe.Pointer(&h.key)), m.seed)
+	}
+	return h.h
+}
+
+// GetHashed is like Get, for the key of h, without hashing the key again.
+func (m *Map[K, V]) GetHashed(h Hash[K]) (value V, ok bool) {
+	return m.GetWithHash(h.key, m.hashed(&h))
+}
+
+// PutHashed is like Put, for the key of h, without hashing the key again.
+func (m *Map[K, V]) PutHashed(h Hash[K], value V) {
+	m.PutWithHash(h.key, m.hashed(&h), value)
+}
+
+// DeleteHashed is like Delete, for the key of h, without hashing the key
+// again.
+func (m *Map[K, V]) DeleteHashed(h Hash[K]) bool {
+	loc := m.findHashed(h.key, m.hashed(&h))
+	if !loc.found {
+		return false
+	}
+	m.deleteAt(loc)
+	return true
+}
@@ -0,0 +1,24 @@
+// Copyright 2024 The Cockroach Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+//go:build swiss_invariants_exhaustive
+
+package swiss
+
+// invariantsExhaustive is true if we were built with the
+// "swiss_invariants_exhaustive" build tag. When true, invariant checks which
+// verify every slot of a bucket after each mutation are performed in
+// addition to the checks enabled by invariants. These checks make each
+// operation O(bucket capacity) and are too slow for large tests.
+const invariantsExhaustive = true
@@ -12,9 +12,10 @@
 // See the License for the specific language governing permissions and
 // limitations under the License.
 
-//go:build !swiss_invariants
+//go:build !swiss_invariants && !swiss_invariants_exhaustive && !race
 
 package swiss
 
-// invariants is false if we were not built with the "swiss_invariants" build tags.
+// invariants is false if we were not built with the "swiss_invariants" or
+// "swiss_invariants_exhaustive" build tags, and without the race detector.
 const invariants = false
@@ -12,9 +12,12 @@
 // See the License for the specific language governing permissions and
 // limitations under the License.
 
-//go:build swiss_invariants
+//go:build swiss_invariants || swiss_invariants_exhaustive || race
 
 package swiss
 
-// invariants is true if we were built with the "swiss_invariants".
+// invariants is true if we were built with the "swiss_invariants" or
+// "swiss_invariants_exhaustive" build tags, or with the race detector
+// enabled. When true, invariant checks that require O(1) work per operation
+// (or O(buckets) work per structural change such as a split) are performed.
 const invariants = true
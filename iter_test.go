@@ -0,0 +1,71 @@
+// Copyright 2024 The Cockroach Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+//go:build go1.23
+
+package swiss
+
+import (
+	"iter"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+// The iteration methods can be used directly as iterators.
+var (
+	_ iter.Seq2[int, int] = (*Map[int, int])(nil).All
+	_ iter.Seq2[int, int] = (*Map[int, int])(nil).AllLive
+	_ iter.Seq[int]       = (*Map[int, int])(nil).Keys
+)
+
+func TestRangeFunc(t *testing.T) {
+	m := New[int, int](0)
+	for i := 0; i < 1000; i++ {
+		m.Put(i, -i)
+	}
+
+	seen := make(map[int]bool)
+	for k, v := range m.All {
+		require.Equal(t, -k, v)
+		require.False(t, seen[k])
+		seen[k] = true
+	}
+	require.Equal(t, m.Len(), len(seen))
+
+	var keys int
+	for k := range m.Keys {
+		require.True(t, seen[k])
+		keys++
+	}
+	require.Equal(t, m.Len(), keys)
+
+	var prefix0 int
+	allRange := func(yield func(k, v int) bool) { m.AllRange(0, 1, yield) }
+	for k := range allRange {
+		require.True(t, seen[k])
+		prefix0++
+	}
+	require.Less(t, prefix0, m.Len())
+
+	// Breaking out of the loop stops iteration.
+	var n int
+	for range m.All {
+		n++
+		if n == 10 {
+			break
+		}
+	}
+	require.Equal(t, 10, n)
+}
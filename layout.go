@@ -0,0 +1,28 @@
+// Copyright 2024 The Cockroach Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package swiss
+
+import "unsafe"
+
+// CtrlBytesFor returns the number of control bytes in the groups which hold
+// the specified number of slots. The capacity is rounded up to a multiple of
+// the number of slots in a Group.
+func CtrlBytesFor(capacity int) int {
+	if capacity <= 0 {
+		return 0
+	}
+	var g ctrlGroup
+	return (capacity + groupSize - 1) / groupSize * int(unsafe.Sizeof(g))
+}
@@ -0,0 +1,33 @@
+// Copyright 2024 The Cockroach Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package lru provides a least-recently-used cache built on swiss.Map. The
+// cache holds its entries in an intrusive doubly-linked list ordered by
+// recency of use, and the map indexes the list entries by key. When the total
+// size of the entries exceeds the capacity of the cache, the least recently
+// used entries are evicted. An entry which is in use can be pinned (see
+// Cache.Pin) to prevent it from being evicted.
+//
+// Usage:
+//
+//	c := lru.New[string, []byte](64<<20,
+//	  lru.WithSize[string, []byte](func(k string, v []byte) int64 {
+//	    return int64(len(k) + len(v))
+//	  }),
+//	  lru.WithEvictionCallback[string, []byte](func(k string, v []byte) {
+//	    ...
+//	  }))
+//	c.Put("a", []byte("value"))
+//	v, ok := c.Get("a")
+package lru
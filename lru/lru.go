@@ -0,0 +1,286 @@
+// Copyright 2024 The Cockroach Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package lru
+
+import "github.com/cockroachdb/swiss"
+
+// Cache is a least-recently-used cache from keys to values, holding entries
+// up to a total size. By default every entry has a size of 1, so the
+// capacity of the cache is a number of entries. A Cache is NOT
+// goroutine-safe.
+type Cache[K comparable, V any] struct {
+	// m indexes the entries by key. The map holds pointers to the entries
+	// rather than the entries themselves as the slots of a map are moved when
+	// it grows, which would invalidate the links between entries.
+	m swiss.Map[K, *entry[K, V]]
+	// root is the sentinel of the circular list of entries, ordered from the
+	// most recently used (root.next) to the least recently used (root.prev).
+	root entry[K, V]
+	// free holds a singly-linked list (through next) of entries available
+	// for reuse, in order to avoid allocating an entry for each insertion
+	// into a full cache.
+	free     *entry[K, V]
+	capacity int64
+	size     int64
+	sizeOf   func(key K, value V) int64
+	onEvict  func(key K, value V)
+}
+
+type entry[K comparable, V any] struct {
+	key   K
+	value V
+	size  int64
+	// pins is the number of calls to Pin for the entry not yet matched by a
+	// call to Unpin. An entry with pins > 0 is not evicted.
+	pins       int32
+	prev, next *entry[K, V]
+}
+
+// Option provides an interface for passing configuration parameters for
+// Cache initialization.
+type Option[K comparable, V any] interface {
+	apply(c *Cache[K, V])
+}
+
+type sizeOption[K comparable, V any] struct {
+	sizeOf func(key K, value V) int64
+}
+
+func (op sizeOption[K, V]) apply(c *Cache[K, V]) {
+	c.sizeOf = op.sizeOf
+}
+
+// WithSize is an option to specify the size of each entry, such as the
+// number of bytes of memory it retains, in which case the capacity of the
+// cache is a number of bytes. The size of an entry is computed when it is
+// inserted.
+func WithSize[K comparable, V any](sizeOf func(key K, value V) int64) Option[K, V] {
+	return sizeOption[K, V]{sizeOf}
+}
+
+type evictionCallbackOption[K comparable, V any] struct {
+	onEvict func(key K, value V)
+}
+
+func (op evictionCallbackOption[K, V]) apply(c *Cache[K, V]) {
+	c.onEvict = op.onEvict
+}
+
+// WithEvictionCallback is an option to specify a function which is called
+// with each entry evicted from the cache to make room for new entries. It is
+// not called for entries removed by Delete or Clear, or for values replaced
+// by Put. The cache must not be accessed by onEvict.
+func WithEvictionCallback[K comparable, V any](onEvict func(key K, value V)) Option[K, V] {
+	return evictionCallbackOption[K, V]{onEvict}
+}
+
+// New constructs a new Cache holding entries up to a total size of capacity.
+func New[K comparable, V any](capacity int64, options ...Option[K, V]) *Cache[K, V] {
+	c := &Cache[K, V]{capacity: capacity}
+	c.root.prev = &c.root
+	c.root.next = &c.root
+	for _, op := range options {
+		op.apply(c)
+	}
+	return c
+}
+
+// Get retrieves the value for the specified key, returning ok=false if the
+// key is not present, and marks the entry as the most recently used.
+func (c *Cache[K, V]) Get(key K) (value V, ok bool) {
+	e, ok := c.m.Get(key)
+	if !ok {
+		return value, false
+	}
+	c.moveToFront(e)
+	return e.value, true
+}
+
+// Peek is like Get, but does not mark the entry as used.
+func (c *Cache[K, V]) Peek(key K) (value V, ok bool) {
+	e, ok := c.m.Get(key)
+	if !ok {
+		return value, false
+	}
+	return e.value, true
+}
+
+// Pin is like Get, but additionally pins the entry, which prevents it from
+// being evicted until a matching call to Unpin. Pins are counted, so an
+// entry pinned n times is evicted only after n calls to Unpin. Pinned entries
+// still count towards the size of the cache, which may therefore exceed its
+// capacity. Pinning does not prevent an entry from being removed by Delete or
+// Clear, which discard its pins, or its value from being replaced by Put.
+func (c *Cache[K, V]) Pin(key K) (value V, ok bool) {
+	e, ok := c.m.Get(key)
+	if !ok {
+		return value, false
+	}
+	e.pins++
+	c.moveToFront(e)
+	return e.value, true
+}
+
+// Unpin releases a pin of the entry for the specified key taken by Pin. When
+// the last pin of an entry is released, entries are evicted (as by Put) if
+// the size of the cache exceeds its capacity. Unpin panics if the entry is
+// present but not pinned, and does nothing if the key is not present.
+func (c *Cache[K, V]) Unpin(key K) {
+	e, ok := c.m.Get(key)
+	if !ok {
+		return
+	}
+	if e.pins == 0 {
+		panic("lru: Unpin of an entry which is not pinned")
+	}
+	e.pins--
+	if e.pins == 0 {
+		c.evict()
+	}
+}
+
+// Put inserts an entry into the cache, overwriting the value of an existing
+// entry with the same key, and marks the entry as the most recently used.
+// The least recently used entries which are not pinned are then evicted
+// until the total size of the entries is within the capacity of the cache,
+// which evicts the new entry itself if its size exceeds the capacity.
+func (c *Cache[K, V]) Put(key K, value V) {
+	size := int64(1)
+	if c.sizeOf != nil {
+		size = c.sizeOf(key, value)
+	}
+	e, ok := c.m.Get(key)
+	if ok {
+		c.size -= e.size
+		e.value, e.size = value, size
+		c.moveToFront(e)
+	} else {
+		e = c.alloc()
+		e.key, e.value, e.size = key, value, size
+		c.m.Put(key, e)
+		c.pushFront(e)
+	}
+	c.size += size
+	c.evict()
+}
+
+// evict evicts the least recently used entries which are not pinned until
+// the total size of the entries is within the capacity of the cache.
+func (c *Cache[K, V]) evict() {
+	for e := c.root.prev; c.size > c.capacity && e != &c.root; {
+		prev := e.prev
+		if e.pins == 0 {
+			c.remove(e)
+			if c.onEvict != nil {
+				c.onEvict(e.key, e.value)
+			}
+			c.release(e)
+		}
+		e = prev
+	}
+}
+
+// Delete deletes the entry for the specified key, returning true if the key
+// was present.
+func (c *Cache[K, V]) Delete(key K) bool {
+	e, ok := c.m.Pop(key)
+	if !ok {
+		return false
+	}
+	c.unlink(e)
+	c.size -= e.size
+	c.release(e)
+	return true
+}
+
+// Clear deletes all of the entries from the cache.
+func (c *Cache[K, V]) Clear() {
+	c.m.Clear()
+	c.root.prev = &c.root
+	c.root.next = &c.root
+	c.size = 0
+	c.free = nil
+}
+
+// Len returns the number of entries in the cache.
+func (c *Cache[K, V]) Len() int {
+	return c.m.Len()
+}
+
+// Size returns the total size of the entries in the cache.
+func (c *Cache[K, V]) Size() int64 {
+	return c.size
+}
+
+// Capacity returns the capacity of the cache.
+func (c *Cache[K, V]) Capacity() int64 {
+	return c.capacity
+}
+
+// All calls yield sequentially for each key and value present in the cache,
+// from the most recently used to the least recently used. If yield returns
+// false, the iteration stops. The cache must not be mutated during
+// iteration, and the entries are not marked as used.
+func (c *Cache[K, V]) All(yield func(key K, value V) bool) {
+	for e := c.root.next; e != &c.root; e = e.next {
+		if !yield(e.key, e.value) {
+			return
+		}
+	}
+}
+
+// remove removes e from both the map and the list.
+func (c *Cache[K, V]) remove(e *entry[K, V]) {
+	c.m.Delete(e.key)
+	c.unlink(e)
+	c.size -= e.size
+}
+
+func (c *Cache[K, V]) pushFront(e *entry[K, V]) {
+	e.prev = &c.root
+	e.next = c.root.next
+	e.prev.next = e
+	e.next.prev = e
+}
+
+func (c *Cache[K, V]) unlink(e *entry[K, V]) {
+	e.prev.next = e.next
+	e.next.prev = e.prev
+}
+
+func (c *Cache[K, V]) moveToFront(e *entry[K, V]) {
+	if c.root.next == e {
+		return
+	}
+	c.unlink(e)
+	c.pushFront(e)
+}
+
+// alloc returns an entry for insertion into the cache, reusing an entry
+// released by an eviction or deletion if one is available.
+func (c *Cache[K, V]) alloc() *entry[K, V] {
+	if e := c.free; e != nil {
+		c.free = e.next
+		return e
+	}
+	return &entry[K, V]{}
+}
+
+// release makes an entry which was removed from the cache available for
+// reuse. The entry is zeroed so that it does not retain its key and value.
+func (c *Cache[K, V]) release(e *entry[K, V]) {
+	*e = entry[K, V]{next: c.free}
+	c.free = e
+}
@@ -0,0 +1,173 @@
+// Copyright 2024 The Cockroach Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package lru
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func keys[K comparable, V any](c *Cache[K, V]) []K {
+	var r []K
+	c.All(func(k K, _ V) bool {
+		r = append(r, k)
+		return true
+	})
+	return r
+}
+
+func TestCache(t *testing.T) {
+	var evicted []int
+	c := New[int, string](3, WithEvictionCallback[int, string](func(k int, _ string) {
+		evicted = append(evicted, k)
+	}))
+	c.Put(1, "a")
+	c.Put(2, "b")
+	c.Put(3, "c")
+	require.Equal(t, []int{3, 2, 1}, keys(c))
+
+	// Get marks an entry as used, while Peek does not.
+	v, ok := c.Get(1)
+	require.True(t, ok)
+	require.Equal(t, "a", v)
+	v, ok = c.Peek(2)
+	require.True(t, ok)
+	require.Equal(t, "b", v)
+	require.Equal(t, []int{1, 3, 2}, keys(c))
+
+	// Inserting into a full cache evicts the least recently used entry.
+	c.Put(4, "d")
+	require.Equal(t, []int{2}, evicted)
+	require.Equal(t, []int{4, 1, 3}, keys(c))
+	_, ok = c.Get(2)
+	require.False(t, ok)
+
+	// Overwriting an entry marks it as used without evicting.
+	c.Put(3, "C")
+	require.Equal(t, []int{3, 4, 1}, keys(c))
+	require.Equal(t, []int{2}, evicted)
+
+	// Deleted entries are not reported as evicted.
+	require.True(t, c.Delete(4))
+	require.False(t, c.Delete(4))
+	require.Equal(t, []int{3, 1}, keys(c))
+	require.Equal(t, 2, c.Len())
+	require.EqualValues(t, 2, c.Size())
+
+	c.Clear()
+	require.Equal(t, 0, c.Len())
+	require.Empty(t, keys(c))
+	c.Put(5, "e")
+	require.Equal(t, []int{5}, keys(c))
+	require.Equal(t, []int{2}, evicted)
+}
+
+func TestCacheSize(t *testing.T) {
+	var evicted []string
+	c := New[string, []byte](10,
+		WithSize[string, []byte](func(k string, v []byte) int64 {
+			return int64(len(v))
+		}),
+		WithEvictionCallback[string, []byte](func(k string, _ []byte) {
+			evicted = append(evicted, k)
+		}))
+	c.Put("a", make([]byte, 4))
+	c.Put("b", make([]byte, 4))
+	require.EqualValues(t, 8, c.Size())
+
+	// Evicting a single entry makes room for the new entry.
+	c.Put("c", make([]byte, 2))
+	require.EqualValues(t, 10, c.Size())
+	require.Empty(t, evicted)
+	c.Put("d", make([]byte, 5))
+	require.Equal(t, []string{"a", "b"}, evicted)
+	require.Equal(t, []string{"d", "c"}, keys(c))
+	require.EqualValues(t, 7, c.Size())
+
+	// Growing an entry evicts others.
+	c.Put("c", make([]byte, 6))
+	require.Equal(t, []string{"a", "b", "d"}, evicted)
+	require.EqualValues(t, 6, c.Size())
+
+	// An entry larger than the capacity is evicted immediately.
+	c.Put("e", make([]byte, 11))
+	require.Equal(t, []string{"a", "b", "d", "c", "e"}, evicted)
+	require.Equal(t, 0, c.Len())
+	require.EqualValues(t, 0, c.Size())
+}
+
+func TestCachePin(t *testing.T) {
+	var evicted []int
+	c := New[int, string](2, WithEvictionCallback[int, string](func(k int, _ string) {
+		evicted = append(evicted, k)
+	}))
+	c.Put(1, "a")
+	c.Put(2, "b")
+	_, ok := c.Pin(3)
+	require.False(t, ok)
+
+	// A pinned entry is skipped by eviction, even if it is the least recently
+	// used.
+	v, ok := c.Pin(1)
+	require.True(t, ok)
+	require.Equal(t, "a", v)
+	c.Pin(1)
+	c.Get(2)
+	c.Put(3, "c")
+	require.Equal(t, []int{2}, evicted)
+	require.Equal(t, []int{3, 1}, keys(c))
+
+	// The size of the cache exceeds its capacity if the pinned entries don't
+	// fit, and the excess is evicted when the last pin is released.
+	c.Pin(3)
+	c.Put(4, "d")
+	require.Equal(t, []int{2, 4}, evicted)
+	c.Put(5, "e")
+	require.Equal(t, []int{2, 4, 5}, evicted)
+	require.EqualValues(t, 2, c.Size())
+	c.Unpin(3)
+	c.Put(6, "f")
+	require.Equal(t, []int{2, 4, 5, 3}, evicted)
+	require.Equal(t, []int{6, 1}, keys(c))
+	c.Unpin(1)
+	require.Equal(t, []int{6, 1}, keys(c))
+	c.Unpin(1)
+	require.Panics(t, func() { c.Unpin(1) })
+	c.Put(7, "g")
+	require.Equal(t, []int{2, 4, 5, 3, 1}, evicted)
+
+	// Deleting an entry discards its pins.
+	c.Pin(7)
+	require.True(t, c.Delete(7))
+	c.Unpin(7)
+	c.Put(7, "g")
+	c.Put(8, "h")
+	require.Equal(t, []int{2, 4, 5, 3, 1, 6}, evicted)
+}
+
+func TestCacheAllocs(t *testing.T) {
+	c := New[int, int](100)
+	for i := 0; i < 100; i++ {
+		c.Put(i, i)
+	}
+	// Evicted entries are reused by subsequent insertions.
+	i := 100
+	require.Zero(t, testing.AllocsPerRun(1000, func() {
+		c.Put(i, i)
+		i++
+	}))
+	require.Equal(t, 100, c.Len())
+}
@@ -31,11 +31,14 @@
 // Swiss tables is the usage of a separate metadata array that stores 1 byte
 // per slot in the table. 7-bits of this "control byte" are taken from
 // hash(key) and the remaining bit is used to indicate whether the slot is
-// empty, full, or deleted. The metadata array allows quick probes. The Google
-// implementation of Swiss tables uses SIMD on x86 CPUs in order to quickly
-// check 16 slots at a time for a match. Neon on arm64 CPUs is apparently too
-// high latency, but the generic version is still able to compare 8 bytes at
-// time through bit tricks (SWAR, SIMD Within A Register).
+// empty, full, or deleted. (The number of bits taken from the hash is h2Bits
+// which can be reduced at build time, see h2_bits_7.go.) The metadata array
+// allows quick probes. The Google implementation of Swiss tables uses SIMD on
+// x86 CPUs in order to quickly check 16 slots at a time for a match. Neon on
+// arm64 CPUs is apparently too high latency, but the generic version is still
+// able to compare 8 bytes at time through bit tricks (SWAR, SIMD Within A
+// Register). Both SIMD variants are available behind build tags for
+// measurement (see group_sse2_amd64.go and match_neon_arm64.go).
 //
 // Google's Swiss Tables layout is N-1 slots where N is a power of 2 and
 // N+groupSize control bytes. The [N:N+groupSize] control bytes mirror the
@@ -47,7 +50,11 @@
 // slots which often results in 1 cache miss for a large or cold map rather
 // than separate accesses for the controls and slots. The mirrored control
 // bytes are no longer needed and and groups no longer start at arbitrary slot
-// index, but only at those that are multiples of 8.
+// index, but only at those that are multiples of 8. In particular, the
+// compact representation of a tiny table falls out of the layout: a bucket
+// with a single group has exactly groupSize control bytes and no sentinel,
+// and can hold groupSize-1 entries (see bucket.resetGrowthLeft). Get, Put,
+// and Delete search such a bucket without constructing a probe sequence.
 //
 // Probing is done by taking the top 57 bits of hash(key)%N as the index into
 // the groups slice and then performing a check of the groupSize control bytes
@@ -103,7 +110,10 @@
 //	| 11 | ------> bucket[localDepth=2]
 //	+----+
 //
-// The index into the directory is "hash(key) >> (64 - globalDepth)".
+// The index into the directory is "hash(key) >> (ptrBits - globalDepth)",
+// where ptrBits is the width of a hash: 64 bits on 64-bit architectures and
+// 32 bits on 32-bit architectures (see h1 for how the bits of a hash are
+// divided).
 //
 // When a bucket gets too large (specified by a configurable threshold) it is
 // split. When a bucket is split its localDepth is incremented. If its
@@ -151,8 +161,8 @@
 // bucket directory points to buckets by value rather than by pointer.
 // Adjacent bucket[K,V]'s which share are logically the same bucket share the
 // bucket.groups slice and have the same values for
-// bucket.{groupMask,localDepth,index}. The other fields of a bucket are only
-// valid for buckets where &m.dir[bucket.index] = &bucket (i.e. the first
+// bucket.{groupMask,capacity,localDepth,salt,index}. The other fields of a bucket are
+// only valid for buckets where &m.dir[bucket.index] = &bucket (i.e. the first
 // bucket in the directory with the specified index). During Get operations,
 // any of the buckets with the same index may be used for retrieval. During
 // Put and Delete operations an additional indirection is performed, though
@@ -179,37 +189,87 @@
 package swiss
 
 import (
+	"context"
 	"fmt"
 	"io"
 	"math"
 	"math/bits"
+	"slices"
+	"strconv"
 	"strings"
+	"sync"
+	"time"
 	"unsafe"
 )
 
 const (
-	groupSize       = 8
-	maxAvgGroupLoad = 7
+	// A rehash in place is considered to have found clustering if more than
+	// 1/clusteredFraction of the entries in the bucket could not be placed in
+	// the first group of their probe sequence. After resaltThreshold
+	// consecutive clustered rehashes the bucket's salt is changed.
+	clusteredFraction = 4
+	resaltThreshold   = 2
+	// maxSalt is the max rotation applied to a hash by a bucket's salt. The
+	// rotation is limited to the bits in h2 so that the high bits used to
+	// index the directory are never rotated into a bucket's probe offset.
+	maxSalt = h2Bits
+	// degenerateSalt is set in the salt of a degenerate bucket: a bucket
+	// which could not be split because its entries share too few distinct
+	// hashes (see bucket.markDegenerate). Within a degenerate bucket entries
+	// are placed by a fallback hash of the key rather than by their hash
+	// (see bucket.slotHash). The flag does not change the rotation applied
+	// by the salt as it is a multiple of the number of bits in a uintptr.
+	degenerateSalt = 0x80
+
+	// h2Mask selects the h2 bits of a hash. A full control byte is 0
+	// followed by the h2Bits of h2 (zero padded if h2Bits < 7). The width of
+	// h2 is limited to 7 bits as the high bit of a control byte indicates
+	// whether the slot is empty or deleted.
+	h2Mask = 1<<h2Bits - 1
 
 	ctrlEmpty   ctrl = 0b10000000
 	ctrlDeleted ctrl = 0b11111110
 
 	bitsetLSB     = 0x0101010101010101
 	bitsetMSB     = 0x8080808080808080
+	bitsetLow7    = 0x7f7f7f7f7f7f7f7f
 	bitsetEmpty   = bitsetLSB * uint64(ctrlEmpty)
 	bitsetDeleted = bitsetLSB * uint64(ctrlDeleted)
 
 	// The default maximum capacity a bucket is allowed to grow to before it
 	// will be split.
 	defaultMaxBucketCapacity uint32 = 4096
-
-	// ptrSize and shiftMask are used to optimize code generation for
-	// Map.bucket(), Map.bucketCount(), and bucketStep(). This technique was
-	// lifted from the Go runtime's runtime/map.go:bucketShift() routine. Note
-	// that ptrSize will be either 4 on 32-bit archs or 8 on 64-bit archs.
-	ptrSize   = 4 << (^uintptr(0) >> 63)
-	ptrBits   = ptrSize * 8
-	shiftMask = ptrSize*8 - 1
+	// maxFlatBucketCapacity is the maximum bucket capacity of a map
+	// configured with WithFlatTable. It is the largest power of 2 capacity,
+	// so the single bucket is never split.
+	maxFlatBucketCapacity uint32 = 1 << 31
+
+	// ptrSize is the size of a pointer, and of a hash as hashes are uintptrs:
+	// either 4 on 32-bit archs or 8 on 64-bit archs. ptrBits is the number of
+	// bits in a hash.
+	//
+	// shiftMask and depthShiftMask are used to optimize code generation for
+	// Map.bucket(), Map.bucketCount(), and bucketStep(). When shifting by a
+	// variable amount the Go compiler inserts checks for shifts of at least
+	// the width of the shifted value, and masking the shift amount allows
+	// the checks to be elided. This technique was lifted from the Go
+	// runtime's runtime/map.go:bucketShift() routine. shiftMask masks shifts
+	// of a hash, and is correct because globalShift is less than ptrBits.
+	// depthShiftMask masks shifts of a uint32 by a depth, and is correct
+	// because depths are at most maxGlobalDepth.
+	ptrSize        = 4 << (^uintptr(0) >> 63)
+	ptrBits        = ptrSize * 8
+	shiftMask      = ptrSize*8 - 1
+	depthShiftMask = 31
+
+	// maxGlobalDepth is the maximum depth of the buckets directory. A bucket
+	// at this depth is resized beyond maxBucketCapacity rather than split.
+	// The directory is indexed by a uint32 (see bucket.index), and a
+	// globalShift of 0 denotes a directory with a single bucket, so the depth
+	// must be less than 32 and less than ptrBits. Neither limit is reached in
+	// practice unless the hash function is degenerate, as a directory of 2^31
+	// buckets does not fit in the address space of a 32-bit process.
+	maxGlobalDepth = 31
 
 	expectedBucketSize = ptrSize + 6*4
 )
@@ -225,7 +285,21 @@ type slot[K comparable, V any] struct {
 	value V
 }
 
+// KV holds a key and its associated value.
+type KV[K comparable, V any] struct {
+	Key   K
+	Value V
+}
+
 // Group holds groupSize control bytes and slots.
+//
+// The control bytes for a group are stored in a single 64-bit word at the
+// start of the Group so that all of a group's control bytes can be read or
+// updated with a single (optionally atomic) 64-bit load, store, or CAS. This
+// requires ctrls to remain the first field of Group, and the size of a Group
+// to be a multiple of 8 bytes so that every Group within a groups slice is
+// 8-byte aligned (slotGroup always holds a multiple of 8 bytes as it contains
+// groupSize slots).
 type Group[K comparable, V any] struct {
 	ctrls ctrlGroup
 	slots slotGroup[K, V]
@@ -234,20 +308,22 @@ type Group[K comparable, V any] struct {
 // bucket implements Google's Swiss Tables hash table design. A Map is
 // composed of 1 or more buckets that are addressed using extendible hashing.
 type bucket[K comparable, V any] struct {
-	// groups is groupMask+1 in length and holds groupSize key/value slots and
-	// their control bytes.
+	// groups is capacity/groupSize in length (or 1 if the bucket is empty)
+	// and holds groupSize key/value slots and their control bytes.
 	groups unsafeSlice[Group[K, V]]
-	// groupMask is the number of groups minus 1 which is used to quickly
-	// compute i%N using a bitwise & operation. The groupMask only changes
-	// when a bucket is resized.
+	// groupMask is the number of groups rounded up to a power of 2, minus 1,
+	// which is used to quickly compute i%N using a bitwise & operation. The
+	// groupMask only changes when a bucket is resized.
 	groupMask uint32
 
-	// Capacity, used, and growthLeft are only updated on mutation operations
-	// (Put, Delete). Read operations (Get) only access the groups and
-	// groupMask fields.
+	// Used and growthLeft are only updated on mutation operations (Put,
+	// Delete). Read operations (Get) only access the groups, groupMask,
+	// capacity, and salt fields.
 
-	// The total number (always 2^N). Equal to `(groupMask+1)*groupSize`
-	// (unless the bucket is empty, when capacity is 0).
+	// The total number of slots, which is a multiple of groupSize. The
+	// capacity is a power of 2 equal to `(groupMask+1)*groupSize` unless the
+	// map was configured with a growth factor other than 2 (see
+	// WithGrowthFactor), or the bucket is empty, when capacity is 0.
 	capacity uint32
 	// The number of filled slots (i.e. the number of elements in the bucket).
 	used uint32
@@ -261,9 +337,23 @@ type bucket[K comparable, V any] struct {
 
 	// localDepth is the number of high bits from hash(key) used to generate
 	// an index for the global directory to locate this bucket. If localDepth
-	// is 0 this bucket is Map.bucket0. LocalDepth is only updated when a
+	// is 0 this bucket is Map.dir[0]. LocalDepth is only updated when a
 	// bucket splits.
-	localDepth uint32
+	localDepth uint8
+	// salt is the amount hash(key) is rotated by before computing h1 for
+	// probing within the bucket (see bucket.probe). The salt does not affect
+	// h2 or the high bits used to index the directory. It is changed when the
+	// bucket is repeatedly rehashed in place, which is a symptom of keys
+	// clustering in the bucket's probe sequences. The high bit
+	// (degenerateSalt) marks a degenerate bucket.
+	salt uint8
+	// inPlaceRehashes is the number of times the bucket has been rehashed in
+	// place since it was last resized, split, or salted.
+	inPlaceRehashes uint8
+	// shared is true if the groups of the bucket may be shared with a
+	// snapshot of the map (see Map.Snapshot). A shared bucket must be
+	// unshared before it is mutated.
+	shared bool
 	// The index of the bucket within Map.dir. The buckets in
 	// Map.dir[index:index+2^(globalDepth-localDepth)] all share the same
 	// groups (and are logically the same bucket). Only the bucket at
@@ -276,21 +366,38 @@ type bucket[K comparable, V any] struct {
 // Map is an unordered map from keys to values with Put, Get, Delete, and All
 // operations. Map is inspired by Google's Swiss Tables design as implemented
 // in Abseil's flat_hash_map, combined with extendible hashing. By default, a
-// Map[K,V] uses the same hash function as Go's builtin map[K]V, though a
-// different hash function can be specified using the WithHash option.
+// Map[K,V] uses the same hash function as Go's builtin map[K]V (except for
+// keys which are byte arrays of 8, 16, or 32 bytes which use a specialized
+// hash function), though a different hash function can be specified using
+// the WithHash option.
+//
+// The zero value for a Map is an empty map ready to use. It is initialized
+// with the default options on first use (including by read operations such
+// as Get), as if by New(0).
 //
-// A Map is NOT goroutine-safe.
+// A Map is NOT goroutine-safe unless it is configured with WithBucketLocks.
+// When built with the "swiss_concurrent_checks" build tag (or the race
+// detector), Get, Put, Delete, and iteration panic if they observe a Put or
+// Delete in progress on another goroutine, similar to the checks performed
+// by Go's builtin map.
 type Map[K comparable, V any] struct {
+	// The zero-size fields come first, as a trailing zero-size field is
+	// padded.
+	_ noCopy
+	// writeCheck detects concurrent writes. It is empty unless
+	// concurrentChecks is true.
+	writeCheck writeCheck
 	// The hash function to each keys of type K. The hash function is
-	// extracted from the Go runtime's implementation of map[K]struct{}.
+	// extracted from the Go runtime's implementation of map[K]struct{}
+	// unless a specialized hash function exists for K (see getHasher).
 	hash hashFn
 	seed uintptr
-	// The allocator to use for the ctrls and slots slices.
-	allocator Allocator[K, V]
-	// bucket0 is always present and inlined in the Map to avoid a pointer
-	// indirection during the common case that the map contains a single
-	// bucket. bucket0 is also used during split operations as a temporary
-	// bucket to split into before the bucket is installed in the directory.
+	// bucket0 is inlined in the Map to avoid an allocation during the common
+	// case that the map contains a single bucket. bucket0 is also used during
+	// split operations as a temporary bucket to split into before the bucket
+	// is installed in the directory. If indirectBucket0 is true, bucket0 is
+	// unused and the single bucket is instead stored in a separately
+	// allocated directory of size 1.
 	bucket0 bucket[K, V]
 	// The directory of buckets. See the comment on bucket.index for details
 	// on how the physical bucket values map to logical buckets.
@@ -300,15 +407,33 @@ type Map[K comparable, V any] struct {
 	used int
 	// globalShift is the number of bits to right shift a hash value to
 	// generate an index for the global directory. As a special case, if
-	// globalShift==0 then bucket0 is used and the directory is not accessed.
-	// Note that globalShift==(64-globalDepth). globalShift is used rather
+	// globalShift==0 then dir[0] (i.e. bucket0 unless indirectBucket0 is
+	// true) is used and the hash is not needed to index the directory.
+	// Note that globalShift==(ptrBits-globalDepth). globalShift is used rather
 	// than globalDepth because the shifting is the more common operation than
 	// needing to compare globalDepth to a bucket's localDepth.
 	globalShift uint32
 	// The maximum capacity a bucket is allowed to grow to before it will be
 	// split.
 	maxBucketCapacity uint32
-	_                 noCopy
+	// opts holds the options which are rarely specified, and the state and
+	// diagnostics which only some maps need. It is nil for a map with the
+	// default options until a diagnostic is first recorded (see
+	// Map.options).
+	opts *mapOptions[K, V]
+	// iterating is the number of iterations over the buckets (see
+	// Map.buckets) which are in progress. Merging buckets while iterating
+	// would move entries which have not yet been visited into buckets which
+	// have, so TryMergeSiblings declines to merge while iterating > 0.
+	iterating uint32
+	// resalts is the number of times a bucket's salt was changed due to
+	// clustering. See bucket.salt. It is kept here rather than in opts, as
+	// resalting happens to maps with the default options under churn.
+	resalts uint32
+	// iterGroups is the address of the groups of the bucket whose entries
+	// are being yielded by an iteration (see Map.iterate). Those groups must
+	// not be mutated in place. See bucket.split and bucket.detachGroups.
+	iterGroups unsafe.Pointer
 }
 
 func normalizeCapacity(capacity uint32) uint32 {
@@ -319,27 +444,196 @@ func normalizeCapacity(capacity uint32) uint32 {
 	return uint32(1) << 31
 }
 
+// grownCapacity returns the capacity that a bucket with the specified
+// capacity is resized to when it runs out of room. The capacity is doubled
+// unless a different growth factor was specified with WithGrowthFactor, in
+// which case the grown capacity is rounded up to a whole number of groups,
+// growing by at least one group.
+func (m *Map[K, V]) grownCapacity(capacity uint32) uint32 {
+	if m.growthFactor() == 0 {
+		return 2 * capacity
+	}
+	c := uint64(math.Ceil(float64(capacity) * m.growthFactor()))
+	c = (c + groupSize - 1) &^ (groupSize - 1)
+	if c <= uint64(capacity) {
+		c = uint64(capacity) + groupSize
+	}
+	if c > math.MaxUint32&^(groupSize-1) {
+		c = math.MaxUint32 &^ (groupSize - 1)
+	}
+	return uint32(c)
+}
+
+// fitCapacity returns the smallest power of 2 bucket capacity, of at least
+// groupSize, which can hold n entries without needing to grow.
+func fitCapacity(n uint32) uint32 {
+	capacity := uint32(groupSize)
+	for capacity < maxFlatBucketCapacity {
+		b := bucket[struct{}, struct{}]{capacity: capacity}
+		b.resetGrowthLeft()
+		if n <= b.growthLeft {
+			break
+		}
+		capacity *= 2
+	}
+	return capacity
+}
+
+func validGrowthFactor(f float64) bool {
+	return f > 1 && f <= 2
+}
+
 // New constructs a new Map with the specified initial capacity. If
 // initialCapacity is 0 the map will start out with zero capacity and will
-// grow on the first insert. The zero value for a Map is not usable.
+// grow on the first insert. The zero value for a Map is an empty map which is
+// equivalent to New(0).
 func New[K comparable, V any](initialCapacity int, options ...Option[K, V]) *Map[K, V] {
 	m := &Map[K, V]{}
 	m.Init(initialCapacity, options...)
 	return m
 }
 
+// NewE is like New, but returns an error rather than silently adjusting
+// options which New would otherwise normalize: a negative initialCapacity, a
+// max bucket capacity (see WithMaxBucketCapacity) which is smaller than a
+// group or not a power of 2, a growth factor (see WithGrowthFactor) which is
+// not in the range (1, 2], a load factor watch threshold (see
+// WithLoadFactorWatch) which is not in the range (0, 1], or an
+// initialCapacity which would require a directory larger than the map
+// supports. NewE also returns an error if WithDeterministicHash is specified
+// for a key type it does not support, or if WithKeyEqual is specified without
+// WithHash or together with WithDeterministicHash, for which New panics.
+func NewE[K comparable, V any](initialCapacity int, options ...Option[K, V]) (*Map[K, V], error) {
+	if _, err := Describe[K, V](initialCapacity, options...); err != nil {
+		return nil, err
+	}
+	return New[K, V](initialCapacity, options...), nil
+}
+
+// Layout describes the buckets and directory of a newly constructed Map. See
+// Describe.
+type Layout struct {
+	// MaxBucketCapacity is the max number of slots in a bucket before the
+	// bucket is split rather than resized.
+	MaxBucketCapacity uint32
+	// BucketCapacity is the number of slots in each of the initial buckets.
+	// An empty map has a BucketCapacity of 0.
+	BucketCapacity uint32
+	// Buckets is the number of initial buckets.
+	Buckets int
+	// GlobalDepth is the number of high bits of hash(key) used to index into
+	// the bucket directory.
+	GlobalDepth uint32
+	// Capacity is the total number of slots across all buckets.
+	Capacity int
+	// GrowthLeft is the number of entries which can be inserted before the
+	// first bucket must be resized or split, assuming keys are uniformly
+	// distributed across buckets.
+	GrowthLeft int
+}
+
+// Describe returns the layout of the Map which would be constructed by
+// NewE(initialCapacity, options...), or the error NewE would return. It is
+// intended for capacity planning and does not allocate the map.
+func Describe[K comparable, V any](initialCapacity int, options ...Option[K, V]) (Layout, error) {
+	if initialCapacity < 0 {
+		return Layout{}, fmt.Errorf("initial capacity %d is negative", initialCapacity)
+	}
+	m := Map[K, V]{maxBucketCapacity: defaultMaxBucketCapacity}
+	for _, op := range options {
+		op.apply(&m)
+	}
+	if m.flat() {
+		m.maxBucketCapacity = maxFlatBucketCapacity
+	}
+	if m.maxBucketCapacity < groupSize {
+		return Layout{}, fmt.Errorf("max bucket capacity %d is smaller than the group size %d",
+			m.maxBucketCapacity, groupSize)
+	}
+	if m.maxBucketCapacity&(m.maxBucketCapacity-1) != 0 {
+		return Layout{}, fmt.Errorf("max bucket capacity %d is not a power of 2", m.maxBucketCapacity)
+	}
+	if m.deterministicHash() {
+		if _, _, err := deterministicHasher[K](); err != nil {
+			return Layout{}, err
+		}
+	}
+	if err := m.checkKeyEqual(); err != nil {
+		return Layout{}, err
+	}
+	if m.growthFactor() != 0 && !validGrowthFactor(m.growthFactor()) {
+		return Layout{}, fmt.Errorf("growth factor %v is not in the range (1, 2]", m.growthFactor())
+	}
+	if m.loadWatch() != nil && !validLoadFactor(m.loadWatch().threshold) {
+		return Layout{}, fmt.Errorf("load factor watch threshold %v is not in the range (0, 1]",
+			m.loadWatch().threshold)
+	}
+	return makeLayout(initialCapacity, m.maxBucketCapacity)
+}
+
+// checkKeyEqual returns an error if the WithKeyEqual option was specified
+// without WithHash, as the default hash function only hashes keys which are
+// == identically, or with WithDeterministicHash, which replaces the hash
+// function. It must be called after the options are applied and before the
+// default hash function is installed.
+func (m *Map[K, V]) checkKeyEqual() error {
+	switch {
+	case m.equal() == nil:
+		return nil
+	case m.deterministicHash():
+		return fmt.Errorf("WithKeyEqual is not supported with WithDeterministicHash")
+	case m.hash == nil:
+		return fmt.Errorf("WithKeyEqual requires WithHash")
+	}
+	return nil
+}
+
+// FromKVs constructs a new Map sized to hold len(kvs) entries and populated
+// with the specified keys and values. If a key appears more than once in kvs
+// the last value wins.
+func FromKVs[K comparable, V any](kvs []KV[K, V], options ...Option[K, V]) *Map[K, V] {
+	m := New[K, V](len(kvs), options...)
+	for i := range kvs {
+		m.Put(kvs[i].Key, kvs[i].Value)
+	}
+	return m
+}
+
+// FromMap constructs a new Map sized to hold len(src) entries and populated
+// with the entries of src, easing migration from builtin maps. The keys of
+// src are distinct, so each entry is inserted without first probing for an
+// existing entry with the same key.
+func FromMap[K comparable, V any](src map[K]V, options ...Option[K, V]) *Map[K, V] {
+	m := New[K, V](len(src), options...)
+	for k, v := range src {
+		h := m.hash(noescape(unsafe.Pointer(&k)), m.seed)
+		b := m.mutableBucket(h)
+		if b.growthLeft == 0 {
+			// The map was sized for len(src) entries, but the entries may
+			// not be evenly distributed between the buckets.
+			b = b.rehash(m, h)
+		}
+		g, i := b.uncheckedPut(m, h, k, v)
+		b.used++
+		m.used++
+		if m.opts != nil {
+			m.inserted(b, g, i, h)
+		}
+		b.checkInvariants(m)
+	}
+	return m
+}
+
 // Init initializes a Map with the specified initial capacity. If
 // initialCapacity is 0 the map will start out with zero capacity and will
-// grow on the first insert. The zero value for a Map is not usable and Init
-// must be called before using the map.
+// grow on the first insert.
 //
 // Init is intended for usage when a Map is embedded by value in another
-// structure.
+// structure. Calling Init is only necessary to specify an initial capacity or
+// options, as the zero value for a Map is initialized with Init(0) on first
+// use.
 func (m *Map[K, V]) Init(initialCapacity int, options ...Option[K, V]) {
 	*m = Map[K, V]{
-		hash:      getRuntimeHasher[K](),
-		seed:      uintptr(fastrand64()),
-		allocator: defaultAllocator[K, V]{},
 		bucket0: bucket[K, V]{
 			// The groups slice for bucket0 in an empty map points to a single
 			// group where the controls are all marked as empty. This
@@ -359,45 +653,231 @@ func (m *Map[K, V]) Init(initialCapacity int, options ...Option[K, V]) {
 		op.apply(m)
 	}
 
+	if err := m.checkKeyEqual(); err != nil {
+		panic(err)
+	}
+	// The seed of the map is 0 unless it was specified along with the hash
+	// function (see seedOption).
+	if m.hash == nil {
+		hash, seed := newHasher[K]()
+		m.hash = hash
+		if m.seed == 0 {
+			m.seed = seed
+		}
+	} else if m.seed == 0 {
+		m.seed = seedBits(newHashSeed())
+	}
+
+	if m.indirectBucket0() {
+		m.dir = makeUnsafeSlice([]bucket[K, V]{m.bucket0})
+		m.bucket0 = bucket[K, V]{}
+	}
+
+	if m.locks() != nil {
+		m.checkBucketLocks()
+	}
+
+	if invariants && m.ledger() == nil {
+		m.options().ledger = newAllocLedger(nil)
+	}
+
+	if m.deterministicHash() {
+		hash, compare, err := deterministicHasher[K]()
+		if err != nil {
+			panic(err)
+		}
+		m.hash, m.seed, m.options().compareKeys = hash, 0, compare
+	}
+	if m.hashTiming() != nil {
+		m.hash = m.hashTiming().wrap(m.hash, m.clock())
+	}
+
+	if m.flat() {
+		m.maxBucketCapacity = maxFlatBucketCapacity
+	}
 	if m.maxBucketCapacity < groupSize {
 		m.maxBucketCapacity = groupSize
 	}
 	m.maxBucketCapacity = normalizeCapacity(m.maxBucketCapacity)
+	if gf := m.growthFactor(); gf != 0 && (!validGrowthFactor(gf) || gf == 2) {
+		m.opts.growthFactor = 0
+	}
+	if m.loadWatch() != nil && !validLoadFactor(m.loadWatch().threshold) {
+		m.opts.loadWatch = nil
+	}
+	if m.cachedHash() && unsafe.Sizeof(slot[K, V]{}) == 0 {
+		// The slots of an allocation can't be told apart by address.
+		m.opts.cachedHash = false
+	}
+	if m.cachedHash() {
+		if _, ok := m.allocator().(defaultAllocator[K, V]); !ok {
+			panic("WithCachedHash is not supported with WithAllocator")
+		}
+	}
 
-	if initialCapacity > 0 {
-		// We consider initialCapacity to be an indication from the caller
-		// about the number of records the map should hold. The realized
-		// capacity of a map is 7/8 of the number of slots, so we set the
-		// target capacity to initialCapacity*8/7.
-		targetCapacity := uintptr((initialCapacity * groupSize) / maxAvgGroupLoad)
-		if targetCapacity <= uintptr(m.maxBucketCapacity) {
-			// Normalize targetCapacity to the smallest value of the form 2^k.
-			m.bucket0.init(m, normalizeCapacity(uint32(targetCapacity)))
-		} else {
-			// If targetCapacity is larger than maxBucketCapacity we need to
-			// size the directory appropriately. We'll size each bucket to
-			// maxBucketCapacity and create enough buckets to hold
-			// initialCapacity.
-			nBuckets := (targetCapacity + uintptr(m.maxBucketCapacity) - 1) / uintptr(m.maxBucketCapacity)
-			globalDepth := uint32(bits.Len32(uint32(nBuckets) - 1))
-			m.growDirectory(globalDepth, 0 /* index */)
-
-			n := m.bucketCount()
-			for i := uint32(0); i < n; i++ {
-				b := m.dir.At(uintptr(i))
-				b.init(m, m.maxBucketCapacity)
-				b.localDepth = globalDepth
-				b.index = i
-			}
-
-			m.checkInvariants()
+	l, err := makeLayout(initialCapacity, m.maxBucketCapacity)
+	if err != nil {
+		panic(err)
+	}
+	if l.Buckets == 1 {
+		if l.BucketCapacity > 0 {
+			m.dir.At(0).init(m, l.BucketCapacity)
+		}
+	} else {
+		m.growDirectory(l.GlobalDepth, 0 /* index */)
+
+		n := m.bucketCount()
+		for i := uint32(0); i < n; i++ {
+			b := m.dir.At(uintptr(i))
+			b.init(m, l.BucketCapacity)
+			b.localDepth = uint8(l.GlobalDepth)
+			b.index = i
 		}
+
+		m.checkInvariants()
 	}
 
 	m.buckets(0, func(b *bucket[K, V]) bool {
 		b.checkInvariants(m)
 		return true
 	})
+
+	if m.opLog() != nil {
+		m.opLog().record(m, opLogRecord[K, V]{
+			Op: opLogInit, Seed: uint64(m.seed), Capacity: initialCapacity,
+		})
+	}
+}
+
+// lazyInit initializes a zero value Map on first use, so that it behaves
+// like a map returned by New(0).
+func (m *Map[K, V]) lazyInit() {
+	if m.hash == nil {
+		m.Init(0)
+	}
+}
+
+// keyString formats key for inclusion in a diagnostic message, using the
+// formatter specified by WithKeyFormatter if any.
+func (m *Map[K, V]) keyString(key K) string {
+	if m.formatKey() != nil {
+		return m.formatKey()(key)
+	}
+	return fmt.Sprint(key)
+}
+
+// bucketString formats the contents of bucket b for inclusion in a
+// diagnostic message (see keyString).
+func (m *Map[K, V]) bucketString(b *bucket[K, V]) string {
+	var buf strings.Builder
+	b.goFormat(&buf, m.formatKey())
+	return buf.String()
+}
+
+// panicf panics with a message formatted according to format, prefixed with
+// the name of the map if it has one (see WithName).
+func (m *Map[K, V]) panicf(format string, args ...any) {
+	msg := fmt.Sprintf(format, args...)
+	if m.name() != "" {
+		msg = fmt.Sprintf("map %q: %s", m.name(), msg)
+	}
+	panic(msg)
+}
+
+// makeLayout computes the initial layout of a map with the specified
+// initialCapacity and (normalized) maxBucketCapacity. A non-positive
+// initialCapacity results in a single empty bucket.
+func makeLayout(initialCapacity int, maxBucketCapacity uint32) (Layout, error) {
+	l := Layout{
+		MaxBucketCapacity: maxBucketCapacity,
+		Buckets:           1,
+	}
+	if initialCapacity <= 0 {
+		return l, nil
+	}
+	if initialCapacity > math.MaxInt/groupSize {
+		return Layout{}, fmt.Errorf("initial capacity %d is too large", initialCapacity)
+	}
+
+	// We consider initialCapacity to be an indication from the caller about
+	// the number of records the map should hold. The realized capacity of a
+	// map is 7/8 of the number of slots, so we set the target capacity to
+	// initialCapacity*8/7.
+	targetCapacity := uintptr((initialCapacity * groupSize) / maxAvgGroupLoad)
+	if targetCapacity <= uintptr(maxBucketCapacity) {
+		// Normalize targetCapacity to the smallest value of the form 2^k.
+		l.BucketCapacity = normalizeCapacity(uint32(targetCapacity))
+		if l.BucketCapacity < groupSize {
+			l.BucketCapacity = groupSize
+		}
+	} else {
+		// If targetCapacity is larger than maxBucketCapacity we need to size
+		// the directory appropriately. We'll size each bucket to
+		// maxBucketCapacity and create enough buckets to hold
+		// initialCapacity.
+		nBuckets := (targetCapacity + uintptr(maxBucketCapacity) - 1) / uintptr(maxBucketCapacity)
+		globalDepth := uint32(bits.Len64(uint64(nBuckets) - 1))
+		if globalDepth >= 32 {
+			return Layout{}, fmt.Errorf("initial capacity %d requires %d buckets which exceeds the max directory size",
+				initialCapacity, nBuckets)
+		}
+		l.BucketCapacity = maxBucketCapacity
+		l.GlobalDepth = globalDepth
+		l.Buckets = 1 << globalDepth
+	}
+
+	l.Capacity = l.Buckets * int(l.BucketCapacity)
+	l.GrowthLeft = l.Buckets * int((uint64(l.BucketCapacity)*maxAvgGroupLoad)/groupSize)
+	return l, nil
+}
+
+// Reserve grows, and if necessary splits, the buckets of the map to make
+// room for n more entries, so that inserting them does not trigger a resize.
+// Like the initialCapacity passed to New, n is a hint: each bucket is sized
+// to hold its share of the n entries in proportion to the fraction of the
+// hash space it covers, so inserting more than n entries, or a set of keys
+// which is skewed towards some buckets, can still cause buckets to grow. A
+// map containing a single bucket (see WithFlatTable) is guaranteed not to
+// resize while inserting the n entries. Reserve panics if n is too large.
+func (m *Map[K, V]) Reserve(n int) {
+	m.lazyInit()
+	if n <= 0 {
+		return
+	}
+	if _, err := makeLayout(m.Len()+n, m.maxBucketCapacity); err != nil {
+		panic(err)
+	}
+
+	for {
+		// Splitting a bucket can grow the directory, which changes the
+		// directory index of every bucket, so the directory is rescanned
+		// after every split. The buckets which were already reserved are
+		// skipped cheaply.
+		split := false
+		for i, count := uint32(0), m.bucketCount(); i < count; i++ {
+			b := m.dir.At(uintptr(i))
+			if b.index != i {
+				continue
+			}
+			share := (uint64(n) + 1<<b.localDepth - 1) >> b.localDepth
+			if uint64(b.growthLeft) >= share {
+				continue
+			}
+			if b.shared {
+				b = m.unshare(b)
+			}
+			if uint64(b.used)+share <= uint64(m.maxBucketCapacity) && b.reserve(m, uint32(share)) {
+				continue
+			}
+			b.split(m, 0, true /* presize */)
+			split = true
+			break
+		}
+		if !split {
+			break
+		}
+	}
+	m.checkInvariants()
 }
 
 // Close closes the map, releasing any memory back to its configured
@@ -406,11 +886,129 @@ func (m *Map[K, V]) Init(initialCapacity int, options ...Option[K, V]) {
 // idempotent.
 func (m *Map[K, V]) Close() {
 	m.buckets(0, func(b *bucket[K, V]) bool {
-		b.close(m.allocator)
+		b.close(m)
+		return true
+	})
+}
+
+// OutstandingAllocations returns the number of allocations obtained from the
+// map's allocator which have not been freed, along with the total number of
+// groups in those allocations. Both are zero for a map which has been closed.
+// This is intended for detecting leaks in tests of Allocator implementations.
+func (m *Map[K, V]) OutstandingAllocations() (allocs, groups int) {
+	m.buckets(0, func(b *bucket[K, V]) bool {
+		if b.capacity > 0 {
+			allocs++
+			groups += int(b.groupCount())
+		}
+		return true
+	})
+	return allocs, groups
+}
+
+// Snapshot returns a new map containing the same entries as m. The snapshot
+// shares the memory for its buckets with m (and any other snapshots) and a
+// bucket is only copied when it is first mutated in either map, so Snapshot
+// requires time proportional to the number of buckets rather than the number
+// of entries. The two maps may be used independently, including
+// concurrently from different goroutines, though the configured allocator
+// is shared between them. Closing either map does not affect the other.
+func (m *Map[K, V]) Snapshot() *Map[K, V] {
+	m.lazyInit()
+
+	if m.shared() == nil {
+		m.options().shared = &sharedGroups{refs: make(map[unsafe.Pointer]int)}
+	}
+	s := &Map[K, V]{
+		hash:              m.hash,
+		seed:              m.seed,
+		used:              m.used,
+		globalShift:       m.globalShift,
+		maxBucketCapacity: m.maxBucketCapacity,
+		opts:              m.opts.derive(),
+	}
+	s.opts.shared = m.shared()
+	if ht := m.hashTiming(); ht != nil {
+		s.hash = s.opts.hashTiming.wrap(ht.hash, m.clock())
+	}
+
+	// Mark all of the buckets (including the duplicate entries in the
+	// directory) as shared before copying the directory.
+	for i, n := uint32(0), m.bucketCount(); i < n; i++ {
+		if b := m.dir.At(uintptr(i)); b.capacity > 0 {
+			b.shared = true
+		}
+	}
+	if m.globalShift == 0 && !m.indirectBucket0() {
+		s.bucket0 = m.bucket0
+		s.dir = makeUnsafeSlice(unsafe.Slice(&s.bucket0, 1))
+	} else {
+		dir := make([]bucket[K, V], m.bucketCount())
+		copy(dir, m.dir.Slice(0, uintptr(len(dir))))
+		s.dir = makeUnsafeSlice(dir)
+	}
+
+	// Account for the snapshot's references to the shared groups.
+	s.buckets(0, func(b *bucket[K, V]) bool {
+		if b.capacity > 0 {
+			groups := b.groups.Slice(0, uintptr(b.groupCount()))
+			ptr := unsafe.Pointer(unsafe.SliceData(groups))
+			s.opts.shared.retain(ptr)
+			if l := s.ledger(); l != nil {
+				l.alloc(b.index, ptr, len(groups))
+			}
+		}
 		return true
 	})
+	return s
+}
+
+// Clone returns a new map containing the same entries as m which does not
+// share any memory with m. Unlike Snapshot, the groups of every bucket are
+// copied eagerly. The directory and the layout of every bucket are copied
+// as-is, so no keys are rehashed, which makes Clone significantly faster
+// than inserting every entry into a new map. The clone uses the same
+// allocator, hash function, and seed as m.
+func (m *Map[K, V]) Clone() *Map[K, V] {
+	m.lazyInit()
+
+	c := &Map[K, V]{
+		hash:              m.hash,
+		seed:              m.seed,
+		used:              m.used,
+		globalShift:       m.globalShift,
+		maxBucketCapacity: m.maxBucketCapacity,
+		opts:              m.opts.derive(),
+	}
+	if ht := m.hashTiming(); ht != nil {
+		c.hash = c.opts.hashTiming.wrap(ht.hash, m.clock())
+	}
 
-	m.allocator = nil
+	if m.globalShift == 0 && !m.indirectBucket0() {
+		c.bucket0 = m.bucket0
+		c.dir = makeUnsafeSlice(unsafe.Slice(&c.bucket0, 1))
+	} else {
+		dir := make([]bucket[K, V], m.bucketCount())
+		copy(dir, m.dir.Slice(0, uintptr(len(dir))))
+		c.dir = makeUnsafeSlice(dir)
+	}
+
+	// Replace the groups of each bucket (which currently reference m's
+	// groups) with a copy.
+	c.buckets(0, func(b *bucket[K, V]) bool {
+		if b.capacity > 0 {
+			old := b.groups.Slice(0, uintptr(b.groupCount()))
+			groups := c.allocGroups(b.index, len(old))
+			copy(groups, old)
+			c.copyCachedHashes(groups, old)
+			b.groups = makeUnsafeSlice(groups)
+			b.shared = false
+			c.installBucket(b)
+		}
+		return true
+	})
+	c.checkInvariants()
+	return c
 }
 
 // Put inserts an entry into the map, overwriting an existing value if an
@@ -421,24 +1019,77 @@ func (m *Map[K, V]) Put(key K, value V) {
 	// value. If the value isn't present we perform an uncheckedPut which
 	// inserts an entry known not to be in the table (violating this
 	// requirement will cause the table to behave erratically).
+	if m.locks() != nil {
+		m.lockedPut(key, value)
+		return
+	}
+	m.lazyInit()
+	if concurrentChecks {
+		m.startWrite()
+		defer m.endWrite()
+	}
+	if m.opLog() != nil {
+		m.opLog().put(m, key, value)
+	}
 	h := m.hash(noescape(unsafe.Pointer(&key)), m.seed)
+	if m.negCache() != nil {
+		m.negCache().remove(h)
+	}
 	b := m.mutableBucket(h)
+	sh := b.slotHash(m, (*K)(noescape(unsafe.Pointer(&key))), h)
+	equal := m.equal()
+
+	if b.groupMask == 0 {
+		// A bucket with a single group is searched without constructing a
+		// probe sequence (see Get). The insertion is only performed here if
+		// there is room left to grow, otherwise it falls through to the
+		// general case below which rehashes the bucket.
+		g := b.groups.At(0)
+		match := g.ctrls.matchH2(h2(sh))
+		for match != 0 {
+			i := match.first()
+			if keyEqual(equal, key, g.slots.Key(i)) {
+				*g.slots.Value(i) = value
+				if m.counters() != nil {
+					m.counters().overwrites++
+				}
+				b.checkInvariants(m)
+				return
+			}
+			match = match.removeFirst()
+		}
+		if b.growthLeft > 0 {
+			i := g.ctrls.matchEmpty().first()
+			g.slots.Set(i, key, value)
+			g.ctrls.Set(i, ctrl(h2(sh)))
+			b.growthLeft--
+			b.used++
+			m.used++
+			if m.opts != nil {
+				m.inserted(b, g, i, h)
+			}
+			b.checkInvariants(m)
+			return
+		}
+	}
 
 	// NB: Unlike the abseil swiss table implementation which uses a common
 	// find routine for Get, Put, and Delete, we have to manually inline the
 	// find routine for performance.
-	seq := makeProbeSeq(h1(h), b.groupMask)
+	seq := b.probe(sh)
 	startOffset := seq.offset
 
 	for ; ; seq = seq.next() {
 		g := b.groups.At(uintptr(seq.offset))
-		match := g.ctrls.matchH2(h2(h))
+		match := g.ctrls.matchH2(h2(sh))
 
 		for match != 0 {
 			i := match.first()
-			slot := g.slots.At(i)
-			if key == slot.key {
-				slot.value = value
+			if keyEqual(equal, key, g.slots.Key(i)) {
+				*g.slots.Value(i) = value
+				if m.counters() != nil {
+					m.counters().overwrites++
+				}
 				b.checkInvariants(m)
 				return
 			}
@@ -454,20 +1105,21 @@ func (m *Map[K, V]) Put(key K, value V) {
 			// start of the probe sequence we can just insert the new entry.
 			if b.growthLeft > 0 && seq.offset == startOffset {
 				i := match.first()
-				slot := g.slots.At(i)
-				slot.key = key
-				slot.value = value
-				g.ctrls.Set(i, ctrl(h2(h)))
+				g.slots.Set(i, key, value)
+				g.ctrls.Set(i, ctrl(h2(sh)))
 				b.growthLeft--
 				b.used++
 				m.used++
+				if m.opts != nil {
+					m.inserted(b, g, i, h)
+				}
 				b.checkInvariants(m)
 				return
 			}
 
 			// Find the first empty or deleted slot in the key's probe
 			// sequence.
-			seq := makeProbeSeq(h1(h), b.groupMask)
+			seq := b.probe(sh)
 			for ; ; seq = seq.next() {
 				g := b.groups.At(uintptr(seq.offset))
 				match = g.ctrls.matchEmptyOrDeleted()
@@ -478,15 +1130,16 @@ func (m *Map[K, V]) Put(key K, value V) {
 					// changing growthLeft) we can insert the entry here.
 					// Otherwise we need to rehash the bucket.
 					if b.growthLeft > 0 || g.ctrls.Get(i) == ctrlDeleted {
-						slot := g.slots.At(i)
-						slot.key = key
-						slot.value = value
+						g.slots.Set(i, key, value)
 						if g.ctrls.Get(i) == ctrlEmpty {
 							b.growthLeft--
 						}
-						g.ctrls.Set(i, ctrl(h2(h)))
+						g.ctrls.Set(i, ctrl(h2(sh)))
 						b.used++
 						m.used++
+						if m.opts != nil {
+							m.inserted(b, g, i, h)
+						}
 						b.checkInvariants(m)
 						return
 					}
@@ -495,33 +1148,275 @@ func (m *Map[K, V]) Put(key K, value V) {
 			}
 
 			if invariants && b.growthLeft != 0 {
-				panic(fmt.Sprintf("invariant failed: growthLeft is unexpectedly non-zero: %d\n%#v", b.growthLeft, b))
+				m.panicf("invariant failed: growthLeft is unexpectedly non-zero: %d\n%s", b.growthLeft, m.bucketString(b))
 			}
 
-			b.rehash(m)
+			if m.memLimit() != nil {
+				if need := m.memoryLimitExcess(b); need > 0 {
+					m.putEvicting(key, value, need)
+					return
+				}
+			}
 
-			// We may have split the bucket in which case we have to
-			// re-determine which bucket the key resides on. This
-			// determination is quick in comparison to rehashing, resizing,
-			// and splitting, so just always do it.
-			b = m.mutableBucket(h)
+			// We may split the bucket in which case the key may now reside in
+			// the new bucket. Rehash returns the bucket the key resides in so
+			// that we don't have to look it up again.
+			b = b.rehash(m, h)
 
 			// Note that we don't have to restart the entire Put process as we
 			// know the key doesn't exist in the map.
-			b.uncheckedPut(h, key, value)
+			g, i := b.uncheckedPut(m, h, key, value)
 			b.used++
 			m.used++
+			if m.opts != nil {
+				m.inserted(b, g, i, h)
+			}
 			b.checkInvariants(m)
 			return
 		}
 	}
 }
 
+// PutWithHash is like Put, but for a key whose hash has already been computed
+// by the caller, avoiding hashing the key again. hash must be the value Hash
+// returns for key (see Hash for when this holds), otherwise the map behaves
+// erratically: e.g. a key which is present may be inserted a second time.
+func (m *Map[K, V]) PutWithHash(key K, hash uintptr, value V) {
+	m.lazyInit()
+	loc := m.findHashed(key, hash)
+	if loc.found {
+		*m.mutableLocation(loc).value() = value
+		if m.counters() != nil {
+			m.counters().overwrites++
+		}
+		if m.opLog() != nil {
+			m.opLog().put(m, key, value)
+		}
+		return
+	}
+	m.insert(loc, key, value)
+}
+
+// GetOrPut retrieves the value from the map for the specified key if it is
+// present, returning loaded=true. Otherwise value is inserted into the map
+// and returned with loaded=false. The key is hashed and its probe sequence
+// walked only once.
+func (m *Map[K, V]) GetOrPut(key K, value V) (actual V, loaded bool) {
+	loc := m.find(key)
+	if loc.found {
+		return *loc.value(), true
+	}
+	m.insert(loc, key, value)
+	return value, false
+}
+
+// PutIfAbsent inserts an entry into the map if an entry with the same key
+// is not already present, returning true if the entry was inserted. Unlike
+// Put, an existing value is never overwritten.
+func (m *Map[K, V]) PutIfAbsent(key K, value V) bool {
+	loc := m.find(key)
+	if loc.found {
+		return false
+	}
+	m.insert(loc, key, value)
+	return true
+}
+
+// ReserveKey returns a pointer to the value for the specified key, inserting
+// the key with the zero value (growing the map if necessary) and returning
+// reserved=true if it is not already present. This allows a value which is
+// expensive to construct to be constructed only if the key is absent, and
+// then stored without hashing the key and walking its probe sequence again:
+//
+//	if v, reserved := m.ReserveKey(key); reserved {
+//	  *v = newExpensiveValue(key)
+//	}
+//
+// The pointer is only valid until the next mutation of the map, which may
+// move the entry to a different slot (see Modify), so the value must be
+// filled in before the map is mutated again. Until then, the reserved entry
+// is present in the map with the zero value.
+func (m *Map[K, V]) ReserveKey(key K) (value *V, reserved bool) {
+	loc := m.find(key)
+	if loc.found {
+		value = m.mutableLocation(loc).value()
+	} else {
+		var zero V
+		value, reserved = m.insert(loc, key, zero), true
+	}
+	if m.opLog() != nil {
+		m.opLog().reserve(m, key)
+	}
+	return value, reserved
+}
+
+// Compute reads, modifies, and writes the entry for the specified key in a
+// single operation. The function f is passed the current value for the key
+// and exists=true if the key is present, or the zero value and exists=false
+// if it is not. If f returns del=true the entry is deleted (or not inserted).
+// Otherwise the entry is inserted or updated with the returned value. The key
+// is hashed and its probe sequence walked only once. The map must not be
+// accessed by f.
+func (m *Map[K, V]) Compute(key K, f func(old V, exists bool) (new V, del bool)) {
+	loc := m.find(key)
+	if loc.found {
+		v, del := f(*loc.value(), true)
+		if del {
+			m.deleteAt(loc)
+			return
+		}
+		*m.mutableLocation(loc).value() = v
+		if m.counters() != nil {
+			m.counters().overwrites++
+		}
+		if m.opLog() != nil {
+			m.opLog().put(m, key, v)
+		}
+		return
+	}
+
+	var zero V
+	if v, del := f(zero, false); !del {
+		m.insert(loc, key, v)
+	}
+}
+
+// Modify calls f with a pointer to the value for the specified key, allowing
+// the value to be updated in place, and returns true. If the key is not
+// present f is not called and false is returned. Modify avoids the separate
+// Get and Put (and the copying of the value) needed to update a field of a
+// large struct value. The pointer must not be retained after f returns and
+// the map must not be accessed by f.
+//
+// Entries are moved between slots by copying them when a bucket is resized,
+// split, or rehashed, so the pointer passed to f refers to the entry's
+// current slot only for the duration of the call. If V is a slice, f may
+// append to *v: the updated slice header is stored in the slot and is
+// copied along with the entry by later resizes. The backing array is never
+// copied by the map, so it is shared with any slices previously returned by
+// Get and with Snapshot and Clone copies of the map. Elements written in
+// place within the existing length are visible through those slices, while
+// appended elements are not. See AppendValue.
+func (m *Map[K, V]) Modify(key K, f func(v *V)) bool {
+	loc := m.find(key)
+	if !loc.found {
+		return false
+	}
+	v := m.mutableLocation(loc).value()
+	f(v)
+	if m.counters() != nil {
+		m.counters().overwrites++
+	}
+	if m.opLog() != nil {
+		m.opLog().put(m, key, *v)
+	}
+	return true
+}
+
+// AppendValue appends elems to the slice value for the specified key,
+// inserting the key with a new slice holding elems if it is not present. The
+// key is hashed and its probe sequence walked only once. It is the
+// equivalent of:
+//
+//	v, _ := m.Get(key)
+//	m.Put(key, append(v, elems...))
+//
+// As with append, the slice stored in the map may share its backing array
+// with slices previously returned by Get (see Map.Modify).
+func AppendValue[K comparable, E any](m *Map[K, []E], key K, elems ...E) {
+	loc := m.find(key)
+	if !loc.found {
+		m.insert(loc, key, append([]E(nil), elems...))
+		return
+	}
+	v := m.mutableLocation(loc).value()
+	*v = append(*v, elems...)
+	if m.counters() != nil {
+		m.counters().overwrites++
+	}
+	if m.opLog() != nil {
+		m.opLog().put(m, key, *v)
+	}
+}
+
+// Number is the set of numeric types which can be the values of a Map passed
+// to Add.
+type Number interface {
+	~int | ~int8 | ~int16 | ~int32 | ~int64 |
+		~uint | ~uint8 | ~uint16 | ~uint32 | ~uint64 | ~uintptr |
+		~float32 | ~float64
+}
+
+// Add adds delta to the value for the specified key, inserting the key with
+// the value delta if it is not present, and returns the new value. The key is
+// hashed and its probe sequence walked only once. It is the equivalent of:
+//
+//	v, _ := m.Get(key)
+//	m.Put(key, v+delta)
+func Add[K comparable, V Number](m *Map[K, V], key K, delta V) V {
+	loc := m.find(key)
+	if !loc.found {
+		m.insert(loc, key, delta)
+		return delta
+	}
+	v := m.mutableLocation(loc).value()
+	*v += delta
+	if m.counters() != nil {
+		m.counters().overwrites++
+	}
+	if m.opLog() != nil {
+		m.opLog().put(m, key, *v)
+	}
+	return *v
+}
+
 // Get retrieves the value from the map for the specified key, returning
 // ok=false if the key is not present.
 func (m *Map[K, V]) Get(key K) (value V, ok bool) {
+	if m.locks() != nil {
+		return m.lockedGet(key)
+	}
+	if concurrentChecks && m.isWriting() {
+		m.panicf("concurrent map read and map write")
+	}
+	m.lazyInit()
+	if m.opLog() != nil {
+		m.opLog().record(m, opLogRecord[K, V]{Op: opLogGet, Key: key})
+	}
 	h := m.hash(noescape(unsafe.Pointer(&key)), m.seed)
+	if m.negCache() != nil && m.negCache().contains(h) {
+		m.options().negCacheHits++
+		return value, false
+	}
 	b := m.bucket(h)
+	sh := b.slotHash(m, (*K)(noescape(unsafe.Pointer(&key))), h)
+	equal := m.equal()
+
+	if b.groupMask == 0 {
+		// A bucket with a single group (a capacity of at most groupSize,
+		// including an empty bucket) is searched without constructing a
+		// probe sequence. Small maps are common, and for them the setup and
+		// looping of the general case below are a significant fraction of the
+		// lookup. The probe sequence of every key only visits group 0, and
+		// the group always contains an empty slot (as growthLeft reserves
+		// 1/8 of the slots), so a key which is not in group 0 is missing.
+		g := b.groups.At(0)
+		match := g.ctrls.matchH2(h2(sh))
+		for match != 0 {
+			i := match.first()
+			if keyEqual(equal, key, g.slots.Key(i)) {
+				if m.moveToFront() && i != 0 {
+					return m.promote(b, g, i), true
+				}
+				return *g.slots.Value(i), true
+			}
+			match = match.removeFirst()
+		}
+		if m.negCache() != nil && !b.probeMatchesH2(h) {
+			m.negCache().add(h)
+		}
+		return value, false
+	}
 
 	// NB: Unlike the abseil swiss table implementation which uses a common
 	// find routine for Get, Put, and Delete, we have to manually inline the
@@ -553,50 +1448,214 @@ func (m *Map[K, V]) Get(key K) (value V, ok bool) {
 	// analysis indicate that even at high load factors, k is less than 32,
 	// meaning that the number of false positive comparisons we must perform is
 	// less than 1/8 per find.
-	seq := makeProbeSeq(h1(h), b.groupMask)
+	if wideProbe && b.probeWide() {
+		if g, i, found := b.findWide(key, sh, equal); found {
+			if m.moveToFront() && i != 0 {
+				return m.promote(b, g, i), true
+			}
+			return *g.slots.Value(i), true
+		}
+		if m.negCache() != nil && !b.probeMatchesH2(h) {
+			m.negCache().add(h)
+		}
+		return value, false
+	}
+	seq := b.probe(sh)
 	for ; ; seq = seq.next() {
 		g := b.groups.At(uintptr(seq.offset))
-		match := g.ctrls.matchH2(h2(h))
+		match := g.ctrls.matchH2(h2(sh))
 
 		for match != 0 {
 			i := match.first()
-			slot := g.slots.At(i)
-			if key == slot.key {
-				return slot.value, true
+			if keyEqual(equal, key, g.slots.Key(i)) {
+				if m.moveToFront() && i != 0 {
+					return m.promote(b, g, i), true
+				}
+				return *g.slots.Value(i), true
 			}
 			match = match.removeFirst()
 		}
 
 		match = g.ctrls.matchEmpty()
 		if match != 0 {
+			if m.negCache() != nil && !b.probeMatchesH2(h) {
+				m.negCache().add(h)
+			}
 			return value, false
 		}
 	}
 }
 
-// Delete deletes the entry corresponding to the specified key from the map.
-// It is a noop to delete a non-existent key.
-func (m *Map[K, V]) Delete(key K) {
+// Hash returns the hash of key computed with the map's hash function (see
+// WithHash) and seed, for use with GetWithHash and PutWithHash by callers
+// which also need the hash for another purpose, such as sharding keys or
+// consulting a bloom filter. The seed is chosen randomly for each map and is
+// changed whenever the map is cleared (see Clear), so a hash is only valid
+// for the map which returned it until the map is next cleared. If the hash
+// function specified with WithHash ignores its seed argument, the hash of a
+// key is always the value returned by the hash function, and may be computed
+// by the caller without calling Hash.
+func (m *Map[K, V]) Hash(key K) uintptr {
+	m.lazyInit()
+	return m.hash(noescape(unsafe.Pointer(&key)), m.seed)
+}
+
+// GetWithHash is like Get, but for a key whose hash has already been computed
+// by the caller, avoiding hashing the key again. hash must be the value Hash
+// returns for key, otherwise a key which is present may not be found.
+func (m *Map[K, V]) GetWithHash(key K, hash uintptr) (value V, ok bool) {
+	m.lazyInit()
+	if m.negCache() != nil && m.negCache().contains(hash) {
+		m.options().negCacheHits++
+		return value, false
+	}
+	b := m.bucket(hash)
+	if v := b.lookup(key, b.slotHash(m, (*K)(noescape(unsafe.Pointer(&key))), hash), m.equal()); v != nil {
+		return *v, true
+	}
+	return value, false
+}
+
+// getBatchSize is the number of keys whose lookups are interleaved by
+// GetBatch.
+const getBatchSize = 32
+
+// GetBatch looks up each of keys, storing the value for keys[i] (or the zero
+// value) in values[i] and whether the key is present in found[i]. GetBatch
+// panics if values or found is shorter than keys. It is equivalent to calling
+// Get for each key, but is considerably faster for a large map whose groups
+// are not in the CPU caches: the keys are hashed, and the first group probed
+// for each key is prefetched, several keys at a time before their lookups
+// are resolved, so that the cache misses of the lookups overlap rather than
+// being incurred one after another. For a small map (or one configured with
+// an option which mutates the map during lookups), GetBatch calls Get for
+// each key.
+func (m *Map[K, V]) GetBatch(keys []K, values []V, found []bool) {
+	if len(values) < len(keys) || len(found) < len(keys) {
+		panic(fmt.Sprintf("GetBatch: len(values)=%d and len(found)=%d must be at least len(keys)=%d",
+			len(values), len(found), len(keys)))
+	}
+	if !m.shouldPrefetchLookups() || m.locks() != nil || m.moveToFront() ||
+		m.negCache() != nil || m.opLog() != nil {
+		for i := range keys {
+			values[i], found[i] = m.Get(keys[i])
+		}
+		return
+	}
+	if concurrentChecks && m.isWriting() {
+		m.panicf("concurrent map read and map write")
+	}
+
+	var hashes [getBatchSize]uintptr
+	for len(keys) > 0 {
+		n := len(keys)
+		if n > getBatchSize {
+			n = getBatchSize
+		}
+		for i := 0; i < n; i++ {
+			h := m.hash(noescape(unsafe.Pointer(&keys[i])), m.seed)
+			hashes[i] = h
+			b := m.bucket(h)
+			g := b.groups.At(uintptr(b.probe(h).offset))
+			prefetchRange(unsafe.Pointer(g), unsafe.Sizeof(*g))
+		}
+		for i := 0; i < n; i++ {
+			b := m.bucket(hashes[i])
+			if v := b.lookup(keys[i], b.slotHash(m, &keys[i], hashes[i]), m.equal()); v != nil {
+				values[i], found[i] = *v, true
+			} else {
+				values[i], found[i] = *new(V), false
+			}
+		}
+		keys, values, found = keys[n:], values[n:], found[n:]
+	}
+}
+
+// promote moves the entry in slot i of group g of bucket b, which was found
+// by Get, to the first slot of the group by swapping it with the entry (or
+// empty or deleted slot) there, and returns its value. See WithMoveToFront.
+func (m *Map[K, V]) promote(b *bucket[K, V], g *Group[K, V], i uint32) V {
+	// Moving entries while iterating could cause the iteration to skip or
+	// repeat an entry, and the groups of a shared bucket must not be written.
+	if m.iterating > 0 || b.shared {
+		return *g.slots.Value(i)
+	}
+	g.slots.Swap(i, &g.slots, 0)
+	if hashes := m.cachedHashes(b.groups, b.groupCount()); hashes != nil {
+		k, k0 := slotIndex(b.groups.ptr, g, i), slotIndex(b.groups.ptr, g, 0)
+		hashes[k], hashes[k0] = hashes[k0], hashes[k]
+	}
+	c := g.ctrls.Get(i)
+	g.ctrls.Set(i, g.ctrls.Get(0))
+	g.ctrls.Set(0, c)
+	return *g.slots.Value(0)
+}
+
+// Delete deletes the entry corresponding to the specified key from the map,
+// returning true if the key was present. It is a noop to delete a
+// non-existent key.
+func (m *Map[K, V]) Delete(key K) bool {
 	// Delete is find composed with "deleted at": we perform find(key), and
 	// then delete at the resulting slot if found.
+	if m.locks() != nil {
+		return m.lockedDelete(key)
+	}
+	m.lazyInit()
+	if concurrentChecks {
+		m.startWrite()
+		defer m.endWrite()
+	}
+	if m.opLog() != nil {
+		m.opLog().delete(m, key)
+	}
 	h := m.hash(noescape(unsafe.Pointer(&key)), m.seed)
 	b := m.mutableBucket(h)
+	sh := b.slotHash(m, (*K)(noescape(unsafe.Pointer(&key))), h)
+	equal := m.equal()
+
+	if b.groupMask == 0 {
+		// A bucket with a single group is searched without constructing a
+		// probe sequence (see Get). The group always contains an empty slot,
+		// so a deleted slot never needs a tombstone.
+		g := b.groups.At(0)
+		match := g.ctrls.matchH2(h2(sh))
+		for match != 0 {
+			i := match.first()
+			if keyEqual(equal, key, g.slots.Key(i)) {
+				b.used--
+				m.used--
+				if m.counters() != nil {
+					m.counters().deletes++
+				}
+				g.slots.Clear(i)
+				g.ctrls.Set(i, ctrlEmpty)
+				b.growthLeft++
+				b.checkInvariants(m)
+				return true
+			}
+			match = match.removeFirst()
+		}
+		b.checkInvariants(m)
+		return false
+	}
 
 	// NB: Unlike the abseil swiss table implementation which uses a common
 	// find routine for Get, Put, and Delete, we have to manually inline the
 	// find routine for performance.
-	seq := makeProbeSeq(h1(h), b.groupMask)
+	seq := b.probe(sh)
 	for ; ; seq = seq.next() {
 		g := b.groups.At(uintptr(seq.offset))
-		match := g.ctrls.matchH2(h2(h))
+		match := g.ctrls.matchH2(h2(sh))
 
 		for match != 0 {
 			i := match.first()
-			s := g.slots.At(i)
-			if key == s.key {
+			if keyEqual(equal, key, g.slots.Key(i)) {
 				b.used--
 				m.used--
-				*s = slot[K, V]{}
+				if m.counters() != nil {
+					m.counters().deletes++
+				}
+				g.slots.Clear(i)
 
 				// Only a full group can appear in the middle of a probe
 				// sequence (a group with at least one empty slot terminates
@@ -611,7 +1670,7 @@ func (m *Map[K, V]) Delete(key K) {
 					g.ctrls.Set(i, ctrlDeleted)
 				}
 				b.checkInvariants(m)
-				return
+				return true
 			}
 			match = match.removeFirst()
 		}
@@ -619,65 +1678,715 @@ func (m *Map[K, V]) Delete(key K) {
 		match = g.ctrls.matchEmpty()
 		if match != 0 {
 			b.checkInvariants(m)
-			return
+			return false
 		}
 	}
 }
 
-// Clear deletes all entries from the map resulting in an empty map.
-func (m *Map[K, V]) Clear() {
+// Pop deletes the entry corresponding to the specified key from the map,
+// returning the value it held and ok=true. If the key is not present, the
+// zero value and ok=false are returned.
+func (m *Map[K, V]) Pop(key K) (value V, ok bool) {
+	loc := m.find(key)
+	if !loc.found {
+		return value, false
+	}
+	value = *loc.value()
+	m.deleteAt(loc)
+	return value, true
+}
+
+// DeleteFunc deletes the entries for which f returns true in a single pass
+// over the map, returning the number of entries deleted. Deleting entries can
+// leave tombstones behind which lengthen probe sequences, so a bucket in
+// which a significant fraction of the slots are tombstones after the pass is
+// rehashed in place to drop them. The map must not be accessed by f.
+func (m *Map[K, V]) DeleteFunc(f func(key K, value V) bool) int {
+	var deleted int
 	m.buckets(0, func(b *bucket[K, V]) bool {
-		for i := uint32(0); i <= b.groupMask; i++ {
+		if b.used == 0 {
+			return true
+		}
+
+		var bucketDeleted bool
+		for i, n := uint32(0), b.groupCount(); i < n; i++ {
 			g := b.groups.At(uintptr(i))
-			g.ctrls.SetEmpty()
-			for j := uint32(0); j < groupSize; j++ {
-				*g.slots.At(j) = slot[K, V]{}
+			for match := g.ctrls.matchFull(); match != 0; match = match.removeFirst() {
+				j := match.first()
+				if !f(*g.slots.Key(j), *g.slots.Value(j)) {
+					continue
+				}
+				if b.shared {
+					// Copy the groups before the first mutation of a bucket
+					// shared with a snapshot.
+					b = m.unshare(b)
+					g = b.groups.At(uintptr(i))
+				}
+				if m.opLog() != nil {
+					m.opLog().delete(m, *g.slots.Key(j))
+				}
+
+				g.slots.Clear(j)
+				// See the comment in Delete for why a tombstone is only
+				// needed if the group is full.
+				if g.ctrls.matchEmpty() != 0 {
+					g.ctrls.Set(j, ctrlEmpty)
+					b.growthLeft++
+				} else {
+					g.ctrls.Set(j, ctrlDeleted)
+				}
+				// The counts are updated with each deletion so that the map
+				// remains consistent if f panics.
+				b.used--
+				m.used--
+				if m.counters() != nil {
+					m.counters().deletes++
+				}
+				deleted++
+				bucketDeleted = true
 			}
 		}
+		if !bucketDeleted {
+			return true
+		}
 
-		b.used = 0
-		b.resetGrowthLeft()
+		// Use the same threshold as rehash for dropping tombstones.
+		if b.capacity > groupSize && b.tombstones() >= b.capacity/3 {
+			b.rehashInPlace(m)
+		}
+		b.checkInvariants(m)
+		return true
+	})
+	if invariants {
+		m.checkUsedInvariants()
+	}
+	return deleted
+}
+
+// Merge inserts each of the entries of other into m. If a key is present in
+// both maps, resolve is called with the key, the value in m, and the value in
+// other, and the entry in m is updated with the returned value. The buckets
+// of m are grown and split up front to hold the keys of other which are not
+// present in m, so that the merge performs at most one resize per bucket
+// rather than repeatedly doubling. Neither map may be accessed by resolve,
+// and other must not be m.
+func (m *Map[K, V]) Merge(other *Map[K, V], resolve func(k K, a, b V) V) {
+	if other.Len() == 0 {
+		return
+	}
+
+	var inserted []uintptr
+	other.All(func(key K, _ V) bool {
+		if loc := m.find(key); !loc.found {
+			inserted = append(inserted, loc.h)
+		}
+		return true
+	})
+	for _, h := range inserted {
+		m.mutableBucket(h)
+	}
+	m.reserve(inserted)
+
+	other.All(func(key K, value V) bool {
+		loc := m.find(key)
+		if !loc.found {
+			m.insert(loc, key, value)
+			return true
+		}
+		v := resolve(key, *loc.value(), value)
+		*m.mutableLocation(loc).value() = v
+		if m.counters() != nil {
+			m.counters().overwrites++
+		}
+		if m.opLog() != nil {
+			m.opLog().put(m, key, v)
+		}
 		return true
 	})
+}
+
+// Intersect deletes the entries of m whose keys are not present in other,
+// retaining the entries whose keys are present in both maps. The values in
+// other are ignored. The smaller of the two maps is iterated and the larger
+// one probed: if other is the smaller map, the entries to retain are
+// collected and reinserted after clearing m (see Clear). The maps must not
+// be accessed during the operation, and other must not be m.
+func (m *Map[K, V]) Intersect(other *Map[K, V]) {
+	if m.Len() <= other.Len() {
+		m.DeleteFunc(func(key K, _ V) bool {
+			_, ok := other.Get(key)
+			return !ok
+		})
+		return
+	}
+
+	kept := make([]KV[K, V], 0, other.Len())
+	other.Keys(func(key K) bool {
+		if v, ok := m.Get(key); ok {
+			kept = append(kept, KV[K, V]{Key: key, Value: v})
+		}
+		return true
+	})
+	m.Clear()
+	for i := range kept {
+		m.Put(kept[i].Key, kept[i].Value)
+	}
+	if m.counters() != nil {
+		// The retained entries were neither deleted nor inserted from the
+		// perspective of the caller.
+		m.counters().deletes -= uint64(len(kept))
+		m.counters().inserts -= uint64(len(kept))
+	}
+}
+
+// Difference deletes the entries of m whose keys are present in other. The
+// values in other are ignored. The smaller of the two maps is iterated and
+// the larger one probed. The maps must not be accessed during the operation,
+// and other must not be m.
+func (m *Map[K, V]) Difference(other *Map[K, V]) {
+	if other.Len() < m.Len() {
+		other.Keys(func(key K) bool {
+			m.Delete(key)
+			return true
+		})
+		return
+	}
+	m.DeleteFunc(func(key K, _ V) bool {
+		_, ok := other.Get(key)
+		return ok
+	})
+}
+
+// location is the result of Map.find. If found is true, g and i identify the
+// slot holding the key. Otherwise g and i identify the first empty or deleted
+// slot in the key's probe sequence, which is where the key would be inserted.
+// offset is the index of g within the bucket's groups.
+type location[K comparable, V any] struct {
+	b      *bucket[K, V]
+	h      uintptr
+	g      *Group[K, V]
+	offset uint32
+	i      uint32
+	found  bool
+}
+
+// value returns the value in the slot identified by the location.
+func (l location[K, V]) value() *V {
+	return l.g.slots.Value(l.i)
+}
+
+// find locates key within the map for a subsequent mutation. It is used by
+// the operations which combine a lookup with an insertion or deletion in
+// order to only hash the key and walk its probe sequence once. Get, Put, and
+// Delete manually inline find for performance. The bucket is not copied if
+// it is shared with a snapshot, so that lookups which end up not mutating
+// the map do not copy the bucket: the location must be passed to
+// mutableLocation before mutating the slot it identifies.
+func (m *Map[K, V]) find(key K) location[K, V] {
+	m.lazyInit()
+	return m.findHashed(key, m.hash(noescape(unsafe.Pointer(&key)), m.seed))
+}
+
+// findHashed is like find, but for a key whose hash h has already been
+// computed with the map's hash function and seed. The map must be
+// initialized.
+func (m *Map[K, V]) findHashed(key K, h uintptr) location[K, V] {
+	b := m.bucket(h)
+	// The canonical bucket is the one located at m.dir[b.index] (see
+	// mutableBucket).
+	b = m.dir.At(uintptr(b.index))
+	loc := location[K, V]{b: b, h: h}
+	loc.g, loc.offset, loc.i, loc.found = b.find(key, b.slotHash(m, (*K)(noescape(unsafe.Pointer(&key))), h), m.equal())
+	return loc
+}
+
+// mutableLocation gives the map exclusive ownership of the bucket of a
+// location returned by find, copying the bucket if it is shared with a
+// snapshot, and returns the location adjusted to refer to the copy.
+func (m *Map[K, V]) mutableLocation(loc location[K, V]) location[K, V] {
+	if loc.b.shared {
+		loc.b = m.unshare(loc.b)
+		loc.g = loc.b.groups.At(uintptr(loc.offset))
+	}
+	return loc
+}
+
+// insert inserts key and value at the location returned by a find for key
+// which did not find the key, rehashing the bucket if it has no room left to
+// grow. It returns the value of the new entry which is valid until the next
+// mutation of the map.
+func (m *Map[K, V]) insert(loc location[K, V], key K, value V) *V {
+	if invariants && loc.found {
+		m.panicf("invariant failed: inserting key %s which is already present", m.keyString(key))
+	}
+	loc = m.mutableLocation(loc)
+	if m.negCache() != nil {
+		m.negCache().remove(loc.h)
+	}
+
+	b, g, i := loc.b, loc.g, loc.i
+	if c := g.ctrls.Get(i); b.growthLeft > 0 || c == ctrlDeleted {
+		// If there is room left to grow in the bucket or the slot is deleted
+		// (and thus we're overwriting it and not changing growthLeft) we can
+		// insert the entry here.
+		b.setSlot(g, i, b.slotHash(m, (*K)(noescape(unsafe.Pointer(&key))), loc.h), key, value)
+	} else {
+		if m.memLimit() != nil {
+			if need := m.memoryLimitExcess(b); need > 0 {
+				return m.insertEvicting(key, value, need)
+			}
+		}
+		b = b.rehash(m, loc.h)
+		g, i = b.uncheckedPut(m, loc.h, key, value)
+	}
+	b.used++
+	m.used++
+	if m.opts != nil {
+		m.inserted(b, g, i, loc.h)
+	}
+	b.checkInvariants(m)
+	if m.opLog() != nil {
+		m.opLog().put(m, key, value)
+	}
+	return g.slots.Value(i)
+}
+
+// deleteAt deletes the entry at the location returned by a find for a key
+// which was found.
+func (m *Map[K, V]) deleteAt(loc location[K, V]) {
+	if invariants && !loc.found {
+		m.panicf("invariant failed: deleting at a location which was not found")
+	}
+	if m.opLog() != nil {
+		m.opLog().delete(m, *loc.g.slots.Key(loc.i))
+	}
+	loc = m.mutableLocation(loc)
+
+	m.used--
+	if m.counters() != nil {
+		m.counters().deletes++
+	}
+	loc.b.deleteSlot(loc.g, loc.i)
+	loc.b.checkInvariants(m)
+}
 
+// Clear deletes all entries from the map resulting in an empty map, and
+// returns the number of entries deleted. The memory held by the buckets is
+// retained for reuse by subsequent insertions. See ClearAndRelease and Reset.
+// Clearing an empty map only changes the hash seed (see below), and buckets
+// which are empty and contain no tombstones are skipped, so calling Clear
+// unconditionally on a map which is usually small or empty is cheap.
+func (m *Map[K, V]) Clear() int {
+	deleted := m.used
+	if deleted > 0 {
+		m.buckets(0, func(b *bucket[K, V]) bool {
+			// An empty bucket shares the emptyCtrls singleton which does not
+			// have space for slots and must not be written.
+			if b.capacity == 0 || (b.used == 0 && b.tombstones() == 0) {
+				return true
+			}
+			if b.shared {
+				b = m.unshare(b)
+			}
+			b.clear()
+			return true
+		})
+	}
+	m.clearedAll()
+	return deleted
+}
+
+// reseed gives the map a new seed. The default hash function is bound to the
+// seed, so it is replaced along with it, as is the fallback hash function of
+// degenerate buckets. A map which has not been initialized is seeded by Init.
+func (m *Map[K, V]) reseed() {
+	switch {
+	case m.hash == nil:
+	case m.customHash():
+		m.seed = seedBits(newHashSeed())
+	default:
+		hash, seed := newHasher[K]()
+		if ht := m.hashTiming(); ht != nil {
+			ht.hash = hash
+		} else {
+			m.hash = hash
+		}
+		m.seed = seed
+	}
+	if m.degenerateHash() != nil {
+		m.opts.degenerateHash, m.opts.degenerateSeed = newHasher[K]()
+	}
+}
+
+// clearedAll updates the map after all of its entries have been removed from
+// its buckets.
+func (m *Map[K, V]) clearedAll() {
 	// Reset the hash seed to make it more difficult for attackers to
 	// repeatedly trigger hash collisions. See issue
-	// https://github.com/golang/go/issues/25237.
-	m.seed = uintptr(fastrand64())
+	// https://github.com/golang/go/issues/25237. The seed of a map with a
+	// deterministic hash is fixed.
+	if !m.deterministicHash() {
+		m.reseed()
+	}
+	if m.negCache() != nil {
+		m.negCache().reset()
+	}
+	if m.counters() != nil {
+		m.counters().deletes += uint64(m.used)
+	}
 	m.used = 0
+	if invariants {
+		m.checkUsedInvariants()
+	}
+	if m.opLog() != nil {
+		m.opLog().record(m, opLogRecord[K, V]{Op: opLogClear, Seed: uint64(m.seed)})
+	}
+}
+
+// ClearAndRelease is like Clear, but rather than retaining the memory held by
+// the buckets it releases all of it back to the allocator and resets the map
+// to a single empty bucket, as though it was newly constructed with an
+// initial capacity of 0 (the options the map was constructed with are
+// retained). This is intended for long-lived maps which alternate between
+// large and small working sets. When called during iteration over the map,
+// ClearAndRelease is equivalent to Clear as shrinking the directory would
+// cause the iteration to skip buckets.
+func (m *Map[K, V]) ClearAndRelease() {
+	if m.iterating > 0 {
+		m.Clear()
+		return
+	}
+
+	m.buckets(0, func(b *bucket[K, V]) bool {
+		// NB: close releases the groups, which may still be referenced by a
+		// snapshot, without modifying them.
+		b.close(m)
+		return true
+	})
+	m.resetDirectory(bucket[K, V]{})
+	m.clearedAll()
+}
+
+// Reset is like Clear, but also resets the directory to a single bucket. The
+// bucket at the start of the directory is retained, cleared of its entries,
+// for reuse by subsequent insertions, while the memory held by the other
+// buckets is released back to the allocator. This is intended for pools of
+// maps, such as per-request scratch maps, where reusing a map should neither
+// allocate nor retain the memory of its largest ever working set. If the
+// retained bucket is shared with a snapshot (see Snapshot) its memory is
+// released as well, rather than being copied only to be cleared. When called
+// during iteration over the map, Reset is equivalent to Clear as shrinking
+// the directory would cause the iteration to skip buckets.
+func (m *Map[K, V]) Reset() {
+	if m.iterating > 0 {
+		m.Clear()
+		return
+	}
+
+	m.lazyInit()
+	b0 := *m.dir.At(0)
+	m.buckets(0, func(b *bucket[K, V]) bool {
+		if b.index != 0 {
+			b.close(m)
+		}
+		return true
+	})
+	switch {
+	case b0.shared:
+		b0.close(m)
+		b0 = bucket[K, V]{}
+	case b0.capacity > 0 && (b0.used > 0 || b0.tombstones() > 0):
+		b0.clear()
+	}
+	b0.localDepth = 0
+	b0.salt = 0
+	b0.inPlaceRehashes = 0
+	m.resetDirectory(b0)
+	m.clearedAll()
+}
+
+// ClearWithHint is like Clear, but also adjusts the capacity of the map
+// toward that of a map constructed with New(expected), for maps which are
+// reused for working sets of varying size (e.g. pooled per-batch scratch
+// maps) and would otherwise retain the capacity of the largest working set
+// they have ever held. If the capacity of the map is more than twice that of
+// New(expected), the memory held by the buckets is released (see
+// ClearAndRelease) and buckets sized for expected entries are allocated in
+// its place. If the capacity is less than that of New(expected), the buckets
+// are grown as by Reserve(expected). Otherwise the memory is retained for
+// reuse, as by Clear. The slack prevents a map reused for working sets of
+// similar sizes from being reallocated every time it is cleared. When called
+// during iteration over the map, ClearWithHint is equivalent to Clear.
+func (m *Map[K, V]) ClearWithHint(expected int) int {
+	if m.iterating > 0 {
+		return m.Clear()
+	}
+	m.lazyInit()
+	if expected < 0 {
+		expected = 0
+	}
+	l, err := makeLayout(expected, m.maxBucketCapacity)
+	if err != nil {
+		panic(err)
+	}
+
+	capacity := m.capacity()
+	if capacity <= 2*l.Capacity {
+		deleted := m.Clear()
+		if capacity < l.Capacity {
+			m.Reserve(expected)
+		}
+		return deleted
+	}
+
+	deleted := m.used
+	m.ClearAndRelease()
+	m.Reserve(expected)
+	return deleted
+}
+
+// resetDirectory resets the directory to contain the single bucket b, which
+// must not hold any entries. If b has no capacity it is given the groups of
+// an empty map (see Init).
+func (m *Map[K, V]) resetDirectory(b bucket[K, V]) {
+	if b.capacity == 0 {
+		b = bucket[K, V]{
+			groups: makeUnsafeSlice(unsafeConvertSlice[Group[K, V]](emptyCtrls[:])),
+		}
+	}
+	if m.indirectBucket0() {
+		if m.globalShift != 0 {
+			m.dir = makeUnsafeSlice(make([]bucket[K, V], 1))
+		}
+		*m.dir.At(0) = b
+	} else {
+		m.bucket0 = b
+		m.dir = makeUnsafeSlice(unsafe.Slice(&m.bucket0, 1))
+	}
+	m.globalShift = 0
+	m.checkInvariants()
+}
+
+// TryMergeSiblings attempts to merge the two sibling buckets covering the
+// hash prefix of the specified depth (i.e. the buckets whose entries have
+// the hash prefix followed by a 0 or a 1 bit) into a single bucket, and to
+// shrink the directory if no bucket requires its full depth. The map does
+// not merge buckets on its own, so after deleting most of the entries in a
+// hash range (e.g. after handing off a shard to another process) an
+// application can call TryMergeSiblings to release the memory held by the
+// now sparse buckets. The prefix is the high depth bits of the hash and
+// TryMergeSiblings panics if the prefix has more than depth bits.
+//
+// TryMergeSiblings returns true if the buckets were merged. The buckets are
+// not merged if the directory does not extend past depth, if either sibling
+// has itself been split further, or if the combined entries of the siblings
+// would not fit in a bucket of at most the max bucket capacity. Merging
+// from the leaves up (deepest depth first) allows an entire hash range to
+// be collapsed by repeated calls. The buckets are also not merged when
+// called during iteration over the map (e.g. from the yield function passed
+// to All) as merging would cause the iteration to skip entries.
+func (m *Map[K, V]) TryMergeSiblings(prefix uint64, depth uint) bool {
+	if depth > ptrBits || (depth < 64 && prefix>>depth != 0) {
+		panic(fmt.Sprintf("invalid prefix %#x for depth %d", prefix, depth))
+	}
+	globalDepth := uint(m.globalDepth())
+	if depth >= globalDepth || m.iterating > 0 {
+		return false
+	}
+
+	// The siblings occupy the two halves of the range of directory entries
+	// which share the prefix.
+	lindex := uint32(prefix) << (globalDepth - depth)
+	rindex := lindex + bucketStep(uint32(globalDepth), uint32(depth)+1)
+	lb, rb := m.dir.At(uintptr(lindex)), m.dir.At(uintptr(rindex))
+	if uint(lb.localDepth) != depth+1 || uint(rb.localDepth) != depth+1 {
+		return false
+	}
+
+	// Size the merged bucket so that it can hold the combined entries of the
+	// siblings without needing to grow.
+	capacity := fitCapacity(lb.used + rb.used)
+	if capacity > m.maxBucketCapacity {
+		return false
+	}
+
+	mb := m.scratchBucket()
+	*mb = bucket[K, V]{
+		localDepth: uint8(depth),
+		salt:       (lb.salt | rb.salt) & degenerateSalt,
+		index:      lindex,
+	}
+	mb.init(m, capacity)
+
+	for _, b := range [2]*bucket[K, V]{lb, rb} {
+		hashes := m.cachedHashes(b.groups, b.groupCount())
+		for i, n := uint32(0), b.groupCount(); i < n && b.used > 0; i++ {
+			g := b.groups.At(uintptr(i))
+			for j := uint32(0); j < groupSize; j++ {
+				if (g.ctrls.Get(j) & ctrlEmpty) == ctrlEmpty {
+					continue
+				}
+				k, v := g.slots.Key(j), g.slots.Value(j)
+				if hashes != nil {
+					h := hashes[i*groupSize+j]
+					ng, ni := mb.uncheckedPut(m, h, *k, *v)
+					m.cacheHash(mb, ng, ni, h)
+				} else {
+					mb.uncheckedPut(m, m.hash(noescape(unsafe.Pointer(k)), m.seed), *k, *v)
+				}
+				mb.used++
+			}
+		}
+		// NB: close releases the groups, which may still be referenced by a
+		// snapshot, without modifying them.
+		b.close(m)
+	}
+
+	m.installBucket(mb).checkInvariants(m)
+	*mb = bucket[K, V]{}
+
+	m.shrinkDirectory()
+	if invariants {
+		m.checkUsedInvariants()
+	}
+	return true
+}
+
+// ShrinkToFit releases the memory held by the map beyond what is needed to
+// hold its entries, such as after deleting most of the entries. Sibling
+// buckets are merged from the leaves up wherever their combined entries fit
+// in a single bucket (see TryMergeSiblings), shrinking the directory, and
+// then each bucket which is larger than needed is resized down to the
+// smallest capacity which holds its entries. An empty map releases all of its
+// memory.
+// Subsequent insertions will need to grow the buckets again, so ShrinkToFit
+// is intended for maps which are not expected to grow back to their former
+// size. Buckets are not merged when called during iteration over the map.
+func (m *Map[K, V]) ShrinkToFit() {
+	m.lazyInit()
+	for depth := m.globalDepth(); depth > 0; depth-- {
+		for prefix := uint64(0); prefix < 1<<(depth-1); prefix++ {
+			m.TryMergeSiblings(prefix, uint(depth-1))
+		}
+	}
+
+	if m.globalShift == 0 && m.used == 0 {
+		// Return the single bucket to the state of an empty map (see Init).
+		b := m.dir.At(0)
+		b.close(m)
+		*b = bucket[K, V]{
+			groups: makeUnsafeSlice(unsafeConvertSlice[Group[K, V]](emptyCtrls[:])),
+		}
+		return
+	}
+
+	m.buckets(0, func(b *bucket[K, V]) bool {
+		if b.capacity == 0 {
+			return true
+		}
+		if capacity := fitCapacity(b.used); capacity < b.capacity {
+			// NB: resize copies the entries of a bucket shared with a
+			// snapshot without modifying its groups.
+			b.resize(m, capacity)
+		}
+		return true
+	})
+	if invariants {
+		m.checkUsedInvariants()
+	}
 }
 
 // All calls yield sequentially for each key and value present in the map. If
 // yield returns false, range stops the iteration. The map can be mutated
 // during iteration, though there is no guarantee that the mutations will be
-// visible to the iteration.
+// visible to the iteration. Every entry which is present for the entire
+// iteration is yielded exactly once.
 //
-// TODO(peter): The naming of All and its signature are meant to conform to
-// the range-over-function Go proposal. When that proposal is accepted (which
-// seems likely), we'll be able to iterate over the map by doing:
+// The signature of All conforms to iter.Seq2[K, V], so with Go 1.23 or later
+// the map can be iterated over using range-over-function:
 //
 //	for k, v := range m.All {
 //	  fmt.Printf("%v: %v\n", k, v)
 //	}
 //
-// See https://github.com/golang/go/issues/61897.
+// Note that All is used as a method value (m.All rather than m.All()). See
+// https://github.com/golang/go/issues/61897.
+//
+// If the map was configured with WithBucketLocks, the map is locked for the
+// duration of the iteration, so yield must not access the map.
 func (m *Map[K, V]) All(yield func(key K, value V) bool) {
-	// Randomize iteration order by starting iteration at a random bucket and
-	// within each bucket at a random offset.
-	offset := uintptr(fastrand64())
-	m.buckets(offset>>32, func(b *bucket[K, V]) bool {
+	if m.locks() != nil {
+		m.locks().dir.Lock()
+		defer m.locks().dir.Unlock()
+	}
+	m.iterate(fastrand64(), yield, nil)
+}
+
+// Keys is like All, but only yields the keys present in the map. The values
+// are not read, which avoids copying them and, for large value types, pulling
+// the cache lines holding them into memory. The signature of Keys conforms
+// to iter.Seq[K], so with Go 1.23 or later Keys can be used as:
+//
+//	for k := range m.Keys {
+//	  fmt.Printf("%v\n", k)
+//	}
+//
+// Like All, Keys is used as a method value (m.Keys rather than m.Keys()).
+func (m *Map[K, V]) Keys(yield func(key K) bool) {
+	m.iterate(fastrand64(), nil, yield)
+}
+
+// iterate implements All and Keys. Exactly one of yield and yieldKey must be
+// non-nil. If yieldKey is non-nil it is called with each key and the values
+// are not read. The high 32 bits of offset select the bucket at which
+// iteration starts and the low 32 bits the offset within each bucket. All
+// and Keys randomize the iteration order by passing a random offset, while
+// Diff passes 0 so that its output is deterministic.
+func (m *Map[K, V]) iterate(
+	offset uint64, yield func(key K, value V) bool, yieldKey func(key K) bool,
+) {
+	src := m
+	if m.strictIteration() {
+		// Iterate over a snapshot so that mutations of m during iteration,
+		// which copy the buckets they touch, are not visible to the
+		// iteration. See WithStrictIterationSnapshot.
+		src = m.Snapshot()
+		defer src.Close()
+	}
+	prefetch := src.shouldPrefetch()
+	outerIterGroups := src.iterGroups
+	defer func() { src.iterGroups = outerIterGroups }()
+	src.buckets(uintptr(offset>>32), func(b *bucket[K, V]) bool {
 		if b.used == 0 {
 			return true
 		}
 
-		// Snapshot the groups, and groupMask so that iteration remains valid
-		// if the map is resized during iteration.
+		// Snapshot the groups, groupMask, and groupCount so that iteration
+		// remains valid if the map is resized during iteration. If the bucket
+		// is split or rehashed in place during iteration, its entries are
+		// moved to new groups (see bucket.split and bucket.detachGroups).
 		groups := b.groups
 		groupMask := b.groupMask
+		groupCount := b.groupCount()
+		src.iterGroups = groups.ptr
 
 		offset32 := uint32(offset)
 		for i := uint32(0); i <= groupMask; i++ {
-			g := groups.At(uintptr((i + offset32) & groupMask))
+			gi := (i + offset32) & groupMask
+			if gi >= groupCount {
+				continue
+			}
+			if concurrentChecks && src.isWriting() {
+				src.panicf("concurrent map iteration and map write")
+			}
+			g := groups.At(uintptr(gi))
+			if prefetch {
+				// Prefetch the next group while yielding the entries of this
+				// one. See shouldPrefetch.
+				if ngi := (gi + 1) & groupMask; ngi < groupCount {
+					prefetchRange(unsafe.Pointer(groups.At(uintptr(ngi))), unsafe.Sizeof(Group[K, V]{}))
+				}
+			}
 			// TODO(peter): Skip over groups that are composed of only empty
 			// or deleted slots using matchEmptyOrDeleted() and counting the
 			// number of bits set.
@@ -685,8 +2394,11 @@ func (m *Map[K, V]) All(yield func(key K, value V) bool) {
 				k := (j + offset32) & (groupSize - 1)
 				// Match full entries which have a high-bit of zero.
 				if (g.ctrls.Get(k) & ctrlEmpty) != ctrlEmpty {
-					slot := g.slots.At(k)
-					if !yield(slot.key, slot.value) {
+					if yieldKey != nil {
+						if !yieldKey(*g.slots.Key(k)) {
+							return false
+						}
+					} else if !yield(*g.slots.Key(k), *g.slots.Value(k)) {
 						return false
 					}
 				}
@@ -696,14 +2408,199 @@ func (m *Map[K, V]) All(yield func(key K, value V) bool) {
 	})
 }
 
+const (
+	// prefetchMinSlotSize and prefetchMinMapSize are the minimum size of a
+	// slot and of the slots of a map, in bytes, for iteration to prefetch
+	// groups. See BenchmarkMapIterLargeValues. prefetchMinMapSize is also
+	// the minimum size for GetBatch to prefetch (see BenchmarkMapGetBatch).
+	prefetchMinSlotSize = 256
+	prefetchMinMapSize  = 1 << 20
+)
+
+// shouldPrefetch returns true if iterating over the map should prefetch the
+// next group while yielding the entries of the current one. The groups are
+// laid out sequentially, which the hardware prefetcher already handles well
+// for small slots, and for a map which fits in the CPU caches the cost of
+// prefetching exceeds its benefit. When yielding large values from a large
+// map, loading the values dominates the cost of iteration and prefetching
+// hides much of the latency of the loads.
+func (m *Map[K, V]) shouldPrefetch() bool {
+	slotSize := unsafe.Sizeof(slot[K, V]{})
+	return prefetchSupported && slotSize >= prefetchMinSlotSize &&
+		uintptr(m.used)*slotSize >= prefetchMinMapSize
+}
+
+// shouldPrefetchLookups returns true if GetBatch should prefetch the memory
+// accessed by lookups. Like shouldPrefetch, prefetching only pays for itself
+// for a map which does not fit in the CPU caches.
+func (m *Map[K, V]) shouldPrefetchLookups() bool {
+	return prefetchSupported && uintptr(m.used)*unsafe.Sizeof(slot[K, V]{}) >= prefetchMinMapSize
+}
+
+// AllRange is like All, but only yields the entries whose hash has the
+// specified prefix in its high depth bits. The hash ranges for the 2^depth
+// prefixes of a given depth are disjoint and together cover every entry in the
+// map, so AllRange can be used to divide a scan of the map between multiple
+// workers, or to select a subset of the map for migration elsewhere. The
+// buckets of the map are partitioned by the high bits of the hash, so
+// AllRange only visits the entries in the buckets which overlap the prefix.
+// Note that the hash of a key changes when the map is cleared (see Clear).
+// AllRange panics if depth exceeds the number of bits in a hash or if prefix
+// does not fit in depth bits.
+func (m *Map[K, V]) AllRange(prefix uint64, depth uint, yield func(key K, value V) bool) {
+	if depth > ptrBits || (depth < 64 && prefix>>depth != 0) {
+		panic(fmt.Sprintf("invalid prefix %#x for depth %d", prefix, depth))
+	}
+	if depth == 0 {
+		m.All(yield)
+		return
+	}
+	shift := ptrBits - depth
+
+	m.buckets(0, func(b *bucket[K, V]) bool {
+		if b.used == 0 {
+			return true
+		}
+
+		// The entries in the bucket share the high localDepth bits of their
+		// hash, which are the high bits of the bucket's index in the
+		// directory. If localDepth >= depth every entry in the bucket either
+		// has the prefix or does not. Otherwise we need to check the hash of
+		// each entry.
+		globalDepth, localDepth := uint(m.globalDepth()), uint(b.localDepth)
+		bucketPrefix := uint64(b.index) >> (globalDepth - localDepth)
+		checkHash := localDepth < depth
+		if checkHash {
+			if bucketPrefix != prefix>>(depth-localDepth) {
+				return true
+			}
+		} else if bucketPrefix>>(localDepth-depth) != prefix {
+			return true
+		}
+
+		// Snapshot the groups and groupCount so that iteration remains valid
+		// if the map is resized during iteration.
+		groups := b.groups
+		groupCount := b.groupCount()
+
+		for i := uint32(0); i < groupCount; i++ {
+			g := groups.At(uintptr(i))
+			for j := uint32(0); j < groupSize; j++ {
+				if (g.ctrls.Get(j) & ctrlEmpty) == ctrlEmpty {
+					continue
+				}
+				k := g.slots.Key(j)
+				if checkHash {
+					h := m.hash(noescape(unsafe.Pointer(k)), m.seed)
+					if uint64(h>>shift) != prefix {
+						continue
+					}
+				}
+				if !yield(*k, *g.slots.Value(j)) {
+					return false
+				}
+			}
+		}
+		return true
+	})
+}
+
+// AllLive is like All, but before yielding an entry it re-verifies that the
+// key is still present in the map and yields the current value for the key.
+// This guarantees that an entry deleted during iteration (including by the
+// yield function) is never subsequently yielded, at the cost of an
+// additional lookup per entry. As with All, entries inserted during
+// iteration may or may not be yielded.
+func (m *Map[K, V]) AllLive(yield func(key K, value V) bool) {
+	m.All(func(key K, value V) bool {
+		if key != key {
+			// A key which is not equal to itself (i.e. NaN) can't be looked
+			// up, nor deleted other than by clearing the map. Like the
+			// runtime, yield the entry as it was iterated over.
+			return yield(key, value)
+		}
+		value, ok := m.getInAll(key)
+		if !ok {
+			return true
+		}
+		return yield(key, value)
+	})
+}
+
+// AppendKVs appends every key and value present in the map to dst and
+// returns the extended slice. The entries are appended in iteration order
+// (see All).
+func (m *Map[K, V]) AppendKVs(dst []KV[K, V]) []KV[K, V] {
+	if n := len(dst) + m.used; n > cap(dst) {
+		dst = append(make([]KV[K, V], 0, n), dst...)
+	}
+	m.All(func(k K, v V) bool {
+		dst = append(dst, KV[K, V]{Key: k, Value: v})
+		return true
+	})
+	return dst
+}
+
+// ToMap returns a builtin map holding every key and value present in the
+// map, for handing the entries to APIs which require a builtin map.
+func (m *Map[K, V]) ToMap() map[K]V {
+	r := make(map[K]V, m.used)
+	m.CopyInto(r)
+	return r
+}
+
+// CopyInto copies every key and value present in the map into dst,
+// overwriting the values of keys already present in dst.
+func (m *Map[K, V]) CopyInto(dst map[K]V) {
+	m.All(func(k K, v V) bool {
+		dst[k] = v
+		return true
+	})
+}
+
+// Chan returns a channel from which every key and value present in the map
+// can be received. Chan takes a Snapshot of the map, which requires time
+// proportional to the number of buckets rather than the number of entries,
+// and a separate goroutine then streams the entries of the snapshot to the
+// channel as they are received. The map may be freely mutated while the
+// channel is being drained: mutations made after Chan returns are never
+// visible to the receiver. The channel has a buffer of size buf and is closed
+// after the last entry is sent or when ctx is canceled, whichever happens
+// first.
+//
+// The caller must either receive until the channel is closed or cancel ctx.
+// Otherwise the goroutine blocks forever, retaining the snapshot's memory.
+// The snapshot is closed by the goroutine, so a configured Allocator may be
+// called from the goroutine concurrently with use of the map (see Snapshot).
+func (m *Map[K, V]) Chan(ctx context.Context, buf int) <-chan KV[K, V] {
+	s := m.Snapshot()
+	ch := make(chan KV[K, V], buf)
+	go func() {
+		defer close(ch)
+		defer s.Close()
+		s.All(func(k K, v V) bool {
+			select {
+			case ch <- KV[K, V]{Key: k, Value: v}:
+				return true
+			case <-ctx.Done():
+				return false
+			}
+		})
+	}()
+	return ch
+}
+
 // GoString implements the fmt.GoStringer interface which is used when
 // formatting using the "%#v" format specifier.
 func (m *Map[K, V]) GoString() string {
 	var buf strings.Builder
+	if m.name() != "" {
+		fmt.Fprintf(&buf, "name=%q  ", m.name())
+	}
 	fmt.Fprintf(&buf, "used=%d  global-depth=%d  bucket-count=%d\n", m.used, m.globalDepth(), m.bucketCount())
 	m.buckets(0, func(b *bucket[K, V]) bool {
 		fmt.Fprintf(&buf, "bucket %d (%p): local-depth=%d\n", b.index, b, b.localDepth)
-		b.goFormat(&buf)
+		b.goFormat(&buf, m.formatKey())
 		return true
 	})
 	return buf.String()
@@ -711,9 +2608,387 @@ func (m *Map[K, V]) GoString() string {
 
 // Len returns the number of entries in the map.
 func (m *Map[K, V]) Len() int {
+	if m.locks() != nil {
+		return m.lockedLen()
+	}
 	return m.used
 }
 
+// Equal reports whether m and other contain the same keys, associated with
+// equal values. Values are compared using ==. See Map.EqualFunc for value
+// types which are not comparable.
+func Equal[K comparable, V comparable](m, other *Map[K, V]) bool {
+	return m.EqualFunc(other, func(a, b V) bool {
+		return a == b
+	})
+}
+
+// EqualFunc reports whether m and other contain the same keys, with the
+// values associated with each key equal according to eq. The lengths of the
+// maps are compared first, and then other is probed for each entry in m.
+func (m *Map[K, V]) EqualFunc(other *Map[K, V], eq func(a, b V) bool) bool {
+	if m.Len() != other.Len() {
+		return false
+	}
+	equal := true
+	m.All(func(key K, value V) bool {
+		var v V
+		var ok bool
+		if other == m {
+			v, ok = m.getInAll(key)
+		} else {
+			v, ok = other.Get(key)
+		}
+		equal = ok && eq(value, v)
+		return equal
+	})
+	return equal
+}
+
+// DiffKind describes how the entry for a key differs between two maps.
+type DiffKind uint8
+
+const (
+	// DiffOnlyInA indicates that the key is present in a but not in b.
+	DiffOnlyInA DiffKind = iota
+	// DiffOnlyInB indicates that the key is present in b but not in a.
+	DiffOnlyInB
+	// DiffValue indicates that the key is present in both maps, associated
+	// with values which are not equal.
+	DiffValue
+)
+
+// String implements the fmt.Stringer interface.
+func (k DiffKind) String() string {
+	switch k {
+	case DiffOnlyInA:
+		return "only-in-a"
+	case DiffOnlyInB:
+		return "only-in-b"
+	case DiffValue:
+		return "value"
+	default:
+		return fmt.Sprintf("DiffKind(%d)", uint8(k))
+	}
+}
+
+// DiffEntry is a difference between two maps reported by Diff. A holds the
+// value in a if Kind is DiffOnlyInA or DiffValue, and B holds the value in b
+// if Kind is DiffOnlyInB or DiffValue. The other value is the zero value.
+type DiffEntry[K comparable, V any] struct {
+	Kind DiffKind
+	Key  K
+	A, B V
+}
+
+// Diff returns the differences between a and b: the keys only present in a,
+// the keys only present in b, and the keys present in both maps whose values
+// are not equal according to equal. It is intended for verifying that two
+// maps which should contain the same entries (e.g. a replica and its source)
+// do so, and for debugging the differences when they do not.
+//
+// Each entry in a is looked up in b, followed by each entry in b being
+// looked up in a only if fewer than b.Len() keys were found in the first
+// pass. The result is pre-sized to hold the difference in length between the
+// maps, which is a lower bound on the number of differences. Unlike All, the
+// maps are iterated in a deterministic order, so diffing the same unmodified
+// maps again produces the same entries in the same order. Neither map may be
+// accessed by equal.
+func Diff[K comparable, V any](a, b *Map[K, V], equal func(V, V) bool) []DiffEntry[K, V] {
+	n := a.Len() - b.Len()
+	if n < 0 {
+		n = -n
+	}
+	diff := make([]DiffEntry[K, V], 0, n)
+
+	var common int
+	a.iterate(0, func(key K, av V) bool {
+		bv, ok := b.Get(key)
+		if !ok {
+			diff = append(diff, DiffEntry[K, V]{Kind: DiffOnlyInA, Key: key, A: av})
+			return true
+		}
+		common++
+		if !equal(av, bv) {
+			diff = append(diff, DiffEntry[K, V]{Kind: DiffValue, Key: key, A: av, B: bv})
+		}
+		return true
+	}, nil)
+
+	if common < b.Len() {
+		b.iterate(0, func(key K, bv V) bool {
+			if _, ok := a.Get(key); !ok {
+				diff = append(diff, DiffEntry[K, V]{Kind: DiffOnlyInB, Key: key, B: bv})
+			}
+			return true
+		}, nil)
+	}
+	return diff
+}
+
+// loadFactorWatch is the state of the WithLoadFactorWatch option.
+type loadFactorWatch struct {
+	threshold float64
+	fn        func(bucket BucketStats)
+}
+
+// validLoadFactor returns true if f is a valid load factor threshold for
+// WithLoadFactorWatch.
+func validLoadFactor(f float64) bool {
+	return f > 0 && f <= 1
+}
+
+// checkLoadFactor calls the WithLoadFactorWatch callback if the insertion of
+// an entry into bucket b, which incremented b.used, raised the load factor of
+// the bucket to the threshold from below it.
+func (m *Map[K, V]) checkLoadFactor(b *bucket[K, V]) {
+	w := m.loadWatch()
+	if w.fn == nil {
+		return
+	}
+	limit := w.threshold * float64(b.capacity)
+	if float64(b.used) >= limit && float64(b.used-1) < limit {
+		w.fn(b.stats())
+	}
+}
+
+// inserted informs the options which observe insertions, if any, of the
+// insertion of an entry whose hash is h into slot i of group g of bucket b.
+// The map must have mapOptions.
+func (m *Map[K, V]) inserted(b *bucket[K, V], g *Group[K, V], i uint32, h uintptr) {
+	if m.opts.cachedHash {
+		m.cacheHash(b, g, i, h)
+	}
+	if m.opts.counters != nil {
+		m.opts.counters.inserts++
+	}
+	if m.opts.loadWatch != nil {
+		m.checkLoadFactor(b)
+	}
+}
+
+// opCounters holds the operation counters enabled by WithOperationCounters.
+type opCounters struct {
+	inserts    uint64
+	overwrites uint64
+	deletes    uint64
+}
+
+// hashTiming holds the samples of the time spent in the hash function taken
+// when WithHashTiming is specified.
+type hashTiming struct {
+	// hash is the wrapped hash function.
+	hash hashFn
+	// every is the sampling interval, and countdown the number of hash
+	// computations until the next sample.
+	every     uint32
+	countdown uint32
+	// calls is the number of hash computations, of which samples were timed
+	// taking a total of sampledNanos.
+	calls        uint64
+	samples      uint64
+	sampledNanos int64
+}
+
+// hashTimerOverhead is the minimum observed time between two consecutive
+// calls to nanotime, which is subtracted from each sample.
+var hashTimerOverhead = sync.OnceValue(func() int64 {
+	overhead := int64(math.MaxInt64)
+	for i := 0; i < 100; i++ {
+		start := nanotime()
+		if d := nanotime() - start; d < overhead {
+			overhead = d
+		}
+	}
+	return overhead
+})
+
+// wrap returns a hash function which calls hash, timing a sample of the
+// calls with clock (or nanotime if clock is nil). The returned function calls
+// t.hash, which is replaced when the map is reseeded (see Map.reseed).
+func (t *hashTiming) wrap(hash hashFn, clock func() int64) hashFn {
+	t.hash = hash
+	var overhead int64
+	if clock == nil {
+		clock = nanotime
+		overhead = hashTimerOverhead()
+	}
+	return func(key unsafe.Pointer, seed uintptr) uintptr {
+		t.calls++
+		if t.countdown > 1 {
+			t.countdown--
+			return t.hash(key, seed)
+		}
+		t.countdown = t.every
+		start := clock()
+		h := t.hash(key, seed)
+		if d := clock() - start - overhead; d > 0 {
+			t.sampledNanos += d
+		}
+		t.samples++
+		return h
+	}
+}
+
+// total returns the estimated total time spent in the hash function.
+func (t *hashTiming) total() time.Duration {
+	if t.samples == 0 {
+		return 0
+	}
+	return time.Duration(float64(t.sampledNanos) * float64(t.calls) / float64(t.samples))
+}
+
+// Stats holds statistics about a Map. See Map.Stats.
+type Stats struct {
+	// Name is the name of the map specified with WithName, if any.
+	Name string
+	// Len is the number of entries in the map.
+	Len int
+	// Capacity is the total number of slots across all buckets.
+	Capacity int
+	// Buckets is the number of buckets in the map.
+	Buckets int
+	// GlobalDepth is the number of high bits of hash(key) used to index into
+	// the bucket directory.
+	GlobalDepth uint32
+	// Inserts is the number of entries inserted into the map (i.e. calls to
+	// Put for a key which was not already present) since the map was
+	// created. Inserts, Overwrites, and Deletes are only maintained if the
+	// WithOperationCounters option was specified, and are zero otherwise.
+	Inserts uint64
+	// Overwrites is the number of times the value for an existing entry was
+	// replaced since the map was created.
+	Overwrites uint64
+	// Deletes is the number of entries removed from the map, either by
+	// Delete or Clear, since the map was created.
+	Deletes uint64
+	// NegativeCacheHits is the number of lookups which were answered by the
+	// negative cache (see WithNegativeCache) without probing the map.
+	NegativeCacheHits uint64
+	// Resalts is the number of times a bucket was found to be repeatedly
+	// rehashed in place due to keys clustering in its probe sequences,
+	// triggering a change to the bucket's salt.
+	Resalts uint64
+	// DegenerateSplits is the number of times splitting a bucket failed to
+	// divide its entries because they all had the same value for the next
+	// bit of their hash, which doubles the max bucket capacity of the map.
+	// Repeated degenerate splits indicate a poor hash function, or keys
+	// chosen to collide. If the entries of the bucket also have few distinct
+	// hashes, the bucket places its entries by a fallback hash function from
+	// then on, which bounds the length of their probe sequences at the cost
+	// of hashing keys twice (see WithHash).
+	DegenerateSplits uint64
+	// HashCalls is the number of times the hash of a key was computed, by
+	// lookups and mutations as well as when rehashing the entries of a
+	// bucket which is resized or split. HashCalls and HashTime are only
+	// maintained if the WithHashTiming option was specified, and are zero
+	// otherwise.
+	HashCalls uint64
+	// HashTime is the estimated total time spent computing hashes, which is
+	// extrapolated from a sample of the hash computations.
+	HashTime time.Duration
+}
+
+// Stats returns statistics about the map. Computing the statistics requires
+// visiting each bucket, but not the entries within a bucket.
+func (m *Map[K, V]) Stats() Stats {
+	s := Stats{
+		Name:              m.name(),
+		Len:               m.used,
+		GlobalDepth:       m.globalDepth(),
+		NegativeCacheHits: m.negCacheHits(),
+		Resalts:           uint64(m.resalts),
+		DegenerateSplits:  m.degenerateSplits(),
+	}
+	if m.counters() != nil {
+		s.Inserts = m.counters().inserts
+		s.Overwrites = m.counters().overwrites
+		s.Deletes = m.counters().deletes
+	}
+	if m.hashTiming() != nil {
+		s.HashCalls = m.hashTiming().calls
+		s.HashTime = m.hashTiming().total()
+	}
+	m.buckets(0, func(b *bucket[K, V]) bool {
+		s.Capacity += int(b.capacity)
+		s.Buckets++
+		return true
+	})
+	return s
+}
+
+// StatsAppend appends the map's statistics (see Map.Stats) to dst as a single
+// line of space separated key=value pairs, and returns the extended buffer:
+//
+//	len=100 capacity=128 buckets=1 global-depth=0 inserts=100 overwrites=0 deletes=0 negative-cache-hits=0 resalts=0 degenerate-splits=0 hash-calls=0 hash-time-ns=0
+//
+// If the map has a name (see WithName), the line begins with a quoted
+// name=... pair. StatsAppend does not allocate if dst has sufficient
+// capacity, making it suitable for frequently logging the statistics of a map
+// on a hot path.
+func (m *Map[K, V]) StatsAppend(dst []byte) []byte {
+	s := m.Stats()
+	if s.Name != "" {
+		dst = append(dst, "name="...)
+		dst = strconv.AppendQuote(dst, s.Name)
+		dst = append(dst, ' ')
+	}
+	dst = append(dst, "len="...)
+	dst = strconv.AppendInt(dst, int64(s.Len), 10)
+	dst = append(dst, " capacity="...)
+	dst = strconv.AppendInt(dst, int64(s.Capacity), 10)
+	dst = append(dst, " buckets="...)
+	dst = strconv.AppendInt(dst, int64(s.Buckets), 10)
+	dst = append(dst, " global-depth="...)
+	dst = strconv.AppendUint(dst, uint64(s.GlobalDepth), 10)
+	dst = append(dst, " inserts="...)
+	dst = strconv.AppendUint(dst, s.Inserts, 10)
+	dst = append(dst, " overwrites="...)
+	dst = strconv.AppendUint(dst, s.Overwrites, 10)
+	dst = append(dst, " deletes="...)
+	dst = strconv.AppendUint(dst, s.Deletes, 10)
+	dst = append(dst, " negative-cache-hits="...)
+	dst = strconv.AppendUint(dst, s.NegativeCacheHits, 10)
+	dst = append(dst, " resalts="...)
+	dst = strconv.AppendUint(dst, s.Resalts, 10)
+	dst = append(dst, " degenerate-splits="...)
+	dst = strconv.AppendUint(dst, s.DegenerateSplits, 10)
+	dst = append(dst, " hash-calls="...)
+	dst = strconv.AppendUint(dst, s.HashCalls, 10)
+	dst = append(dst, " hash-time-ns="...)
+	dst = strconv.AppendInt(dst, int64(s.HashTime), 10)
+	return dst
+}
+
+// BucketStats describes the state of a single bucket within a Map. See
+// Map.ForEachBucketStats.
+type BucketStats struct {
+	// Index is the index of the first directory entry pointing to the bucket.
+	Index uint32
+	// LocalDepth is the number of high bits of hash(key) used to select the
+	// bucket from the directory.
+	LocalDepth uint32
+	// Used is the number of entries in the bucket.
+	Used uint32
+	// Capacity is the number of slots in the bucket.
+	Capacity uint32
+	// GrowthLeft is the number of entries that can be inserted into the
+	// bucket before it needs to be rehashed, resized, or split.
+	GrowthLeft uint32
+	// Tombstones is the number of deleted slots in the bucket which have not
+	// yet been reclaimed.
+	Tombstones uint32
+}
+
+// ForEachBucketStats calls yield sequentially for each bucket in the map,
+// in directory order. If yield returns false, iteration stops. The map must
+// not be mutated during iteration.
+func (m *Map[K, V]) ForEachBucketStats(yield func(BucketStats) bool) {
+	m.buckets(0, func(b *bucket[K, V]) bool {
+		return yield(b.stats())
+	})
+}
+
 // capacity returns the total capacity of all map buckets.
 func (m *Map[K, V]) capacity() int {
 	var capacity int
@@ -729,7 +3004,10 @@ func (m *Map[K, V]) bucket(h uintptr) *bucket[K, V] {
 	// NB: It is faster to check for the single bucket case using a
 	// conditional than to index into the directory.
 	if m.globalShift == 0 {
-		return &m.bucket0
+		if !m.indirectBucket0() {
+			return &m.bucket0
+		}
+		return m.dir.At(0)
 	}
 	// When shifting by a variable amount the Go compiler inserts overflow
 	// checks that the shift is less than the maximum allowed (32 or 64).
@@ -741,7 +3019,14 @@ func (m *Map[K, V]) mutableBucket(h uintptr) *bucket[K, V] {
 	// NB: It is faster to check for the single bucket case using a
 	// conditional than to to index into the directory.
 	if m.globalShift == 0 {
-		return &m.bucket0
+		b := &m.bucket0
+		if m.indirectBucket0() {
+			b = m.dir.At(0)
+		}
+		if b.shared {
+			return m.unshare(b)
+		}
+		return b
 	}
 	// When shifting by a variable amount the Go compiler inserts overflow
 	// checks that the shift is less than the maximum allowed (32 or 64).
@@ -750,13 +3035,31 @@ func (m *Map[K, V]) mutableBucket(h uintptr) *bucket[K, V] {
 	// The mutable bucket is the one located at m.dir[b.index]. This will
 	// usually be either the current bucket b, or the immediately preceding
 	// bucket which is usually in the same cache line.
-	return m.dir.At(uintptr(b.index))
+	//
+	// NB: Caching metadata in the directory (e.g. a per-entry tag holding
+	// growthLeft) to avoid this indirection was considered, but the
+	// directory already holds buckets by value, so b.localDepth and b.index
+	// are read without a dereference. The mutable fields (used, growthLeft)
+	// change on every Put and Delete and would have to be written to every
+	// directory entry sharing the bucket. See BenchmarkDirectory.
+	b = m.dir.At(uintptr(b.index))
+	if b.shared {
+		b = m.unshare(b)
+	}
+	return b
 }
 
 // buckets calls yield sequentially for each bucket in the map. If yield
 // returns false, iteration stops. Offset specifies the bucket to start
 // iteration at (used to randomize iteration order).
 func (m *Map[K, V]) buckets(offset uintptr, yield func(b *bucket[K, V]) bool) {
+	m.lazyInit()
+
+	// Iteration copes with the directory growing, but not shrinking. See
+	// TryMergeSiblings.
+	m.iterating++
+	defer func() { m.iterating-- }()
+
 	b := m.dir.At(offset & uintptr(m.bucketCount()-1))
 	// We iterate over the first bucket in a logical group of buckets (i.e.
 	// buckets which share bucket.groups). The first bucket has the accurate
@@ -775,7 +3078,7 @@ func (m *Map[K, V]) buckets(offset uintptr, yield func(b *bucket[K, V]) bool) {
 
 	for {
 		originalGlobalDepth := m.globalDepth()
-		originalLocalDepth := b.localDepth
+		originalLocalDepth := uint32(b.localDepth)
 		originalIndex := b.index
 
 		if !yield(b) {
@@ -867,8 +3170,7 @@ func (m *Map[K, V]) globalDepth() uint32 {
 
 // bucketCount returns the number of buckets in the buckets directory.
 func (m *Map[K, V]) bucketCount() uint32 {
-	const shiftMask = 31
-	return uint32(1) << (m.globalDepth() & shiftMask)
+	return uint32(1) << (m.globalDepth() & depthShiftMask)
 }
 
 // bucketStep is the number of buckets to step over in the buckets directory
@@ -877,8 +3179,7 @@ func (m *Map[K, V]) bucketCount() uint32 {
 //
 //	[b.index:b.index+bucketStep(m.globalDepth(), b.localDepth)]
 func bucketStep(globalDepth, localDepth uint32) uint32 {
-	const shiftMask = 31
-	return uint32(1) << ((globalDepth - localDepth) & shiftMask)
+	return uint32(1) << ((globalDepth - localDepth) & depthShiftMask)
 }
 
 // adjustBucketIndex adjusts the index of a bucket to account for the growth
@@ -892,7 +3193,7 @@ func adjustBucketIndex(index, currentGlobalDepth, originalGlobalDepth uint32) ui
 // installBucket installs a bucket into the buckets directory, overwriting
 // every index in the range of entries the bucket occupies.
 func (m *Map[K, V]) installBucket(b *bucket[K, V]) *bucket[K, V] {
-	step := bucketStep(m.globalDepth(), b.localDepth)
+	step := bucketStep(m.globalDepth(), uint32(b.localDepth))
 	for i := uint32(0); i < step; i++ {
 		*m.dir.At(uintptr(b.index + i)) = *b
 	}
@@ -902,9 +3203,9 @@ func (m *Map[K, V]) installBucket(b *bucket[K, V]) *bucket[K, V] {
 // growDirectory grows the directory slice to 1<<newGlobalDepth buckets. Grow
 // directory returns the new index location for the bucket specified by index.
 func (m *Map[K, V]) growDirectory(newGlobalDepth, index uint32) (newIndex uint32) {
-	if invariants && newGlobalDepth > 32 {
-		panic(fmt.Sprintf("invariant failed: expectedly large newGlobalDepth %d->%d",
-			m.globalDepth(), newGlobalDepth))
+	if invariants && newGlobalDepth > maxGlobalDepth {
+		m.panicf("invariant failed: expectedly large newGlobalDepth %d->%d",
+			m.globalDepth(), newGlobalDepth)
 	}
 
 	newDir := makeUnsafeSlice(make([]bucket[K, V], 1<<newGlobalDepth))
@@ -927,7 +3228,7 @@ func (m *Map[K, V]) growDirectory(newGlobalDepth, index uint32) (newIndex uint32
 			setNewIndex = false
 		}
 		b.index = j
-		step := bucketStep(newGlobalDepth, b.localDepth)
+		step := bucketStep(newGlobalDepth, uint32(b.localDepth))
 		for k := uint32(0); k < step; k++ {
 			*newDir.At(uintptr(j + k)) = *b
 		}
@@ -946,46 +3247,315 @@ func (m *Map[K, V]) growDirectory(newGlobalDepth, index uint32) (newIndex uint32
 	return newIndex
 }
 
+// scratchBucket returns space for a bucket which is being constructed before
+// it is installed in the directory. bucket0 is used if it is not in use (the
+// directory contains more than 1 entry) and the map is not configured to keep
+// bucket0 unused (see WithIndirectBucket0). Otherwise a new bucket is
+// allocated.
+func (m *Map[K, V]) scratchBucket() *bucket[K, V] {
+	if m.globalShift == 0 || m.indirectBucket0() {
+		return &bucket[K, V]{}
+	}
+	return &m.bucket0
+}
+
+// shrinkDirectory halves the size of the directory for as long as every
+// bucket occupies 2 or more entries (i.e. has a local depth less than the
+// global depth). If the directory shrinks to a single entry, that bucket is
+// moved to bucket0 (unless the map was configured with WithIndirectBucket0).
+func (m *Map[K, V]) shrinkDirectory() {
+	for m.globalShift != 0 {
+		globalDepth := m.globalDepth()
+		shrink := true
+		m.buckets(0, func(b *bucket[K, V]) bool {
+			shrink = uint32(b.localDepth) < globalDepth
+			return shrink
+		})
+		if !shrink {
+			return
+		}
+
+		newGlobalDepth := globalDepth - 1
+		if newGlobalDepth == 0 && !m.indirectBucket0() {
+			m.bucket0 = *m.dir.At(0)
+			m.dir = makeUnsafeSlice(unsafe.Slice(&m.bucket0, 1))
+			m.globalShift = 0
+			break
+		}
+
+		newDir := makeUnsafeSlice(make([]bucket[K, V], 1<<newGlobalDepth))
+		for i, n := uint32(0), uint32(1)<<newGlobalDepth; i < n; i++ {
+			b := newDir.At(uintptr(i))
+			*b = *m.dir.At(uintptr(2 * i))
+			b.index /= 2
+		}
+		m.dir = newDir
+		m.globalShift = 0
+		if newGlobalDepth > 0 {
+			m.globalShift = ptrBits - newGlobalDepth
+		}
+	}
+
+	m.checkInvariants()
+}
+
+// Validate verifies the internal consistency of the map's structure: that
+// the bucket directory is well formed, that the per-bucket counts of used,
+// deleted, and growth-left slots are consistent with each bucket's capacity,
+// and that Len equals the sum of the per-bucket used counts. Validate
+// requires time proportional to the number of buckets (not the number of
+// entries) and is intended to be called on demand, for example after a
+// sequence of operations in a test or when diagnosing a suspected bug. An
+// error is returned describing the first inconsistency found.
+func (m *Map[K, V]) Validate() error {
+	m.lazyInit()
+	if err := m.validateDirectory(); err != nil {
+		return err
+	}
+	return m.validateUsed()
+}
+
+// validateDirectory verifies the structure of the bucket directory.
+func (m *Map[K, V]) validateDirectory() error {
+	if m.globalShift == 0 {
+		if isBucket0 := m.dir.ptr == unsafe.Pointer(&m.bucket0); !m.indirectBucket0() && !isBucket0 {
+			return fmt.Errorf("directory (%p) does not point to bucket0 (%p)", m.dir.ptr, &m.bucket0)
+		} else if m.indirectBucket0() && isBucket0 {
+			return fmt.Errorf("directory (%p) points to bucket0 with an indirect bucket0", m.dir.ptr)
+		}
+		if b := m.dir.At(0); b.localDepth != 0 {
+			return fmt.Errorf("expected local-depth=0, but found %d", b.localDepth)
+		}
+		return nil
+	}
+
+	for i, n := uint32(0), m.bucketCount(); i < n; i++ {
+		b := m.dir.At(uintptr(i))
+		if b == nil {
+			return fmt.Errorf("dir[%d]: nil bucket", i)
+		}
+		if uint32(b.localDepth) > m.globalDepth() {
+			return fmt.Errorf("dir[%d]: local-depth=%d is greater than global-depth=%d",
+				i, b.localDepth, m.globalDepth())
+		}
+		n := uint32(1) << (m.globalDepth() - uint32(b.localDepth))
+		if i < b.index || i >= b.index+n {
+			return fmt.Errorf("dir[%d]: out of expected range [%d,%d)", i, b.index, b.index+n)
+		}
+	}
+	return nil
+}
+
+// validateUsed verifies that the used count for the map equals the sum of
+// the used counts of its buckets, and that the slot accounting within each
+// bucket is consistent. This is only true when the map is not in the middle
+// of a structural change (i.e. a bucket split).
+func (m *Map[K, V]) validateUsed() error {
+	var used int
+	var err error
+	m.buckets(0, func(b *bucket[K, V]) bool {
+		if b.used+b.growthLeft > (b.capacity*maxAvgGroupLoad)/groupSize {
+			err = fmt.Errorf("bucket %d: used=%d plus growth-left=%d exceeds the load limit of capacity=%d",
+				b.index, b.used, b.growthLeft, b.capacity)
+			return false
+		}
+		used += int(b.used)
+		return true
+	})
+	if err != nil {
+		return err
+	}
+	if used != m.used {
+		return fmt.Errorf("map used=%d, but buckets contain %d entries", m.used, used)
+	}
+	return nil
+}
+
 // checkInvariants verifies the internal consistency of the map's structure,
 // checking conditions that should always be true for a correctly functioning
 // map. If any of these invariants are violated, it panics, indicating a bug
 // in the map implementation.
 func (m *Map[K, V]) checkInvariants() {
 	if invariants {
-		if m.globalShift == 0 {
-			if m.dir.ptr != unsafe.Pointer(&m.bucket0) {
-				panic(fmt.Sprintf("directory (%p) does not point to bucket0 (%p)", m.dir.ptr, &m.bucket0))
-			}
-			if m.bucket0.localDepth != 0 {
-				panic(fmt.Sprintf("expected local-depth=0, but found %d", m.bucket0.localDepth))
-			}
-		} else {
-			for i, n := uint32(0), m.bucketCount(); i < n; i++ {
-				b := m.dir.At(uintptr(i))
-				if b == nil {
-					panic(fmt.Sprintf("dir[%d]: nil bucket", i))
-				}
-				if b.localDepth > m.globalDepth() {
-					panic(fmt.Sprintf("dir[%d]: local-depth=%d is greater than global-depth=%d",
-						i, b.localDepth, m.globalDepth()))
-				}
-				n := uint32(1) << (m.globalDepth() - b.localDepth)
-				if i < b.index || i >= b.index+n {
-					panic(fmt.Sprintf("dir[%d]: out of expected range [%d,%d)", i, b.index, b.index+n))
-				}
-			}
+		if err := m.validateDirectory(); err != nil {
+			m.panicf("%v", err)
 		}
 	}
 }
 
-func (b *bucket[K, V]) close(allocator Allocator[K, V]) {
-	if b.capacity > 0 {
-		allocator.Free(b.groups.Slice(0, uintptr(b.groupMask+1)))
-		b.capacity = 0
-		b.used = 0
+// checkUsedInvariants verifies that the map's used count matches the sum of
+// the bucket used counts, panicking if it does not. Unlike checkInvariants,
+// this may only be called once a structural change to the map has
+// completed. The check requires O(buckets) time, so callers are responsible
+// for only performing it when the cost is warranted by the enabled
+// invariants level.
+func (m *Map[K, V]) checkUsedInvariants() {
+	if err := m.validateUsed(); err != nil {
+		m.panicf("invariant failed: %v\n%#v", err, m)
+	}
+}
+
+func (b *bucket[K, V]) close(m *Map[K, V]) {
+	if b.capacity > 0 {
+		m.freeGroups(b.index, b.groups.Slice(0, uintptr(b.groupCount())))
+		b.capacity = 0
+		b.used = 0
+	}
+	b.groups = makeUnsafeSlice([]Group[K, V](nil))
+	b.groupMask = 0
+}
+
+// allocGroups allocates n groups from the map's allocator (or along with
+// their cached hashes, see allocCachedGroups) for use by the bucket at the specified
+// index.
+func (m *Map[K, V]) allocGroups(index uint32, n int) []Group[K, V] {
+	var groups []Group[K, V]
+	if m.cachedHash() {
+		groups = allocCachedGroups[K, V](n)
+	} else {
+		groups = m.allocator().Alloc(n)
+	}
+	if m.ledger() != nil {
+		m.ledger().alloc(index, unsafe.Pointer(unsafe.SliceData(groups)), n)
+	}
+	return groups
+}
+
+// freeGroups releases groups previously allocated by allocGroups for the
+// bucket at the specified index.
+func (m *Map[K, V]) freeGroups(index uint32, groups []Group[K, V]) {
+	if m.ledger() != nil {
+		m.ledger().free(index, unsafe.Pointer(unsafe.SliceData(groups)), len(groups))
+	}
+	if m.shared() != nil && !m.shared().release(unsafe.Pointer(unsafe.SliceData(groups))) {
+		// The groups are still in use by a snapshot.
+		return
+	}
+	if !m.cachedHash() {
+		m.allocator().Free(groups)
+	}
+}
+
+// unshare gives the map exclusive ownership of the groups of bucket b which
+// may be shared with a snapshot, copying the groups if they are still
+// referenced by another map. It returns the (reinstalled) mutable bucket.
+func (m *Map[K, V]) unshare(b *bucket[K, V]) *bucket[K, V] {
+	b.shared = false
+	old := b.groups.Slice(0, uintptr(b.groupCount()))
+	if m.shared().isShared(unsafe.Pointer(unsafe.SliceData(old))) {
+		// Copy before releasing our reference so that the groups can't be
+		// freed out from under us by another map.
+		groups := m.allocGroups(b.index, len(old))
+		copy(groups, old)
+		m.copyCachedHashes(groups, old)
+		m.freeGroups(b.index, old)
+		b.groups = makeUnsafeSlice(groups)
+	}
+	return m.installBucket(b)
+}
+
+// detachGroups moves the entries of bucket b, which is being iterated over,
+// to newly allocated groups before the bucket is rehashed in place. The
+// iteration continues over the original groups, which are left intact, so
+// that moving entries within the bucket does not cause the iteration to skip
+// or repeat them. A split evacuates such a bucket instead (see bucket.split).
+func (b *bucket[K, V]) detachGroups(m *Map[K, V]) {
+	old := b.groups.Slice(0, uintptr(b.groupCount()))
+	groups := m.allocGroups(b.index, len(old))
+	copy(groups, old)
+	m.copyCachedHashes(groups, old)
+	m.freeGroups(b.index, old)
+	b.groups = makeUnsafeSlice(groups)
+}
+
+// sharedGroups reference counts the group allocations shared between a map
+// and its snapshots. The maps sharing a sharedGroups may be used concurrently
+// from different goroutines, so access is synchronized.
+type sharedGroups struct {
+	mu sync.Mutex
+	// refs holds the number of maps referencing each allocation which has
+	// been shared, keyed by the address of the first group. An allocation
+	// which is not present is referenced by a single map.
+	refs map[unsafe.Pointer]int
+}
+
+// retain adds a reference to the allocation starting at ptr.
+func (s *sharedGroups) retain(ptr unsafe.Pointer) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if n, ok := s.refs[ptr]; ok {
+		s.refs[ptr] = n + 1
+	} else {
+		s.refs[ptr] = 2
+	}
+}
+
+// release removes a reference to the allocation starting at ptr, returning
+// true if it was the last reference.
+func (s *sharedGroups) release(ptr unsafe.Pointer) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	n, ok := s.refs[ptr]
+	switch {
+	case !ok:
+		return true
+	case n <= 2:
+		delete(s.refs, ptr)
+	default:
+		s.refs[ptr] = n - 1
+	}
+	return false
+}
+
+// isShared returns true if the allocation starting at ptr is referenced by
+// more than one map.
+func (s *sharedGroups) isShared(ptr unsafe.Pointer) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	_, ok := s.refs[ptr]
+	return ok
+}
+
+// allocLedger records the allocations obtained from a map's allocator which
+// have not yet been freed, keyed by the address of the first group.
+type allocLedger struct {
+	outstanding map[unsafe.Pointer]int
+	onMismatch  func(error)
+}
+
+func newAllocLedger(onMismatch func(error)) *allocLedger {
+	return &allocLedger{
+		outstanding: make(map[unsafe.Pointer]int),
+		onMismatch:  onMismatch,
+	}
+}
+
+func (l *allocLedger) alloc(index uint32, ptr unsafe.Pointer, n int) {
+	if m, ok := l.outstanding[ptr]; ok {
+		l.mismatch(fmt.Errorf("bucket %d: allocation of %d groups at %p overlaps outstanding allocation of %d groups",
+			index, n, ptr, m))
+	}
+	l.outstanding[ptr] = n
+}
+
+func (l *allocLedger) free(index uint32, ptr unsafe.Pointer, n int) {
+	m, ok := l.outstanding[ptr]
+	switch {
+	case !ok:
+		l.mismatch(fmt.Errorf("bucket %d: free of %d groups at %p which are not outstanding (double free?)",
+			index, n, ptr))
+	case m != n:
+		l.mismatch(fmt.Errorf("bucket %d: free of %d groups at %p, but %d groups were allocated",
+			index, n, ptr, m))
+	}
+	delete(l.outstanding, ptr)
+}
+
+func (l *allocLedger) mismatch(err error) {
+	if l.onMismatch == nil {
+		panic(fmt.Sprintf("invariant failed: %v", err))
 	}
-	b.groups = makeUnsafeSlice([]Group[K, V](nil))
-	b.groupMask = 0
+	l.onMismatch(err)
 }
 
 // tombstones returns the number of deleted (tombstone) entries in the bucket.
@@ -995,37 +3565,157 @@ func (b *bucket[K, V]) tombstones() uint32 {
 	return (b.capacity*maxAvgGroupLoad)/groupSize - b.used - b.growthLeft
 }
 
+// probeMatchesH2 returns true if any slot in the probe sequence for hash h
+// has a control byte matching h2(h). If false is returned, no key with hash h
+// is present in the bucket. The keys of a degenerate bucket are not placed by
+// their hash (see bucket.slotHash), so true is always returned for one.
+func (b *bucket[K, V]) probeMatchesH2(h uintptr) bool {
+	if b.salt >= degenerateSalt {
+		return true
+	}
+	seq := b.probe(h)
+	for ; ; seq = seq.next() {
+		g := b.groups.At(uintptr(seq.offset))
+		if g.ctrls.matchH2(h2(h)) != 0 {
+			return true
+		}
+		if g.ctrls.matchEmpty() != 0 {
+			return false
+		}
+	}
+}
+
+func (b *bucket[K, V]) stats() BucketStats {
+	return BucketStats{
+		Index:      b.index,
+		LocalDepth: uint32(b.localDepth),
+		Used:       b.used,
+		Capacity:   b.capacity,
+		GrowthLeft: b.growthLeft,
+		Tombstones: b.tombstones(),
+	}
+}
+
 // uncheckedPut inserts an entry known not to be in the table. Used by Put
 // after it has failed to find an existing entry to overwrite duration
-// insertion.
-func (b *bucket[K, V]) uncheckedPut(h uintptr, key K, value V) {
+// insertion. It returns the group and index of the slot holding the entry.
+func (b *bucket[K, V]) uncheckedPut(m *Map[K, V], h uintptr, key K, value V) (*Group[K, V], uint32) {
 	if invariants && b.growthLeft == 0 {
-		panic(fmt.Sprintf("invariant failed: growthLeft is unexpectedly 0\n%#v", b))
+		m.panicf("invariant failed: growthLeft is unexpectedly 0\n%s", m.bucketString(b))
 	}
 
 	// Given key and its hash hash(key), to insert it, we construct a
 	// probeSeq, and use it to find the first group with an unoccupied (empty
 	// or deleted) slot. We place the key/value into the first such slot in
 	// the group and mark it as full with key's H2.
-	seq := makeProbeSeq(h1(h), b.groupMask)
+	return b.placeNew(b.slotHash(m, (*K)(noescape(unsafe.Pointer(&key))), h), key, value)
+}
+
+// placeNew is uncheckedPut without the invariant check, for use by code
+// which operates on a bucket outside of a Map (see SmallMap). The bucket
+// must have room left to grow.
+func (b *bucket[K, V]) placeNew(h uintptr, key K, value V) (*Group[K, V], uint32) {
+	// Given key and its hash hash(key), to insert it, we construct a
+	// probeSeq, and use it to find the first group with an unoccupied (empty
+	// or deleted) slot. We place the key/value into the first such slot in
+	// the group and mark it as full with key's H2.
+	seq := b.probe(h)
 	for ; ; seq = seq.next() {
 		g := b.groups.At(uintptr(seq.offset))
 		match := g.ctrls.matchEmptyOrDeleted()
 		if match != 0 {
 			i := match.first()
-			slot := g.slots.At(i)
-			slot.key = key
-			slot.value = value
-			if g.ctrls.Get(i) == ctrlEmpty {
-				b.growthLeft--
+			b.setSlot(g, i, h, key, value)
+			return g, i
+		}
+	}
+}
+
+// setSlot stores key and value in the empty or deleted slot i of group g,
+// marking it as full with the h2 of hash h. Inserting into an empty slot
+// consumes growthLeft, while reusing a tombstone does not. The caller is
+// responsible for incrementing used.
+func (b *bucket[K, V]) setSlot(g *Group[K, V], i uint32, h uintptr, key K, value V) {
+	g.slots.Set(i, key, value)
+	if g.ctrls.Get(i) == ctrlEmpty {
+		b.growthLeft--
+	}
+	g.ctrls.Set(i, ctrl(h2(h)))
+}
+
+// find walks the probe sequence of hash h looking for key, comparing keys
+// with equal (see keyEqual). If the key is found, the slot holding it is
+// slot i of group g at index offset within the bucket. Otherwise g and i
+// identify the first empty or deleted slot in the probe sequence, where key
+// would be inserted, or g is nil if there is no such slot (i.e. the bucket
+// is empty).
+func (b *bucket[K, V]) find(key K, h uintptr, equal equalFn) (g *Group[K, V], offset, i uint32, found bool) {
+	seq := b.probe(h)
+	for ; ; seq = seq.next() {
+		pg := b.groups.At(uintptr(seq.offset))
+		match := pg.ctrls.matchH2(h2(h))
+
+		for match != 0 {
+			j := match.first()
+			if keyEqual(equal, key, pg.slots.Key(j)) {
+				return pg, seq.offset, j, true
 			}
-			g.ctrls.Set(i, ctrl(h2(h)))
-			return
+			match = match.removeFirst()
+		}
+
+		if g == nil {
+			if match := pg.ctrls.matchEmptyOrDeleted(); match != 0 {
+				g, offset, i = pg, seq.offset, match.first()
+			}
+		}
+
+		if pg.ctrls.matchEmpty() != 0 {
+			return g, offset, i, false
+		}
+	}
+}
+
+// lookup returns the value of key, which has hash h, or nil if the key is
+// not present in the bucket. Keys are compared with equal (see keyEqual).
+func (b *bucket[K, V]) lookup(key K, h uintptr, equal equalFn) *V {
+	seq := b.probe(h)
+	for ; ; seq = seq.next() {
+		g := b.groups.At(uintptr(seq.offset))
+		match := g.ctrls.matchH2(h2(h))
+		for match != 0 {
+			i := match.first()
+			if keyEqual(equal, key, g.slots.Key(i)) {
+				return g.slots.Value(i)
+			}
+			match = match.removeFirst()
+		}
+		if g.ctrls.matchEmpty() != 0 {
+			return nil
 		}
 	}
 }
 
-func (b *bucket[K, V]) rehash(m *Map[K, V]) {
+// deleteSlot removes the entry in slot i of group g, which must be full.
+func (b *bucket[K, V]) deleteSlot(g *Group[K, V], i uint32) {
+	b.used--
+	g.slots.Clear(i)
+
+	// See the comment in Map.Delete for why a tombstone is only needed if
+	// the group is full.
+	if g.ctrls.matchEmpty() != 0 {
+		g.ctrls.Set(i, ctrlEmpty)
+		b.growthLeft++
+	} else {
+		g.ctrls.Set(i, ctrlDeleted)
+	}
+}
+
+// rehash makes room in the bucket for an insertion by dropping tombstones,
+// resizing, or splitting the bucket. It returns the mutable bucket in which
+// an entry with hash h now resides: the receiver unless the bucket was split
+// and h belongs in the new bucket (or the bucket was replaced by the new
+// bucket).
+func (b *bucket[K, V]) rehash(m *Map[K, V], h uintptr) *bucket[K, V] {
 	// Rehash in place if we can recover >= 1/3 of the capacity. Note that
 	// this heuristic differs from Abseil's and was experimentally determined
 	// to balance performance on the PutDelete benchmark vs achieving a
@@ -1040,20 +3730,42 @@ func (b *bucket[K, V]) rehash(m *Map[K, V]) {
 	// called if we've reached the thresold of capacity/8 empty slots. So the
 	// number of tomstones is capacity*7/8 - used.
 	if b.capacity > groupSize && b.tombstones() >= b.capacity/3 {
+		// If a significant fraction of the entries could not be placed in
+		// the first group of their probe sequence the keys are clustering.
+		// When this happens repeatedly we change the bucket's salt and
+		// rehash again in order to spread the keys across different probe
+		// sequences. Note that the salt only affects probing within the
+		// bucket, so the bucket's position in the directory is unaffected.
+		if displaced := b.rehashInPlace(m); displaced <= b.used/clusteredFraction {
+			b.inPlaceRehashes = 0
+			return b
+		}
+		b.inPlaceRehashes++
+		if b.inPlaceRehashes < resaltThreshold {
+			return b
+		}
+		salt := b.salt &^ degenerateSalt
+		if salt <= 1 {
+			salt = maxSalt
+		} else {
+			salt--
+		}
+		b.salt = b.salt&degenerateSalt | salt
+		b.inPlaceRehashes = 0
+		m.resalts++
 		b.rehashInPlace(m)
-		return
+		return m.installBucket(b)
 	}
 
 	// If the newCapacity is larger than the maxBucketCapacity split the
 	// bucket instead of resizing. Each of the new buckets will be the same
-	// size as the current bucket.
-	newCapacity := 2 * b.capacity
-	if newCapacity > m.maxBucketCapacity {
-		b.split(m)
-		return
+	// size as the current bucket. A bucket at maxGlobalDepth can't be split.
+	newCapacity := m.grownCapacity(b.capacity)
+	if newCapacity > m.maxBucketCapacity && uint32(b.localDepth) < maxGlobalDepth {
+		return b.split(m, h, false)
 	}
 
-	b.resize(m, newCapacity)
+	return b.resize(m, newCapacity)
 }
 
 func (b *bucket[K, V]) init(m *Map[K, V], newCapacity uint32) {
@@ -1061,80 +3773,285 @@ func (b *bucket[K, V]) init(m *Map[K, V], newCapacity uint32) {
 		newCapacity = groupSize
 	}
 
-	if invariants && newCapacity&(newCapacity-1) != 0 {
-		panic(fmt.Sprintf("invariant failed: bucket size %d is not a power of 2", newCapacity))
+	if invariants && newCapacity%groupSize != 0 {
+		m.panicf("invariant failed: bucket size %d is not a multiple of %d", newCapacity, groupSize)
 	}
 
-	b.capacity = newCapacity
-	b.groupMask = b.capacity/groupSize - 1
-	b.groups = makeUnsafeSlice(m.allocator.Alloc(int(b.groupMask + 1)))
+	// Allocate before modifying the bucket so that the bucket is left intact
+	// if the allocator panics.
+	groups := m.allocGroups(b.index, int(newCapacity/groupSize))
+	b.setGroups(groups)
+	b.shared = false
 
-	for i := uint32(0); i <= b.groupMask; i++ {
-		g := b.groups.At(uintptr(i))
-		g.ctrls.SetEmpty()
+	if invariants && uintptr(b.groups.ptr)&7 != 0 {
+		m.panicf("invariant failed: groups %p are not 8-byte aligned", b.groups.ptr)
 	}
+}
 
+// setGroups replaces the groups of the bucket with the newly allocated
+// groups, setting the capacity to match and marking every slot empty. The
+// entries in the old groups are not moved (see reinsert).
+func (b *bucket[K, V]) setGroups(groups []Group[K, V]) {
+	groupCount := uint32(len(groups))
+	b.capacity = groupCount * groupSize
+	b.groupMask = normalizeCapacity(groupCount) - 1
+	b.groups = makeUnsafeSlice(groups)
+	for i := range groups {
+		groups[i].ctrls.SetEmpty()
+	}
 	b.resetGrowthLeft()
 }
 
+// reinsert inserts the entries in the first n of the groups, which are not
+// present in the bucket, into the bucket, which must have room for them.
+// hash and seed are the hash function and seed of the bucket's keys.
+func (b *bucket[K, V]) reinsert(groups unsafeSlice[Group[K, V]], n uint32, hash hashFn, seed uintptr) {
+	for i := uint32(0); i < n; i++ {
+		g := groups.At(uintptr(i))
+		for j := uint32(0); j < groupSize; j++ {
+			if (g.ctrls.Get(j) & ctrlEmpty) == ctrlEmpty {
+				continue
+			}
+			k := g.slots.Key(j)
+			b.placeNew(hash(noescape(unsafe.Pointer(k)), seed), *k, *g.slots.Value(j))
+		}
+	}
+}
+
 // resize the capacity of the table by allocating a bigger array and
 // uncheckedPutting each element of the table into the new array (we know that
 // no insertion here will Put an already-present value), and discard the old
-// backing array.
-func (b *bucket[K, V]) resize(m *Map[K, V], newCapacity uint32) {
+// backing array. The resized bucket is returned.
+func (b *bucket[K, V]) resize(m *Map[K, V], newCapacity uint32) *bucket[K, V] {
 	if invariants && b != m.dir.At(uintptr(b.index)) {
-		panic(fmt.Sprintf("invariant failed: attempt to resize bucket %p, but it is not at Map.dir[%d/%p]",
-			b, b.index, m.dir.At(uintptr(b.index))))
+		m.panicf("invariant failed: attempt to resize bucket %p, but it is not at Map.dir[%d/%p]",
+			b, b.index, m.dir.At(uintptr(b.index)))
 	}
 
 	oldGroups := b.groups
-	oldGroupMask := b.groupMask
+	oldGroupCount := b.groupCount()
 	oldCapacity := b.capacity
 	b.init(m, newCapacity)
+	b.inPlaceRehashes = 0
 
 	if oldCapacity > 0 {
-		for i := uint32(0); i <= oldGroupMask; i++ {
-			g := oldGroups.At(uintptr(i))
-			for j := uint32(0); j < groupSize; j++ {
-				if (g.ctrls.Get(j) & ctrlEmpty) == ctrlEmpty {
-					continue
-				}
-				slot := g.slots.At(j)
-				h := m.hash(noescape(unsafe.Pointer(&slot.key)), m.seed)
-				b.uncheckedPut(h, slot.key, slot.value)
+		if m.cachedHash() {
+			m.reinsertCached(b, oldGroups, oldGroupCount)
+		} else {
+			hash, seed := m.hash, m.seed
+			if b.salt >= degenerateSalt {
+				hash, seed = m.degenerateHash(), m.degenerateSeed()
 			}
+			b.reinsert(oldGroups, oldGroupCount, hash, seed)
 		}
-
-		m.allocator.Free(oldGroups.Slice(0, uintptr(oldGroupMask+1)))
+		m.freeGroups(b.index, oldGroups.Slice(0, uintptr(oldGroupCount)))
 	}
 
 	b = m.installBucket(b)
 	b.checkInvariants(m)
+	if invariantsExhaustive {
+		m.checkUsedInvariants()
+	}
+	return b
+}
+
+// reserve grows the bucket, if necessary, so that n entries can be inserted
+// without rehashing, returning true on success. False is returned if the
+// bucket would need to grow past the maximum bucket capacity, in which case
+// it needs to be split.
+func (b *bucket[K, V]) reserve(m *Map[K, V], n uint32) bool {
+	if b.growthLeft >= n {
+		return true
+	}
+	targetCapacity := (uint64(b.used+n)*groupSize + maxAvgGroupLoad - 1) / maxAvgGroupLoad
+	if targetCapacity > uint64(m.maxBucketCapacity) {
+		return false
+	}
+	newCapacity := normalizeCapacity(uint32(targetCapacity))
+	if newCapacity < b.capacity {
+		// The bucket has room for the entries once its tombstones are
+		// dropped.
+		newCapacity = b.capacity
+	}
+	b = b.resize(m, newCapacity)
+	return b.growthLeft >= n
+}
+
+// reserve grows and splits the buckets in which entries with the specified
+// hashes would be inserted so that all of the entries can be inserted
+// without rehashing (and thus without allocating). The hashes must be of
+// keys which are not present in the map, and the buckets must not be shared
+// with a snapshot.
+func (m *Map[K, V]) reserve(hashes []uintptr) {
+	if len(hashes) == 0 {
+		return
+	}
+	// Group the hashes by bucket. Splitting a bucket only divides its own
+	// hashes between it and its sibling, so each bucket's hashes remain
+	// adjacent as the buckets are reserved in turn. The hashes are ordered by
+	// a longer prefix than the directory index when buckets will need to be
+	// split to hold them, so that the hashes of the buckets created by the
+	// splits are also adjacent (see reserveBucket).
+	depth := m.globalDepth()
+	for n := uint64(len(hashes)); n > uint64(m.maxBucketCapacity) && depth < maxReservePrefixDepth; n >>= 1 {
+		depth++
+	}
+	sorted := make([]uintptr, len(hashes))
+	for i, j := range orderByPrefix(hashes, depth) {
+		sorted[i] = hashes[j]
+	}
+	for len(sorted) > 0 {
+		index := m.bucket(sorted[0]).index
+		n := 1
+		for n < len(sorted) && m.bucket(sorted[n]).index == index {
+			n++
+		}
+		m.reserveBucket(sorted[:n])
+		sorted = sorted[n:]
+	}
+}
+
+// reserveBucket is reserve for hashes which are all in the same bucket. The
+// hashes are reordered.
+//
+// A split which leaves every hash on one side indicates that the hashes
+// include duplicates: a key which is repeated (e.g. in the keys passed to
+// PutBatch) inserts a single entry, so the duplicates are dropped and the
+// bucket is reserved for the distinct hashes. Splitting stops if a split
+// leaves every distinct hash on one side, or once the bucket has been split
+// maxReservePrefixDepth times: the hashes then share a longer prefix than
+// splitting can separate within that bound (e.g. a degenerate hash
+// function), and further splits would only grow the directory. The bucket
+// is left as it is, and inserting its entries falls back to growing and
+// splitting the bucket as Put does.
+func (m *Map[K, V]) reserveBucket(hashes []uintptr) {
+	m.reserveBucketDepth(hashes, maxReservePrefixDepth)
+}
+
+// reserveBucketDepth is reserveBucket, splitting the bucket at most splits
+// times.
+func (m *Map[K, V]) reserveBucketDepth(hashes []uintptr, splits int) {
+	compacted := false
+	for ; len(hashes) > 0; splits-- {
+		index := m.bucket(hashes[0]).index
+		b := m.dir.At(uintptr(index))
+		if b.reserve(m, uint32(len(hashes))) || splits == 0 ||
+			uint32(b.localDepth) >= maxGlobalDepth {
+			return
+		}
+		b.split(m, 0, true)
+
+		// Partition the hashes between the bucket and its new sibling (the
+		// split may have grown the directory and changed the bucket's
+		// index), and reserve the sibling's separately. If the hashes are
+		// ordered by a long enough prefix (see reserve), the bucket's hashes
+		// precede its sibling's and the partitioning leaves them in order.
+		index = m.bucket(hashes[0]).index
+		n := 1
+		for i := 1; i < len(hashes); i++ {
+			if m.bucket(hashes[i]).index == index {
+				hashes[n], hashes[i] = hashes[i], hashes[n]
+				n++
+			}
+		}
+		if n == len(hashes) {
+			if compacted {
+				return
+			}
+			// Sorting the hashes keeps them ordered by prefix.
+			slices.Sort(hashes)
+			hashes = slices.Compact(hashes)
+			compacted = true
+			continue
+		}
+		m.reserveBucketDepth(hashes[n:], splits-1)
+		hashes = hashes[:n]
+	}
+}
+
+// maxReservePrefixDepth is the maximum length of the hash prefix by which
+// Map.reserve orders hashes beyond the directory's global depth, and the
+// maximum number of times reserveBucket splits a bucket.
+const maxReservePrefixDepth = 16
+
+// orderByBucket returns the indexes of hashes ordered by the directory index
+// of each hash, so that the hashes in the same bucket are adjacent. The order
+// of the hashes with the same directory index is preserved.
+func (m *Map[K, V]) orderByBucket(hashes []uintptr) []int {
+	return orderByPrefix(hashes, m.globalDepth())
+}
+
+// orderByPrefix returns the indexes of hashes ordered by the high depth bits
+// of each hash. The order of the hashes with the same prefix is preserved.
+func orderByPrefix(hashes []uintptr, depth uint32) []int {
+	order := make([]int, len(hashes))
+	if depth == 0 {
+		for i := range order {
+			order[i] = i
+		}
+		return order
+	}
+	// A counting sort on the prefix.
+	shift := (ptrBits - depth) & shiftMask
+	offsets := make([]int, 1<<depth+1)
+	for _, h := range hashes {
+		offsets[(h>>shift)+1]++
+	}
+	for i := 1; i < len(offsets); i++ {
+		offsets[i] += offsets[i-1]
+	}
+	for i, h := range hashes {
+		j := h >> shift
+		order[offsets[j]] = i
+		offsets[j]++
+	}
+	return order
 }
 
 // split divides the entries in a bucket between the receiver and a new bucket
 // of the same size, and then installs the new bucket into the buckets
-// directory, growing the buckets directory if necessary.
-func (b *bucket[K, V]) split(m *Map[K, V]) {
+// directory, growing the buckets directory if necessary. The bucket in which
+// an entry with hash h resides after the split is returned.
+//
+// If presize is true the split is being performed to make room for entries
+// which have not been inserted yet (see Map.reserve) and either bucket may be
+// left empty. Otherwise an empty bucket indicates that maxBucketCapacity is
+// too small or that the hash function is degenerate, and the bucket is
+// resized rather than split, after being marked degenerate if its entries
+// have few distinct hashes (see bucket.markDegenerate).
+func (b *bucket[K, V]) split(m *Map[K, V], h uintptr, presize bool) *bucket[K, V] {
 	if invariants && b != m.dir.At(uintptr(b.index)) {
-		panic(fmt.Sprintf("invariant failed: attempt to split bucket %p, but it is not at Map.dir[%d/%p]",
-			b, b.index, m.dir.At(uintptr(b.index))))
+		m.panicf("invariant failed: attempt to split bucket %p, but it is not at Map.dir[%d/%p]",
+			b, b.index, m.dir.At(uintptr(b.index)))
 	}
 
-	// Create the new bucket as a clone of the bucket being split. If we're
-	// splitting bucket0 we need to allocate a *bucket[K, V] for scratch
-	// space. Otherwise we use bucket0 as the scratch space.
-	var newb *bucket[K, V]
-	if m.globalShift == 0 {
-		newb = &bucket[K, V]{}
-	} else {
-		newb = &m.bucket0
-	}
+	// Create the new bucket as a clone of the bucket being split. The groups
+	// of the new bucket are allocated when the first record is moved to it,
+	// so that a split which moves no records (see below) does not allocate.
+	newb := m.scratchBucket()
 	*newb = bucket[K, V]{
 		localDepth: b.localDepth,
+		salt:       b.salt & degenerateSalt,
 		index:      b.index,
 	}
-	newb.init(m, b.capacity)
+
+	// If b is being iterated over (see Map.iterate), its groups are left
+	// untouched so that the iteration yields each of their records exactly
+	// once: b is given newly allocated groups, and every record is evacuated
+	// from the old groups into either b or newb. Otherwise the records which
+	// stay in b are left in place. Evacuating on every split would double the
+	// number of allocations performed by splitting, and a split could only
+	// make progress if both allocations succeeded, so it is only done when
+	// necessary.
+	groups, groupCount := b.groups, b.groupCount()
+	hashes := m.cachedHashes(groups, groupCount)
+	evacuate := m.iterGroups != nil && groups.ptr == m.iterGroups
+	if evacuate {
+		newb.init(m, b.capacity)
+		b.used = 0
+		b.inPlaceRehashes = 0
+		b.init(m, b.capacity)
+	}
 
 	// Divide the records between the 2 buckets (b and newb). This is done by
 	// examining the new bit in the hash that will be added to the bucket
@@ -1142,24 +4059,45 @@ func (b *bucket[K, V]) split(m *Map[K, V]) {
 	// the record is moved to bucket newb. We're relying on the bucket b
 	// staying earlier in the directory than newb after the directory is
 	// grown.
-	mask := uintptr(1) << (ptrBits - (b.localDepth + 1))
-	for i := uint32(0); i <= b.groupMask; i++ {
-		g := b.groups.At(uintptr(i))
+	mask := uintptr(1) << (ptrBits - (uint32(b.localDepth) + 1))
+	for i := uint32(0); i < groupCount; i++ {
+		g := groups.At(uintptr(i))
 		for j := uint32(0); j < groupSize; j++ {
 			if (g.ctrls.Get(j) & ctrlEmpty) == ctrlEmpty {
 				continue
 			}
 
-			s := g.slots.At(j)
-			h := m.hash(noescape(unsafe.Pointer(&s.key)), m.seed)
+			k, v := g.slots.Key(j), g.slots.Value(j)
+			var h uintptr
+			if hashes != nil {
+				h = hashes[i*groupSize+j]
+			} else {
+				h = m.hash(noescape(unsafe.Pointer(k)), m.seed)
+			}
 			if (h & mask) == 0 {
-				// Nothing to do, the record is staying in b.
+				// The record is staying in b.
+				if evacuate {
+					ng, ni := b.uncheckedPut(m, h, *k, *v)
+					if hashes != nil {
+						m.cacheHash(b, ng, ni, h)
+					}
+					b.used++
+				}
 				continue
 			}
 
 			// Insert the record into newb.
-			newb.uncheckedPut(h, s.key, s.value)
+			if newb.capacity == 0 {
+				newb.init(m, b.capacity)
+			}
+			ng, ni := newb.uncheckedPut(m, h, *k, *v)
+			if hashes != nil {
+				m.cacheHash(newb, ng, ni, h)
+			}
 			newb.used++
+			if evacuate {
+				continue
+			}
 
 			// Delete the record from b.
 			if g.ctrls.matchEmpty() != 0 {
@@ -1169,52 +4107,54 @@ func (b *bucket[K, V]) split(m *Map[K, V]) {
 				g.ctrls.Set(j, ctrlDeleted)
 			}
 
-			*s = slot[K, V]{}
+			g.slots.Clear(j)
 			b.used--
 		}
 	}
 
-	if newb.used == 0 {
+	if evacuate {
+		m.freeGroups(b.index, groups.Slice(0, uintptr(groupCount)))
+	}
+
+	if newb.used == 0 && !presize {
 		// We didn't move any records to the new bucket. Either
 		// maxBucketCapacity is too small and we got unlucky, or we have a
 		// degenerate hash function (e.g. one that returns a constant in the
 		// high bits).
 		m.maxBucketCapacity = 2 * m.maxBucketCapacity
-		newb.close(m.allocator)
+		m.options().degenerateSplits++
+		newb.close(m)
 		*newb = bucket[K, V]{}
-		b.resize(m, 2*b.capacity)
-		return
+		b.markDegenerate(m)
+		return b.resize(m, 2*b.capacity)
+	}
+	if newb.capacity == 0 {
+		// A presizing split which moved no records still installs the new
+		// bucket, which needs room for the records to come.
+		newb.init(m, b.capacity)
 	}
 
-	if b.used == 0 {
+	if b.used == 0 && !presize {
 		// We moved all of the records to the new bucket (note the two
 		// conditions are equivalent and both are present merely for clarity).
 		// Similar to the above, bump maxBucketCapacity and resize the bucket
 		// rather than splitting. We'll replace the old bucket with the new
 		// bucket in the directory.
 		m.maxBucketCapacity = 2 * m.maxBucketCapacity
-		b.close(m.allocator)
+		m.options().degenerateSplits++
+		b.close(m)
+		newb.markDegenerate(m)
 		newb = m.installBucket(newb)
 		m.checkInvariants()
-		newb.resize(m, 2*newb.capacity)
-		return
+		return newb.resize(m, 2*newb.capacity)
 	}
 
-	// We need to ensure bucket b, which we evacuated records from, has empty
-	// slots as we may be inserting into it. We also want to drop any
-	// tombstones that may have been left in bucket to ensure lookups for
-	// non-existent keys don't have to traverse long probe chains. With a good
-	// hash function, 50% of the entries in b should have been moved to newb,
-	// so we should be able to drop tombstones corresponding to ~50% of the
-	// entries.
-	b.rehashInPlace(m)
-
 	// Grow the directory if necessary.
-	if b.localDepth >= m.globalDepth() {
+	if uint32(b.localDepth) >= m.globalDepth() {
 		// When the directory grows b will be invalidated. We pass in b's
 		// index so that growDirectory will return the new index it resides
 		// at.
-		i := m.growDirectory(b.localDepth+1, b.index)
+		i := m.growDirectory(uint32(b.localDepth)+1, b.index)
 		b = m.dir.At(uintptr(i))
 	}
 
@@ -1223,26 +4163,93 @@ func (b *bucket[K, V]) split(m *Map[K, V]) {
 	b.localDepth++
 	m.installBucket(b)
 	newb.localDepth = b.localDepth
-	newb.index = b.index + bucketStep(m.globalDepth(), b.localDepth)
-	m.installBucket(newb)
+	newb.index = b.index + bucketStep(m.globalDepth(), uint32(b.localDepth))
+	b.checkInvariants(m)
+	nb := m.installBucket(newb)
+	nb.checkInvariants(m)
+
+	// We need to ensure bucket b, which we evacuated records from, has empty
+	// slots as we may be inserting into it. We also want to drop any
+	// tombstones that may have been left in bucket to ensure lookups for
+	// non-existent keys don't have to traverse long probe chains. With a good
+	// hash function, 50% of the entries in b should have been moved to newb,
+	// so we should be able to drop tombstones corresponding to ~50% of the
+	// entries. This is done after both buckets have been installed so that
+	// the map-wide used counts are consistent when rehashInPlace checks them.
+	// An evacuated bucket has no tombstones.
+	if !evacuate {
+		b.rehashInPlace(m)
+		b.inPlaceRehashes = 0
+		m.installBucket(b)
+	}
 	*newb = bucket[K, V]{}
 
-	if invariants {
+	if invariantsExhaustive {
 		m.checkInvariants()
+		m.checkUsedInvariants()
 		m.buckets(0, func(b *bucket[K, V]) bool {
 			b.checkInvariants(m)
 			return true
 		})
 	}
+
+	if (h & mask) != 0 {
+		return nb
+	}
+	return b
+}
+
+// markDegenerate marks the bucket, which a split failed to divide, as
+// degenerate (see degenerateSalt) if its entries have fewer than one distinct
+// hash per group's worth of entries. Such entries would fill long probe
+// sequences no matter how large the bucket grows, as keys with the same hash
+// share a probe sequence. The caller must resize the bucket, which places
+// its entries by the fallback hash function. A map which compares keys with
+// a function specified by WithKeyEqual has no fallback hash function
+// consistent with its key equality, so its buckets are never degenerate.
+func (b *bucket[K, V]) markDegenerate(m *Map[K, V]) {
+	if m.equal() != nil || b.salt >= degenerateSalt {
+		return
+	}
+	hashes := make([]uintptr, 0, b.used)
+	cached := m.cachedHashes(b.groups, b.groupCount())
+	for i, n := uint32(0), b.groupCount(); i < n; i++ {
+		g := b.groups.At(uintptr(i))
+		for j := uint32(0); j < groupSize; j++ {
+			if (g.ctrls.Get(j) & ctrlEmpty) == ctrlEmpty {
+				continue
+			}
+			if cached != nil {
+				hashes = append(hashes, cached[i*groupSize+j])
+			} else {
+				hashes = append(hashes, m.hash(noescape(unsafe.Pointer(g.slots.Key(j))), m.seed))
+			}
+		}
+	}
+	slices.Sort(hashes)
+	if len(slices.Compact(hashes))*groupSize > int(b.used) {
+		return
+	}
+	if m.degenerateHash() == nil {
+		o := m.options()
+		o.degenerateHash, o.degenerateSeed = newHasher[K]()
+	}
+	b.salt |= degenerateSalt
 }
 
-func (b *bucket[K, V]) rehashInPlace(m *Map[K, V]) {
+// rehashInPlace drops the tombstones in the bucket without resizing it,
+// returning the number of entries which could not be placed in the first
+// group of their probe sequence.
+func (b *bucket[K, V]) rehashInPlace(m *Map[K, V]) (displaced uint32) {
 	if invariants && b != m.dir.At(uintptr(b.index)) {
-		panic(fmt.Sprintf("invariant failed: attempt to rehash bucket %p, but it is not at Map.dir[%d/%p]",
-			b, b.index, m.dir.At(uintptr(b.index))))
+		m.panicf("invariant failed: attempt to rehash bucket %p, but it is not at Map.dir[%d/%p]",
+			b, b.index, m.dir.At(uintptr(b.index)))
 	}
 	if b.capacity == 0 {
-		return
+		return 0
+	}
+	if m.iterGroups != nil && b.groups.ptr == m.iterGroups {
+		b.detachGroups(m)
 	}
 
 	// We want to drop all of the deletes in place. We first walk over the
@@ -1252,10 +4259,13 @@ func (b *bucket[K, V]) rehashInPlace(m *Map[K, V]) {
 	// slots as DELETED gives us a marker to locate the previously FULL slots.
 
 	// Mark all DELETED slots as EMPTY and all FULL slots as DELETED.
-	for i := uint32(0); i <= b.groupMask; i++ {
+	for i, n := uint32(0), b.groupCount(); i < n; i++ {
 		b.groups.At(uintptr(i)).ctrls.convertNonFullToEmptyAndFullToDeleted()
 	}
 
+	// The cached hashes (if any) are moved along with the entries.
+	hashes := m.cachedHashes(b.groups, b.groupCount())
+
 	// Now we walk over all of the DELETED slots (a.k.a. the previously FULL
 	// slots). For each slot we find the first probe group we can place the
 	// element in which reestablishes the probe invariant. Note that as this
@@ -1263,16 +4273,27 @@ func (b *bucket[K, V]) rehashInPlace(m *Map[K, V]) {
 	// the range [0, i). We may move the element at i to the range [0, i) if
 	// that is where the first group with an empty slot in its probe chain
 	// resides, but we never set a slot in [0, i) to DELETED.
-	for i := uint32(0); i <= b.groupMask; i++ {
+	for i, n := uint32(0), b.groupCount(); i < n; i++ {
 		g := b.groups.At(uintptr(i))
 		for j := uint32(0); j < groupSize; j++ {
 			if g.ctrls.Get(j) != ctrlDeleted {
 				continue
 			}
 
-			s := g.slots.At(j)
-			h := m.hash(noescape(unsafe.Pointer(&s.key)), m.seed)
-			seq := makeProbeSeq(h1(h), b.groupMask)
+			// h is the key's hash, which is cached, and sh the hash which
+			// places it within the bucket (see bucket.slotHash).
+			var h, sh uintptr
+			switch {
+			case hashes != nil:
+				h = hashes[i*groupSize+j]
+				sh = b.slotHash(m, g.slots.Key(j), h)
+			case b.salt >= degenerateSalt:
+				sh = m.degenerateHash()(noescape(unsafe.Pointer(g.slots.Key(j))), m.degenerateSeed())
+			default:
+				h = m.hash(noescape(unsafe.Pointer(g.slots.Key(j))), m.seed)
+				sh = h
+			}
+			seq := b.probe(sh)
 			desiredOffset := seq.offset
 
 			var targetGroup *Group[K, V]
@@ -1290,31 +4311,43 @@ func (b *bucket[K, V]) rehashInPlace(m *Map[K, V]) {
 				// If the target index falls within the first probe group
 				// then we don't need to move the element as it already
 				// falls in the best probe position.
-				g.ctrls.Set(j, ctrl(h2(h)))
+				g.ctrls.Set(j, ctrl(h2(sh)))
 
 			case targetGroup.ctrls.Get(target) == ctrlEmpty:
 				// The target slot is empty. Transfer the element to the
 				// empty slot and mark the slot at index i as empty.
-				targetGroup.ctrls.Set(target, ctrl(h2(h)))
-				*targetGroup.slots.At(target) = *s
-				*s = slot[K, V]{}
+				if seq.offset != desiredOffset {
+					displaced++
+				}
+				targetGroup.ctrls.Set(target, ctrl(h2(sh)))
+				targetGroup.slots.Set(target, *g.slots.Key(j), *g.slots.Value(j))
+				g.slots.Clear(j)
 				g.ctrls.Set(j, ctrlEmpty)
+				if hashes != nil {
+					hashes[seq.offset*groupSize+target] = h
+				}
 
 			case targetGroup.ctrls.Get(target) == ctrlDeleted:
 				// The slot at target has an element (i.e. it was FULL).
 				// We're going to swap our current element with that
 				// element and then repeat processing of index i which now
 				// holds the element which was at target.
-				targetGroup.ctrls.Set(target, ctrl(h2(h)))
-				t := targetGroup.slots.At(target)
-				*s, *t = *t, *s
+				if seq.offset != desiredOffset {
+					displaced++
+				}
+				targetGroup.ctrls.Set(target, ctrl(h2(sh)))
+				g.slots.Swap(j, &targetGroup.slots, target)
+				if hashes != nil {
+					k := seq.offset*groupSize + target
+					hashes[i*groupSize+j], hashes[k] = hashes[k], h
+				}
 				// Repeat processing of the j'th slot which now holds a
 				// new key/value.
 				j--
 
 			default:
-				panic(fmt.Sprintf("ctrl at position %d (%02x) should be empty or deleted",
-					target, targetGroup.ctrls.Get(target)))
+				m.panicf("ctrl at position %d (%02x) should be empty or deleted",
+					target, targetGroup.ctrls.Get(target))
 			}
 		}
 	}
@@ -1323,6 +4356,25 @@ func (b *bucket[K, V]) rehashInPlace(m *Map[K, V]) {
 	b.growthLeft -= b.used
 
 	b.checkInvariants(m)
+	if invariantsExhaustive {
+		m.checkUsedInvariants()
+	}
+	return displaced
+}
+
+// clear removes all of the entries and tombstones from the bucket, retaining
+// its groups. The bucket must not be shared with a snapshot.
+func (b *bucket[K, V]) clear() {
+	// Zero the groups in a single pass (which releases any pointers held by
+	// the slots), and then mark each group's slots as empty with a single
+	// write.
+	groups := b.groups.Slice(0, uintptr(b.groupCount()))
+	clear(groups)
+	for i := range groups {
+		groups[i].ctrls.SetEmpty()
+	}
+	b.used = 0
+	b.resetGrowthLeft()
 }
 
 func (b *bucket[K, V]) resetGrowthLeft() {
@@ -1330,8 +4382,9 @@ func (b *bucket[K, V]) resetGrowthLeft() {
 	if b.capacity <= groupSize {
 		// If the map fits in a single group then we're able to fill all of
 		// the slots except 1 (an empty slot is needed to terminate find
-		// operations).
-		growthLeft = int(b.capacity - 1)
+		// operations), within the maximum load factor which limits a 16 slot
+		// group (see the swiss_sse2 build tag) to 14 entries.
+		growthLeft = min(int(b.capacity)-1, int((b.capacity*maxAvgGroupLoad)/groupSize))
 	} else {
 		growthLeft = int((b.capacity * maxAvgGroupLoad) / groupSize)
 	}
@@ -1345,7 +4398,7 @@ func (b *bucket[K, V]) resetGrowthLeft() {
 // performance problem with BenchmarkGetMiss.
 func (b *bucket[K, V]) fullGroups() uint32 {
 	var full uint32
-	for i := uint32(0); i <= b.groupMask; i++ {
+	for i, n := uint32(0), b.groupCount(); i < n; i++ {
 		g := b.groups.At(uintptr(i))
 		if g.ctrls.matchEmpty() == 0 {
 			full++
@@ -1354,14 +4407,31 @@ func (b *bucket[K, V]) fullGroups() uint32 {
 	return full
 }
 
+// checkInvariants verifies the internal consistency of the bucket. The O(1)
+// slot accounting checks are performed when built with invariants enabled,
+// while the checks which examine every slot in the bucket are only performed
+// when built with exhaustive invariants enabled.
 func (b *bucket[K, V]) checkInvariants(m *Map[K, V]) {
 	if invariants {
-		// For every non-empty slot, verify we can retrieve the key using Get.
-		// Count the number of used and deleted slots.
+		if b.used+b.growthLeft > (b.capacity*maxAvgGroupLoad)/groupSize {
+			m.panicf("invariant failed: used=%d plus growth-left=%d exceeds the load limit of capacity=%d",
+				b.used, b.growthLeft, b.capacity)
+		}
+		if uint32(b.localDepth) > m.globalDepth() {
+			m.panicf("invariant failed: local-depth=%d is greater than global-depth=%d",
+				b.localDepth, m.globalDepth())
+		}
+	}
+
+	if invariantsExhaustive {
+		// For every non-empty slot, verify we can retrieve the key, as Get
+		// would. Get itself is not used as it can have side effects (see
+		// WithOpLog and WithMoveToFront). Count the number of used and
+		// deleted slots.
 		var used uint32
 		var deleted uint32
 		var empty uint32
-		for i := uint32(0); i <= b.groupMask; i++ {
+		for i, n := uint32(0), b.groupCount(); i < n; i++ {
 			g := b.groups.At(uintptr(i))
 			for j := uint32(0); j < groupSize; j++ {
 				c := g.ctrls.Get(j)
@@ -1371,34 +4441,45 @@ func (b *bucket[K, V]) checkInvariants(m *Map[K, V]) {
 				case c == ctrlEmpty:
 					empty++
 				default:
-					slot := g.slots.At(j)
-					if _, ok := m.Get(slot.key); !ok {
-						h := m.hash(noescape(unsafe.Pointer(&slot.key)), m.seed)
-						panic(fmt.Sprintf("invariant failed: slot(%d/%d): %v not found [h2=%02x h1=%07x]\n%#v",
-							i, j, slot.key, h2(h), h1(h), b))
-					}
 					used++
+					key := *g.slots.Key(j)
+					if !keyEqual(m.equal(), key, (*K)(noescape(unsafe.Pointer(&key)))) {
+						// A key which is not equal to itself (e.g. a NaN
+						// float) can never be found, and is hashed randomly.
+						continue
+					}
+					h := m.hash(noescape(unsafe.Pointer(&key)), m.seed)
+					if !m.find(key).found || (m.negCache() != nil && m.negCache().contains(h)) {
+						m.panicf("invariant failed: slot(%d/%d): %s not found [h2=%02x h1=%07x]\n%s",
+							i, j, m.keyString(key), h2(h), h1(h), m.bucketString(b))
+					}
+					if hashes := m.cachedHashes(b.groups, b.groupCount()); hashes != nil && hashes[i*groupSize+j] != h {
+						m.panicf("invariant failed: slot(%d/%d): %s has cached hash %x, but hash %x\n%s",
+							i, j, m.keyString(key), hashes[i*groupSize+j], h, m.bucketString(b))
+					}
 				}
 			}
 		}
 
 		if used != b.used {
-			panic(fmt.Sprintf("invariant failed: found %d used slots, but used count is %d\n%#v",
-				used, b.used, b))
+			m.panicf("invariant failed: found %d used slots, but used count is %d\n%s",
+				used, b.used, m.bucketString(b))
 		}
 
 		growthLeft := (b.capacity*maxAvgGroupLoad)/groupSize - b.used - deleted
 		if growthLeft != b.growthLeft {
-			panic(fmt.Sprintf("invariant failed: found %d growthLeft, but expected %d\n%#v",
-				b.growthLeft, growthLeft, b))
+			m.panicf("invariant failed: found %d growthLeft, but expected %d\n%s",
+				b.growthLeft, growthLeft, m.bucketString(b))
 		}
 		if deleted != b.tombstones() {
-			panic(fmt.Sprintf("invariant failed: found %d tombstones, but expected %d\n%#v",
-				deleted, b.tombstones(), b))
+			m.panicf("invariant failed: found %d tombstones, but expected %d\n%s",
+				deleted, b.tombstones(), m.bucketString(b))
 		}
 
-		if empty == 0 {
-			panic(fmt.Sprintf("invariant failed: found no empty slots (violates probe invariant)\n%#v", b))
+		// NB: An empty bucket has no groups of its own (its groups are the
+		// shared emptyCtrls).
+		if empty == 0 && b.capacity > 0 {
+			m.panicf("invariant failed: found no empty slots (violates probe invariant)\n%s", m.bucketString(b))
 		}
 	}
 }
@@ -1407,13 +4488,15 @@ func (b *bucket[K, V]) checkInvariants(m *Map[K, V]) {
 // formatting using the "%#v" format specifier.
 func (b *bucket[K, V]) GoString() string {
 	var buf strings.Builder
-	b.goFormat(&buf)
+	b.goFormat(&buf, nil)
 	return buf.String()
 }
 
-func (b *bucket[K, V]) goFormat(w io.Writer) {
+// goFormat writes the contents of the bucket to w, formatting keys with
+// formatKey if it is non-nil (see WithKeyFormatter).
+func (b *bucket[K, V]) goFormat(w io.Writer, formatKey func(K) string) {
 	fmt.Fprintf(w, "capacity=%d  used=%d  growth-left=%d\n", b.capacity, b.used, b.growthLeft)
-	for i := uint32(0); i <= b.groupMask; i++ {
+	for i, n := uint32(0), b.groupCount(); i < n; i++ {
 		g := b.groups.At(uintptr(i))
 		fmt.Fprintf(w, "  group %d\n", i)
 		for j := uint32(0); j < groupSize; j++ {
@@ -1423,46 +4506,61 @@ func (b *bucket[K, V]) goFormat(w io.Writer) {
 			case ctrlDeleted:
 				fmt.Fprintf(w, "    %d: %02x [deleted]\n", j, c)
 			default:
-				slot := g.slots.At(j)
-				fmt.Fprintf(w, "    %d: %02x [%v:%v]\n", j, c, slot.key, slot.value)
+				key, value := *g.slots.Key(j), *g.slots.Value(j)
+				if formatKey != nil {
+					fmt.Fprintf(w, "    %d: %02x [%s:%v]\n", j, c, formatKey(key), value)
+				} else {
+					fmt.Fprintf(w, "    %d: %02x [%v:%v]\n", j, c, key, value)
+				}
 			}
 		}
 	}
 }
 
-// bitset represents a set of slots within a group.
+// negativeCache is a small fixed-size cache of the hashes of keys which were
+// recently looked up and found to not be present in the map. The cache is
+// indexed by h2(hash), so an entry holds a hash whose low h2Bits equal its
+// index. An empty entry holds a value whose low h2Bits differ from its index
+// (and thus can never equal the hash of a key indexing that entry).
 //
-// The underlying representation uses one byte per slot, where each byte is
-// either 0x80 if the slot is part of the set or 0x00 otherwise. This makes it
-// convenient to calculate for an entire group at once (e.g. see matchEmpty).
-type bitset uint64
+// A hash is only added to the cache if no slot in the key's probe sequence
+// has a matching h2, which proves that no key with the same hash is present
+// in the map. A cached hash remains valid until a key with that hash is
+// inserted (see remove) or the hash seed changes (see reset). Deleting keys,
+// and resizing or splitting buckets never invalidates a cached hash as those
+// operations do not add keys to the map.
+type negativeCache [1 << h2Bits]uintptr
+
+func newNegativeCache() *negativeCache {
+	c := &negativeCache{}
+	c.reset()
+	return c
+}
 
-// first assumes that only the MSB of each control byte can be set (e.g. bitset
-// is the result of matchEmpty or similar) and returns the relative index of the
-// first control byte in the group that has the MSB set.
-//
-// Returns 8 if the bitset is 0.
-// Returns groupSize if the bitset is empty.
-func (b bitset) first() uint32 {
-	return uint32(bits.TrailingZeros64(uint64(b))) >> 3
+// reset empties the cache.
+func (c *negativeCache) reset() {
+	for i := range c {
+		c[i] = uintptr(i) ^ 1
+	}
 }
 
-// removeFirst removes the first set bit (that is, resets the least significant set bit to 0).
-func (b bitset) removeFirst() bitset {
-	return b & (b - 1)
+// contains returns true if a key with hash h is known to not be present.
+func (c *negativeCache) contains(h uintptr) bool {
+	return c[h2(h)] == h
 }
 
-func (b bitset) String() string {
-	var buf strings.Builder
-	buf.Grow(groupSize)
-	for i := 0; i < groupSize; i++ {
-		if (b & (bitset(0x80) << (i << 3))) != 0 {
-			buf.WriteString("1")
-		} else {
-			buf.WriteString("0")
-		}
+// remove removes h from the cache. It must be called before inserting a key
+// with hash h into the map.
+func (c *negativeCache) remove(h uintptr) {
+	if i := h2(h); c[i] == h {
+		c[i] = i ^ 1
 	}
-	return buf.String()
+}
+
+// add adds h to the cache. The caller must have verified that no key with
+// hash h is present in the map.
+func (c *negativeCache) add(h uintptr) {
+	c[h2(h)] = h
 }
 
 // Each slot in the hash table has a control byte which can have one of three
@@ -1473,91 +4571,11 @@ func (b bitset) String() string {
 //	   full: 0 h h h h h h h  // h represents the H1 hash bits
 type ctrl uint8
 
-// ctrlGroup is a fixed size array of groupSize control bytes stored in a
-// uint64.
-type ctrlGroup uint64
-
 // Get returns the i-th control byte.
 func (g *ctrlGroup) Get(i uint32) ctrl {
 	return *(*ctrl)(unsafe.Add(unsafe.Pointer(g), i))
 }
 
-// Set sets the i-th control byte.
-func (g *ctrlGroup) Set(i uint32, c ctrl) {
-	*(*ctrl)(unsafe.Add(unsafe.Pointer(g), i)) = c
-}
-
-// SetEmpty sets all the control bytes to empty.
-func (g *ctrlGroup) SetEmpty() {
-	*g = ctrlGroup(bitsetEmpty)
-}
-
-// matchH2 returns the set of slots which are full and for which the 7-bit hash
-// matches the given value. May return false positives.
-func (g *ctrlGroup) matchH2(h uintptr) bitset {
-	// NB: This generic matching routine produces false positive matches when
-	// h is 2^N and the control bytes have a seq of 2^N followed by 2^N+1. For
-	// example: if ctrls==0x0302 and h=02, we'll compute v as 0x0100. When we
-	// subtract off 0x0101 the first 2 bytes we'll become 0xffff and both be
-	// considered matches of h. The false positive matches are not a problem,
-	// just a rare inefficiency. Note that they only occur if there is a real
-	// match and never occur on ctrlEmpty, or ctrlDeleted. The subsequent key
-	// comparisons ensure that there is no correctness issue.
-	v := uint64(*g) ^ (bitsetLSB * uint64(h))
-	return bitset(((v - bitsetLSB) &^ v) & bitsetMSB)
-}
-
-// matchEmpty returns the set of slots in the group that are empty.
-func (g *ctrlGroup) matchEmpty() bitset {
-	// An empty slot is   1000 0000
-	// A deleted slot is  1111 1110
-	// A full slot is     0??? ????
-	//
-	// A slot is empty iff bit 7 is set and bit 1 is not. We could select any
-	// of the other bits here (e.g. v << 1 would also work).
-	v := uint64(*g)
-	return bitset((v &^ (v << 6)) & bitsetMSB)
-}
-
-// matchEmptyOrDeleted returns the set of slots in the group that are empty or
-// deleted.
-func (g *ctrlGroup) matchEmptyOrDeleted() bitset {
-	// An empty slot is  1000 0000
-	// A deleted slot is 1111 1110
-	// A full slot is    0??? ????
-	//
-	// A slot is empty or deleted iff bit 7 is set and bit 0 is not.
-	v := uint64(*g)
-	return bitset((v &^ (v << 7)) & bitsetMSB)
-}
-
-// convertNonFullToEmptyAndFullToDeleted converts deleted control bytes in a
-// group to empty control bytes, and control bytes indicating full slots to
-// deleted control bytes.
-func (g *ctrlGroup) convertNonFullToEmptyAndFullToDeleted() {
-	// An empty slot is     1000 0000
-	// A deleted slot is    1111 1110
-	// A full slot is       0??? ????
-	//
-	// We select the MSB, invert, add 1 if the MSB was set and zero out the low
-	// bit.
-	//
-	//  - if the MSB was set (i.e. slot was empty, or deleted):
-	//     v:             1000 0000
-	//     ^v:            0111 1111
-	//     ^v + (v >> 7): 1000 0000
-	//     &^ bitsetLSB:  1000 0000 = empty slot.
-	//
-	// - if the MSB was not set (i.e. full slot):
-	//     v:             0000 0000
-	//     ^v:            1111 1111
-	//     ^v + (v >> 7): 1111 1111
-	//     &^ bitsetLSB:  1111 1110 = deleted slot.
-	//
-	v := uint64(*g) & bitsetMSB
-	*g = ctrlGroup((^v + (v >> 7)) &^ bitsetLSB)
-}
-
 func (g *ctrlGroup) String() string {
 	var buf strings.Builder
 	buf.Grow(groupSize)
@@ -1568,29 +4586,6 @@ func (g *ctrlGroup) String() string {
 	return buf.String()
 }
 
-// slotGroup is a fixed size array of groupSize slots.
-//
-// The keys and values are stored interleaved in slots with a memory layout
-// that looks like K/V/K/V/K/V/K/V.../K/V. An alternate layout would be have
-// parallel arrays of keys and values: K/K/K/K.../K/V/V/V/V.../V. The latter
-// has better space utilization if you have something like uint64 keys and
-// bool values, but it is measurably slower at large map sizes. Below shows
-// this perf hit with a Map[uint64,uint64]. The problem is due to the key and
-// value being stored in separate cache lines.
-//
-// MapGetHit/swissMap/Int64/262144-10    9.31ns ± 3%  10.04ns ± 3%   +7.81%  (p=0.008 n=5+5)
-// MapGetHit/swissMap/Int64/524288-10    16.7ns ± 1%   18.2ns ± 3%   +8.98%  (p=0.008 n=5+5)
-// MapGetHit/swissMap/Int64/1048576-10   24.7ns ± 2%   27.6ns ± 0%  +11.74%  (p=0.008 n=5+5)
-// MapGetHit/swissMap/Int64/2097152-10   33.3ns ± 1%   37.7ns ± 1%  +13.12%  (p=0.008 n=5+5)
-// MapGetHit/swissMap/Int64/4194304-10   36.6ns ± 0%   43.0ns ± 1%  +17.37%  (p=0.008 n=5+5)
-type slotGroup[K comparable, V any] struct {
-	slots [groupSize]slot[K, V]
-}
-
-func (g *slotGroup[K, V]) At(i uint32) *slot[K, V] {
-	return (*slot[K, V])(unsafe.Add(unsafe.Pointer(&g.slots[0]), uintptr(i)*unsafe.Sizeof(g.slots[0])))
-}
-
 // emptyCtrls is a singleton for a single empty groupSize set of controls.
 var emptyCtrls = func() []ctrl {
 	var v [groupSize]ctrl
@@ -1611,40 +4606,114 @@ var emptyCtrls = func() []ctrl {
 // It turns out that this probe sequence visits every group exactly once if
 // the number of groups is a power of two, since (i^2+i)/2 is a bijection in
 // Z/(2^m). See https://en.wikipedia.org/wiki/Quadratic_probing
+//
+// If the number of groups is not a power of two (see WithGrowthFactor), mask
+// is the number of groups rounded up to a power of two, minus 1, and offsets
+// greater than last (the index of the last group) are skipped. The sequence
+// still visits every group exactly once.
 type probeSeq struct {
 	mask   uint32
+	last   uint32
 	offset uint32
 	index  uint32
 }
 
-func makeProbeSeq(hash uintptr, mask uint32) probeSeq {
-	return probeSeq{
+func makeProbeSeq(hash uintptr, mask, last uint32) probeSeq {
+	s := probeSeq{
 		mask:   mask,
+		last:   last,
 		offset: uint32(hash) & mask,
 		index:  0,
 	}
+	if s.offset > s.last {
+		s = s.next()
+	}
+	return s
 }
 
 func (s probeSeq) next() probeSeq {
-	s.index++
-	s.offset = (s.offset + s.index) & s.mask
-	return s
+	for {
+		s.index++
+		s.offset = (s.offset + s.index) & s.mask
+		if s.offset <= s.last {
+			return s
+		}
+	}
 }
 
 func (s probeSeq) String() string {
-	return fmt.Sprintf("mask=%d offset=%d index=%d", s.mask, s.offset, s.index)
+	return fmt.Sprintf("mask=%d last=%d offset=%d index=%d", s.mask, s.last, s.offset, s.index)
+}
+
+// probe returns the probe sequence for hash h within the bucket.
+//
+// The rotation by the bucket's salt is a single instruction and is applied
+// unconditionally. Skipping it for unsalted buckets (the common case) was
+// measured to make no difference to lookup performance.
+func (b *bucket[K, V]) probe(h uintptr) probeSeq {
+	// NB: For an empty bucket capacity is 0 and the index of the last group
+	// wraps around to the maximum uint32, which permits the single empty
+	// group at offset 0.
+	return makeProbeSeq(h1(uintptr(bits.RotateLeft(uint(h), int(b.salt)))), b.groupMask,
+		b.capacity/groupSize-1)
+}
+
+// slotHash returns the hash which determines the probe sequence and h2 of
+// key, whose hash is h, within the bucket. This is h unless the bucket is
+// degenerate (see degenerateSalt), in which case the key is hashed with the
+// map's fallback hash function.
+func (b *bucket[K, V]) slotHash(m *Map[K, V], key *K, h uintptr) uintptr {
+	if b.salt < degenerateSalt {
+		return h
+	}
+	return m.degenerateHash()(noescape(unsafe.Pointer(key)), m.degenerateSeed())
+}
+
+// groupCount returns the number of groups in the bucket, which is 0 for an
+// empty bucket.
+func (b *bucket[K, V]) groupCount() uint32 {
+	return b.capacity / groupSize
 }
 
-// Extracts the H1 portion of a hash: the 57 upper bits.
+// Extracts the H1 portion of a hash: the 57 upper bits (with the default
+// h2Bits of 7), or the 25 upper bits of a 32-bit hash.
+//
+// The bits of a hash are divided between the directory, the probe sequence,
+// and h2. The high localDepth bits select the bucket, the low bits of h1
+// select the group at which a probe sequence starts within the bucket (see
+// bucket.probe), and the low h2Bits bits are h2. The entries of a bucket
+// share their high localDepth bits, so if the probe bits overlap them the
+// probe sequences of the bucket start in fewer distinct groups, which
+// lengthens them. A bucket of 2^k groups overlaps when localDepth+k+h2Bits
+// exceeds ptrBits. With 64-bit hashes this does not happen in practice. With
+// 32-bit hashes and buckets of the default max capacity (512 groups) it
+// happens at a local depth above 16, i.e. in maps of roughly 2^16 buckets
+// of ~3500 entries, which approaches the limit of a 32-bit address space.
 func h1(h uintptr) uintptr {
-	return h >> 7
+	return h >> h2Bits
 }
 
-// Extracts the H2 portion of a hash: the 7 bits not used for h1.
+// Extracts the H2 portion of a hash: the h2Bits (7 by default) bits not used
+// for h1.
 //
 // These are used as an occupied control byte.
 func h2(h uintptr) uintptr {
-	return h & 0x7f
+	return h & h2Mask
+}
+
+// equalFn reports whether the keys pointed to by a and b are equal.
+type equalFn func(a, b unsafe.Pointer) bool
+
+// keyEqual reports whether key is equal to the key pointed to by k, with
+// equal if it is non-nil (see WithKeyEqual) and otherwise with ==. Checking
+// for a nil equal is cheap compared to the comparison itself, and keeps ==
+// inlined in the find loops for maps which do not specify an equality
+// function.
+func keyEqual[K comparable](equal equalFn, key K, k *K) bool {
+	if equal == nil {
+		return key == *k
+	}
+	return equal(noescape(unsafe.Pointer(&key)), unsafe.Pointer(k))
 }
 
 // noescape hides a pointer from escape analysis.  noescape is
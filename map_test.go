@@ -15,10 +15,22 @@
 package swiss
 
 import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"encoding/gob"
+	"errors"
 	"fmt"
+	"hash/fnv"
+	"io"
 	"math"
+	"math/bits"
 	"math/rand"
+	"slices"
 	"sort"
+	"strconv"
+	"strings"
+	"sync"
 	"testing"
 	"time"
 	"unsafe"
@@ -37,11 +49,19 @@ func unsafeCtrlGroup(ctrls []ctrl) *ctrlGroup {
 	return (*ctrlGroup)(unsafe.Pointer(unsafe.SliceData(ctrls)))
 }
 
-// toBuiltinMap returns the elements as a map[K]V. Useful for testing.
-func (m *Map[K, V]) toBuiltinMap() map[K]V {
-	r := make(map[K]V)
-	m.All(func(k K, v V) bool {
-		r[k] = v
+// skipUnlessGroupSize8 skips a test whose expectations are derived from the
+// default 8 slot groups (see the swiss_sse2 build tag).
+func skipUnlessGroupSize8(t *testing.T) {
+	if groupSize != 8 {
+		t.Skipf("expectations assume 8 slot groups, not %d", groupSize)
+	}
+}
+
+// bucketStats returns the stats for every bucket in the map.
+func (m *Map[K, V]) bucketStats() []BucketStats {
+	var r []BucketStats
+	m.ForEachBucketStats(func(s BucketStats) bool {
+		r = append(r, s)
 		return true
 	})
 	return r
@@ -61,18 +81,33 @@ func (m *Map[K, V]) randElement() (key K, value V, ok bool) {
 	return
 }
 
-func TestLittleEndian(t *testing.T) {
+func TestByteOrder(t *testing.T) {
 	// The implementation of group h2 matching and group empty and deleted
-	// masking assumes a little endian CPU architecture. Assert that we are
-	// running on one.
+	// masking byte swaps the control bytes on a big endian CPU architecture.
+	// Assert that bigEndian matches the architecture we are running on.
 	b := []uint8{0x1, 0x2, 0x3, 0x4}
 	v := *(*uint32)(unsafe.Pointer(&b[0]))
-	require.EqualValues(t, 0x04030201, v)
+	if bigEndian {
+		require.EqualValues(t, 0x01020304, v)
+	} else {
+		require.EqualValues(t, 0x04030201, v)
+	}
+
+	// The control byte set in slot i is read back from slot i, and is the
+	// only slot matched.
+	for i := uint32(0); i < groupSize; i++ {
+		var g ctrlGroup
+		g.SetEmpty()
+		g.Set(i, 0x5)
+		require.Equal(t, ctrl(0x5), g.Get(i))
+		require.Equal(t, []uint32{i}, slotsOf(g.matchH2(0x5)))
+		require.Equal(t, []uint32{i}, slotsOf(g.matchFull()))
+	}
 }
 
 func TestProbeSeq(t *testing.T) {
 	genSeq := func(n int, hash uintptr, mask uint32) []uint32 {
-		seq := makeProbeSeq(hash, mask)
+		seq := makeProbeSeq(hash, mask, mask)
 		vals := make([]uint32, n)
 		for i := 0; i < n; i++ {
 			vals[i] = seq.offset
@@ -105,34 +140,196 @@ func TestProbeSeq(t *testing.T) {
 	}
 }
 
+func TestProbeSeqPartial(t *testing.T) {
+	// When the number of groups is not a power of 2 the probe sequence skips
+	// the offsets past the last group, but still visits every group exactly
+	// once.
+	for groups := uint32(1); groups <= 64; groups++ {
+		mask := normalizeCapacity(groups) - 1
+		for hash := uintptr(0); hash <= uintptr(mask); hash++ {
+			seq := makeProbeSeq(hash, mask, groups-1)
+			seen := make(map[uint32]bool)
+			for i := uint32(0); i < groups; i++ {
+				require.Less(t, seq.offset, groups)
+				require.False(t, seen[seq.offset], "offset %d visited twice", seq.offset)
+				seen[seq.offset] = true
+				seq = seq.next()
+			}
+		}
+	}
+}
+
+// ctrlsOf returns a group of control bytes holding ctrls, followed by pad
+// for the remainder of the group.
+func ctrlsOf(pad ctrl, ctrls ...ctrl) []ctrl {
+	for len(ctrls) < groupSize {
+		ctrls = append(ctrls, pad)
+	}
+	return ctrls
+}
+
+// slotsOf returns the indexes of the slots in b.
+func slotsOf(b bitset) []uint32 {
+	var slots []uint32
+	for ; b != 0; b = b.removeFirst() {
+		slots = append(slots, b.first())
+	}
+	return slots
+}
+
 func TestMatchH2(t *testing.T) {
-	ctrls := []ctrl{0x1, 0x2, 0x3, 0x4, 0x5, 0x6, 0x7, 0x8}
-	for i := uintptr(1); i <= 8; i++ {
+	ctrls := make([]ctrl, groupSize)
+	for i := range ctrls {
+		ctrls[i] = ctrl(i + 1)
+	}
+	for i := uintptr(1); i <= groupSize; i++ {
 		match := unsafeCtrlGroup(ctrls).matchH2(i)
 		bit := match.first()
 		require.EqualValues(t, i-1, bit)
 	}
 }
 
+func TestMatchH2Exact(t *testing.T) {
+	if groupSize == 8 {
+		// The example of a false positive from the comment in matchH2SWAR.
+		ctrls := ctrlsOf(ctrlEmpty, 0x2, 0x3)
+		require.Equal(t, bitset(0x8080), unsafeCtrlGroup(ctrls).matchH2SWAR(2))
+		require.Equal(t, bitset(0x80), unsafeCtrlGroup(ctrls).matchH2Exact(2))
+	}
+
+	for i := 0; i < 10000; i++ {
+		ctrls := make([]ctrl, groupSize)
+		for j := range ctrls {
+			switch r := rand.Intn(10); {
+			case r == 0:
+				ctrls[j] = ctrlEmpty
+			case r == 1:
+				ctrls[j] = ctrlDeleted
+			default:
+				ctrls[j] = ctrl(rand.Intn(4))
+			}
+		}
+		h := uintptr(rand.Intn(4))
+
+		var expected []uint32
+		for j := range ctrls {
+			if ctrls[j] == ctrl(h) {
+				expected = append(expected, uint32(j))
+			}
+		}
+		g := unsafeCtrlGroup(ctrls)
+		exact := g.matchH2Exact(h)
+		require.Equal(t, expected, slotsOf(exact))
+		// The SWAR routine may produce false positives, but never false
+		// negatives.
+		require.Equal(t, exact, g.matchH2SWAR(h)&exact)
+	}
+}
+
+func TestMatchNEON(t *testing.T) {
+	if !neonMatch {
+		t.Skip("requires the swiss_neon build tag on arm64")
+	}
+	for i := 0; i < 10000; i++ {
+		ctrls := make([]ctrl, groupSize)
+		for j := range ctrls {
+			switch r := rand.Intn(10); {
+			case r == 0:
+				ctrls[j] = ctrlEmpty
+			case r == 1:
+				ctrls[j] = ctrlDeleted
+			default:
+				ctrls[j] = ctrl(rand.Intn(4))
+			}
+		}
+		h := uintptr(rand.Intn(4))
+
+		var expectedH2, expectedEmptyOrDeleted []uint32
+		for j := range ctrls {
+			if ctrls[j] == ctrl(h) {
+				expectedH2 = append(expectedH2, uint32(j))
+			}
+			if ctrls[j]&ctrlEmpty != 0 {
+				expectedEmptyOrDeleted = append(expectedEmptyOrDeleted, uint32(j))
+			}
+		}
+		g := unsafeCtrlGroup(ctrls)
+		require.Equal(t, expectedH2, slotsOf(matchH2NEON(g, h)))
+		require.Equal(t, expectedEmptyOrDeleted, slotsOf(matchEmptyOrDeletedNEON(g)))
+	}
+}
+
+func TestFindWide(t *testing.T) {
+	if !wideProbe || wideProbeGroups == 0 {
+		t.Skip("requires the swiss_avx build tag and AVX2 on amd64")
+	}
+	maxGroups := wideProbeGroups
+	defer func() { wideProbeGroups = maxGroups }()
+
+	for _, n := range []int{4, 8} {
+		if n > maxGroups {
+			continue
+		}
+		t.Run(fmt.Sprintf("groups=%d", n), func(t *testing.T) {
+			wideProbeGroups = n
+			m := New[int, int](0, WithMaxBucketCapacity[int, int](math.MaxUint32))
+			for i := 0; i < 10000; i++ {
+				m.Put(i, i)
+			}
+			// Leave tombstones in the probe sequences.
+			for i := 0; i < 10000; i += 3 {
+				m.Delete(i)
+			}
+			b := m.bucket(0)
+			require.True(t, b.probeWide())
+			for i := -1000; i < 11000; i++ {
+				h := m.hash(noescape(unsafe.Pointer(&i)), m.seed)
+				g, _, j, found := b.find(i, h, nil)
+				wg, wj, wfound := b.findWide(i, h, nil)
+				require.Equal(t, found, wfound, "key %d", i)
+				if found {
+					require.Equal(t, g, wg)
+					require.Equal(t, j, wj)
+				}
+				v, ok := m.Get(i)
+				require.Equal(t, found, ok)
+				if ok {
+					require.Equal(t, i, v)
+				}
+			}
+		})
+	}
+}
+
 func TestMatchEmpty(t *testing.T) {
 	testCases := []struct {
 		ctrls    []ctrl
 		expected []uint32
 	}{
-		{[]ctrl{0x1, 0x2, 0x3, 0x4, 0x5, 0x6, 0x7, 0x8}, nil},
-		{[]ctrl{0x1, 0x2, 0x3, ctrlEmpty, 0x5, ctrlDeleted, 0x7, 0x8}, []uint32{3}},
-		{[]ctrl{0x1, 0x2, 0x3, ctrlEmpty, 0x5, 0x6, ctrlEmpty, 0x8}, []uint32{3, 6}},
+		{ctrlsOf(0x9, 0x1, 0x2, 0x3, 0x4, 0x5, 0x6, 0x7, 0x8), nil},
+		{ctrlsOf(0x9, 0x1, 0x2, 0x3, ctrlEmpty, 0x5, ctrlDeleted, 0x7, 0x8), []uint32{3}},
+		{ctrlsOf(0x9, 0x1, 0x2, 0x3, ctrlEmpty, 0x5, 0x6, ctrlEmpty, 0x8), []uint32{3, 6}},
 	}
 	for _, c := range testCases {
 		t.Run("", func(t *testing.T) {
 			match := unsafeCtrlGroup(c.ctrls).matchEmpty()
-			var results []uint32
-			for match != 0 {
-				idx := match.first()
-				results = append(results, idx)
-				match = match.removeFirst()
-			}
-			require.Equal(t, c.expected, results)
+			require.Equal(t, c.expected, slotsOf(match))
+		})
+	}
+}
+
+func TestMatchFull(t *testing.T) {
+	testCases := []struct {
+		ctrls    []ctrl
+		expected []uint32
+	}{
+		{ctrlsOf(ctrlEmpty, ctrlEmpty, ctrlEmpty, ctrlDeleted, ctrlEmpty, ctrlEmpty, ctrlEmpty, ctrlDeleted, ctrlEmpty), nil},
+		{ctrlsOf(ctrlEmpty, 0x1, 0x2, ctrlEmpty, ctrlDeleted, 0x5, 0x6, 0x7, ctrlEmpty), []uint32{0, 1, 4, 5, 6}},
+	}
+	for _, c := range testCases {
+		t.Run("", func(t *testing.T) {
+			match := unsafeCtrlGroup(c.ctrls).matchFull()
+			require.Equal(t, c.expected, slotsOf(match))
 		})
 	}
 }
@@ -142,19 +339,13 @@ func TestMatchEmptyOrDeleted(t *testing.T) {
 		ctrls    []ctrl
 		expected []uint32
 	}{
-		{[]ctrl{0x1, 0x2, 0x3, 0x4, 0x5, 0x6, 0x7, 0x8}, nil},
-		{[]ctrl{0x1, 0x2, ctrlEmpty, ctrlDeleted, 0x5, 0x6, 0x7, ctrlEmpty}, []uint32{2, 3, 7}},
+		{ctrlsOf(0x9, 0x1, 0x2, 0x3, 0x4, 0x5, 0x6, 0x7, 0x8), nil},
+		{ctrlsOf(0x9, 0x1, 0x2, ctrlEmpty, ctrlDeleted, 0x5, 0x6, 0x7, ctrlEmpty), []uint32{2, 3, 7}},
 	}
 	for _, c := range testCases {
 		t.Run("", func(t *testing.T) {
 			match := unsafeCtrlGroup(c.ctrls).matchEmptyOrDeleted()
-			var results []uint32
-			for match != 0 {
-				idx := match.first()
-				results = append(results, idx)
-				match = match.removeFirst()
-			}
-			require.Equal(t, c.expected, results)
+			require.Equal(t, c.expected, slotsOf(match))
 		})
 	}
 }
@@ -182,19 +373,38 @@ func TestConvertNonFullToEmptyAndFullToDeleted(t *testing.T) {
 	}
 }
 
-func bitsetFromString(t *testing.T, str string) bitset {
-	require.Equal(t, 8, len(str))
-	var b bitset
-	for i := 0; i < 8; i++ {
-		require.True(t, str[i] == '0' || str[i] == '1')
-		if str[i] == '1' {
-			b |= 0x80 << (i * 8)
+func TestCtrlGroupWith(t *testing.T) {
+	ctrls := make([]ctrl, groupSize)
+	for i := range ctrls {
+		ctrls[i] = ctrl(i + 1)
+	}
+	for i := uint32(0); i < groupSize; i++ {
+		expected := append([]ctrl(nil), ctrls...)
+		expected[i] = ctrlDeleted
+
+		g := *unsafeCtrlGroup(ctrls)
+		g = g.with(i, ctrlDeleted)
+		require.Equal(t, *unsafeCtrlGroup(expected), g)
+
+		// The word-wise update must agree with the byte-wise Get.
+		for j := uint32(0); j < groupSize; j++ {
+			require.Equal(t, expected[j], g.Get(j))
 		}
+		g.Set(i, ctrl(i+1))
+		require.Equal(t, *unsafeCtrlGroup(ctrls), g)
 	}
-	return b
+}
+
+func TestGroupLayout(t *testing.T) {
+	// Every control word must be 8-byte aligned so that it can be updated
+	// with a single 64-bit store.
+	require.EqualValues(t, 0, unsafe.Offsetof(Group[int8, int8]{}.ctrls))
+	require.EqualValues(t, 0, unsafe.Sizeof(Group[int8, int8]{})%8)
+	require.EqualValues(t, 0, unsafe.Sizeof(Group[[3]byte, bool]{})%8)
 }
 
 func TestInitialCapacity(t *testing.T) {
+	skipUnlessGroupSize8(t)
 	testCases := []struct {
 		initialCapacity   int
 		maxBucketCapacity uint32
@@ -220,13 +430,242 @@ func TestInitialCapacity(t *testing.T) {
 	}
 }
 
+func TestNewE(t *testing.T) {
+	testCases := []struct {
+		initialCapacity   int
+		maxBucketCapacity uint32
+		expectedErr       string
+	}{
+		{0, defaultMaxBucketCapacity, ""},
+		{1000, groupSize, ""},
+		{-1, defaultMaxBucketCapacity, "initial capacity -1 is negative"},
+		{16, groupSize - 1, fmt.Sprintf("max bucket capacity %d is smaller than the group size %d", groupSize-1, groupSize)},
+		{16, 0, fmt.Sprintf("max bucket capacity 0 is smaller than the group size %d", groupSize)},
+		{65536, 4095, "max bucket capacity 4095 is not a power of 2"},
+		{math.MaxInt, defaultMaxBucketCapacity, "initial capacity .* is too large"},
+	}
+	if ptrBits == 64 {
+		// On 32-bit platforms any valid initialCapacity fits in the directory.
+		testCases = append(testCases, struct {
+			initialCapacity   int
+			maxBucketCapacity uint32
+			expectedErr       string
+		}{math.MaxInt / 16, groupSize, "initial capacity .* requires .* buckets which exceeds the max directory size"})
+	}
+	for _, c := range testCases {
+		t.Run("", func(t *testing.T) {
+			m, err := NewE[int, int](c.initialCapacity,
+				WithMaxBucketCapacity[int, int](c.maxBucketCapacity))
+			if c.expectedErr != "" {
+				require.Regexp(t, c.expectedErr, err)
+				require.Nil(t, m)
+				return
+			}
+			require.NoError(t, err)
+			require.NoError(t, m.Validate())
+		})
+	}
+}
+
+func TestKeyEqual(t *testing.T) {
+	// Keys which differ only in case are equal.
+	stringHash, _ := newHasher[string]()
+	hash := func(key *string, seed uintptr) uintptr {
+		s := strings.ToLower(*key)
+		return stringHash(noescape(unsafe.Pointer(&s)), seed)
+	}
+	equal := func(a, b *string) bool {
+		return strings.EqualFold(*a, *b)
+	}
+	m := New[string, int](0, WithHash[string, int](hash), WithKeyEqual[string, int](equal),
+		WithMaxBucketCapacity[string, int](128))
+	const n = 1000
+	for i := 0; i < n; i++ {
+		m.Put(fmt.Sprintf("key%d", i), i)
+	}
+	for i := 0; i < n; i++ {
+		m.Put(fmt.Sprintf("KEY%d", i), -i)
+	}
+	require.Equal(t, n, m.Len())
+	require.NoError(t, m.Validate())
+	c := m.Clone()
+	for i := 0; i < n; i++ {
+		v, ok := m.Get(fmt.Sprintf("Key%d", i))
+		require.True(t, ok)
+		require.Equal(t, -i, v)
+		v, ok = c.Get(fmt.Sprintf("kEY%d", i))
+		require.True(t, ok)
+		require.Equal(t, -i, v)
+	}
+	m.All(func(key string, value int) bool {
+		// The key which was inserted first is retained.
+		require.Equal(t, fmt.Sprintf("key%d", -value), key)
+		return true
+	})
+	for i := 0; i < n; i += 2 {
+		require.True(t, m.Delete(fmt.Sprintf("KeY%d", i)))
+	}
+	require.Equal(t, n/2, m.Len())
+	_, ok := m.Get("KEY0")
+	require.False(t, ok)
+
+	_, err := NewE[string, int](0, WithKeyEqual[string, int](equal))
+	require.EqualError(t, err, "WithKeyEqual requires WithHash")
+	require.Panics(t, func() { New[string, int](0, WithKeyEqual[string, int](equal)) })
+	_, err = NewE[string, int](0, WithHash[string, int](hash), WithKeyEqual[string, int](equal),
+		WithDeterministicHash[string, int]())
+	require.EqualError(t, err, "WithKeyEqual is not supported with WithDeterministicHash")
+}
+
+func TestKeyFormatter(t *testing.T) {
+	redact := func(key string) string {
+		return fmt.Sprintf("<%d bytes>", len(key))
+	}
+	m := New[string, int](0, WithKeyFormatter[string, int](redact))
+	m.Put("secret", 1)
+	require.Equal(t, "<6 bytes>", m.keyString("secret"))
+	for _, s := range []string{m.GoString(), m.Clone().GoString(), m.bucketString(m.dir.At(0))} {
+		require.NotContains(t, s, "secret")
+		require.Contains(t, s, "[<6 bytes>:1]")
+	}
+
+	// By default keys are formatted with %v.
+	m = New[string, int](0)
+	m.Put("secret", 1)
+	require.Equal(t, "secret", m.keyString("secret"))
+	require.Contains(t, m.GoString(), "[secret:1]")
+}
+
+func TestGrowthFactor(t *testing.T) {
+	for _, f := range []float64{0.5, 1, 2.5, math.NaN()} {
+		_, err := NewE[int, int](0, WithGrowthFactor[int, int](f))
+		require.Regexp(t, "growth factor .* is not in the range", err)
+		// New ignores an invalid growth factor.
+		require.EqualValues(t, 0, New[int, int](0, WithGrowthFactor[int, int](f)).growthFactor())
+	}
+
+	if groupSize == 8 {
+		m := New[int, int](0)
+		require.EqualValues(t, 16, m.grownCapacity(8))
+		m = New[int, int](0, WithGrowthFactor[int, int](1.5))
+		require.EqualValues(t, 8, m.grownCapacity(0))
+		require.EqualValues(t, 16, m.grownCapacity(8))
+		require.EqualValues(t, 24, m.grownCapacity(16))
+		require.EqualValues(t, 40, m.grownCapacity(24))
+		require.EqualValues(t, 6144, m.grownCapacity(4096))
+		m = New[int, int](0, WithGrowthFactor[int, int](1.01))
+		require.EqualValues(t, 24, m.grownCapacity(16))
+	}
+
+	for _, f := range []float64{1.25, 1.5, 2} {
+		t.Run(fmt.Sprintf("f=%v", f), func(t *testing.T) {
+			// Use a small max bucket capacity so that buckets with a partial
+			// power of 2 of groups are split as well as resized.
+			m := New[int, int](0, WithGrowthFactor[int, int](f),
+				WithMaxBucketCapacity[int, int](256))
+			e := make(map[int]int)
+			capacities := make(map[uint32]bool)
+			for i := 0; i < 20000; i++ {
+				k := rand.Intn(5000)
+				if rand.Intn(4) == 0 {
+					m.Delete(k)
+					delete(e, k)
+				} else {
+					m.Put(k, i)
+					e[k] = i
+				}
+				for _, bs := range m.bucketStats() {
+					capacities[uint32(bs.Capacity)] = true
+				}
+			}
+			require.NoError(t, m.Validate())
+			require.Equal(t, len(e), m.Len())
+			for k, v := range e {
+				got, ok := m.Get(k)
+				require.True(t, ok)
+				require.Equal(t, v, got)
+			}
+			var n int
+			m.All(func(k, v int) bool {
+				require.Equal(t, e[k], v)
+				n++
+				return true
+			})
+			require.Equal(t, len(e), n)
+
+			var partial bool
+			for c := range capacities {
+				require.Zero(t, c%groupSize)
+				if c&(c-1) != 0 {
+					partial = true
+				}
+			}
+			require.Equal(t, f != 2, partial)
+		})
+	}
+}
+
+func TestFlatTable(t *testing.T) {
+	// Exhaustive invariants make each operation on the single bucket O(n).
+	n := 100000
+	if invariantsExhaustive {
+		n = 2000
+	}
+	// WithFlatTable overrides WithMaxBucketCapacity regardless of order.
+	m := New[int, int](0, WithFlatTable[int, int](), WithMaxBucketCapacity[int, int](groupSize))
+	for i := 0; i < n; i++ {
+		m.Put(i, i)
+	}
+	require.NoError(t, m.Validate())
+	s := m.Stats()
+	require.Equal(t, 1, s.Buckets)
+	require.EqualValues(t, 0, s.GlobalDepth)
+	for i := 0; i < n; i++ {
+		v, ok := m.Get(i)
+		require.True(t, ok)
+		require.Equal(t, i, v)
+	}
+
+	l, err := Describe[int, int](1000000, WithMaxBucketCapacity[int, int](groupSize),
+		WithFlatTable[int, int]())
+	require.NoError(t, err)
+	require.Equal(t, 1, l.Buckets)
+	require.EqualValues(t, maxFlatBucketCapacity, l.MaxBucketCapacity)
+}
+
+func TestDescribe(t *testing.T) {
+	for _, maxBucketCapacity := range []uint32{groupSize, 64, defaultMaxBucketCapacity} {
+		for _, initialCapacity := range []int{0, 1, 7, 8, 100, 896, 897, 10000} {
+			l, err := Describe[int, int](initialCapacity,
+				WithMaxBucketCapacity[int, int](maxBucketCapacity))
+			require.NoError(t, err)
+
+			m := New[int, int](initialCapacity,
+				WithMaxBucketCapacity[int, int](maxBucketCapacity))
+			s := m.Stats()
+			require.EqualValues(t, maxBucketCapacity, l.MaxBucketCapacity)
+			require.EqualValues(t, s.Buckets, l.Buckets)
+			require.EqualValues(t, s.GlobalDepth, l.GlobalDepth)
+			require.EqualValues(t, s.Capacity, l.Capacity)
+			require.LessOrEqual(t, initialCapacity, l.GrowthLeft)
+
+			var growthLeft int
+			for _, bs := range m.bucketStats() {
+				require.EqualValues(t, l.BucketCapacity, bs.Capacity)
+				growthLeft += int(bs.GrowthLeft)
+			}
+			require.EqualValues(t, l.GrowthLeft, growthLeft)
+		}
+	}
+}
+
 func TestBasic(t *testing.T) {
 	test := func(t *testing.T, m *Map[int, int]) {
 		const count = 100
 
 		e := make(map[int]int)
 		require.EqualValues(t, 0, m.Len())
-		require.EqualValues(t, 0, m.dir.At(0).growthLeft)
+		require.EqualValues(t, 0, m.bucketStats()[0].GrowthLeft)
 
 		// Non-existent.
 		for i := 0; i < count; i++ {
@@ -242,7 +681,7 @@ func TestBasic(t *testing.T) {
 			require.True(t, ok)
 			require.EqualValues(t, i+count, v)
 			require.EqualValues(t, i+1, m.Len())
-			require.Equal(t, e, m.toBuiltinMap())
+			require.Equal(t, e, m.ToMap())
 		}
 
 		// Update.
@@ -253,17 +692,18 @@ func TestBasic(t *testing.T) {
 			require.True(t, ok)
 			require.EqualValues(t, i+2*count, v)
 			require.EqualValues(t, count, m.Len())
-			require.Equal(t, e, m.toBuiltinMap())
+			require.Equal(t, e, m.ToMap())
 		}
 
 		// Delete.
 		for i := 0; i < count; i++ {
-			m.Delete(i)
+			require.True(t, m.Delete(i))
 			delete(e, i)
 			require.EqualValues(t, count-i-1, m.Len())
 			_, ok := m.Get(i)
 			require.False(t, ok)
-			require.Equal(t, e, m.toBuiltinMap())
+			require.False(t, m.Delete(i))
+			require.Equal(t, e, m.ToMap())
 		}
 	}
 
@@ -271,14 +711,21 @@ func TestBasic(t *testing.T) {
 		test(t, New[int, int](0))
 	})
 
+	t.Run("cachedHash", func(t *testing.T) {
+		m := New[int, int](0, WithCachedHash[int, int](), WithMaxBucketCapacity[int, int](64))
+		test(t, m)
+		checkCachedHashes(t, m)
+	})
+
 	t.Run("degenerate", func(t *testing.T) {
 		testDegenerate := func(t *testing.T, h uintptr) {
 			m := New[int, int](0,
 				WithHash[int, int](func(key *int, seed uintptr) uintptr {
 					return h
 				}),
-				WithMaxBucketCapacity[int, int](8))
+				WithMaxBucketCapacity[int, int](groupSize))
 			test(t, m)
+			require.NotZero(t, m.Stats().DegenerateSplits)
 		}
 
 		for _, v := range []uintptr{0, ^uintptr(0)} {
@@ -295,6 +742,252 @@ func TestBasic(t *testing.T) {
 	})
 }
 
+func TestDegenerateSplit(t *testing.T) {
+	skipUnlessGroupSize8(t)
+	// Splitting a bucket whose entries all have the same hash moves none of
+	// them, and must not allocate groups for the new bucket. The only
+	// allocations are those of the bucket doubling in size.
+	a := &countingAllocator[int, int]{}
+	m := New[int, int](0, WithAllocator[int, int](a),
+		WithHash[int, int](func(key *int, seed uintptr) uintptr {
+			return 0
+		}),
+		WithMaxBucketCapacity[int, int](groupSize))
+	for i := 0; i < 1000; i++ {
+		m.Put(i, i)
+	}
+	require.NoError(t, m.Validate())
+	s := m.Stats()
+	require.Equal(t, 1, s.Buckets)
+	require.EqualValues(t, 2048, s.Capacity)
+	// The bucket grew from 8 to 2048 slots, splitting and doubling the max
+	// bucket capacity at each step beyond the initial capacity.
+	require.EqualValues(t, 8, s.DegenerateSplits)
+	require.Equal(t, 9, a.alloc)
+	require.Equal(t, 8, a.free)
+}
+
+func TestDeepDirectory(t *testing.T) {
+	// The directory is indexed by the high bits of the hash, which on 32-bit
+	// architectures leaves fewer bits between the directory and h2. Grow the
+	// directory one level at a time to a depth which uses most of the bits
+	// of a 32-bit hash above h1's probe bits: the chain keys hash to a single
+	// high bit each (the j'th to bit ptrBits-1-j), and the other keys hash to
+	// their (small) value. Each split of the bucket holding the other keys
+	// moves exactly one chain key to a new bucket.
+	const depth = 20
+	const chain = 1 << 20
+	m := New[int, int](0,
+		WithHash[int, int](func(key *int, seed uintptr) uintptr {
+			if k := *key; k >= chain {
+				return uintptr(1) << (ptrBits - 1 - (k - chain))
+			}
+			return uintptr(*key)
+		}),
+		WithMaxBucketCapacity[int, int](64))
+	for j := 0; j < depth; j++ {
+		m.Put(chain+j, j)
+	}
+	n := 0
+	for ; m.globalDepth() < depth; n++ {
+		require.Less(t, n, 1000)
+		m.Put(n, n)
+	}
+	require.NoError(t, m.Validate())
+	require.EqualValues(t, 1<<depth, m.bucketCount())
+	require.EqualValues(t, 0, m.Stats().DegenerateSplits)
+
+	// The chain key j is alone in a bucket of local depth j+1, and the other
+	// keys are in the bucket at the start of the directory.
+	for j := 0; j < depth; j++ {
+		h := m.Hash(chain + j)
+		b := m.bucket(h)
+		require.EqualValues(t, j+1, b.localDepth)
+		require.EqualValues(t, 1, b.used)
+		require.EqualValues(t, h>>(ptrBits-depth), b.index)
+		v, ok := m.Get(chain + j)
+		require.True(t, ok)
+		require.Equal(t, j, v)
+	}
+	b := m.bucket(0)
+	require.EqualValues(t, depth, b.localDepth)
+	require.EqualValues(t, 0, b.index)
+	require.EqualValues(t, n, b.used)
+	for i := 0; i < n; i++ {
+		v, ok := m.Get(i)
+		require.True(t, ok)
+		require.Equal(t, i, v)
+	}
+}
+
+func TestZeroValue(t *testing.T) {
+	// Each operation is performed on a fresh zero value map, as the first
+	// use initializes the map.
+	ops := map[string]func(m *Map[int, int]){
+		"Get": func(m *Map[int, int]) {
+			_, ok := m.Get(1)
+			require.False(t, ok)
+		},
+		"Put": func(m *Map[int, int]) {
+			m.Put(1, 1)
+			require.Equal(t, 1, m.Len())
+		},
+		"Delete": func(m *Map[int, int]) {
+			require.False(t, m.Delete(1))
+		},
+		"PutIfAbsent": func(m *Map[int, int]) {
+			require.True(t, m.PutIfAbsent(1, 1))
+		},
+		"All": func(m *Map[int, int]) {
+			m.All(func(k, v int) bool {
+				t.Fatalf("unexpected entry %d", k)
+				return true
+			})
+		},
+		"Clear": func(m *Map[int, int]) {
+			m.Clear()
+		},
+		"ClearAndRelease": func(m *Map[int, int]) {
+			m.ClearAndRelease()
+		},
+		"Reset": func(m *Map[int, int]) {
+			m.Reset()
+		},
+		"ShrinkToFit": func(m *Map[int, int]) {
+			m.ShrinkToFit()
+		},
+		"Reserve": func(m *Map[int, int]) {
+			m.Reserve(100)
+		},
+		"Stats": func(m *Map[int, int]) {
+			require.Equal(t, 1, m.Stats().Buckets)
+		},
+		"Snapshot": func(m *Map[int, int]) {
+			require.NoError(t, m.Snapshot().Validate())
+		},
+		"Clone": func(m *Map[int, int]) {
+			require.NoError(t, m.Clone().Validate())
+		},
+		"Batch": func(m *Map[int, int]) {
+			tx := m.Batch()
+			tx.Put(1, 1)
+			tx.Commit()
+		},
+		"Equal": func(m *Map[int, int]) {
+			require.True(t, Equal(m, New[int, int](0)))
+		},
+		"Close": func(m *Map[int, int]) {
+			m.Close()
+		},
+	}
+	for name, op := range ops {
+		t.Run(name, func(t *testing.T) {
+			var m Map[int, int]
+			op(&m)
+			require.NoError(t, m.Validate())
+		})
+	}
+
+	// A zero value map embedded by value behaves like New(0).
+	var s struct {
+		m Map[int, int]
+	}
+	e := make(map[int]int)
+	for i := 0; i < 1000; i++ {
+		s.m.Put(i, i)
+		e[i] = i
+	}
+	require.NoError(t, s.m.Validate())
+	require.Equal(t, e, s.m.ToMap())
+}
+
+// probeLength returns the number of groups probed by a lookup of key, which
+// must be present in the map.
+func probeLength[K comparable, V any](m *Map[K, V], key K) int {
+	h := m.hash(noescape(unsafe.Pointer(&key)), m.seed)
+	b := m.bucket(h)
+	seq := b.probe(b.slotHash(m, &key, h))
+	for n := 1; ; n++ {
+		g := b.groups.At(uintptr(seq.offset))
+		for j := uint32(0); j < groupSize; j++ {
+			if (g.ctrls.Get(j)&ctrlEmpty) != ctrlEmpty && *g.slots.Key(j) == key {
+				return n
+			}
+		}
+		seq = seq.next()
+	}
+}
+
+func TestDegenerateBucket(t *testing.T) {
+	// With a constant hash a split never divides the entries of a bucket, and
+	// without a fallback every entry would share one probe sequence. The
+	// bucket is marked degenerate and places its entries by the fallback
+	// hash, so that the probe sequences remain short however many entries
+	// the bucket holds.
+	constant := WithHash[int, int](func(key *int, seed uintptr) uintptr {
+		return 0
+	})
+	for _, cached := range []bool{false, true} {
+		t.Run(fmt.Sprintf("cached=%t", cached), func(t *testing.T) {
+			options := []Option[int, int]{constant, WithMaxBucketCapacity[int, int](64)}
+			if cached {
+				options = append(options, WithCachedHash[int, int]())
+			}
+			m := New[int, int](0, options...)
+			const n = 10000
+			e := make(map[int]int)
+			for i := 0; i < n; i++ {
+				m.Put(i, i)
+				e[i] = i
+			}
+			// Leave tombstones behind to be dropped by rehashing in place.
+			for i := 0; i < n; i += 2 {
+				require.True(t, m.Delete(i))
+				delete(e, i)
+			}
+			for i := n; i < 2*n; i += 2 {
+				m.Put(i, i)
+				e[i] = i
+			}
+			require.NoError(t, m.Validate())
+			require.Equal(t, e, m.ToMap())
+			require.Equal(t, 1, m.Stats().Buckets)
+			require.Greater(t, m.Stats().DegenerateSplits, uint64(0))
+
+			var total, longest int
+			for k := range e {
+				l := probeLength(m, k)
+				total += l
+				longest = max(longest, l)
+			}
+			require.LessOrEqual(t, float64(total)/float64(len(e)), 1.5)
+			require.LessOrEqual(t, longest, 16)
+
+			// Clones and snapshots share the fallback hash function.
+			c := m.Clone()
+			require.True(t, Equal(m, c))
+			s := m.Snapshot()
+			for k := range e {
+				m.Put(k, -k)
+			}
+			require.NoError(t, c.Validate())
+			require.NoError(t, s.Validate())
+			require.Equal(t, e, s.ToMap())
+		})
+	}
+
+	// Keys compared by WithKeyEqual have no fallback hash, so their bucket is
+	// never marked degenerate.
+	m := New[int, int](0, constant,
+		WithKeyEqual[int, int](func(a, b *int) bool { return *a == *b }),
+		WithMaxBucketCapacity[int, int](8))
+	for i := 0; i < 100; i++ {
+		m.Put(i, i)
+	}
+	require.NoError(t, m.Validate())
+	require.Equal(t, 100/groupSize+1, probeLength(m, 99))
+}
+
 func TestRandom(t *testing.T) {
 	test := func(t *testing.T, m *Map[int, int]) {
 		e := make(map[int]int)
@@ -326,9 +1019,11 @@ func TestRandom(t *testing.T) {
 					require.EqualValues(t, e[k], v)
 				}
 			default: // 5% rehash in place and iterate
-				i := rand.Intn(int(m.bucketCount()))
+				// Rehash the bucket at its own index, as a bucket may
+				// occupy several entries of the directory.
+				i := m.dir.At(uintptr(rand.Intn(int(m.bucketCount())))).index
 				m.dir.At(uintptr(i)).rehashInPlace(m)
-				require.Equal(t, e, m.toBuiltinMap())
+				require.Equal(t, e, m.ToMap())
 			}
 			require.EqualValues(t, len(e), m.Len())
 		}
@@ -338,6 +1033,12 @@ func TestRandom(t *testing.T) {
 		test(t, New[int, int](0))
 	})
 
+	t.Run("cachedHash", func(t *testing.T) {
+		m := New[int, int](0, WithCachedHash[int, int](), WithMaxBucketCapacity[int, int](64))
+		test(t, m)
+		checkCachedHashes(t, m)
+	})
+
 	t.Run("degenerate", func(t *testing.T) {
 		testDegenerate := func(t *testing.T, h uintptr) {
 			m := New[int, int](0,
@@ -356,50 +1057,2354 @@ func TestRandom(t *testing.T) {
 	})
 }
 
-func TestIterateMutate(t *testing.T) {
-	m := New[int, int](0)
-	for i := 0; i < 100; i++ {
-		m.Put(i, i)
+func testFixedKeys[K comparable](t *testing.T, expected hashFn, makeKey func(i int) K) {
+	m := New[K, int](0)
+	// The map uses the expected hash function, if specified (the runtime's
+	// hash function is bound to the map's seed). Hash functions are compared
+	// by their results, as a generic function instantiated in different
+	// contexts may be compiled to different wrappers.
+	for i := 0; expected != nil && i < 16; i++ {
+		k := makeKey(i)
+		require.Equal(t, expected(noescape(unsafe.Pointer(&k)), m.seed), m.hash(noescape(unsafe.Pointer(&k)), m.seed))
 	}
-	e := m.toBuiltinMap()
-	require.EqualValues(t, 100, m.Len())
-	require.EqualValues(t, 100, len(e))
 
-	// Iterate over the map, resizing it periodically. We should see all of
-	// the elements that were originally in the map because All takes a
-	// snapshot of the ctrls and slots before iterating.
-	vals := make(map[int]int)
-	m.All(func(k, v int) bool {
-		if (k % 10) == 0 {
-			m.dir.At(0).resize(m, 2*m.dir.At(0).capacity)
+	// The hash of sequential keys should be well distributed in both the
+	// high bits (used to index the directory) and the low bits (used for
+	// H2), and differ from the hash of the keys in another map.
+	const count = 4096
+	o := New[K, int](0)
+	high := make(map[uintptr]bool)
+	low := make(map[uintptr]bool)
+	for i := 0; i < count; i++ {
+		k := makeKey(i)
+		h := m.hash(noescape(unsafe.Pointer(&k)), m.seed)
+		require.NotEqual(t, h, o.hash(noescape(unsafe.Pointer(&k)), o.seed))
+		high[h>>(ptrBits-8)] = true
+		low[h&0x7f] = true
+	}
+	require.Equal(t, 256, len(high))
+	require.Equal(t, 128, len(low))
+
+	for i := 0; i < count; i++ {
+		m.Put(makeKey(i), i)
+	}
+	for i := 0; i < count; i += 2 {
+		require.True(t, m.Delete(makeKey(i)))
+	}
+	require.NoError(t, m.Validate())
+	require.Equal(t, count/2, m.Len())
+	for i := 0; i < count; i++ {
+		v, ok := m.Get(makeKey(i))
+		require.Equal(t, i%2 == 1, ok)
+		if ok {
+			require.Equal(t, i, v)
 		}
-		vals[k] = v
-		return true
-	})
-	require.EqualValues(t, e, vals)
+	}
 }
 
-func TestIterateDelete(t *testing.T) {
-	m := New[int, int](0)
-	for i := 0; i < 100; i++ {
-		m.Put(i, i)
+// TestFixedKeysSeed verifies that the fixed size hash functions don't have
+// families of keys which collide regardless of the seed: keys whose bytes
+// cancel the constants used by the hash functions, and keys which exchange
+// the operands of the multiplications.
+func TestFixedKeysSeed(t *testing.T) {
+	key := func(words ...uint64) (k [32]byte) {
+		for i, w := range words {
+			binary.LittleEndian.PutUint64(k[8*i:], w)
+		}
+		return k
 	}
-	e := m.toBuiltinMap()
-	require.EqualValues(t, 100, m.Len())
-	require.EqualValues(t, 100, len(e))
+	for _, c := range []struct {
+		name string
+		hash hashFn
+		keys [][32]byte
+	}{
+		{"8", hashBytes8, [][32]byte{key(hashM2), key(0)}},
+		{"16", hashBytes16, [][32]byte{
+			key(hashM2, 0), key(hashM2, 1), key(hashM2, 2),
+			key(1, 2), key(2^hashM2, 1^hashM2),
+		}},
+		{"32", hashBytes32, [][32]byte{
+			key(hashM2, 0, hashM3, 0), key(hashM2, 1, hashM3, 1), key(hashM2, 2, hashM3, 2),
+			key(1, 2, 3, 4), key(3^hashM3^hashM2, 4^hashM4, 1^hashM2^hashM3, 2^hashM4),
+		}},
+	} {
+		t.Run(c.name, func(t *testing.T) {
+			for seed := uintptr(0); seed < 16; seed++ {
+				// The keys hash to distinct values for each seed.
+				seen := make(map[uintptr]bool)
+				for i := range c.keys {
+					h := c.hash(noescape(unsafe.Pointer(&c.keys[i])), seed)
+					require.False(t, seen[h], "seed=%d key=%d", seed, i)
+					seen[h] = true
+				}
+			}
+			// Each key hashes to distinct values for different seeds.
+			for i := range c.keys {
+				seen := make(map[uintptr]bool)
+				for seed := uintptr(0); seed < 16; seed++ {
+					h := c.hash(noescape(unsafe.Pointer(&c.keys[i])), seed)
+					require.False(t, seen[h], "seed=%d key=%d", seed, i)
+					seen[h] = true
+				}
+			}
+		})
+	}
+}
 
-	// Iterate over the map, deleting elements periodically. We should see all of
-	// the elements that were originally in the map because All takes a
-	// snapshot of the ctrls and slots before iterating.
-	vals := make(map[int]int)
-	m.All(func(k, v int) bool {
-		if (k % 10) == 0 {
-			m.Delete(k)
-		}
-		vals[k] = v
-		return true
+func TestFixedKeys(t *testing.T) {
+	type uuid [16]byte
+
+	t.Run("8", func(t *testing.T) {
+		testFixedKeys(t, hashBytes8, func(i int) (k [8]byte) {
+			binary.BigEndian.PutUint32(k[4:], uint32(i))
+			return k
+		})
+	})
+	t.Run("16", func(t *testing.T) {
+		testFixedKeys(t, hashBytes16, func(i int) (k [16]byte) {
+			binary.BigEndian.PutUint32(k[12:], uint32(i))
+			return k
+		})
+	})
+	t.Run("uuid", func(t *testing.T) {
+		testFixedKeys(t, hashBytes16, func(i int) (k uuid) {
+			binary.LittleEndian.PutUint32(k[:], uint32(i))
+			return k
+		})
+	})
+	t.Run("32", func(t *testing.T) {
+		testFixedKeys(t, hashBytes32, func(i int) (k [32]byte) {
+			binary.BigEndian.PutUint32(k[28:], uint32(i))
+			return k
+		})
+	})
+	t.Run("4", func(t *testing.T) {
+		testFixedKeys(t, nil, func(i int) (k [4]byte) {
+			binary.BigEndian.PutUint32(k[:], uint32(i))
+			return k
+		})
 	})
-	require.EqualValues(t, e, vals)
+}
+
+func TestStats(t *testing.T) {
+	m := New[int, int](0, WithMaxBucketCapacity[int, int](64),
+		WithOperationCounters[int, int]())
+	require.Equal(t, Stats{Buckets: 1}, m.Stats())
+
+	for i := 0; i < 1000; i++ {
+		m.Put(i, i)
+	}
+	for i := 0; i < 100; i++ {
+		m.Put(i, i+1)
+	}
+	for i := 0; i < 1000; i += 2 {
+		m.Delete(i)
+	}
+	m.Delete(-1)
+
+	s := m.Stats()
+	require.EqualValues(t, m.Len(), s.Len)
+	require.EqualValues(t, m.capacity(), s.Capacity)
+	require.EqualValues(t, len(m.bucketStats()), s.Buckets)
+	require.EqualValues(t, m.globalDepth(), s.GlobalDepth)
+	require.EqualValues(t, 1000, s.Inserts)
+	require.EqualValues(t, 100, s.Overwrites)
+	require.EqualValues(t, 500, s.Deletes)
+
+	m.Clear()
+	s = m.Stats()
+	require.EqualValues(t, 0, s.Len)
+	require.EqualValues(t, 1000, s.Deletes)
+
+	// The operation counters are disabled by default.
+	m = New[int, int](0)
+	for i := 0; i < 100; i++ {
+		m.Put(i, i)
+		m.Put(i, i)
+		m.Delete(i)
+	}
+	s = m.Stats()
+	require.EqualValues(t, 0, s.Inserts)
+	require.EqualValues(t, 0, s.Overwrites)
+	require.EqualValues(t, 0, s.Deletes)
+}
+
+func TestName(t *testing.T) {
+	m := New[int, int](0, WithName[int, int]("users by id"))
+	m.Put(1, 1)
+	require.Equal(t, "users by id", m.Stats().Name)
+	require.True(t, strings.HasPrefix(string(m.StatsAppend(nil)), `name="users by id" len=1 `))
+	require.True(t, strings.HasPrefix(m.GoString(), `name="users by id"  used=1 `))
+	require.Equal(t, "users by id", m.Snapshot().Stats().Name)
+	require.Equal(t, "users by id", m.Clone().Stats().Name)
+	require.PanicsWithValue(t, `map "users by id": invariant failed: corrupt`, func() {
+		m.panicf("invariant failed: %s", "corrupt")
+	})
+
+	// An unnamed map omits the name.
+	m = New[int, int](0)
+	require.Empty(t, m.Stats().Name)
+	require.True(t, strings.HasPrefix(string(m.StatsAppend(nil)), "len=0 "))
+	require.PanicsWithValue(t, "invariant failed: corrupt", func() {
+		m.panicf("invariant failed: %s", "corrupt")
+	})
+}
+
+func TestStatsAppend(t *testing.T) {
+	m := New[int, int](0, WithMaxBucketCapacity[int, int](64))
+	for i := 0; i < 1000; i++ {
+		m.Put(i, i)
+	}
+	m.Put(0, 1)
+	m.Delete(1)
+
+	s := m.Stats()
+	expected := fmt.Sprintf("len=%d capacity=%d buckets=%d global-depth=%d inserts=%d overwrites=%d deletes=%d negative-cache-hits=%d resalts=%d degenerate-splits=%d hash-calls=%d hash-time-ns=%d",
+		s.Len, s.Capacity, s.Buckets, s.GlobalDepth, s.Inserts, s.Overwrites, s.Deletes, s.NegativeCacheHits, s.Resalts,
+		s.DegenerateSplits, s.HashCalls, int64(s.HashTime))
+	require.Equal(t, expected, string(m.StatsAppend(nil)))
+	require.Equal(t, "prefix: "+expected, string(m.StatsAppend([]byte("prefix: "))))
+
+	if !invariants {
+		buf := make([]byte, 0, 256)
+		allocs := testing.AllocsPerRun(100, func() {
+			buf = m.StatsAppend(buf[:0])
+		})
+		require.EqualValues(t, 0, allocs)
+	}
+}
+
+func TestHashTiming(t *testing.T) {
+	if invariantsExhaustive {
+		t.Skip("exhaustive invariants hash every key on each operation")
+	}
+
+	// A slow hash function, which takes at least 1us to compute a hash.
+	slowHash := func(key *int, seed uintptr) uintptr {
+		for start := time.Now(); time.Since(start) < time.Microsecond; {
+		}
+		return uintptr(uint64(*key) * 0x9e3779b97f4a7c15)
+	}
+	for _, n := range []uint32{0, 1, 10} {
+		t.Run(fmt.Sprint(n), func(t *testing.T) {
+			m := New[int, int](1000, WithHash[int, int](slowHash), WithHashTiming[int, int](n))
+			for i := 0; i < 1000; i++ {
+				m.Put(i, i)
+			}
+			// The map was sized to hold the entries, so each Put hashed the
+			// key exactly once.
+			s := m.Stats()
+			require.EqualValues(t, 1000, s.HashCalls)
+			require.GreaterOrEqual(t, s.HashTime, 500*time.Microsecond)
+
+			// Clones have their own statistics.
+			c := m.Clone()
+			require.Zero(t, c.Stats().HashCalls)
+			c.Get(1)
+			require.EqualValues(t, 1, c.Stats().HashCalls)
+			require.EqualValues(t, 1000, m.Stats().HashCalls)
+		})
+	}
+
+	// With a clock which advances by 1us each time it is read, every timed
+	// hash computation takes exactly 1us, including for clones.
+	var now int64
+	clock := WithClock[int, int](func() int64 {
+		now += int64(time.Microsecond)
+		return now
+	})
+	m := New[int, int](100, WithHashTiming[int, int](1), clock)
+	for i := 0; i < 10; i++ {
+		m.Put(i, i)
+	}
+	require.Equal(t, 10*time.Microsecond, m.Stats().HashTime)
+	c := m.Clone()
+	c.Get(1)
+	require.Equal(t, time.Microsecond, c.Stats().HashTime)
+
+	m = New[int, int](0)
+	m.Put(1, 1)
+	require.Zero(t, m.Stats().HashCalls)
+	require.Zero(t, m.Stats().HashTime)
+}
+
+func TestForEachBucketStats(t *testing.T) {
+	m := New[int, int](0, WithMaxBucketCapacity[int, int](groupSize))
+	for i := 0; i < 1000; i++ {
+		m.Put(i, i)
+	}
+	for i := 0; i < 1000; i += 3 {
+		m.Delete(i)
+	}
+
+	stats := m.bucketStats()
+	require.Greater(t, len(stats), 1)
+
+	var used, capacity int
+	for i, s := range stats {
+		if i > 0 {
+			require.Greater(t, s.Index, stats[i-1].Index)
+		}
+		require.LessOrEqual(t, s.LocalDepth, m.globalDepth())
+		require.EqualValues(t, (s.Capacity*maxAvgGroupLoad)/groupSize-s.Used-s.GrowthLeft, s.Tombstones)
+		used += int(s.Used)
+		capacity += int(s.Capacity)
+	}
+	require.EqualValues(t, m.Len(), used)
+	require.EqualValues(t, m.capacity(), capacity)
+
+	// Iteration terminates early when yield returns false.
+	var count int
+	m.ForEachBucketStats(func(BucketStats) bool {
+		count++
+		return false
+	})
+	require.EqualValues(t, 1, count)
+}
+
+func TestCtrlSummary(t *testing.T) {
+	m := New[int, int](0, WithMaxBucketCapacity[int, int](64))
+	require.Equal(t, [128]int{}, m.H2Histogram())
+	require.Equal(t, CtrlSummary{}, m.CtrlSummary())
+
+	for i := 0; i < 10000; i++ {
+		m.Put(i, i)
+	}
+	for i := 0; i < 10000; i += 3 {
+		m.Delete(i)
+	}
+
+	hist := m.H2Histogram()
+	var expected [128]int
+	var tombstones int
+	m.buckets(0, func(b *bucket[int, int]) bool {
+		tombstones += int(b.tombstones())
+		return true
+	})
+	m.All(func(k, _ int) bool {
+		expected[h2(m.hash(noescape(unsafe.Pointer(&k)), m.seed))]++
+		return true
+	})
+	require.Equal(t, expected, hist)
+
+	s := m.CtrlSummary()
+	require.Equal(t, m.Len(), s.Full)
+	require.Equal(t, tombstones, s.Deleted)
+	require.Equal(t, m.capacity(), s.Full+s.Empty+s.Deleted)
+	require.Equal(t, m.capacity()/groupSize, s.Groups)
+	// The default hash distributes h2 uniformly: the statistic is well within
+	// a few times its degrees of freedom.
+	require.Less(t, s.H2ChiSquare, float64(4<<h2Bits))
+
+	// A hash which only varies its high bits puts every entry in h2 0.
+	m = New[int, int](0, WithHash[int, int](func(key *int, seed uintptr) uintptr {
+		return uintptr(*key) << h2Bits
+	}))
+	for i := 0; i < 1000; i++ {
+		m.Put(i, i)
+	}
+	require.Equal(t, 1000, m.H2Histogram()[0])
+	require.Greater(t, m.CtrlSummary().H2ChiSquare, float64(100<<h2Bits))
+}
+
+// checkCachedHashes verifies that the cached hash of every entry in a map
+// configured with WithCachedHash is the hash of its key.
+func checkCachedHashes[K comparable, V any](t *testing.T, m *Map[K, V]) {
+	require.True(t, m.cachedHash())
+	m.buckets(0, func(b *bucket[K, V]) bool {
+		if b.capacity == 0 {
+			return true
+		}
+		hashes := m.cachedHashes(b.groups, b.groupCount())
+		require.Len(t, hashes, int(b.capacity))
+		for i := uint32(0); i < b.groupCount(); i++ {
+			g := b.groups.At(uintptr(i))
+			for j := uint32(0); j < groupSize; j++ {
+				if (g.ctrls.Get(j) & ctrlEmpty) == ctrlEmpty {
+					continue
+				}
+				k := g.slots.Key(j)
+				require.Equal(t, m.hash(noescape(unsafe.Pointer(k)), m.seed), hashes[i*groupSize+j],
+					"key %v", *k)
+			}
+		}
+		return true
+	})
+}
+
+func TestCachedHash(t *testing.T) {
+	var hashes int
+	hash, _ := newHasher[string]()
+	countingHash := func(key *string, seed uintptr) uintptr {
+		hashes++
+		return hash(noescape(unsafe.Pointer(key)), seed)
+	}
+	for _, cached := range []bool{false, true} {
+		options := []Option[string, int]{
+			WithHash[string, int](countingHash), WithMaxBucketCapacity[string, int](128),
+		}
+		if cached {
+			options = append(options, WithCachedHash[string, int]())
+		}
+		m := New[string, int](0, options...)
+		hashes = 0
+		for i := 0; i < 10000; i++ {
+			m.Put(strconv.Itoa(i), i)
+		}
+		// Each Put hashes its key, and without cached hashes every resize
+		// and split hashes the keys again. Exhaustive invariants hash every
+		// key on each operation.
+		switch {
+		case invariantsExhaustive:
+		case cached:
+			require.Equal(t, 10000, hashes)
+		default:
+			require.Greater(t, hashes, 20000)
+		}
+	}
+
+	m := New[string, int](0, WithCachedHash[string, int](), WithMaxBucketCapacity[string, int](64),
+		WithMoveToFront[string, int]())
+	for i := 0; i < 1000; i++ {
+		m.Put(strconv.Itoa(i), i)
+	}
+	s := m.Snapshot()
+	c := m.Clone()
+	for i := 0; i < 1000; i += 3 {
+		m.Delete(strconv.Itoa(i))
+	}
+	// Mutating the map while iterating over it evacuates the buckets being
+	// iterated over when they are split or rehashed in place.
+	m.All(func(k string, v int) bool {
+		m.Put(k+"x", v)
+		return true
+	})
+	for i := 0; i < 1000; i++ {
+		m.Get(strconv.Itoa(i))
+	}
+	m.ShrinkToFit()
+	for m.TryMergeSiblings(0, 1) || m.TryMergeSiblings(1, 1) {
+	}
+	for _, x := range []*Map[string, int]{m, s, c} {
+		require.NoError(t, x.Validate())
+		checkCachedHashes(t, x)
+	}
+	require.Equal(t, 1000, s.Len())
+	require.Equal(t, 1000, c.Len())
+	groupBytes := int64(unsafe.Sizeof(Group[string, int]{})) + groupSize*ptrSize
+	_, groups := m.OutstandingAllocations()
+	require.Equal(t, int64(groups)*groupBytes+m.directoryBytes(), m.SizeInBytes())
+
+	require.Panics(t, func() {
+		New[int, int](0, WithBucketLocks[int, int](1), WithCachedHash[int, int]())
+	})
+	require.Panics(t, func() {
+		New[int, int](0, WithAllocator[int, int](&countingAllocator[int, int]{}), WithCachedHash[int, int]())
+	})
+}
+
+func TestLoadFactorWatch(t *testing.T) {
+	var crossings []BucketStats
+	m := New[int, int](0, WithMaxBucketCapacity[int, int](64),
+		WithLoadFactorWatch[int, int](0.5, func(s BucketStats) {
+			crossings = append(crossings, s)
+		}))
+	for i := 0; i < 10000; i++ {
+		n := len(crossings)
+		m.Put(i, i)
+		if len(crossings) == n {
+			continue
+		}
+		// The load factor of the bucket reached the threshold with this
+		// insertion.
+		require.Equal(t, n+1, len(crossings))
+		s := crossings[n]
+		require.GreaterOrEqual(t, 2*s.Used, s.Capacity)
+		require.Less(t, 2*(s.Used-1), s.Capacity)
+	}
+	require.Greater(t, len(crossings), m.Stats().Buckets)
+
+	// A load factor threshold outside of (0, 1] is rejected by NewE and
+	// ignored by New.
+	_, err := NewE[int, int](0, WithLoadFactorWatch[int, int](1.5, nil))
+	require.Regexp(t, "load factor watch threshold 1.5 is not in the range", err)
+	m = New[int, int](0, WithLoadFactorWatch[int, int](0, func(BucketStats) {
+		t.Fatal("unexpected call")
+	}))
+	for i := 0; i < 100; i++ {
+		m.Put(i, i)
+	}
+
+	// The caller may grow the map ahead of demand once Put has returned.
+	var reserve int
+	r := New[int, int](0, WithMaxBucketCapacity[int, int](64),
+		WithLoadFactorWatch[int, int](0.75, func(s BucketStats) {
+			reserve += int(s.Capacity)
+		}))
+	for i := 0; i < 1000; i++ {
+		r.Put(i, i)
+		if reserve > 0 {
+			r.Reserve(reserve)
+			reserve = 0
+		}
+	}
+	require.NoError(t, r.Validate())
+	require.Equal(t, 1000, r.Len())
+	require.Panics(t, func() {
+		New[int, int](0, WithBucketLocks[int, int](1), WithLoadFactorWatch[int, int](0.5, nil))
+	})
+}
+
+func TestValidate(t *testing.T) {
+	for _, maxBucketCapacity := range []uint32{groupSize, 64, math.MaxUint32} {
+		t.Run(fmt.Sprint(maxBucketCapacity), func(t *testing.T) {
+			m := New[int, int](0, WithMaxBucketCapacity[int, int](maxBucketCapacity))
+			require.NoError(t, m.Validate())
+
+			// Splits and resizes.
+			for i := 0; i < 2000; i++ {
+				m.Put(i, i)
+				if i%97 == 0 {
+					require.NoError(t, m.Validate())
+				}
+			}
+			require.NoError(t, m.Validate())
+
+			// Deletes and in-place rehashes.
+			for i := 0; i < 2000; i += 3 {
+				m.Delete(i)
+			}
+			require.NoError(t, m.Validate())
+			for _, s := range m.bucketStats() {
+				m.dir.At(uintptr(s.Index)).rehashInPlace(m)
+			}
+			require.NoError(t, m.Validate())
+
+			m.Clear()
+			require.NoError(t, m.Validate())
+
+			// Corrupt the map's used count.
+			m.used++
+			require.Error(t, m.Validate())
+		})
+	}
+}
+
+func TestGetBatch(t *testing.T) {
+	type value [16]int
+	for _, n := range []int{0, 100, 10000} {
+		for _, moveToFront := range []bool{false, true} {
+			t.Run(fmt.Sprintf("n=%d/moveToFront=%t", n, moveToFront), func(t *testing.T) {
+				var options []Option[int, value]
+				if moveToFront {
+					options = append(options, WithMoveToFront[int, value]())
+				}
+				m := New[int, value](0, options...)
+				for i := 0; i < n; i++ {
+					m.Put(i, value{i})
+				}
+				if n == 10000 && !moveToFront {
+					// The map is large enough for lookups to be prefetched.
+					require.Equal(t, prefetchSupported, m.shouldPrefetchLookups())
+				}
+
+				// Look up a mix of present and missing keys, in a batch which
+				// spans several interleaved chunks.
+				keys := make([]int, 3*getBatchSize+5)
+				for i := range keys {
+					keys[i] = rand.Intn(2*n + 1)
+				}
+				values := make([]value, len(keys))
+				found := make([]bool, len(keys))
+				for i := range values {
+					values[i] = value{-1}
+				}
+				m.GetBatch(keys, values, found)
+				for i, k := range keys {
+					v, ok := m.Get(k)
+					require.Equal(t, ok, found[i], "key %d", k)
+					require.Equal(t, v, values[i], "key %d", k)
+				}
+			})
+		}
+	}
+
+	m := New[int, int](0)
+	m.GetBatch(nil, nil, nil)
+	require.PanicsWithValue(t, "GetBatch: len(values)=1 and len(found)=2 must be at least len(keys)=2", func() {
+		m.GetBatch([]int{1, 2}, make([]int, 1), make([]bool, 2))
+	})
+}
+
+func TestGetPutWithHash(t *testing.T) {
+	var m Map[int, int]
+	for i := 0; i < 10000; i++ {
+		h := m.Hash(i)
+		require.Equal(t, m.hash(noescape(unsafe.Pointer(&i)), m.seed), h)
+		m.PutWithHash(i, h, i)
+		m.PutWithHash(i, h, i+1)
+		v, ok := m.GetWithHash(i, h)
+		require.True(t, ok)
+		require.Equal(t, i+1, v)
+	}
+	require.NoError(t, m.Validate())
+	require.Equal(t, 10000, m.Len())
+	for i := 0; i < 20000; i++ {
+		v, ok := m.GetWithHash(i, m.Hash(i))
+		w, wok := m.Get(i)
+		require.Equal(t, wok, ok)
+		require.Equal(t, w, v)
+	}
+
+	// Clearing the map changes the seed.
+	h := m.Hash(1)
+	m.Clear()
+	require.NotEqual(t, h, m.Hash(1))
+
+	// The hash of a key in a map whose hash function ignores the seed is the
+	// value returned by the hash function.
+	hash := func(key *int, seed uintptr) uintptr { return uintptr(*key) * 0x9e3779b1 }
+	m2 := New[int, int](0, WithHash[int, int](hash))
+	for i := 0; i < 1000; i++ {
+		m2.PutWithHash(i, hash(&i, 0), i)
+	}
+	for i := 0; i < 1000; i++ {
+		v, ok := m2.Get(i)
+		require.True(t, ok)
+		require.Equal(t, i, v)
+	}
+}
+
+func TestHasher(t *testing.T) {
+	m := New[int, int](0)
+	hasher := m.Hasher()
+	hashes := make([]Hash[int], 1000)
+	for i := range hashes {
+		hashes[i] = hasher.Hash(i)
+		require.Equal(t, i, hashes[i].Key())
+		require.Equal(t, m.Hash(i), hashes[i].h)
+	}
+	for _, h := range hashes {
+		_, ok := m.GetHashed(h)
+		require.False(t, ok)
+		m.PutHashed(h, h.Key())
+	}
+	require.Equal(t, len(hashes), m.Len())
+	for _, h := range hashes[:500] {
+		v, ok := m.GetHashed(h)
+		require.True(t, ok)
+		require.Equal(t, h.Key(), v)
+		require.True(t, m.DeleteHashed(h))
+		require.False(t, m.DeleteHashed(h))
+	}
+	require.Equal(t, 500, m.Len())
+	require.NoError(t, m.Validate())
+
+	// Clearing the map changes its seed, after which the keys of stale
+	// hashes are hashed again.
+	m.Clear()
+	for _, h := range hashes {
+		m.PutHashed(h, -h.Key())
+	}
+	for i := range hashes {
+		v, ok := m.Get(i)
+		require.True(t, ok)
+		require.Equal(t, -i, v)
+	}
+	require.NoError(t, m.Validate())
+
+	// The zero Hash holds the zero key.
+	v, ok := m.GetHashed(Hash[int]{})
+	require.True(t, ok)
+	require.Equal(t, 0, v)
+}
+
+func TestDeterministicHash(t *testing.T) {
+	// fingerprint hashes the stream of entries yielded by AllByHash.
+	fingerprint := func(m *Map[string, int]) uint64 {
+		f := fnv.New64a()
+		var prev uintptr
+		m.AllByHash(func(k string, v int) bool {
+			h := m.Hash(k)
+			require.LessOrEqual(t, uint64(prev), uint64(h))
+			prev = h
+			fmt.Fprintf(f, "%s=%d,", k, v)
+			return true
+		})
+		return f.Sum64()
+	}
+
+	// Maps with the same contents yield their entries in the same order,
+	// regardless of the order in which the entries were inserted or the
+	// layout of the maps.
+	var want uint64
+	for i, maxBucketCapacity := range []uint32{groupSize, 64, math.MaxUint32} {
+		m := New[string, int](0, WithMaxBucketCapacity[string, int](maxBucketCapacity),
+			WithDeterministicHash[string, int]())
+		for _, j := range rand.Perm(2000) {
+			m.Put(fmt.Sprint(j), j)
+		}
+		for j := 1000; j < 2000; j++ {
+			m.Delete(fmt.Sprint(j))
+		}
+		m.Clear()
+		for _, j := range rand.Perm(1000) {
+			m.Put(fmt.Sprint(j), j)
+		}
+		require.Equal(t, 1000, m.Len())
+		got := fingerprint(m)
+		if i == 0 {
+			want = got
+		}
+		require.Equal(t, want, got)
+	}
+
+	if ptrBits == 64 {
+		// The hashes, and so the order of iteration, are the same in every
+		// process and on every 64-bit architecture.
+		require.Equal(t, uint64(0x2194392625d0dfe7), want)
+		s := New[string, int](0, WithDeterministicHash[string, int]())
+		require.Equal(t, uint64(0x7e827b783374001d), uint64(s.Hash("swiss")))
+		i := New[int, int](0, WithDeterministicHash[int, int]())
+		require.Equal(t, uint64(0x59a0e98cf707b0b9), uint64(i.Hash(-1)))
+		b := New[[20]byte, int](0, WithDeterministicHash[[20]byte, int]())
+		require.Equal(t, uint64(0xa2f4c90e30d73b21), uint64(b.Hash([20]byte{1, 2, 3})))
+	}
+
+	// Entries whose keys have the same hash are ordered by key.
+	m := New[int, int](0, WithDeterministicHash[int, int]())
+	m.hash = func(unsafe.Pointer, uintptr) uintptr { return 0 }
+	for _, i := range rand.Perm(7) {
+		m.Put(i, i)
+	}
+	var keys []int
+	m.AllByHash(func(k, _ int) bool {
+		keys = append(keys, k)
+		return true
+	})
+	require.Equal(t, []int{0, 1, 2, 3, 4, 5, 6}, keys)
+
+	// Unsupported key types are rejected.
+	_, err := NewE[float64, int](0, WithDeterministicHash[float64, int]())
+	require.Regexp(t, "deterministic hashing is not supported for keys of type float64", err)
+	require.Panics(t, func() {
+		New[float64, int](0, WithDeterministicHash[float64, int]())
+	})
+}
+
+func TestGetOrPut(t *testing.T) {
+	for _, maxBucketCapacity := range []uint32{groupSize, 64, defaultMaxBucketCapacity} {
+		t.Run(fmt.Sprint(maxBucketCapacity), func(t *testing.T) {
+			m := New[int, int](0, WithMaxBucketCapacity[int, int](maxBucketCapacity))
+			e := make(map[int]int)
+			for i := 0; i < 10000; i++ {
+				k := rand.Intn(2000)
+				if rand.Intn(4) == 0 {
+					m.Delete(k)
+					delete(e, k)
+					continue
+				}
+				v, loaded := m.GetOrPut(k, i)
+				ev, eloaded := e[k]
+				require.Equal(t, eloaded, loaded)
+				if eloaded {
+					require.Equal(t, ev, v)
+				} else {
+					require.Equal(t, i, v)
+					e[k] = i
+				}
+			}
+			require.NoError(t, m.Validate())
+			require.Equal(t, len(e), m.Len())
+			for k, ev := range e {
+				v, ok := m.Get(k)
+				require.True(t, ok)
+				require.Equal(t, ev, v)
+			}
+		})
+	}
+}
+
+func TestPutIfAbsent(t *testing.T) {
+	m := New[int, int](0, WithMaxBucketCapacity[int, int](groupSize),
+		WithOperationCounters[int, int]())
+	for i := 0; i < 1000; i++ {
+		require.True(t, m.PutIfAbsent(i, i))
+	}
+	for i := 0; i < 1000; i++ {
+		require.False(t, m.PutIfAbsent(i, -i))
+		v, ok := m.Get(i)
+		require.True(t, ok)
+		require.Equal(t, i, v)
+	}
+	for i := 0; i < 1000; i += 2 {
+		m.Delete(i)
+	}
+	for i := 0; i < 1000; i++ {
+		require.Equal(t, i%2 == 0, m.PutIfAbsent(i, -i))
+	}
+	require.NoError(t, m.Validate())
+	require.Equal(t, 1000, m.Len())
+	require.EqualValues(t, 1500, m.Stats().Inserts)
+	require.EqualValues(t, 0, m.Stats().Overwrites)
+}
+
+// h2Stats holds statistics about the matching of control bytes against
+// h2(hash(key)) performed while probing for a set of keys. See probeH2Stats.
+type h2Stats struct {
+	// Keys is the number of keys probed for.
+	Keys int
+	// Groups is the number of groups visited while probing.
+	Groups int
+	// Matches is the number of control bytes which exactly matched h2.
+	Matches int
+	// Collisions is the number of Matches for which the key in the slot was
+	// not the key being probed for.
+	Collisions int
+	// FalsePositives is the number of additional control bytes reported as
+	// matching h2 by the default SWAR matching routine which did not actually
+	// match. Building with the "swiss_exact_h2" build tag selects a matching
+	// routine which does not produce false positives.
+	FalsePositives int
+}
+
+// probeH2Stats probes the map for each of the specified keys in the same
+// manner as Get, and returns statistics about how effective the control byte
+// matching was at filtering the slots whose keys needed to be compared. It is
+// intended for evaluating the matching routines against real key
+// distributions and is not optimized for performance.
+func probeH2Stats[K comparable, V any](m *Map[K, V], keys []K) h2Stats {
+	var s h2Stats
+	for i := range keys {
+		key := keys[i]
+		h := m.hash(noescape(unsafe.Pointer(&key)), m.seed)
+		b := m.bucket(h)
+		s.Keys++
+
+		seq := b.probe(h)
+	probe:
+		for ; ; seq = seq.next() {
+			g := b.groups.At(uintptr(seq.offset))
+			s.Groups++
+			exact := g.ctrls.matchH2Exact(h2(h))
+			swar := g.ctrls.matchH2SWAR(h2(h))
+			s.FalsePositives += bits.OnesCount64(uint64(swar &^ exact))
+
+			for match := exact; match != 0; match = match.removeFirst() {
+				s.Matches++
+				if key == *g.slots.Key(match.first()) {
+					break probe
+				}
+				s.Collisions++
+			}
+
+			if g.ctrls.matchEmpty() != 0 {
+				break
+			}
+		}
+	}
+	return s
+}
+
+func TestH2Stats(t *testing.T) {
+	m := New[int, int](0)
+	keys := make([]int, 1000)
+	for i := range keys {
+		keys[i] = i
+		m.Put(i, i)
+	}
+	s := probeH2Stats(m, keys)
+	require.Equal(t, len(keys), s.Keys)
+	require.LessOrEqual(t, s.Keys, s.Groups)
+	require.Equal(t, s.Keys, s.Matches-s.Collisions)
+
+	// Probing for keys which are not present never finds a match.
+	for i := range keys {
+		keys[i] = -1 - i
+	}
+	s = probeH2Stats(m, keys)
+	require.Equal(t, s.Matches, s.Collisions)
+}
+
+func TestEqual(t *testing.T) {
+	m1 := New[int, int](0)
+	m2 := New[int, int](0, WithMaxBucketCapacity[int, int](groupSize))
+	require.True(t, Equal(m1, m2))
+	for i := 0; i < 1000; i++ {
+		m1.Put(i, i)
+	}
+	// Insert in a different order so that the maps have different layouts.
+	for i := 999; i >= 0; i-- {
+		m2.Put(i, i)
+	}
+	require.True(t, Equal(m1, m2))
+	require.True(t, Equal(m2, m1))
+
+	m2.Put(500, -1)
+	require.False(t, Equal(m1, m2))
+	require.True(t, m1.EqualFunc(m2, func(a, b int) bool {
+		return a == b || b == -1
+	}))
+
+	// Same length but a different key.
+	m2.Delete(500)
+	m2.Put(1000, 1000)
+	require.Equal(t, m1.Len(), m2.Len())
+	require.False(t, Equal(m1, m2))
+	require.False(t, Equal(m2, m1))
+
+	m2.Delete(1000)
+	require.False(t, Equal(m1, m2))
+
+	// Values which are not comparable.
+	s1 := New[int, []int](0)
+	s2 := New[int, []int](0)
+	s1.Put(1, []int{1, 2})
+	s2.Put(1, []int{1, 2})
+	require.True(t, s1.EqualFunc(s2, slices.Equal[[]int]))
+	s2.Put(1, []int{1})
+	require.False(t, s1.EqualFunc(s2, slices.Equal[[]int]))
+}
+
+func TestCompute(t *testing.T) {
+	m := New[int, int](0, WithMaxBucketCapacity[int, int](groupSize),
+		WithOperationCounters[int, int]())
+	e := make(map[int]int)
+	for i := 0; i < 20000; i++ {
+		k := rand.Intn(1000)
+		del := rand.Intn(4) == 0
+		m.Compute(k, func(old int, exists bool) (int, bool) {
+			ev, eexists := e[k]
+			require.Equal(t, eexists, exists)
+			require.Equal(t, ev, old)
+			return old + 1, del
+		})
+		if del {
+			delete(e, k)
+		} else {
+			e[k]++
+		}
+	}
+	require.NoError(t, m.Validate())
+	require.Equal(t, len(e), m.Len())
+	for k, ev := range e {
+		v, ok := m.Get(k)
+		require.True(t, ok)
+		require.Equal(t, ev, v)
+	}
+
+	s := m.Stats()
+	require.EqualValues(t, len(e), s.Inserts-s.Deletes)
+}
+
+func TestDeleteFunc(t *testing.T) {
+	for _, maxBucketCapacity := range []uint32{groupSize, 64, defaultMaxBucketCapacity} {
+		t.Run(fmt.Sprint(maxBucketCapacity), func(t *testing.T) {
+			m := New[int, int](0, WithMaxBucketCapacity[int, int](maxBucketCapacity),
+				WithOperationCounters[int, int]())
+			e := make(map[int]int)
+			for i := 0; i < 10000; i++ {
+				m.Put(i, i%7)
+				e[i] = i % 7
+			}
+			snap := m.Snapshot()
+
+			// Delete the majority of the entries so that buckets are left
+			// with many tombstones.
+			n := m.DeleteFunc(func(k, v int) bool {
+				require.Equal(t, e[k], v)
+				return v != 0
+			})
+			var expected int
+			for k, v := range e {
+				if v != 0 {
+					delete(e, k)
+					expected++
+				}
+			}
+			require.Equal(t, expected, n)
+			require.NoError(t, m.Validate())
+			require.Equal(t, e, m.ToMap())
+			require.EqualValues(t, expected, m.Stats().Deletes)
+			m.buckets(0, func(b *bucket[int, int]) bool {
+				if b.capacity > groupSize {
+					require.Less(t, b.tombstones(), b.capacity/3)
+				}
+				return true
+			})
+
+			// The snapshot is unaffected.
+			require.Equal(t, 10000, snap.Len())
+			require.NoError(t, snap.Validate())
+
+			require.Equal(t, 0, m.DeleteFunc(func(k, v int) bool { return false }))
+
+			// A panic from f leaves the map consistent, with the entries
+			// deleted before the panic removed.
+			var calls int
+			require.Panics(t, func() {
+				m.DeleteFunc(func(k, v int) bool {
+					if calls++; calls == len(e)/2 {
+						panic("boom")
+					}
+					return true
+				})
+			})
+			require.NoError(t, m.Validate())
+			require.Equal(t, len(e)-(calls-1), m.Len())
+
+			require.Equal(t, m.Len(), m.DeleteFunc(func(k, v int) bool { return true }))
+			require.Equal(t, 0, m.Len())
+			require.NoError(t, m.Validate())
+		})
+	}
+}
+
+func TestDeleteBatch(t *testing.T) {
+	for _, maxBucketCapacity := range []uint32{groupSize, 64, defaultMaxBucketCapacity} {
+		t.Run(fmt.Sprint(maxBucketCapacity), func(t *testing.T) {
+			m := New[int, int](0, WithMaxBucketCapacity[int, int](maxBucketCapacity),
+				WithOperationCounters[int, int]())
+			e := make(map[int]int)
+			for i := 0; i < 10000; i++ {
+				m.Put(i, i)
+				e[i] = i
+			}
+			snap := m.Snapshot()
+
+			// Delete most of the entries, along with keys which are missing
+			// or repeated.
+			var keys []int
+			expected := 0
+			for i := 0; i < 20000; i++ {
+				if i%4 != 0 {
+					keys = append(keys, i)
+					if _, ok := e[i]; ok {
+						expected++
+					}
+					delete(e, i)
+				}
+			}
+			keys = append(keys, 1, 2, -1)
+			require.Equal(t, expected, m.DeleteBatch(keys))
+			require.NoError(t, m.Validate())
+			require.Equal(t, e, m.ToMap())
+			require.EqualValues(t, expected, m.Stats().Deletes)
+			m.buckets(0, func(b *bucket[int, int]) bool {
+				if b.capacity > groupSize {
+					require.Less(t, b.tombstones(), b.capacity/3)
+				}
+				return true
+			})
+
+			// The snapshot is unaffected.
+			require.Equal(t, 10000, snap.Len())
+			require.NoError(t, snap.Validate())
+
+			require.Equal(t, 0, m.DeleteBatch(nil))
+			require.Equal(t, 0, m.DeleteBatch(keys))
+		})
+	}
+}
+
+func TestBatch(t *testing.T) {
+	for _, maxBucketCapacity := range []uint32{groupSize, 64, defaultMaxBucketCapacity} {
+		t.Run(fmt.Sprint(maxBucketCapacity), func(t *testing.T) {
+			m := New[int, int](0, WithMaxBucketCapacity[int, int](maxBucketCapacity),
+				WithOperationCounters[int, int]())
+			e := make(map[int]int)
+			for i := 0; i < 1000; i++ {
+				m.Put(i, i)
+				e[i] = i
+			}
+			snap := m.Snapshot()
+
+			// Staged mutations are not visible in the map until the batch is
+			// committed, but are visible through the batch.
+			tx := m.Batch()
+			for i := 0; i < 3000; i += 3 {
+				tx.Put(i, -i)
+			}
+			for i := 1; i < 3000; i += 6 {
+				tx.Delete(i)
+			}
+			tx.Put(1, 100)
+			tx.Delete(3)
+			require.Equal(t, 1500, tx.Len())
+			require.Equal(t, e, m.ToMap())
+			v, ok := tx.Get(1)
+			require.True(t, ok)
+			require.Equal(t, 100, v)
+			_, ok = tx.Get(3)
+			require.False(t, ok)
+			v, ok = tx.Get(2)
+			require.True(t, ok)
+			require.Equal(t, 2, v)
+
+			tx.Rollback()
+			require.Equal(t, 0, tx.Len())
+			require.Equal(t, e, m.ToMap())
+
+			for i := 0; i < 3000; i += 3 {
+				tx.Put(i, -i)
+				e[i] = -i
+			}
+			for i := 1; i < 3000; i += 6 {
+				tx.Delete(i)
+				delete(e, i)
+			}
+			tx.Commit()
+			require.Equal(t, 0, tx.Len())
+			require.NoError(t, m.Validate())
+			require.Equal(t, e, m.ToMap())
+			stats := m.Stats()
+			require.EqualValues(t, 1000+666, stats.Inserts)
+			require.EqualValues(t, 334, stats.Overwrites)
+			require.EqualValues(t, 167, stats.Deletes)
+
+			// The snapshot is unaffected.
+			require.Equal(t, 1000, snap.Len())
+			require.NoError(t, snap.Validate())
+			snap.All(func(k, v int) bool {
+				require.Equal(t, k, v)
+				return true
+			})
+		})
+	}
+}
+
+func TestBatchEmptyMap(t *testing.T) {
+	// Committing a large batch to an empty map splits the empty bucket to
+	// make room for the entries, which must not be mistaken for a degenerate
+	// hash function (which would grow maxBucketCapacity).
+	m := New[int, int](0, WithMaxBucketCapacity[int, int](64))
+	tx := m.Batch()
+	for i := 0; i < 10000; i++ {
+		tx.Put(i, i)
+	}
+	tx.Commit()
+	require.NoError(t, m.Validate())
+	require.Equal(t, 10000, m.Len())
+	require.EqualValues(t, 64, m.maxBucketCapacity)
+	m.ForEachBucketStats(func(s BucketStats) bool {
+		require.LessOrEqual(t, s.Capacity, uint32(64))
+		return true
+	})
+}
+
+func TestBatchDegenerateHash(t *testing.T) {
+	// The hashes of the staged entries cannot be separated by splitting, so
+	// Commit must stop splitting the bucket and insert the entries as Put
+	// does rather than splitting forever.
+	m := New[int, int](0, WithHash[int, int](func(key *int, seed uintptr) uintptr {
+		return 0
+	}), WithMaxBucketCapacity[int, int](8))
+	tx := m.Batch()
+	for i := 0; i < 30; i++ {
+		tx.Put(i, i)
+	}
+	tx.Commit()
+	require.NoError(t, m.Validate())
+	require.Equal(t, 30, m.Len())
+	for i := 0; i < 30; i++ {
+		v, ok := m.Get(i)
+		require.True(t, ok)
+		require.Equal(t, i, v)
+	}
+	require.LessOrEqual(t, m.globalDepth(), uint32(maxReservePrefixDepth))
+}
+
+func TestPutBatch(t *testing.T) {
+	for _, maxBucketCapacity := range []uint32{groupSize, 64, defaultMaxBucketCapacity} {
+		t.Run(fmt.Sprint(maxBucketCapacity), func(t *testing.T) {
+			m := New[int, int](0, WithMaxBucketCapacity[int, int](maxBucketCapacity),
+				WithOperationCounters[int, int]())
+			e := make(map[int]int)
+			for i := 0; i < 1000; i++ {
+				m.Put(i, i)
+				e[i] = i
+			}
+			snap := m.Snapshot()
+
+			// Overwrite every third existing entry and insert new entries,
+			// with a repeated key whose last value wins.
+			var keys, values []int
+			for i := 0; i < 5000; i += 3 {
+				keys = append(keys, i)
+				values = append(values, -i)
+				e[i] = -i
+			}
+			keys = append(keys, 3001, 3001)
+			values = append(values, 1, 2)
+			e[3001] = 2
+			m.PutBatch(keys, values)
+			require.NoError(t, m.Validate())
+			require.Equal(t, e, m.ToMap())
+			stats := m.Stats()
+			require.EqualValues(t, 1000+1333+1, stats.Inserts)
+			require.EqualValues(t, 334+1, stats.Overwrites)
+
+			// The snapshot is unaffected.
+			require.Equal(t, 1000, snap.Len())
+			require.NoError(t, snap.Validate())
+			snap.All(func(k, v int) bool {
+				require.Equal(t, k, v)
+				return true
+			})
+		})
+	}
+
+	m := New[int, int](0)
+	m.PutBatch(nil, nil)
+	require.Equal(t, 0, m.Len())
+	require.PanicsWithValue(t, "PutBatch: len(keys)=2 does not equal len(values)=1", func() {
+		m.PutBatch([]int{1, 2}, []int{1})
+	})
+}
+
+func TestPutBatchDuplicates(t *testing.T) {
+	// A repeated key inserts a single entry, and must not be counted as many
+	// entries in one bucket which splitting can never separate.
+	m := New[int, int](0)
+	m.PutBatch(make([]int, 5000), make([]int, 5000))
+	require.NoError(t, m.Validate())
+	require.Equal(t, 1, m.Len())
+
+	m = New[int, int](0, WithMaxBucketCapacity[int, int](8))
+	keys, values := make([]int, 20), make([]int, 20)
+	for i := range values {
+		values[i] = i
+	}
+	m.PutBatch(keys, values)
+	require.NoError(t, m.Validate())
+	require.Equal(t, map[int]int{0: 19}, m.ToMap())
+	// The duplicates are detected by the first split, which does not separate
+	// them.
+	require.LessOrEqual(t, m.globalDepth(), uint32(1))
+}
+
+func TestReserve(t *testing.T) {
+	for _, maxBucketCapacity := range []uint32{groupSize, 64, defaultMaxBucketCapacity} {
+		t.Run(fmt.Sprint(maxBucketCapacity), func(t *testing.T) {
+			m := New[int, int](0, WithMaxBucketCapacity[int, int](maxBucketCapacity))
+			for i := 0; i < 100; i++ {
+				m.Put(i, i)
+			}
+			// Reserving room in a map shared with a snapshot must leave the
+			// snapshot untouched.
+			snap := m.Snapshot()
+
+			const n = 10000
+			m.Reserve(n)
+			require.NoError(t, m.Validate())
+			require.Equal(t, 100, m.Len())
+			s := m.Stats()
+			l, err := Describe[int, int](n+100, WithMaxBucketCapacity[int, int](maxBucketCapacity))
+			require.NoError(t, err)
+			// The number of buckets is not compared as the initial Puts may
+			// have grown maxBucketCapacity (see bucket.split).
+			require.GreaterOrEqual(t, s.Capacity, l.Capacity)
+
+			// Reserving room which is already available is a no-op.
+			m.Reserve(n)
+			require.Equal(t, s, m.Stats())
+
+			for i := 100; i < n+100; i++ {
+				m.Put(i, i)
+			}
+			require.NoError(t, m.Validate())
+			require.Equal(t, n+100, m.Len())
+			if s.Buckets == 1 {
+				require.Equal(t, s.Capacity, m.Stats().Capacity)
+			}
+
+			require.NoError(t, snap.Validate())
+			require.Equal(t, 100, snap.Len())
+			for i := 0; i < 100; i++ {
+				v, ok := snap.Get(i)
+				require.True(t, ok)
+				require.Equal(t, i, v)
+			}
+		})
+	}
+
+	// A flat table is guaranteed not to resize while inserting the reserved
+	// entries. The count is kept small as the single bucket makes each Put
+	// O(n) under exhaustive invariants.
+	const n = 1000
+	m := New[int, int](0, WithFlatTable[int, int]())
+	m.Reserve(n)
+	c := m.Stats().Capacity
+	for i := 0; i < n; i++ {
+		m.Put(i, i)
+	}
+	require.Equal(t, c, m.Stats().Capacity)
+	require.Panics(t, func() { m.Reserve(math.MaxInt / 2) })
+}
+
+func TestShrinkToFit(t *testing.T) {
+	for _, maxBucketCapacity := range []uint32{groupSize, 64, defaultMaxBucketCapacity} {
+		t.Run(fmt.Sprint(maxBucketCapacity), func(t *testing.T) {
+			m := New[int, int](0, WithMaxBucketCapacity[int, int](maxBucketCapacity))
+			e := make(map[int]int)
+			for i := 0; i < 100000; i++ {
+				m.Put(i, i)
+				if rand.Intn(1000) == 0 {
+					e[i] = i
+				}
+			}
+			snap := m.Snapshot()
+			m.DeleteFunc(func(k, _ int) bool {
+				_, ok := e[k]
+				return !ok
+			})
+			before := m.Stats()
+
+			m.ShrinkToFit()
+			require.NoError(t, m.Validate())
+			require.Equal(t, e, m.ToMap())
+			after := m.Stats()
+			require.Less(t, after.Buckets, before.Buckets)
+			require.Less(t, after.Capacity, before.Capacity)
+			m.ForEachBucketStats(func(s BucketStats) bool {
+				require.Equal(t, fitCapacity(s.Used), s.Capacity)
+				return true
+			})
+
+			// The snapshot still holds all of the entries.
+			require.NoError(t, snap.Validate())
+			require.Equal(t, 100000, snap.Len())
+
+			m.Clear()
+			m.ShrinkToFit()
+			require.NoError(t, m.Validate())
+			require.Equal(t, 1, m.Stats().Buckets)
+			require.Equal(t, 0, m.Stats().Capacity)
+			m.Put(1, 1)
+			require.NoError(t, m.Validate())
+			require.Equal(t, 1, m.Len())
+		})
+	}
+}
+
+func TestStrictIterationSnapshot(t *testing.T) {
+	a := &countingAllocator[int, int]{}
+	m := New[int, int](0, WithAllocator[int, int](a),
+		WithMaxBucketCapacity[int, int](64),
+		WithStrictIterationSnapshot[int, int]())
+	for i := 0; i < 1000; i++ {
+		m.Put(i, i)
+	}
+
+	// Inserting and overwriting during iteration does not affect the entries
+	// yielded.
+	e := m.ToMap()
+	yielded := make(map[int]int)
+	m.All(func(k, v int) bool {
+		yielded[k] = v
+		m.Put(k+1000, k)
+		m.Put(k, -k)
+		return true
+	})
+	require.Equal(t, e, yielded)
+	require.NoError(t, m.Validate())
+	require.Equal(t, 2000, m.Len())
+
+	// AllLive omits the entries deleted during iteration.
+	var n int
+	m.AllLive(func(k, v int) bool {
+		m.Delete(k ^ 1)
+		n++
+		return true
+	})
+	require.Equal(t, 1000, n)
+
+	// Computing the closure of x -> 2x mod 1000 by inserting into the map
+	// being iterated terminates once no new entries are found.
+	m.Clear()
+	m.Put(1, 0)
+	for changed := true; changed; {
+		changed = false
+		m.Keys(func(k int) bool {
+			changed = m.PutIfAbsent((2*k)%1000, 0) || changed
+			return true
+		})
+	}
+	require.NoError(t, m.Validate())
+	require.Equal(t, 103, m.Len())
+
+	m.Close()
+	allocs, groups := m.OutstandingAllocations()
+	require.Zero(t, allocs)
+	require.Zero(t, groups)
+	require.Equal(t, a.alloc, a.free)
+}
+
+func TestClearAndRelease(t *testing.T) {
+	for _, indirect := range []bool{false, true} {
+		t.Run(fmt.Sprintf("indirect=%t", indirect), func(t *testing.T) {
+			a := &countingAllocator[int, int]{}
+			options := []Option[int, int]{
+				WithAllocator[int, int](a),
+				WithMaxBucketCapacity[int, int](64),
+				WithOperationCounters[int, int](),
+			}
+			if indirect {
+				options = append(options, WithIndirectBucket0[int, int]())
+			}
+			m := New[int, int](0, options...)
+			for round := 0; round < 3; round++ {
+				for i := 0; i < 10000; i++ {
+					m.Put(i, i)
+				}
+				snap := m.Snapshot()
+				m.ClearAndRelease()
+				require.NoError(t, m.Validate())
+				require.Equal(t, 0, m.Len())
+				s := m.Stats()
+				require.Equal(t, 1, s.Buckets)
+				require.Equal(t, 0, s.Capacity)
+				require.Equal(t, s.Inserts, s.Deletes)
+				allocs, _ := m.OutstandingAllocations()
+				require.Zero(t, allocs)
+
+				// The snapshot is unaffected.
+				require.NoError(t, snap.Validate())
+				require.Equal(t, 10000, snap.Len())
+				snap.Close()
+				require.Equal(t, a.alloc, a.free)
+
+				_, ok := m.Get(1)
+				require.False(t, ok)
+			}
+		})
+	}
+}
+
+func TestReset(t *testing.T) {
+	for _, indirect := range []bool{false, true} {
+		t.Run(fmt.Sprintf("indirect=%t", indirect), func(t *testing.T) {
+			a := &countingAllocator[int, int]{}
+			options := []Option[int, int]{
+				WithAllocator[int, int](a),
+				WithMaxBucketCapacity[int, int](64),
+				WithOperationCounters[int, int](),
+			}
+			if indirect {
+				options = append(options, WithIndirectBucket0[int, int]())
+			}
+			m := New[int, int](0, options...)
+			for round := 0; round < 3; round++ {
+				for i := 0; i < 10000; i++ {
+					m.Put(i, i)
+				}
+				m.Reset()
+				require.NoError(t, m.Validate())
+				require.Equal(t, 0, m.Len())
+				s := m.Stats()
+				require.Equal(t, 1, s.Buckets)
+				require.Equal(t, 64, s.Capacity)
+				require.Equal(t, s.Inserts, s.Deletes)
+				allocs, _ := m.OutstandingAllocations()
+				require.Equal(t, 1, allocs)
+
+				// Reusing the map for a small working set does not allocate.
+				alloc := a.alloc
+				for i := 0; i < 50; i++ {
+					m.Put(i, i)
+				}
+				require.Equal(t, alloc, a.alloc)
+				require.NoError(t, m.Validate())
+				m.Reset()
+			}
+
+			// The retained bucket is released rather than copied if it is
+			// shared with a snapshot.
+			for i := 0; i < 1000; i++ {
+				m.Put(i, i)
+			}
+			snap := m.Snapshot()
+			m.Reset()
+			require.NoError(t, m.Validate())
+			require.Equal(t, 0, m.Stats().Capacity)
+			require.NoError(t, snap.Validate())
+			require.Equal(t, 1000, snap.Len())
+			snap.Close()
+			m.Close()
+			require.Equal(t, a.alloc, a.free)
+		})
+	}
+}
+
+func TestClearWithHint(t *testing.T) {
+	a := &countingAllocator[int, int]{}
+	options := []Option[int, int]{WithAllocator[int, int](a)}
+	m := New[int, int](0, options...)
+	fill := func(n int) {
+		for i := 0; i < n; i++ {
+			m.Put(i, i)
+		}
+	}
+	capacity := func(n int) int {
+		l, err := Describe[int, int](n, options...)
+		require.NoError(t, err)
+		return l.Capacity
+	}
+
+	// A map cleared with a much smaller hint shrinks to the capacity of a new
+	// map with that capacity.
+	fill(10000)
+	require.Equal(t, 10000, m.ClearWithHint(100))
+	require.NoError(t, m.Validate())
+	require.Equal(t, 0, m.Len())
+	require.Equal(t, capacity(100), m.Stats().Capacity)
+
+	// Reusing the map for the hinted working set, which fits in a single
+	// bucket, does not allocate.
+	alloc := a.alloc
+	fill(100)
+	require.Equal(t, alloc, a.alloc)
+
+	// A map cleared with a hint within twice its capacity retains its memory.
+	require.Equal(t, 100, m.ClearWithHint(60))
+	require.Equal(t, alloc, a.alloc)
+	require.Equal(t, capacity(100), m.Stats().Capacity)
+
+	// A map cleared with a larger hint grows as by Reserve.
+	fill(100)
+	require.Equal(t, 100, m.ClearWithHint(5000))
+	require.NoError(t, m.Validate())
+	require.LessOrEqual(t, capacity(5000), m.Stats().Capacity)
+	fill(5000)
+	require.NoError(t, m.Validate())
+
+	// Pooled maps reused for batches of varying sizes converge to the size
+	// of the batches rather than carrying the largest ever seen.
+	for _, n := range []int{10000, 50, 3000, 50} {
+		m.ClearWithHint(n)
+		fill(n)
+		require.NoError(t, m.Validate())
+	}
+	require.Equal(t, capacity(50), m.Stats().Capacity)
+
+	m.Close()
+	require.Equal(t, a.alloc, a.free)
+}
+
+func TestMerge(t *testing.T) {
+	for _, maxBucketCapacity := range []uint32{groupSize, 64, defaultMaxBucketCapacity} {
+		t.Run(fmt.Sprint(maxBucketCapacity), func(t *testing.T) {
+			a := &countingAllocator[int, int]{}
+			m := New[int, int](0, WithAllocator[int, int](a),
+				WithMaxBucketCapacity[int, int](maxBucketCapacity))
+			other := New[int, int](0)
+			e := make(map[int]int)
+			for i := 0; i < 1000; i++ {
+				m.Put(i, i)
+				e[i] = i
+			}
+			for i := 500; i < 20000; i++ {
+				other.Put(i, -i)
+				if _, ok := e[i]; ok {
+					e[i] += -i
+				} else {
+					e[i] = -i
+				}
+			}
+			snap := m.Snapshot()
+			m.Merge(other, func(k, a, b int) int {
+				require.Equal(t, k, a)
+				require.Equal(t, -k, b)
+				return a + b
+			})
+			require.NoError(t, m.Validate())
+			require.Equal(t, e, m.ToMap())
+			require.Equal(t, 19500, other.Len())
+			require.Equal(t, 1000, snap.Len())
+			require.NoError(t, snap.Validate())
+
+			// Merging the entries of a map which are all present only
+			// overwrites values, and does not allocate.
+			allocs := a.alloc
+			m.Merge(snap, func(k, a, b int) int {
+				return b
+			})
+			require.Equal(t, allocs, a.alloc)
+			for i := 0; i < 1000; i++ {
+				e[i] = i
+			}
+			require.Equal(t, e, m.ToMap())
+
+			// Merging an empty map is a no-op.
+			m.Merge(New[int, int](0), nil)
+			require.Equal(t, e, m.ToMap())
+		})
+	}
+}
+
+func TestMergePresize(t *testing.T) {
+	// Presizing the buckets means that each bucket of the merged map is
+	// allocated at most twice: once by the split which created it (or for
+	// the original bucket) and once when it is resized to hold its share of
+	// the merged entries.
+	a := &countingAllocator[int, int]{}
+	m := New[int, int](0, WithAllocator[int, int](a))
+	other := New[int, int](0)
+	for i := 0; i < 100000; i++ {
+		other.Put(i, i)
+	}
+	m.Merge(other, nil)
+	require.Equal(t, 100000, m.Len())
+	require.LessOrEqual(t, a.alloc, 2*m.Stats().Buckets)
+}
+
+func TestIntersectDifference(t *testing.T) {
+	// Exercise both the case where the receiver is the smaller map and the
+	// case where other is.
+	for _, n := range []int{100, 10000} {
+		t.Run(fmt.Sprint(n), func(t *testing.T) {
+			makeMaps := func() (*Map[int, int], *Map[int, int], map[int]int, map[int]bool) {
+				m := New[int, int](0, WithMaxBucketCapacity[int, int](64),
+					WithOperationCounters[int, int]())
+				other := New[int, int](0)
+				e := make(map[int]int)
+				o := make(map[int]bool)
+				for i := 0; i < 1000; i++ {
+					k := rand.Intn(2000)
+					m.Put(k, i)
+					e[k] = i
+				}
+				for i := 0; i < n; i++ {
+					k := rand.Intn(2 * n)
+					other.Put(k, -1)
+					o[k] = true
+				}
+				return m, other, e, o
+			}
+
+			m, other, e, o := makeMaps()
+			otherLen := other.Len()
+			inserts := m.Stats().Inserts
+			m.Intersect(other)
+			for k := range e {
+				if !o[k] {
+					delete(e, k)
+				}
+			}
+			require.NoError(t, m.Validate())
+			require.Equal(t, e, m.ToMap())
+			require.Equal(t, otherLen, other.Len())
+			stats := m.Stats()
+			require.Equal(t, inserts, stats.Inserts)
+			require.EqualValues(t, stats.Inserts-stats.Deletes, m.Len())
+
+			m, other, e, o = makeMaps()
+			otherLen = other.Len()
+			m.Difference(other)
+			for k := range o {
+				delete(e, k)
+			}
+			require.NoError(t, m.Validate())
+			require.Equal(t, e, m.ToMap())
+			require.Equal(t, otherLen, other.Len())
+		})
+	}
+}
+
+func TestDiff(t *testing.T) {
+	a := New[int, int](0, WithMaxBucketCapacity[int, int](64))
+	b := New[int, int](0)
+	require.Empty(t, Diff(a, b, func(x, y int) bool { return x == y }))
+
+	expected := make(map[int]DiffEntry[int, int])
+	for i := 0; i < 10000; i++ {
+		switch i % 4 {
+		case 0:
+			a.Put(i, i)
+			b.Put(i, i)
+		case 1:
+			a.Put(i, i)
+			expected[i] = DiffEntry[int, int]{Kind: DiffOnlyInA, Key: i, A: i}
+		case 2:
+			b.Put(i, -i)
+			expected[i] = DiffEntry[int, int]{Kind: DiffOnlyInB, Key: i, B: -i}
+		case 3:
+			a.Put(i, i)
+			b.Put(i, -i)
+			expected[i] = DiffEntry[int, int]{Kind: DiffValue, Key: i, A: i, B: -i}
+		}
+	}
+
+	diff := Diff(a, b, func(x, y int) bool { return x == y })
+	actual := make(map[int]DiffEntry[int, int])
+	for _, d := range diff {
+		actual[d.Key] = d
+	}
+	require.Len(t, diff, len(actual))
+	require.Equal(t, expected, actual)
+
+	// Diffing the same maps again produces the same order.
+	require.Equal(t, diff, Diff(a, b, func(x, y int) bool { return x == y }))
+	require.Empty(t, Diff(a, a, func(x, y int) bool { return x == y }))
+	require.Equal(t, "only-in-b", DiffOnlyInB.String())
+}
+
+// failingAllocator is an Allocator which panics once a limit on the number
+// of allocations is reached.
+type failingAllocator[K comparable, V any] struct {
+	countingAllocator[K, V]
+	limit int
+}
+
+func (a *failingAllocator[K, V]) Alloc(n int) []Group[K, V] {
+	if a.alloc >= a.limit {
+		panic("out of memory")
+	}
+	return a.countingAllocator.Alloc(n)
+}
+
+func TestBatchCommitFailure(t *testing.T) {
+	for _, maxBucketCapacity := range []uint32{groupSize, 64, defaultMaxBucketCapacity} {
+		t.Run(fmt.Sprint(maxBucketCapacity), func(t *testing.T) {
+			a := &failingAllocator[int, int]{limit: math.MaxInt}
+			hash, _ := newHasher[int]()
+			m := New[int, int](0,
+				WithAllocator[int, int](a),
+				WithMaxBucketCapacity[int, int](maxBucketCapacity),
+				WithHash[int, int](func(key *int, seed uintptr) uintptr {
+					if *key == -1 {
+						panic("bad key")
+					}
+					return hash(noescape(unsafe.Pointer(key)), seed)
+				}))
+			for i := 0; i < 1000; i++ {
+				m.Put(i, i)
+			}
+			e := m.ToMap()
+			snap := m.Snapshot()
+
+			stage := func(tx *Batch[int, int]) {
+				for i := 0; i < 3000; i += 2 {
+					tx.Put(i, -i)
+				}
+				for i := 1; i < 1000; i += 4 {
+					tx.Delete(i)
+				}
+			}
+
+			// A panic from the hash function leaves the map unmodified.
+			tx := m.Batch()
+			stage(tx)
+			tx.Put(-1, -1)
+			require.PanicsWithValue(t, "bad key", tx.Commit)
+			require.NoError(t, m.Validate())
+			require.Equal(t, e, m.ToMap())
+
+			// A panic from the allocator at any point leaves the entries of
+			// the map unmodified.
+			for limit := a.alloc; ; limit++ {
+				a.limit = limit
+				tx := m.Batch()
+				stage(tx)
+				var panicked bool
+				func() {
+					defer func() { panicked = recover() != nil }()
+					tx.Commit()
+				}()
+				require.NoError(t, m.Validate())
+				if !panicked {
+					break
+				}
+				require.Equal(t, e, m.ToMap())
+			}
+			for i := 0; i < 3000; i += 2 {
+				e[i] = -i
+			}
+			for i := 1; i < 1000; i += 4 {
+				delete(e, i)
+			}
+			require.Equal(t, e, m.ToMap())
+			require.Equal(t, 1000, snap.Len())
+			require.NoError(t, snap.Validate())
+		})
+	}
+}
+
+func TestModify(t *testing.T) {
+	type value struct {
+		hits  int
+		bytes [64]byte
+	}
+	m := New[int, value](0, WithMaxBucketCapacity[int, value](groupSize))
+	for i := 0; i < 1000; i += 2 {
+		m.Put(i, value{})
+	}
+	// Take a snapshot to verify that Modify does not mutate shared groups.
+	snap := m.Snapshot()
+	for i := 0; i < 1000; i++ {
+		for j := 0; j < i%3; j++ {
+			ok := m.Modify(i, func(v *value) {
+				v.hits++
+				v.bytes[v.hits] = byte(i)
+			})
+			require.Equal(t, i%2 == 0, ok)
+		}
+	}
+	require.NoError(t, m.Validate())
+	require.Equal(t, 500, m.Len())
+	for i := 0; i < 1000; i++ {
+		v, ok := m.Get(i)
+		require.Equal(t, i%2 == 0, ok)
+		if ok {
+			require.Equal(t, i%3, v.hits)
+			if v.hits > 0 {
+				require.Equal(t, byte(i), v.bytes[v.hits])
+			}
+		}
+		v, _ = snap.Get(i)
+		require.Equal(t, value{}, v)
+	}
+}
+
+func TestReserveKey(t *testing.T) {
+	m := New[int, []int](0, WithMaxBucketCapacity[int, []int](8))
+	for i := 0; i < 1000; i += 2 {
+		m.Put(i, []int{i})
+	}
+	// Take a snapshot to verify that ReserveKey does not mutate shared groups.
+	snap := m.Snapshot()
+	constructed := 0
+	for i := 0; i < 1000; i++ {
+		v, reserved := m.ReserveKey(i)
+		require.Equal(t, i%2 == 1, reserved)
+		if reserved {
+			require.Nil(t, *v)
+			*v = []int{i}
+			constructed++
+		} else {
+			require.Equal(t, []int{i}, *v)
+			*v = append(*v, -i)
+		}
+	}
+	require.Equal(t, 500, constructed)
+	require.Equal(t, 1000, m.Len())
+	require.NoError(t, m.Validate())
+	for i := 0; i < 1000; i++ {
+		v, ok := m.Get(i)
+		require.True(t, ok)
+		if i%2 == 0 {
+			require.Equal(t, []int{i, -i}, v)
+			v, _ = snap.Get(i)
+			require.Equal(t, []int{i}, v)
+		} else {
+			require.Equal(t, []int{i}, v)
+			_, ok = snap.Get(i)
+			require.False(t, ok)
+		}
+	}
+}
+
+func TestSliceValues(t *testing.T) {
+	// Append to slice values via Modify and AppendValue while the map grows,
+	// so that the values are moved by resizes and splits between appends.
+	m := New[int, []int](0, WithMaxBucketCapacity[int, []int](8))
+	e := make(map[int][]int)
+	for i := 0; i < 5000; i++ {
+		k := rand.Intn(500)
+		if rand.Intn(2) == 0 {
+			AppendValue(m, k, i, -i)
+			e[k] = append(e[k], i, -i)
+		} else if m.Modify(k, func(v *[]int) { *v = append(*v, i) }) {
+			e[k] = append(e[k], i)
+		}
+		if rand.Intn(50) == 0 {
+			m.Delete(k)
+			delete(e, k)
+		}
+	}
+	require.NoError(t, m.Validate())
+	require.Equal(t, len(e), m.Len())
+	for k, ev := range e {
+		v, ok := m.Get(k)
+		require.True(t, ok)
+		require.Equal(t, ev, v)
+	}
+
+	// The backing array of a slice value is shared with the slices returned
+	// by Get and with snapshots. Elements written in place are visible
+	// through them, while appended elements are not.
+	m = New[int, []int](0)
+	m.Put(1, make([]int, 1, 4))
+	v, _ := m.Get(1)
+	snap := m.Snapshot()
+	m.Modify(1, func(v *[]int) {
+		(*v)[0] = 1
+		*v = append(*v, 2)
+	})
+	AppendValue(m, 1, 3)
+	require.Equal(t, []int{1}, v)
+	sv, _ := snap.Get(1)
+	require.Equal(t, []int{1}, sv)
+	v, _ = m.Get(1)
+	require.Equal(t, []int{1, 2, 3}, v)
+	snap.Close()
+
+	// AppendValue inserts a missing key.
+	AppendValue(m, 2)
+	v, ok := m.Get(2)
+	require.True(t, ok)
+	require.Empty(t, v)
+	AppendValue(m, 3, 1, 2)
+	v, _ = m.Get(3)
+	require.Equal(t, []int{1, 2}, v)
+	require.Equal(t, 3, m.Len())
+}
+
+func TestAdd(t *testing.T) {
+	m := New[int, int](0, WithMaxBucketCapacity[int, int](groupSize))
+	e := make(map[int]int)
+	for i := 0; i < 5000; i++ {
+		k := rand.Intn(500)
+		delta := rand.Intn(10) - 5
+		e[k] += delta
+		require.Equal(t, e[k], Add(m, k, delta))
+	}
+	require.NoError(t, m.Validate())
+	require.Equal(t, e, m.ToMap())
+
+	f := New[string, float64](0)
+	require.Equal(t, 1.5, Add(f, "a", 1.5))
+	require.Equal(t, 1.0, Add(f, "a", -0.5))
+	require.Equal(t, 1, f.Len())
+}
+
+func TestPop(t *testing.T) {
+	m := New[int, int](0, WithMaxBucketCapacity[int, int](groupSize),
+		WithOperationCounters[int, int]())
+	for i := 0; i < 1000; i++ {
+		m.Put(i, -i)
+	}
+	for i := 0; i < 1000; i += 2 {
+		v, ok := m.Pop(i)
+		require.True(t, ok)
+		require.Equal(t, -i, v)
+		_, ok = m.Pop(i)
+		require.False(t, ok)
+	}
+	require.Equal(t, 500, m.Len())
+	require.NoError(t, m.Validate())
+	for i := 0; i < 1000; i++ {
+		v, ok := m.Get(i)
+		require.Equal(t, i%2 == 1, ok)
+		if ok {
+			require.Equal(t, -i, v)
+		}
+	}
+	require.EqualValues(t, 500, m.Stats().Deletes)
+}
+
+func TestAllRange(t *testing.T) {
+	for _, maxBucketCapacity := range []uint32{groupSize, 64, defaultMaxBucketCapacity} {
+		t.Run(fmt.Sprint(maxBucketCapacity), func(t *testing.T) {
+			m := New[int, int](0, WithMaxBucketCapacity[int, int](maxBucketCapacity))
+			const count = 5000
+			for i := 0; i < count; i++ {
+				m.Put(i, i)
+			}
+
+			for _, depth := range []uint{0, 1, 3, uint(m.globalDepth()), uint(m.globalDepth()) + 2, ptrBits} {
+				seen := make(map[int]bool)
+				prefixes := []uint64{0, 1, 2, 3, 4, 5, 6, 7}
+				if depth < 3 {
+					prefixes = prefixes[:1<<depth]
+				}
+				for _, prefix := range prefixes {
+					m.AllRange(prefix, depth, func(k, v int) bool {
+						require.Equal(t, k, v)
+						require.False(t, seen[k])
+						seen[k] = true
+						if depth > 0 {
+							h := m.hash(noescape(unsafe.Pointer(&k)), m.seed)
+							require.EqualValues(t, prefix, uint64(h)>>(ptrBits-depth))
+						}
+						return true
+					})
+				}
+				if depth <= 3 {
+					// The prefixes cover the entire hash space.
+					require.Equal(t, count, len(seen))
+				}
+			}
+
+			// Stopping iteration early.
+			var n int
+			m.AllRange(0, 1, func(k, v int) bool {
+				n++
+				return n < 10
+			})
+			require.Equal(t, 10, n)
+
+			require.Panics(t, func() { m.AllRange(2, 1, nil) })
+			require.Panics(t, func() { m.AllRange(0, ptrBits+1, nil) })
+		})
+	}
+}
+
+func TestTryMergeSiblings(t *testing.T) {
+	for _, maxBucketCapacity := range []uint32{groupSize, 64, defaultMaxBucketCapacity} {
+		t.Run(fmt.Sprint(maxBucketCapacity), func(t *testing.T) {
+			a := &countingAllocator[int, int]{}
+			m := New[int, int](0, WithAllocator[int, int](a),
+				WithMaxBucketCapacity[int, int](maxBucketCapacity))
+			const count = 5000
+			for i := 0; i < count; i++ {
+				m.Put(i, i)
+			}
+			snap := m.Snapshot()
+
+			globalDepth := uint(m.globalDepth())
+			require.False(t, m.TryMergeSiblings(0, globalDepth))
+			require.Panics(t, func() { m.TryMergeSiblings(2, 1) })
+
+			// mergeRange merges the buckets under the prefix from the leaves
+			// up.
+			mergeRange := func(prefix uint64, depth uint) {
+				for d := uint(m.globalDepth()); d > depth; d-- {
+					for p := uint64(0); p < 1<<(d-1-depth); p++ {
+						m.TryMergeSiblings(prefix<<(d-1-depth)|p, d-1)
+					}
+				}
+			}
+
+			// Delete the entries with a hash prefix of 1 and collapse the
+			// buckets for that half of the hash space.
+			hashPrefix := func(k int) uint64 {
+				return uint64(m.hash(noescape(unsafe.Pointer(&k)), m.seed) >> (ptrBits - 1))
+			}
+			var remaining []int
+			for i := 0; i < count; i++ {
+				if hashPrefix(i) == 1 {
+					require.True(t, m.Delete(i))
+				} else {
+					remaining = append(remaining, i)
+				}
+			}
+			buckets := m.Stats().Buckets
+			mergeRange(1, 1)
+			require.NoError(t, m.Validate())
+			if globalDepth > 1 {
+				require.Less(t, m.Stats().Buckets, buckets)
+			}
+			m.buckets(0, func(b *bucket[int, int]) bool {
+				if uint64(b.index)>>(m.globalDepth()-1) == 1 {
+					require.EqualValues(t, 1, b.localDepth)
+					require.EqualValues(t, 0, b.used)
+				}
+				return true
+			})
+			require.Equal(t, len(remaining), m.Len())
+			for _, k := range remaining {
+				v, ok := m.Get(k)
+				require.True(t, ok)
+				require.Equal(t, k, v)
+			}
+
+			// Delete the remaining entries and collapse the directory down
+			// to a single bucket.
+			for _, k := range remaining {
+				require.True(t, m.Delete(k))
+			}
+			mergeRange(0, 0)
+			require.NoError(t, m.Validate())
+			require.EqualValues(t, 0, m.globalDepth())
+			require.Equal(t, 1, m.Stats().Buckets)
+			require.False(t, m.TryMergeSiblings(0, 0))
+
+			// The map remains usable after merging.
+			for i := 0; i < count; i++ {
+				m.Put(i, -i)
+			}
+			require.NoError(t, m.Validate())
+			require.Equal(t, count, m.Len())
+
+			// Merging did not affect the snapshot.
+			require.Equal(t, count, snap.Len())
+			for i := 0; i < count; i++ {
+				v, ok := snap.Get(i)
+				require.True(t, ok)
+				require.Equal(t, i, v)
+			}
+
+			m.Close()
+			snap.Close()
+			require.Equal(t, a.alloc, a.free)
+		})
+	}
+}
+
+// TestTryMergeSiblingsDuringIteration verifies that merging buckets from
+// within an iteration does not cause the iteration to skip entries.
+func TestTryMergeSiblingsDuringIteration(t *testing.T) {
+	m := New[int, int](0, WithMaxBucketCapacity[int, int](groupSize))
+	for i := 0; i < 1000; i++ {
+		m.Put(i, i)
+	}
+	e := make(map[int]int)
+	for i := 0; i < 1000; i++ {
+		if i%100 == 0 {
+			e[i] = i
+		} else {
+			m.Delete(i)
+		}
+	}
+	mergeAll := func() (merged bool) {
+		for d := uint(m.globalDepth()); d > 0; d-- {
+			for p := uint64(0); p < 1<<(d-1); p++ {
+				if m.TryMergeSiblings(p, d-1) {
+					merged = true
+				}
+			}
+		}
+		return merged
+	}
+
+	seen := make(map[int]int)
+	m.All(func(k, v int) bool {
+		require.False(t, mergeAll())
+		seen[k] = v
+		return true
+	})
+	require.Equal(t, e, seen)
+
+	// The merges succeed once iteration has completed.
+	require.True(t, mergeAll())
+	require.NoError(t, m.Validate())
+	require.Equal(t, e, m.ToMap())
+}
+
+func TestIndirectBucket0(t *testing.T) {
+	for _, initialCapacity := range []int{0, 8, 1000} {
+		t.Run(fmt.Sprint(initialCapacity), func(t *testing.T) {
+			m := New[int, int](initialCapacity, WithIndirectBucket0[int, int](),
+				WithMaxBucketCapacity[int, int](64))
+			checkBucket0 := func(m *Map[int, int]) {
+				require.NoError(t, m.Validate())
+				require.NotEqual(t, unsafe.Pointer(&m.bucket0), m.dir.ptr)
+				require.Equal(t, bucket[int, int]{}, m.bucket0)
+			}
+			checkBucket0(m)
+
+			e := make(map[int]int)
+			for i := 0; i < 1000; i++ {
+				m.Put(i, i)
+				e[i] = i
+			}
+			checkBucket0(m)
+			snap := m.Snapshot()
+			checkBucket0(snap)
+
+			// Collapse the map back down to a single bucket.
+			for i := 0; i < 1000; i++ {
+				require.True(t, m.Delete(i))
+			}
+			for d := int(m.globalDepth()) - 1; d >= 0; d-- {
+				for p := uint64(0); p < 1<<d; p++ {
+					m.TryMergeSiblings(p, uint(d))
+				}
+			}
+			require.EqualValues(t, 0, m.globalDepth())
+			checkBucket0(m)
+
+			for i := 0; i < 100; i++ {
+				m.Put(i, -i)
+			}
+			checkBucket0(m)
+			require.Equal(t, 100, m.Len())
+			require.Equal(t, e, snap.ToMap())
+			checkBucket0(snap)
+		})
+	}
+}
+
+func TestNegativeCache(t *testing.T) {
+	// A degenerate hash function results in all keys having the same hash.
+	// The negative cache must never report a present key as missing.
+	for _, hash := range []func(key *int, seed uintptr) uintptr{
+		nil,
+		func(key *int, seed uintptr) uintptr { return 0 },
+		func(key *int, seed uintptr) uintptr { return uintptr(*key) & 0xff },
+	} {
+		t.Run("", func(t *testing.T) {
+			options := []Option[int, int]{
+				WithNegativeCache[int, int](),
+				WithMaxBucketCapacity[int, int](64),
+			}
+			if hash != nil {
+				options = append(options, WithHash[int, int](hash))
+			}
+			m := New[int, int](0, options...)
+			e := make(map[int]int)
+			for i := 0; i < 5000; i++ {
+				k := rand.Intn(500)
+				switch r := rand.Float64(); {
+				case r < 0.3:
+					m.Put(k, i)
+					e[k] = i
+				case r < 0.4:
+					m.Delete(k)
+					delete(e, k)
+				case r < 0.41:
+					m.Clear()
+					clear(e)
+				default:
+					v, ok := m.Get(k)
+					ev, eok := e[k]
+					require.Equal(t, eok, ok, "key %d", k)
+					require.Equal(t, ev, v, "key %d", k)
+				}
+			}
+		})
+	}
+
+	m := New[int, int](0, WithNegativeCache[int, int]())
+	for i := 0; i < 100; i++ {
+		m.Put(i, i)
+	}
+	// A miss is only cached if no slot in the probe sequence has a matching
+	// H2, so find a missing key which does not collide with a present key.
+	k := -1
+	for ; ; k-- {
+		h := m.hash(noescape(unsafe.Pointer(&k)), m.seed)
+		if !m.bucket(h).probeMatchesH2(h) {
+			break
+		}
+	}
+	_, ok := m.Get(k)
+	require.False(t, ok)
+	require.EqualValues(t, 0, m.Stats().NegativeCacheHits)
+	_, ok = m.Get(k)
+	require.False(t, ok)
+	require.EqualValues(t, 1, m.Stats().NegativeCacheHits)
+	m.Put(k, 1)
+	v, ok := m.Get(k)
+	require.True(t, ok)
+	require.EqualValues(t, 1, v)
+}
+
+func TestResalt(t *testing.T) {
+	skipUnlessGroupSize8(t)
+	// A hash function where the bits used for the probe offset within a
+	// bucket are identical for all keys in a "phase", while the low bits (h2)
+	// vary. This causes all of the keys for a phase to cluster at the same
+	// probe offset. Deleting the keys for one phase and inserting the keys for
+	// the next phase leaves tombstones behind which are not reused, forcing
+	// the bucket to be repeatedly rehashed in place.
+	hash := func(key *int, seed uintptr) uintptr {
+		return uintptr(*key&h2Mask) | uintptr((*key>>12)&1)<<(h2Bits+6) | uintptr(*key>>h2Bits)<<20
+	}
+	m := New[int, int](0,
+		WithHash[int, int](hash),
+		WithMaxBucketCapacity[int, int](1024))
+
+	const n = 450
+	for p := 0; p < 8; p++ {
+		for i := 0; i < n; i++ {
+			m.Put(p<<12|i, i)
+		}
+		for i := 0; i < n; i++ {
+			v, ok := m.Get(p<<12 | i)
+			require.True(t, ok)
+			require.EqualValues(t, i, v)
+		}
+		require.NoError(t, m.Validate())
+		for i := 0; i < n; i++ {
+			m.Delete(p<<12 | i)
+		}
+	}
+
+	s := m.Stats()
+	require.EqualValues(t, 1, s.Resalts)
+	require.EqualValues(t, 1, s.Buckets)
+	require.EqualValues(t, 0, s.Len)
+}
+
+func TestIterateMutate(t *testing.T) {
+	m := New[int, int](0)
+	for i := 0; i < 100; i++ {
+		m.Put(i, i)
+	}
+	e := m.ToMap()
+	require.EqualValues(t, 100, m.Len())
+	require.EqualValues(t, 100, len(e))
+
+	// Iterate over the map, resizing it periodically. We should see all of
+	// the elements that were originally in the map because All takes a
+	// snapshot of the ctrls and slots before iterating.
+	vals := make(map[int]int)
+	m.All(func(k, v int) bool {
+		if (k % 10) == 0 {
+			m.dir.At(0).resize(m, 2*m.dir.At(0).capacity)
+		}
+		vals[k] = v
+		return true
+	})
+	require.EqualValues(t, e, vals)
+}
+
+func TestIterateDelete(t *testing.T) {
+	m := New[int, int](0)
+	for i := 0; i < 100; i++ {
+		m.Put(i, i)
+	}
+	e := m.ToMap()
+	require.EqualValues(t, 100, m.Len())
+	require.EqualValues(t, 100, len(e))
+
+	// Iterate over the map, deleting elements periodically. We should see all of
+	// the elements that were originally in the map because All takes a
+	// snapshot of the ctrls and slots before iterating.
+	vals := make(map[int]int)
+	m.All(func(k, v int) bool {
+		if (k % 10) == 0 {
+			m.Delete(k)
+		}
+		vals[k] = v
+		return true
+	})
+	require.EqualValues(t, e, vals)
+}
+
+func TestIterateLive(t *testing.T) {
+	m := New[int, int](0, WithMaxBucketCapacity[int, int](16))
+	for i := 0; i < 100; i++ {
+		m.Put(i, i)
+	}
+
+	// Iterate over the map, deleting and updating other elements. Deleted
+	// elements must never be yielded, and updated elements must be yielded
+	// with their current value.
+	vals := make(map[int]int)
+	deleted := make(map[int]bool)
+	m.AllLive(func(k, v int) bool {
+		require.False(t, deleted[k], "deleted key %d yielded", k)
+		if _, ok := vals[k^1]; !ok {
+			m.Delete(k ^ 1)
+			deleted[k^1] = true
+		}
+		if _, ok := vals[k^2]; !ok && !deleted[k^2] {
+			m.Put(k^2, -(k ^ 2))
+		}
+		vals[k] = v
+		return true
+	})
+	require.Equal(t, m.ToMap(), vals)
+
+	count := 0
+	m.AllLive(func(k, v int) bool {
+		count++
+		return false
+	})
+	require.Equal(t, 1, count)
 }
 
 func TestIterateTerminatesEarly(t *testing.T) {
@@ -408,16 +3413,1098 @@ func TestIterateTerminatesEarly(t *testing.T) {
 	m.Put(2, 2)
 	m.Put(3, 3)
 
-	count := 0
-	m.All(func(key int, value int) bool {
-		count++
-		if count == 2 {
-			return false // Terminate iteration after 2 elements
+	count := 0
+	m.All(func(key int, value int) bool {
+		count++
+		if count == 2 {
+			return false // Terminate iteration after 2 elements
+		}
+		return true
+	})
+
+	require.Equal(t, 2, count)
+}
+
+func TestIteratePrefetch(t *testing.T) {
+	// Iterating over a map with large values which does not fit in the CPU
+	// caches prefetches groups, including across the wraparound of the
+	// starting offset and with groups absent due to the growth factor.
+	m := New[int, [32]int64](0, WithGrowthFactor[int, [32]int64](1.5))
+	e := make(map[int]int64)
+	for i := 0; i < 10000; i++ {
+		m.Put(i, [32]int64{int64(-i)})
+		e[i] = int64(-i)
+	}
+	require.Equal(t, prefetchSupported, m.shouldPrefetch())
+	got := make(map[int]int64)
+	m.All(func(k int, v [32]int64) bool {
+		got[k] = v[0]
+		return true
+	})
+	require.Equal(t, e, got)
+	require.False(t, New[int, [32]int64](0).shouldPrefetch())
+	require.False(t, New[int, int](0).shouldPrefetch())
+}
+
+func TestKeys(t *testing.T) {
+	m := New[int, int](0, WithMaxBucketCapacity[int, int](groupSize))
+	for i := 0; i < 1000; i++ {
+		m.Put(i, -i)
+	}
+	for i := 0; i < 1000; i += 3 {
+		m.Delete(i)
+	}
+
+	var keys []int
+	m.Keys(func(key int) bool {
+		keys = append(keys, key)
+		return true
+	})
+	var expected []int
+	m.All(func(key, value int) bool {
+		expected = append(expected, key)
+		return true
+	})
+	require.ElementsMatch(t, expected, keys)
+	require.Equal(t, m.Len(), len(keys))
+
+	count := 0
+	m.Keys(func(key int) bool {
+		count++
+		return count < 10
+	})
+	require.Equal(t, 10, count)
+}
+
+func TestKVs(t *testing.T) {
+	m := New[int, int](0)
+	for i := 0; i < 100; i++ {
+		m.Put(i, -i)
+	}
+
+	prefix := []KV[int, int]{{Key: -1, Value: 1}}
+	kvs := m.AppendKVs(prefix)
+	require.Len(t, kvs, 101)
+	require.Equal(t, prefix[0], kvs[0])
+
+	sort.Slice(kvs, func(i, j int) bool {
+		return kvs[i].Key < kvs[j].Key
+	})
+	for i := range kvs {
+		require.Equal(t, KV[int, int]{Key: i - 1, Value: -(i - 1)}, kvs[i])
+	}
+
+	kvs = append(kvs, KV[int, int]{Key: -1, Value: 2})
+	m2 := FromKVs(kvs, WithMaxBucketCapacity[int, int](groupSize))
+	require.EqualValues(t, 101, m2.Len())
+	v, ok := m2.Get(-1)
+	require.True(t, ok)
+	require.EqualValues(t, 2, v)
+	m2.Delete(-1)
+	require.Equal(t, m.ToMap(), m2.ToMap())
+}
+
+func TestFromMap(t *testing.T) {
+	for _, n := range []int{0, 1, 7, 100, 10000} {
+		t.Run(fmt.Sprint(n), func(t *testing.T) {
+			src := make(map[int]int)
+			for i := 0; i < n; i++ {
+				src[i] = -i
+			}
+			m := FromMap(src, WithMaxBucketCapacity[int, int](64),
+				WithOperationCounters[int, int]())
+			require.NoError(t, m.Validate())
+			require.Equal(t, src, m.ToMap())
+			require.EqualValues(t, n, m.Stats().Inserts)
+		})
+	}
+
+	m := FromMap[int, int](nil)
+	require.Equal(t, 0, m.Len())
+	require.NoError(t, m.Validate())
+}
+
+func TestToMap(t *testing.T) {
+	var m Map[int, int]
+	require.Equal(t, map[int]int{}, m.ToMap())
+
+	src := make(map[int]int)
+	for i := 0; i < 100; i++ {
+		src[i] = -i
+	}
+	m2 := FromMap(src)
+	require.Equal(t, src, m2.ToMap())
+
+	// CopyInto overwrites the values of keys present in both maps and
+	// retains the other entries of dst.
+	dst := map[int]int{1: 1, 1000: 1000}
+	m2.CopyInto(dst)
+	require.Len(t, dst, 101)
+	require.Equal(t, -1, dst[1])
+	require.Equal(t, 1000, dst[1000])
+}
+
+func TestGob(t *testing.T) {
+	type state struct {
+		M *Map[string, int]
+	}
+	for _, n := range []int{0, 1, 100, 10000} {
+		t.Run(fmt.Sprint(n), func(t *testing.T) {
+			e := make(map[string]int)
+			for i := 0; i < n; i++ {
+				e[strconv.Itoa(i)] = i
+			}
+			var buf bytes.Buffer
+			require.NoError(t, gob.NewEncoder(&buf).Encode(state{M: FromMap(e)}))
+
+			var s state
+			require.NoError(t, gob.NewDecoder(&buf).Decode(&s))
+			require.Equal(t, e, s.M.ToMap())
+			require.NoError(t, s.M.Validate())
+		})
+	}
+
+	// Decoding replaces the entries of an initialized map, retaining its
+	// options.
+	m := New[int, int](0, WithName[int, int]("decoded"))
+	m.Put(-1, -1)
+	data, err := FromMap(map[int]int{1: 2}).GobEncode()
+	require.NoError(t, err)
+	require.NoError(t, m.GobDecode(data))
+	require.Equal(t, map[int]int{1: 2}, m.ToMap())
+	require.Equal(t, "decoded", m.Stats().Name)
+
+	// The encoding is stable.
+	require.Equal(t, "030400020304000203040004", fmt.Sprintf("%x", data))
+
+	require.Error(t, m.GobDecode(data[:len(data)-1]))
+	require.Error(t, m.GobDecode([]byte("\x03\x04\x00\x7f")))
+}
+
+func TestBiMap(t *testing.T) {
+	var bm BiMap[int, string]
+	require.True(t, bm.PutEnforcingUniqueness(1, "a"))
+	require.True(t, bm.PutEnforcingUniqueness(1, "a"))
+	require.False(t, bm.PutEnforcingUniqueness(2, "a"))
+	require.True(t, bm.PutEnforcingUniqueness(1, "b"))
+	_, ok := bm.GetByValue("a")
+	require.False(t, ok)
+	k, ok := bm.GetByValue("b")
+	require.True(t, ok)
+	require.Equal(t, 1, k)
+
+	// Put replaces both the entry with the same key and the entry with the
+	// same value.
+	bm.Put(2, "c")
+	bm.Put(2, "b")
+	require.Equal(t, 1, bm.Len())
+	v, ok := bm.Get(2)
+	require.True(t, ok)
+	require.Equal(t, "b", v)
+	_, ok = bm.Get(1)
+	require.False(t, ok)
+
+	// Cross-check a random sequence of operations against a pair of builtin
+	// maps.
+	bm2 := NewBiMap[int, int](0)
+	forward := make(map[int]int)
+	reverse := make(map[int]int)
+	del := func(k int) {
+		if v, ok := forward[k]; ok {
+			delete(forward, k)
+			delete(reverse, v)
+		}
+	}
+	rng := rand.New(rand.NewSource(1))
+	for i := 0; i < 10000; i++ {
+		k, v := rng.Intn(200), rng.Intn(200)
+		switch rng.Intn(4) {
+		case 0:
+			bm2.Put(k, v)
+			if k2, ok := reverse[v]; ok {
+				del(k2)
+			}
+			del(k)
+			forward[k], reverse[v] = v, k
+		case 1:
+			_, exists := reverse[v]
+			ok := bm2.PutEnforcingUniqueness(k, v)
+			require.Equal(t, !exists || reverse[v] == k, ok)
+			if ok {
+				del(k)
+				forward[k], reverse[v] = v, k
+			}
+		case 2:
+			_, exists := forward[k]
+			require.Equal(t, exists, bm2.Delete(k))
+			del(k)
+		case 3:
+			k2, exists := reverse[v]
+			require.Equal(t, exists, bm2.DeleteByValue(v))
+			if exists {
+				del(k2)
+			}
+		}
+	}
+	require.Equal(t, len(forward), bm2.Len())
+	got := make(map[int]int)
+	bm2.All(func(k, v int) bool {
+		got[k] = v
+		k2, ok := bm2.GetByValue(v)
+		require.True(t, ok)
+		require.Equal(t, k, k2)
+		return true
+	})
+	require.Equal(t, forward, got)
+}
+
+func TestMoveToFront(t *testing.T) {
+	m := New[int, int](0, WithMoveToFront[int, int]())
+	for i := 0; i < 7; i++ {
+		m.Put(i, -i)
+	}
+	g := m.dir.At(0).groups.At(0)
+	front := func() int {
+		return *g.slots.Key(0)
+	}
+
+	// A Get hit moves the entry to the first slot of its group.
+	for i := 0; i < 7; i++ {
+		v, ok := m.Get(i)
+		require.True(t, ok)
+		require.Equal(t, -i, v)
+		require.Equal(t, i, front())
+	}
+	require.Equal(t, map[int]int{0: 0, 1: -1, 2: -2, 3: -3, 4: -4, 5: -5, 6: -6}, m.ToMap())
+	require.NoError(t, m.Validate())
+
+	// Entries are not moved while iterating.
+	m.All(func(k, _ int) bool {
+		m.Get((k + 1) % 7)
+		require.Equal(t, 6, front())
+		return true
+	})
+
+	// Entries are not moved while the bucket is shared with a snapshot.
+	s := m.Snapshot()
+	defer s.Close()
+	m.Get(3)
+	require.Equal(t, 6, front())
+	require.Equal(t, 6, *s.dir.At(0).groups.At(0).slots.Key(0))
+
+	// Large maps move entries within the groups of every bucket.
+	m = New[int, int](0, WithMoveToFront[int, int](), WithMaxBucketCapacity[int, int](64))
+	for i := 0; i < 10000; i++ {
+		m.Put(i, -i)
+	}
+	for i := 0; i < 10000; i += 3 {
+		v, ok := m.Get(i)
+		require.True(t, ok)
+		require.Equal(t, -i, v)
+	}
+	require.NoError(t, m.Validate())
+	for i := 0; i < 10000; i++ {
+		v, ok := m.Get(i)
+		require.True(t, ok)
+		require.Equal(t, -i, v)
+	}
+}
+
+func TestNestedMap(t *testing.T) {
+	var n NestedMap[int, int, int]
+	e := make(map[int]map[int]int)
+	check := func() {
+		t.Helper()
+		require.Equal(t, len(e), n.OuterLen())
+		count := 0
+		got := make(map[int]map[int]int)
+		n.All(func(k1, k2, v int) bool {
+			if got[k1] == nil {
+				got[k1] = make(map[int]int)
+			}
+			got[k1][k2] = v
+			count++
+			return true
+		})
+		require.Equal(t, e, got)
+		require.Equal(t, count, n.Len())
+		for k1, inner := range e {
+			require.Equal(t, len(inner), n.InnerLen(k1))
+		}
+	}
+
+	rng := rand.New(rand.NewSource(1))
+	for i := 0; i < 10000; i++ {
+		k1, k2 := rng.Intn(50), rng.Intn(20)
+		switch r := rng.Intn(100); {
+		case r < 50:
+			n.Put(k1, k2, i)
+			if e[k1] == nil {
+				e[k1] = make(map[int]int)
+			}
+			e[k1][k2] = i
+		case r < 95:
+			_, exists := e[k1][k2]
+			require.Equal(t, exists, n.Delete(k1, k2))
+			delete(e[k1], k2)
+			if len(e[k1]) == 0 {
+				delete(e, k1)
+			}
+		default:
+			require.Equal(t, len(e[k1]), n.DeleteAll(k1))
+			delete(e, k1)
+		}
+		v, ok := n.Get(k1, k2)
+		ev, eok := e[k1][k2]
+		require.Equal(t, eok, ok)
+		require.Equal(t, ev, v)
+	}
+	check()
+	require.LessOrEqual(t, len(n.pool), maxPooledInnerMaps)
+
+	// Inner maps are reused after their last entry is deleted.
+	n2 := NewNestedMap[int, int, int]()
+	n2.Put(1, 1, 1)
+	inner, _ := n2.outer.Get(1)
+	require.True(t, n2.Delete(1, 1))
+	require.Equal(t, 0, n2.OuterLen())
+	n2.Put(2, 1, 1)
+	reused, _ := n2.outer.Get(2)
+	require.Same(t, inner, reused)
+
+	// With a pooled inner map available, inserting a new outer key does not
+	// allocate a map. Clearing the released inner map may bind its hash
+	// function to a new seed (see Map.reseed), which is the only allocation.
+	n2.Put(3, 1, 1)
+	require.True(t, n2.Delete(3, 1))
+	if !invariants {
+		require.LessOrEqual(t, testing.AllocsPerRun(100, func() {
+			n2.Put(3, 1, 1)
+			n2.Delete(3, 1)
+		}), 1.0)
+	}
+	n2.Close()
+}
+
+func TestSmallMap(t *testing.T) {
+	var m SmallMap[int, int]
+	_, ok := m.Get(1)
+	require.False(t, ok)
+	require.False(t, m.Delete(1))
+	require.Equal(t, 0, m.Len())
+	m.Clear()
+
+	e := make(map[int]int)
+	check := func() {
+		t.Helper()
+		require.Equal(t, len(e), m.Len())
+		got := make(map[int]int)
+		m.All(func(k, v int) bool {
+			got[k] = v
+			return true
+		})
+		require.Equal(t, e, got)
+		m.b.checkSlotAccounting(t)
+	}
+
+	// A mix of operations on a small key space accumulates tombstones,
+	// which are dropped when the bucket is rehashed at the same capacity.
+	rng := rand.New(rand.NewSource(1))
+	for i := 0; i < 20000; i++ {
+		k := rng.Intn(200)
+		switch r := rng.Intn(100); {
+		case r < 50:
+			m.Put(k, i)
+			e[k] = i
+		case r < 90:
+			_, exists := e[k]
+			require.Equal(t, exists, m.Delete(k))
+			delete(e, k)
+		default:
+			v, ok := m.Get(k)
+			ev, exists := e[k]
+			require.Equal(t, exists, ok)
+			require.Equal(t, ev, v)
+		}
+		if i%1000 == 0 {
+			check()
+		}
+	}
+	check()
+	require.LessOrEqual(t, m.b.capacity, uint32(512))
+
+	m.Clear()
+	clear(e)
+	check()
+	for i := 0; i < 1000; i++ {
+		m.Put(i, i)
+		e[i] = i
+	}
+	check()
+
+	// Iteration terminates early when yield returns false.
+	var count int
+	m.All(func(k, v int) bool {
+		count++
+		return false
+	})
+	require.Equal(t, 1, count)
+}
+
+// checkSlotAccounting verifies the slot accounting of a bucket outside of a
+// Map: used and growthLeft must agree with its control bytes.
+func (b *bucket[K, V]) checkSlotAccounting(t *testing.T) {
+	t.Helper()
+	var full, empty int
+	for i := uint32(0); i < b.groupCount(); i++ {
+		g := b.groups.At(uintptr(i))
+		full += bits.OnesCount64(uint64(g.ctrls.matchFull()))
+		empty += bits.OnesCount64(uint64(g.ctrls.matchEmpty()))
+	}
+	require.EqualValues(t, b.used, full)
+	if b.capacity > 0 {
+		require.Greater(t, empty, 0)
+		require.EqualValues(t, int(b.capacity)-full-empty, int(b.tombstones()))
+	}
+}
+
+func TestConcurrentMap(t *testing.T) {
+	for _, shards := range []int{0, 1, 3, 16} {
+		t.Run(fmt.Sprint(shards), func(t *testing.T) {
+			c := NewConcurrentMap[int, int](0, WithShards[int, int](shards),
+				WithMaxBucketCapacity[int, int](64))
+			if shards > 0 {
+				require.Equal(t, 1<<bits.Len(uint(shards-1)), len(c.shards))
+			}
+
+			// Each goroutine operates on its own range of keys, checking the
+			// map against its own model.
+			const goroutines, keys = 8, 1000
+			var wg sync.WaitGroup
+			models := make([]map[int]int, goroutines)
+			for g := 0; g < goroutines; g++ {
+				models[g] = make(map[int]int)
+				wg.Add(1)
+				go func(g int, e map[int]int) {
+					defer wg.Done()
+					rng := rand.New(rand.NewSource(int64(g)))
+					for i := 0; i < 10000; i++ {
+						k := g*keys + rng.Intn(keys)
+						if rng.Intn(3) == 0 {
+							_, exists := e[k]
+							if c.Delete(k) != exists {
+								t.Errorf("delete %d: expected %t", k, exists)
+							}
+							delete(e, k)
+						} else {
+							c.Put(k, i)
+							e[k] = i
+						}
+						v, ok := c.Get(k)
+						if ev, eok := e[k]; ok != eok || v != ev {
+							t.Errorf("get %d: expected %d,%t, found %d,%t", k, ev, eok, v, ok)
+						}
+					}
+				}(g, models[g])
+			}
+			wg.Wait()
+
+			e := make(map[int]int)
+			for _, m := range models {
+				for k, v := range m {
+					e[k] = v
+				}
+			}
+			require.Equal(t, len(e), c.Len())
+			got := make(map[int]int)
+			c.All(func(k, v int) bool {
+				got[k] = v
+				return true
+			})
+			require.Equal(t, e, got)
+			for i := range c.shards {
+				require.NoError(t, c.shards[i].m.Validate())
+			}
+		})
+	}
+
+	// A key is hashed once per operation.
+	var calls int
+	hash := WithHash[int, int](func(key *int, seed uintptr) uintptr {
+		calls++
+		return uintptr(uint64(*key)*0x9e3779b97f4a7c15) ^ seed
+	})
+	c := NewConcurrentMap[int, int](1000, hash, WithShards[int, int](4))
+	for i := 0; i < 100; i++ {
+		c.Put(i, i)
+		c.Get(i)
+	}
+	c.Delete(0)
+	if !invariantsExhaustive {
+		// Exhaustive invariants hash every key on each operation.
+		require.Equal(t, 201, calls)
+	}
+
+	// An entry stored with a hint is stored in the shard selected by the hint,
+	// and is found using the same hint.
+	c = NewConcurrentMap[int, int](0, WithShards[int, int](4))
+	for i := 0; i < 100; i++ {
+		c.PutHint(uint(i%6), i, i)
+	}
+	require.Equal(t, 100, c.Len())
+	for i := 0; i < 100; i++ {
+		_, ok := c.shards[i%6%4].m.Get(i)
+		require.True(t, ok)
+		v, ok := c.GetHint(uint(i%6), i)
+		require.True(t, ok)
+		require.Equal(t, i, v)
+	}
+	for i := 0; i < 100; i += 2 {
+		require.True(t, c.DeleteHint(uint(i%6), i))
+		require.False(t, c.DeleteHint(uint(i%6), i))
+	}
+	require.Equal(t, 50, c.Len())
+	for i := 0; i < 100; i++ {
+		_, ok := c.GetHint(uint(i%6), i)
+		require.Equal(t, i%2 == 1, ok)
+	}
+
+	require.Panics(t, func() {
+		NewConcurrentMap[int, int](0, WithOpLog[int, int](io.Discard))
+	})
+}
+
+func TestBucketLocks(t *testing.T) {
+	for _, stripes := range []int{0, 1, 3} {
+		for _, maxBucketCapacity := range []uint32{groupSize, 64, defaultMaxBucketCapacity} {
+			t.Run(fmt.Sprintf("%d/%d", stripes, maxBucketCapacity), func(t *testing.T) {
+				m := New[int, int](0, WithBucketLocks[int, int](stripes),
+					WithMaxBucketCapacity[int, int](maxBucketCapacity))
+				if stripes > 0 {
+					require.Equal(t, 1<<bits.Len(uint(stripes-1)), len(m.locks().stripes))
+				}
+
+				// Each goroutine operates on its own range of keys, checking
+				// the map against its own model, while the buckets are resized
+				// and split by the insertions of the other goroutines.
+				const goroutines, keys = 8, 1000
+				var wg sync.WaitGroup
+				models := make([]map[int]int, goroutines)
+				for g := 0; g < goroutines; g++ {
+					models[g] = make(map[int]int)
+					wg.Add(1)
+					go func(g int, e map[int]int) {
+						defer wg.Done()
+						rng := rand.New(rand.NewSource(int64(g)))
+						for i := 0; i < 10000; i++ {
+							k := g*keys + rng.Intn(keys)
+							if rng.Intn(3) == 0 {
+								_, exists := e[k]
+								if m.Delete(k) != exists {
+									t.Errorf("delete %d: expected %t", k, exists)
+								}
+								delete(e, k)
+							} else {
+								m.Put(k, i)
+								e[k] = i
+							}
+							v, ok := m.Get(k)
+							if ev, eok := e[k]; ok != eok || v != ev {
+								t.Errorf("get %d: expected %d,%t, found %d,%t", k, ev, eok, v, ok)
+							}
+							if i%1000 == 0 {
+								m.Len()
+							}
+						}
+					}(g, models[g])
+				}
+				wg.Wait()
+
+				e := make(map[int]int)
+				for _, model := range models {
+					for k, v := range model {
+						e[k] = v
+					}
+				}
+				require.Equal(t, len(e), m.Len())
+				require.Equal(t, e, m.ToMap())
+				require.NoError(t, m.Validate())
+			})
 		}
+	}
+
+	// Entries in a bucket shared with a snapshot are copied before being
+	// mutated.
+	m := New[int, int](0, WithBucketLocks[int, int](0))
+	for i := 0; i < 100; i++ {
+		m.Put(i, i)
+	}
+	snap := m.Snapshot()
+	for i := 0; i < 100; i += 2 {
+		m.Put(i, -i)
+		m.Delete(i + 1)
+	}
+	require.Equal(t, 50, m.Len())
+	require.Equal(t, 100, snap.Len())
+	for i := 0; i < 100; i++ {
+		v, ok := snap.Get(i)
+		require.True(t, ok)
+		require.Equal(t, i, v)
+	}
+	require.NoError(t, m.Validate())
+	require.NoError(t, snap.Validate())
+
+	require.PanicsWithValue(t, "WithOpLog is not supported with WithBucketLocks", func() {
+		New[int, int](0, WithBucketLocks[int, int](0), WithOpLog[int, int](io.Discard))
+	})
+}
+
+// TestBucketLocksAll tests the methods which look up keys while iterating
+// over a map with bucket locks, during which the map is locked for writing.
+func TestBucketLocksAll(t *testing.T) {
+	m := New[int, int](0, WithBucketLocks[int, int](0))
+	e := make(map[int]int)
+	for i := 0; i < 100; i++ {
+		m.Put(i, i)
+		e[i] = i
+	}
+
+	r := make(map[int]int)
+	m.AllLive(func(k, v int) bool {
+		r[k] = v
 		return true
 	})
+	require.Equal(t, e, r)
+	require.True(t, Equal(m, m))
+	require.True(t, m.EqualFunc(m, func(a, b int) bool { return a == b }))
+}
 
-	require.Equal(t, 2, count)
+func TestConcurrentChecks(t *testing.T) {
+	if !concurrentChecks {
+		t.Skip("requires the swiss_concurrent_checks build tag")
+	}
+	m := New[int, int](0, WithName[int, int]("checked"))
+	for i := 0; i < 100; i++ {
+		m.Put(i, i)
+	}
+	// Mutating the map during iteration from the same goroutine is allowed.
+	m.All(func(k, v int) bool {
+		m.Put(k+100, v)
+		m.Delete(k)
+		return true
+	})
+
+	// Simulate a Put or Delete in progress on another goroutine.
+	m.startWrite()
+	require.PanicsWithValue(t, `map "checked": concurrent map read and map write`, func() {
+		m.Get(1)
+	})
+	require.PanicsWithValue(t, `map "checked": concurrent map writes`, func() {
+		m.Put(1, 1)
+	})
+	require.PanicsWithValue(t, `map "checked": concurrent map writes`, func() {
+		m.Delete(1)
+	})
+	require.PanicsWithValue(t, `map "checked": concurrent map iteration and map write`, func() {
+		m.All(func(k, v int) bool { return true })
+	})
+	m.endWrite()
+	m.Put(1, 1)
+	require.NoError(t, m.Validate())
+}
+
+func TestReadMostlyMap(t *testing.T) {
+	r := NewReadMostlyMap[int, int](0, WithMaxBucketCapacity[int, int](64))
+	const keys = 1000
+	done := make(chan struct{})
+	var wg sync.WaitGroup
+	for g := 0; g < 4; g++ {
+		wg.Add(1)
+		go func(g int) {
+			defer wg.Done()
+			// Every update sets all of the keys to the same increasing value,
+			// so a reader observing a key decrease has seen a partial update.
+			rng := rand.New(rand.NewSource(int64(g)))
+			last := make([]int, keys)
+			for {
+				select {
+				case <-done:
+					return
+				default:
+				}
+				k := rng.Intn(keys)
+				v, ok := r.Get(k)
+				if ok && v < last[k] {
+					t.Errorf("get %d: found %d after %d", k, v, last[k])
+				}
+				last[k] = v
+			}
+		}(g)
+	}
+	for i := 1; i <= 100; i++ {
+		r.Update(func(m *Map[int, int]) {
+			for k := 0; k < keys; k++ {
+				m.Put(k, i)
+			}
+		})
+	}
+	close(done)
+	wg.Wait()
+
+	require.Equal(t, keys, r.Len())
+	r.All(func(k, v int) bool {
+		require.Equal(t, 100, v)
+		return true
+	})
+	r.Put(keys, 1)
+	v, ok := r.Get(keys)
+	require.True(t, ok)
+	require.Equal(t, 1, v)
+	require.True(t, r.Delete(keys))
+	require.False(t, r.Delete(keys))
+	_, ok = r.Get(keys)
+	require.False(t, ok)
+	require.NoError(t, r.w.Validate())
+	require.NoError(t, r.published.Load().Validate())
+	// The retired snapshots have released their references, leaving only
+	// the groups shared by the map and the published snapshot.
+	require.LessOrEqual(t, len(r.w.shared().refs), r.w.Stats().Buckets)
+
+	require.Panics(t, func() {
+		NewReadMostlyMap[int, int](0, WithMoveToFront[int, int]())
+	})
+}
+
+func TestExpiringMap(t *testing.T) {
+	var now int64 = 1
+	clock := WithClock[int, int](func() int64 { return now })
+	em := NewExpiringMap[int, int](0, 10*time.Second, clock)
+
+	em.Put(1, 1)
+	em.PutWithTTL(2, 2, time.Second)
+	em.PutWithTTL(3, 3, 0)
+	v, ok := em.Get(2)
+	require.True(t, ok)
+	require.Equal(t, 2, v)
+
+	// Entry 2 expires. It is absent from Get and All, but is only reclaimed
+	// by Get.
+	now += int64(time.Second)
+	require.Equal(t, 3, em.Len())
+	got := make(map[int]int)
+	em.All(func(k, v int) bool {
+		got[k] = v
+		return true
+	})
+	require.Equal(t, map[int]int{1: 1, 3: 3}, got)
+	_, ok = em.Get(2)
+	require.False(t, ok)
+	require.Equal(t, 2, em.Len())
+
+	// Putting an entry again resets its expiration.
+	now += int64(9 * time.Second)
+	em.Put(2, 2)
+	require.False(t, em.Delete(1))
+	require.Equal(t, 0, em.ExpireNow())
+	require.Equal(t, 2, em.Len())
+	now += int64(10 * time.Second)
+	require.Equal(t, 1, em.ExpireNow())
+	_, ok = em.Get(3)
+	require.True(t, ok)
+	require.True(t, em.Delete(3))
+	require.Equal(t, 0, em.Len())
+
+	// Expired entries are swept by Put, so a map whose entries expire as
+	// fast as they are put does not grow without bound.
+	for i := 0; i < 10000; i++ {
+		now += int64(time.Second)
+		em.PutWithTTL(i, i, time.Second)
+		require.LessOrEqual(t, em.Len(), 3)
+	}
+
+	// The zero value is usable, and its entries never expire.
+	var zero ExpiringMap[int, int]
+	zero.clock = em.clock
+	zero.Put(1, 1)
+	now += int64(1000 * time.Hour)
+	require.Equal(t, 0, zero.ExpireNow())
+	v, ok = zero.Get(1)
+	require.True(t, ok)
+	require.Equal(t, 1, v)
+
+	// A TTL so large that the expiration would overflow never expires,
+	// rather than wrapping around to an expiration in the past.
+	em.PutWithTTL(1, 1, math.MaxInt64)
+	em.PutWithTTL(2, 2, time.Duration(math.MaxInt64-now))
+	now += int64(1000 * time.Hour)
+	require.Equal(t, 0, em.ExpireNow())
+	_, ok = em.Get(1)
+	require.True(t, ok)
+	_, ok = em.Get(2)
+	require.True(t, ok)
+
+	require.Panics(t, func() {
+		NewExpiringMap[int, int](0, time.Second, WithNegativeCache[int, int]())
+	})
+}
+
+func TestOpLog(t *testing.T) {
+	// The default hash function is bound to a seed which is not recorded,
+	// so the map is hashed by a function of the recorded seed.
+	hash := func(key *int, seed uintptr) uintptr {
+		k := uint64(*key)
+		return hashBytes8(noescape(unsafe.Pointer(&k)), seed)
+	}
+	options := []Option[int, int]{
+		WithHash[int, int](hash),
+		WithMaxBucketCapacity[int, int](64),
+		WithNegativeCache[int, int](),
+	}
+	var buf bytes.Buffer
+	m := New[int, int](100, append(options, WithOpLog[int, int](&buf))...)
+	rng := rand.New(rand.NewSource(1))
+	for i := 0; i < 10000; i++ {
+		k := rng.Intn(2000)
+		switch r := rng.Intn(100); {
+		case r < 50:
+			m.Put(k, i)
+		case r < 75:
+			m.Get(k)
+		case r < 99:
+			m.Delete(k)
+		default:
+			m.Clear()
+		}
+	}
+
+	// The replayed map has the same entries and, as the hash function is
+	// deterministic, the same layout.
+	var rebuf bytes.Buffer
+	r, err := Replay[int, int](bytes.NewReader(buf.Bytes()),
+		append(options, WithOpLog[int, int](&rebuf))...)
+	require.NoError(t, err)
+	require.NoError(t, r.Validate())
+	require.Equal(t, m.ToMap(), r.ToMap())
+	require.Equal(t, m.Stats(), r.Stats())
+	require.Equal(t, m.seed, r.seed)
+
+	// Replaying a map records an equivalent op log.
+	r2, err := Replay[int, int](&rebuf, options...)
+	require.NoError(t, err)
+	require.Equal(t, m.Stats(), r2.Stats())
+
+	// An op log truncated within a record returns the map replayed up to the
+	// truncated record.
+	r, err = Replay[int, int](bytes.NewReader(buf.Bytes()[:buf.Len()-1]), options...)
+	require.ErrorIs(t, err, io.ErrUnexpectedEOF)
+	require.NotNil(t, r)
+
+	_, err = Replay[int, int](bytes.NewReader(nil))
+	require.ErrorIs(t, err, io.EOF)
+}
+
+func TestOpLogMutations(t *testing.T) {
+	// Every method which mutates the map is recorded, so that replaying the
+	// op log reproduces the entries of the map.
+	other := New[int, int](0)
+	for i := 50; i < 150; i++ {
+		other.Put(i, -i)
+	}
+	testCases := []struct {
+		name   string
+		mutate func(m *Map[int, int])
+	}{
+		{"PutIfAbsent", func(m *Map[int, int]) {
+			for i := 0; i < 200; i += 3 {
+				m.PutIfAbsent(i, -i)
+			}
+		}},
+		{"GetOrPut", func(m *Map[int, int]) {
+			for i := 0; i < 200; i += 3 {
+				m.GetOrPut(i, -i)
+			}
+		}},
+		{"Compute", func(m *Map[int, int]) {
+			for i := 0; i < 200; i += 3 {
+				m.Compute(i, func(old int, exists bool) (int, bool) {
+					return old + 1, i%2 == 0
+				})
+			}
+		}},
+		{"Modify", func(m *Map[int, int]) {
+			for i := 0; i < 200; i += 3 {
+				m.Modify(i, func(v *int) { *v *= 2 })
+			}
+		}},
+		{"Add", func(m *Map[int, int]) {
+			for i := 0; i < 200; i += 3 {
+				Add(m, i, 7)
+			}
+		}},
+		{"ReserveKey", func(m *Map[int, int]) {
+			for i := 0; i < 200; i += 3 {
+				if v, reserved := m.ReserveKey(i); reserved {
+					*v = -i
+				} else {
+					*v++
+				}
+			}
+			m.Get(0)
+		}},
+		{"Pop", func(m *Map[int, int]) {
+			for i := 0; i < 200; i += 3 {
+				m.Pop(i)
+			}
+		}},
+		{"DeleteFunc", func(m *Map[int, int]) {
+			m.DeleteFunc(func(k, v int) bool { return k%3 == 0 })
+		}},
+		{"Batch", func(m *Map[int, int]) {
+			tx := m.Batch()
+			for i := 0; i < 200; i += 3 {
+				if i%2 == 0 {
+					tx.Put(i, -i)
+				} else {
+					tx.Delete(i)
+				}
+			}
+			tx.Commit()
+		}},
+		{"Reset", func(m *Map[int, int]) {
+			m.Reset()
+			m.Put(1, 1)
+		}},
+		{"ClearAndRelease", func(m *Map[int, int]) {
+			m.ClearAndRelease()
+			m.Put(1, 1)
+		}},
+		{"ClearWithHint", func(m *Map[int, int]) {
+			m.ClearWithHint(0)
+			m.Put(1, 1)
+		}},
+		{"Merge", func(m *Map[int, int]) {
+			m.Merge(other, func(k, a, b int) int { return a + b })
+		}},
+		{"Intersect", func(m *Map[int, int]) {
+			m.Intersect(other)
+		}},
+		{"Difference", func(m *Map[int, int]) {
+			m.Difference(other)
+		}},
+		{"PutWithHash", func(m *Map[int, int]) {
+			for i := 0; i < 200; i += 3 {
+				m.PutWithHash(i, m.Hash(i), -i)
+			}
+		}},
+		{"Hashed", func(m *Map[int, int]) {
+			h := m.Hasher()
+			for i := 0; i < 200; i += 3 {
+				m.PutHashed(h.Hash(i), -i)
+				m.DeleteHashed(h.Hash(i + 1))
+			}
+		}},
+		{"PutBatch", func(m *Map[int, int]) {
+			m.PutBatch([]int{1, 2, 300, 300}, []int{-1, -2, -3, -4})
+		}},
+		{"DeleteBatch", func(m *Map[int, int]) {
+			m.DeleteBatch([]int{1, 2, 300})
+		}},
+	}
+	for _, c := range testCases {
+		t.Run(c.name, func(t *testing.T) {
+			var buf bytes.Buffer
+			m := New[int, int](0, WithMaxBucketCapacity[int, int](16), WithOpLog[int, int](&buf))
+			for i := 0; i < 100; i++ {
+				m.Put(i, i)
+			}
+			c.mutate(m)
+			r, err := Replay[int, int](bytes.NewReader(buf.Bytes()),
+				WithMaxBucketCapacity[int, int](16))
+			require.NoError(t, err)
+			require.NoError(t, r.Validate())
+			require.True(t, Equal(m, r), "%v\n%v", m.ToMap(), r.ToMap())
+		})
+	}
+}
+
+// failingWriter returns an error from Write after n bytes have been written.
+type failingWriter struct {
+	n int
+}
+
+func (w *failingWriter) Write(p []byte) (int, error) {
+	if len(p) > w.n {
+		w.n = 0
+		return 0, errors.New("failed")
+	}
+	w.n -= len(p)
+	return len(p), nil
+}
+
+func TestOpLogErrors(t *testing.T) {
+	// Recording stops at the first error returned by the writer.
+	m := New[int, int](0, WithOpLog[int, int](&failingWriter{n: 200}))
+	for i := 0; i < 100; i++ {
+		m.Put(i, i)
+	}
+	require.Equal(t, 100, m.Len())
+
+	// Keys which cannot be encoded panic.
+	type unexported struct{ x int }
+	require.Panics(t, func() {
+		New[unexported, int](0, WithOpLog[unexported, int](io.Discard))
+	})
+}
+
+func TestChan(t *testing.T) {
+	m := New[int, int](0)
+	for i := 0; i < 100; i++ {
+		m.Put(i, i)
+	}
+	e := m.ToMap()
+
+	// Mutations made while the channel is drained are not visible.
+	vals := make(map[int]int)
+	for kv := range m.Chan(context.Background(), 0) {
+		m.Delete(kv.Key)
+		m.Put(kv.Key+1000, kv.Value)
+		vals[kv.Key] = kv.Value
+	}
+	require.Equal(t, e, vals)
+
+	// Canceling the context closes the channel early.
+	ctx, cancel := context.WithCancel(context.Background())
+	ch := m.Chan(ctx, 0)
+	<-ch
+	cancel()
+	count := 0
+	for range ch {
+		count++
+	}
+	require.Less(t, count, m.Len()-1)
+
+	// The entries are streamed from a snapshot of the map which is closed
+	// once every entry has been sent.
+	a := &countingAllocator[int, int]{}
+	m = New[int, int](1000, WithAllocator[int, int](a))
+	for i := 0; i < 1000; i++ {
+		m.Put(i, i)
+	}
+	ch = m.Chan(context.Background(), 0)
+	<-ch
+	// Mutating every bucket copies it as it is shared with the snapshot
+	// being streamed.
+	for i := 0; i < 1000; i++ {
+		m.Put(i, -i)
+	}
+	count = 1
+	for kv := range ch {
+		require.Equal(t, kv.Key, kv.Value)
+		count++
+	}
+	require.Equal(t, 1000, count)
+	m.Close()
+	require.Equal(t, a.alloc, a.free)
 }
 
 func TestClear(t *testing.T) {
@@ -427,6 +4514,7 @@ func TestClear(t *testing.T) {
 	}{
 		{count: 1000, maxBucketCapacity: math.MaxUint32},
 		{count: 1000, maxBucketCapacity: 8},
+		{count: 0, maxBucketCapacity: math.MaxUint32},
 	}
 	for _, c := range testCases {
 		t.Run("", func(t *testing.T) {
@@ -436,29 +4524,42 @@ func TestClear(t *testing.T) {
 			}
 
 			capacity := m.capacity()
-			m.Clear()
+			require.Equal(t, c.count, m.Clear())
 			require.EqualValues(t, 0, m.Len())
 			require.EqualValues(t, capacity, m.capacity())
+			require.NoError(t, m.Validate())
+			for _, s := range m.bucketStats() {
+				require.Zero(t, s.Tombstones)
+			}
 
 			m.All(func(k, v int) bool {
 				require.Fail(t, "should not iterate")
 				return true
 			})
+
+			// Clearing an empty map deletes nothing.
+			require.Equal(t, 0, m.Clear())
+			require.NoError(t, m.Validate())
 		})
 	}
 }
 
 type countingAllocator[K comparable, V any] struct {
+	mu    sync.Mutex
 	alloc int
 	free  int
 }
 
 func (a *countingAllocator[K, V]) Alloc(n int) []Group[K, V] {
+	a.mu.Lock()
+	defer a.mu.Unlock()
 	a.alloc++
 	return make([]Group[K, V], n)
 }
 
 func (a *countingAllocator[K, V]) Free(_ []Group[K, V]) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
 	a.free++
 }
 
@@ -471,8 +4572,9 @@ func TestAllocator(t *testing.T) {
 		m.Put(i, i)
 	}
 
-	// 8 -> 16 -> 32 -> 64 -> 128
-	const expected = 5
+	// 8 -> 16 -> 32 -> 64 -> 128, or 16 -> 32 -> 64 -> 128 with 16 slot
+	// groups.
+	expected := bits.Len(128 / groupSize)
 	require.EqualValues(t, expected, a.alloc)
 	require.EqualValues(t, expected-1, a.free)
 
@@ -481,9 +4583,413 @@ func TestAllocator(t *testing.T) {
 	require.EqualValues(t, expected, a.free)
 }
 
+func TestLayout(t *testing.T) {
+	groupBytes := func(slotSize uintptr) int {
+		return CtrlBytesFor(groupSize) + groupSize*int(slotSize)
+	}
+	require.EqualValues(t, unsafe.Sizeof(Group[int64, int64]{}), groupBytes(SlotSize[int64, int64]()))
+	require.EqualValues(t, unsafe.Sizeof(Group[int32, [3]byte]{}), groupBytes(SlotSize[int32, [3]byte]()))
+	if LayoutVersion == 1 || ptrSize%groupSize == 0 {
+		// See SlotSize for the padding of a Group with zero-size values.
+		require.EqualValues(t, unsafe.Sizeof(Group[string, struct{}]{}), groupBytes(SlotSize[string, struct{}]()))
+	}
+	require.EqualValues(t, 16, SlotSize[int64, int64]())
+	if LayoutVersion == 1 {
+		require.EqualValues(t, 8, SlotSize[int32, [3]byte]())
+	} else {
+		// The parallel arrays of keys and values need no padding between
+		// the key and value of each slot.
+		require.EqualValues(t, 7, SlotSize[int32, [3]byte]())
+		require.EqualValues(t, 9, SlotSize[int8, int64]())
+
+		// The keys of a group are contiguous, followed by its values.
+		var g Group[int8, int64]
+		require.EqualValues(t, 1, uintptr(unsafe.Pointer(g.slots.Key(1)))-uintptr(unsafe.Pointer(g.slots.Key(0))))
+		require.EqualValues(t, groupSize, uintptr(unsafe.Pointer(g.slots.Value(0)))-uintptr(unsafe.Pointer(g.slots.Key(0))))
+	}
+
+	require.Equal(t, 0, CtrlBytesFor(0))
+	require.Equal(t, groupSize, CtrlBytesFor(1))
+	require.Equal(t, groupSize, CtrlBytesFor(groupSize))
+	require.Equal(t, 2*groupSize, CtrlBytesFor(groupSize+1))
+	require.Equal(t, 1024, CtrlBytesFor(1024))
+
+	// The groups allocated for a bucket hold CtrlBytesFor(capacity) control
+	// bytes.
+	m := New[int, int](100)
+	var capacity int
+	m.ForEachBucketStats(func(s BucketStats) bool {
+		capacity += int(s.Capacity)
+		return true
+	})
+	_, groups := m.OutstandingAllocations()
+	require.Equal(t, CtrlBytesFor(capacity), groups*int(unsafe.Sizeof(Group[int, int]{}.ctrls)))
+}
+
+func TestMemoryLimit(t *testing.T) {
+	groupBytes := int64(unsafe.Sizeof(Group[int, int]{}))
+	bucketBytes := int64(unsafe.Sizeof(bucket[int, int]{}))
+	m := New[int, int](0)
+	require.Zero(t, m.SizeInBytes())
+	m.Put(1, 1)
+	require.Equal(t, groupBytes, m.SizeInBytes())
+
+	// The eviction callback is told how far the map would exceed the limit.
+	// With a limit of 0 that is the size the map would grow to, which
+	// includes the growth of the directory when a bucket is split.
+	var need int64
+	m = New[int, int](0, WithMaxBucketCapacity[int, int](64),
+		WithMemoryLimit[int, int](0, func(m *Map[int, int], n int64) {
+			need = n
+		}))
+	for i := 0; i < 1000; i++ {
+		need = 0
+		m.Put(i, i)
+		if need > 0 {
+			require.Equal(t, need, m.SizeInBytes())
+		}
+	}
+	_, groups := m.OutstandingAllocations()
+	require.Equal(t, int64(groups)*groupBytes+int64(m.bucketCount())*bucketBytes, m.SizeInBytes())
+
+	// Evicting the oldest entries keeps the map within the limit.
+	const limit = 16 << 10
+	var order []int
+	calls := 0
+	m = New[int, int](0, WithMaxBucketCapacity[int, int](64),
+		WithMemoryLimit[int, int](limit, func(m *Map[int, int], n int64) {
+			calls++
+			require.Positive(t, n)
+			for i := 0; i < 10 && len(order) > 0; i++ {
+				require.True(t, m.Delete(order[0]))
+				order = order[1:]
+			}
+		}))
+	for i := 0; i < 10000; i++ {
+		m.Put(i, i)
+		order = append(order, i)
+		require.LessOrEqual(t, m.SizeInBytes(), int64(limit))
+	}
+	require.Positive(t, calls)
+	require.Equal(t, len(order), m.Len())
+	for _, k := range order {
+		v, ok := m.Get(k)
+		require.True(t, ok)
+		require.Equal(t, k, v)
+	}
+	require.NoError(t, m.Validate())
+
+	// PutErr refuses insertions which would exceed the limit, but not
+	// overwrites.
+	m = New[int, int](0, WithMemoryLimit[int, int](limit, nil))
+	var err error
+	n := 0
+	for ; err == nil; n++ {
+		err = m.PutErr(n, n)
+	}
+	require.ErrorIs(t, err, ErrMemoryLimit)
+	require.Equal(t, n-1, m.Len())
+	require.LessOrEqual(t, m.SizeInBytes(), int64(limit))
+	_, ok := m.Get(n - 1)
+	require.False(t, ok)
+	require.NoError(t, m.PutErr(0, -1))
+	v, _ := m.Get(0)
+	require.Equal(t, -1, v)
+	// Put grows the map regardless.
+	m.Put(n-1, n-1)
+	require.Equal(t, n, m.Len())
+	require.Greater(t, m.SizeInBytes(), int64(limit))
+	require.NoError(t, New[int, int](0).PutErr(1, 1))
+
+	// The callback may mutate the map arbitrarily, including reseeding it,
+	// before an insertion by a function other than Put is completed.
+	m = New[int, int](0, WithMemoryLimit[int, int](limit, func(m *Map[int, int], n int64) {
+		m.ClearAndRelease()
+	}))
+	for i := 0; i < 10000; i++ {
+		require.Equal(t, 1, Add(m, i, 1))
+		require.LessOrEqual(t, m.SizeInBytes(), int64(limit))
+	}
+	require.Less(t, m.Len(), 10000)
+	v, _ = m.Get(9999)
+	require.Equal(t, 1, v)
+	require.NoError(t, m.Validate())
+}
+
+func TestAllocationLedger(t *testing.T) {
+	a := &countingAllocator[int, int]{}
+	m := New[int, int](0, WithAllocator[int, int](a),
+		WithAllocationLedger[int, int](nil),
+		WithMaxBucketCapacity[int, int](64))
+	for i := 0; i < 1000; i++ {
+		m.Put(i, i)
+		allocs, groups := m.OutstandingAllocations()
+		require.Equal(t, a.alloc-a.free, allocs)
+		require.Equal(t, len(m.ledger().outstanding), allocs)
+		require.Equal(t, m.capacity()/groupSize, groups)
+	}
+	m.Close()
+	allocs, groups := m.OutstandingAllocations()
+	require.Equal(t, 0, allocs)
+	require.Equal(t, 0, groups)
+
+	// A double free panics by default.
+	m = New[int, int](1, WithAllocationLedger[int, int](nil))
+	g := m.bucket0.groups.Slice(0, 1)
+	m.Close()
+	require.PanicsWithValue(t,
+		fmt.Sprintf("invariant failed: bucket 0: free of 1 groups at %p which are not outstanding (double free?)",
+			unsafe.SliceData(g)),
+		func() { m.freeGroups(0, g) })
+
+	// Mismatches are reported to the callback if one is specified.
+	var errs []error
+	l := newAllocLedger(func(err error) {
+		errs = append(errs, err)
+	})
+	var mem [2]Group[int, int]
+	p := unsafe.Pointer(&mem[0])
+	l.alloc(3, p, 2)
+	l.alloc(4, p, 2)
+	l.free(5, p, 1)
+	require.Len(t, errs, 2)
+	require.EqualError(t, errs[0], fmt.Sprintf(
+		"bucket 4: allocation of 2 groups at %p overlaps outstanding allocation of 2 groups", p))
+	require.EqualError(t, errs[1], fmt.Sprintf(
+		"bucket 5: free of 1 groups at %p, but 2 groups were allocated", p))
+}
+
+func TestSnapshot(t *testing.T) {
+	for _, maxBucketCapacity := range []uint32{groupSize, 64, defaultMaxBucketCapacity} {
+		t.Run(fmt.Sprint(maxBucketCapacity), func(t *testing.T) {
+			a := &countingAllocator[int, int]{}
+			m := New[int, int](0, WithAllocator[int, int](a),
+				WithAllocationLedger[int, int](nil),
+				WithMaxBucketCapacity[int, int](maxBucketCapacity))
+			e := make(map[int]int)
+			for i := 0; i < 1000; i++ {
+				m.Put(i, i)
+				e[i] = i
+			}
+
+			// Create a chain of snapshots, mutating each map concurrently
+			// and verifying that the mutations are not visible to the other
+			// maps.
+			maps := []*Map[int, int]{m, m.Snapshot()}
+			maps = append(maps, maps[1].Snapshot(), m.Snapshot())
+			expected := make([]map[int]int, len(maps))
+			var wg sync.WaitGroup
+			for i := range maps {
+				expected[i] = make(map[int]int)
+				for k, v := range e {
+					expected[i][k] = v
+				}
+				wg.Add(1)
+				go func(m *Map[int, int], e map[int]int) {
+					defer wg.Done()
+					rng := rand.New(rand.NewSource(int64(len(e))))
+					for j := 0; j < 2000; j++ {
+						k := rng.Intn(2000)
+						if rng.Intn(3) == 0 {
+							m.Delete(k)
+							delete(e, k)
+						} else {
+							m.Put(k, j)
+							e[k] = j
+						}
+					}
+				}(maps[i], expected[i])
+			}
+			wg.Wait()
+
+			for i := range maps {
+				require.NoError(t, maps[i].Validate())
+				require.Equal(t, len(expected[i]), maps[i].Len())
+				for k, ev := range expected[i] {
+					v, ok := maps[i].Get(k)
+					require.True(t, ok)
+					require.Equal(t, ev, v)
+				}
+			}
+
+			// The groups are only freed once all of the maps referencing them
+			// have been closed.
+			for i := range maps {
+				maps[i].Close()
+				allocs, groups := maps[i].OutstandingAllocations()
+				require.Equal(t, 0, allocs)
+				require.Equal(t, 0, groups)
+			}
+			require.Equal(t, a.alloc, a.free)
+			require.Empty(t, m.shared().refs)
+		})
+	}
+}
+
+func TestClone(t *testing.T) {
+	for _, maxBucketCapacity := range []uint32{groupSize, 64, defaultMaxBucketCapacity} {
+		for _, indirect := range []bool{false, true} {
+			t.Run(fmt.Sprintf("%d/indirect=%t", maxBucketCapacity, indirect), func(t *testing.T) {
+				a := &countingAllocator[int, int]{}
+				options := []Option[int, int]{
+					WithAllocator[int, int](a),
+					WithAllocationLedger[int, int](nil),
+					WithMaxBucketCapacity[int, int](maxBucketCapacity),
+				}
+				if indirect {
+					options = append(options, WithIndirectBucket0[int, int]())
+				}
+				m := New[int, int](0, options...)
+
+				// Clone an empty map and a map with a single bucket before
+				// populating m.
+				c := m.Clone()
+				require.NoError(t, c.Validate())
+				require.Equal(t, 0, c.Len())
+				c.Put(1, 1)
+				require.Equal(t, 0, m.Len())
+				c.Close()
+
+				e := make(map[int]int)
+				for i := 0; i < 1000; i++ {
+					m.Put(i, i)
+					e[i] = i
+					if i == 3 {
+						c := m.Clone()
+						require.NoError(t, c.Validate())
+						require.Equal(t, e, c.ToMap())
+						c.Close()
+					}
+				}
+				// Leave some tombstones behind which are copied by the clone.
+				for i := 0; i < 1000; i += 7 {
+					m.Delete(i)
+					delete(e, i)
+				}
+				snap := m.Snapshot()
+
+				c = m.Clone()
+				require.NoError(t, c.Validate())
+				require.Equal(t, e, c.ToMap())
+				require.Equal(t, m.bucketCount(), c.bucketCount())
+				require.Equal(t, m.capacity(), c.capacity())
+
+				// The clone does not share any groups with m (or the
+				// snapshot of m).
+				groups := make(map[unsafe.Pointer]bool)
+				m.buckets(0, func(b *bucket[int, int]) bool {
+					groups[b.groups.ptr] = true
+					return true
+				})
+				var buckets int
+				c.buckets(0, func(b *bucket[int, int]) bool {
+					require.False(t, b.shared)
+					require.False(t, groups[b.groups.ptr])
+					buckets++
+					return true
+				})
+				allocs, _ := c.OutstandingAllocations()
+				require.Equal(t, buckets, allocs)
+
+				// Mutations to the clone are not visible in m and vice versa.
+				for i := 0; i < 2000; i += 3 {
+					c.Put(i, -i)
+				}
+				for i := 1; i < 1000; i += 3 {
+					m.Delete(i)
+				}
+				require.NoError(t, c.Validate())
+				require.NoError(t, m.Validate())
+				for k, v := range e {
+					if k%3 == 0 {
+						v = -k
+					}
+					cv, ok := c.Get(k)
+					require.True(t, ok)
+					require.Equal(t, v, cv)
+					if k%3 != 1 {
+						mv, ok := m.Get(k)
+						require.True(t, ok)
+						require.Equal(t, k, mv)
+					}
+				}
+
+				for _, x := range []*Map[int, int]{m, snap, c} {
+					x.Close()
+					allocs, groups := x.OutstandingAllocations()
+					require.Equal(t, 0, allocs)
+					require.Equal(t, 0, groups)
+				}
+				require.Equal(t, a.alloc, a.free)
+			})
+		}
+	}
+}
+
+// TestSnapshotFindDoesNotCopy verifies that operations which look up a key
+// but end up not mutating the map do not copy buckets shared with a
+// snapshot.
+func TestSnapshotFindDoesNotCopy(t *testing.T) {
+	m := New[int, int](0, WithMaxBucketCapacity[int, int](64))
+	for i := 0; i < 1000; i++ {
+		m.Put(i, i)
+	}
+	snap := m.Snapshot()
+	allocs, _ := m.OutstandingAllocations()
+	// The batch deletes keys which are not present.
+	tx := m.Batch()
+	for i := 0; i < 2000; i++ {
+		if i < 1000 {
+			v, loaded := m.GetOrPut(i, -i)
+			require.True(t, loaded)
+			require.Equal(t, i, v)
+			require.False(t, m.PutIfAbsent(i, -i))
+		} else {
+			_, ok := m.Pop(i)
+			require.False(t, ok)
+			require.False(t, m.Modify(i, func(v *int) { *v = -1 }))
+			m.Compute(i, func(old int, exists bool) (int, bool) {
+				require.False(t, exists)
+				return 0, true
+			})
+			tx.Delete(i)
+		}
+	}
+	tx.Commit()
+	m.buckets(0, func(b *bucket[int, int]) bool {
+		require.True(t, b.shared)
+		return true
+	})
+	a, _ := m.OutstandingAllocations()
+	require.Equal(t, allocs, a)
+
+	// Mutating operations copy the bucket and don't affect the snapshot.
+	require.True(t, m.Modify(1, func(v *int) { *v = -1 }))
+	m.Compute(2, func(old int, exists bool) (int, bool) { return -2, false })
+	_, ok := m.Pop(3)
+	require.True(t, ok)
+	m.GetOrPut(-4, -4)
+	tx.Put(5, -5)
+	tx.Commit()
+	require.NoError(t, m.Validate())
+	require.NoError(t, snap.Validate())
+	for k, v := range map[int]int{1: -1, 2: -2, -4: -4, 5: -5} {
+		actual, ok := m.Get(k)
+		require.True(t, ok)
+		require.Equal(t, v, actual)
+	}
+	_, ok = m.Get(3)
+	require.False(t, ok)
+	require.Equal(t, 1000, snap.Len())
+	snap.All(func(k, v int) bool {
+		require.Equal(t, k, v)
+		return true
+	})
+}
+
 func TestResizeVsSplit(t *testing.T) {
-	if invariants {
-		t.Skip("skipped due to slowness under invariants")
+	if invariantsExhaustive {
+		t.Skip("skipped due to slowness under exhaustive invariants")
 	}
 
 	count := 1_000_000 + rand.Intn(500_000)
@@ -493,7 +4999,7 @@ func TestResizeVsSplit(t *testing.T) {
 		m.Put(x, x)
 	}
 	start := time.Now()
-	m.dir.At(0).split(m)
+	m.dir.At(0).split(m, 0, false)
 	if testing.Verbose() {
 		fmt.Printf(" split(%d): %6.3fms\n", count, time.Since(start).Seconds()*1000)
 	}
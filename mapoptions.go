@@ -0,0 +1,345 @@
+// Copyright 2024 The Cockroach Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package swiss
+
+import "unsafe"
+
+// mapOptions holds the fields of a Map which are not needed by a map with
+// the default options, so that they don't enlarge every Map. Each field is
+// read through the Map method of the same name, which returns the zero value
+// if the map has no mapOptions.
+type mapOptions[K comparable, V any] struct {
+	// equal is the key equality function specified with the WithKeyEqual
+	// option, or nil if keys are compared with ==.
+	equal equalFn
+	// The allocator to use for the ctrls and slots slices. It is nil (i.e.
+	// defaultAllocator) unless the WithAllocator option was specified.
+	allocator Allocator[K, V]
+	// indirectBucket0 is set by the WithIndirectBucket0 option.
+	indirectBucket0 bool
+	// flat is set by the WithFlatTable option.
+	flat bool
+	// strictIteration is set by the WithStrictIterationSnapshot option.
+	strictIteration bool
+	// moveToFront is set by the WithMoveToFront option.
+	moveToFront bool
+	// deterministicHash is set by the WithDeterministicHash option.
+	deterministicHash bool
+	// customHash is set if the hash function of the map is not the default
+	// hash function, which is bound to the map's seed and replaced when the
+	// map is reseeded (see Map.reseed).
+	customHash bool
+	// cachedHash is true if the groups are allocated along with the hashes
+	// of the keys in their slots (see allocCachedGroups). It is set by the
+	// WithCachedHash option.
+	cachedHash bool
+	// name is set by the WithName option.
+	name string
+	// formatKey is set by the WithKeyFormatter option.
+	formatKey func(K) string
+	// compareKeys totally orders keys, and is used by AllByHash to order
+	// keys with the same hash. It is nil unless the WithDeterministicHash
+	// option was specified.
+	compareKeys func(a, b unsafe.Pointer) int
+	// growthFactor is the factor by which a bucket's capacity is multiplied
+	// when it is resized. It is 0 (equivalent to 2) unless the
+	// WithGrowthFactor option was specified.
+	growthFactor float64
+	// negCache records recent lookups which missed. It is nil unless the
+	// WithNegativeCache option was specified.
+	negCache *negativeCache
+	// counters tracks the churn of the map since creation. It is nil unless
+	// the WithOperationCounters option was specified. See Stats.
+	counters *opCounters
+	// hashTiming samples the time spent in the hash function, which is
+	// wrapped in order to do so. It is nil unless the WithHashTiming option
+	// was specified.
+	hashTiming *hashTiming
+	// clock returns the current monotonic time in nanoseconds. It is nil
+	// (i.e. nanotime) unless the WithClock option was specified.
+	clock func() int64
+	// opLog records the operations performed on the map. It is nil unless
+	// the WithOpLog option was specified.
+	opLog *opLog[K, V]
+	// memLimit bounds the size of the map. It is nil unless the
+	// WithMemoryLimit option was specified.
+	memLimit *memoryLimit[K, V]
+	// loadWatch reports buckets whose load factor crosses a threshold. It is
+	// nil unless the WithLoadFactorWatch option was specified.
+	loadWatch *loadFactorWatch
+	// locks makes Get, Put, Delete, Len, and All safe for concurrent use. It
+	// is nil unless the WithBucketLocks option was specified.
+	locks *bucketLocks
+	// ledger, if non-nil, tracks each outstanding allocation in order to
+	// detect mismatched frees. See WithAllocationLedger.
+	ledger *allocLedger
+	// shared, if non-nil, reference counts the group allocations shared
+	// between the map and its snapshots. See Map.Snapshot.
+	shared *sharedGroups
+	// degenerateHash is the fallback hash function of degenerate buckets
+	// (see degenerateSalt), and degenerateSeed its seed. They are set when
+	// the first bucket is marked degenerate.
+	degenerateHash hashFn
+	degenerateSeed uintptr
+	// negCacheHits is the number of lookups answered by negCache.
+	negCacheHits uint64
+	// degenerateSplits is the number of bucket splits which failed to
+	// divide the entries of the bucket. See bucket.split.
+	degenerateSplits uint64
+}
+
+// options returns the mapOptions of the map, allocating them if the map has
+// none. It is used to set a field of the mapOptions.
+func (m *Map[K, V]) options() *mapOptions[K, V] {
+	if m.opts == nil {
+		m.opts = &mapOptions[K, V]{}
+	}
+	return m.opts
+}
+
+// derive returns the mapOptions of a snapshot or clone of a map with the
+// options o. The configuration is carried over, while the negative cache,
+// operation counters, memory limit, hash timing, and allocation ledger of
+// the new map start afresh. The op log, load factor watch, bucket locks,
+// shared groups, and diagnostics are not carried over.
+func (o *mapOptions[K, V]) derive() *mapOptions[K, V] {
+	if o == nil {
+		return nil
+	}
+	d := &mapOptions[K, V]{
+		equal:             o.equal,
+		allocator:         o.allocator,
+		indirectBucket0:   o.indirectBucket0,
+		flat:              o.flat,
+		strictIteration:   o.strictIteration,
+		moveToFront:       o.moveToFront,
+		deterministicHash: o.deterministicHash,
+		customHash:        o.customHash,
+		cachedHash:        o.cachedHash,
+		name:              o.name,
+		formatKey:         o.formatKey,
+		compareKeys:       o.compareKeys,
+		growthFactor:      o.growthFactor,
+		clock:             o.clock,
+		degenerateHash:    o.degenerateHash,
+		degenerateSeed:    o.degenerateSeed,
+	}
+	if o.negCache != nil {
+		d.negCache = newNegativeCache()
+	}
+	if o.counters != nil {
+		d.counters = &opCounters{}
+	}
+	if o.memLimit != nil {
+		d.memLimit = &memoryLimit[K, V]{limit: o.memLimit.limit, evict: o.memLimit.evict}
+	}
+	if o.hashTiming != nil {
+		d.hashTiming = &hashTiming{every: o.hashTiming.every}
+	}
+	if o.ledger != nil {
+		d.ledger = newAllocLedger(o.ledger.onMismatch)
+	}
+	return d
+}
+
+// allocator returns the allocator of the map.
+func (m *Map[K, V]) allocator() Allocator[K, V] {
+	if m.opts == nil || m.opts.allocator == nil {
+		return defaultAllocator[K, V]{}
+	}
+	return m.opts.allocator
+}
+
+func (m *Map[K, V]) equal() equalFn {
+	if m.opts == nil {
+		return nil
+	}
+	return m.opts.equal
+}
+
+func (m *Map[K, V]) indirectBucket0() bool {
+	if m.opts == nil {
+		return false
+	}
+	return m.opts.indirectBucket0
+}
+
+func (m *Map[K, V]) flat() bool {
+	if m.opts == nil {
+		return false
+	}
+	return m.opts.flat
+}
+
+func (m *Map[K, V]) strictIteration() bool {
+	if m.opts == nil {
+		return false
+	}
+	return m.opts.strictIteration
+}
+
+func (m *Map[K, V]) moveToFront() bool {
+	if m.opts == nil {
+		return false
+	}
+	return m.opts.moveToFront
+}
+
+func (m *Map[K, V]) deterministicHash() bool {
+	if m.opts == nil {
+		return false
+	}
+	return m.opts.deterministicHash
+}
+
+func (m *Map[K, V]) customHash() bool {
+	if m.opts == nil {
+		return false
+	}
+	return m.opts.customHash
+}
+
+func (m *Map[K, V]) cachedHash() bool {
+	if m.opts == nil {
+		return false
+	}
+	return m.opts.cachedHash
+}
+
+func (m *Map[K, V]) name() string {
+	if m.opts == nil {
+		return ""
+	}
+	return m.opts.name
+}
+
+func (m *Map[K, V]) formatKey() func(K) string {
+	if m.opts == nil {
+		return nil
+	}
+	return m.opts.formatKey
+}
+
+func (m *Map[K, V]) compareKeys() func(a, b unsafe.Pointer) int {
+	if m.opts == nil {
+		return nil
+	}
+	return m.opts.compareKeys
+}
+
+func (m *Map[K, V]) growthFactor() float64 {
+	if m.opts == nil {
+		return 0
+	}
+	return m.opts.growthFactor
+}
+
+func (m *Map[K, V]) negCache() *negativeCache {
+	if m.opts == nil {
+		return nil
+	}
+	return m.opts.negCache
+}
+
+func (m *Map[K, V]) counters() *opCounters {
+	if m.opts == nil {
+		return nil
+	}
+	return m.opts.counters
+}
+
+func (m *Map[K, V]) hashTiming() *hashTiming {
+	if m.opts == nil {
+		return nil
+	}
+	return m.opts.hashTiming
+}
+
+func (m *Map[K, V]) clock() func() int64 {
+	if m.opts == nil {
+		return nil
+	}
+	return m.opts.clock
+}
+
+func (m *Map[K, V]) opLog() *opLog[K, V] {
+	if m.opts == nil {
+		return nil
+	}
+	return m.opts.opLog
+}
+
+func (m *Map[K, V]) memLimit() *memoryLimit[K, V] {
+	if m.opts == nil {
+		return nil
+	}
+	return m.opts.memLimit
+}
+
+func (m *Map[K, V]) loadWatch() *loadFactorWatch {
+	if m.opts == nil {
+		return nil
+	}
+	return m.opts.loadWatch
+}
+
+func (m *Map[K, V]) locks() *bucketLocks {
+	if m.opts == nil {
+		return nil
+	}
+	return m.opts.locks
+}
+
+func (m *Map[K, V]) ledger() *allocLedger {
+	if m.opts == nil {
+		return nil
+	}
+	return m.opts.ledger
+}
+
+func (m *Map[K, V]) shared() *sharedGroups {
+	if m.opts == nil {
+		return nil
+	}
+	return m.opts.shared
+}
+
+func (m *Map[K, V]) degenerateHash() hashFn {
+	if m.opts == nil {
+		return nil
+	}
+	return m.opts.degenerateHash
+}
+
+func (m *Map[K, V]) degenerateSeed() uintptr {
+	if m.opts == nil {
+		return 0
+	}
+	return m.opts.degenerateSeed
+}
+
+func (m *Map[K, V]) negCacheHits() uint64 {
+	if m.opts == nil {
+		return 0
+	}
+	return m.opts.negCacheHits
+}
+
+func (m *Map[K, V]) degenerateSplits() uint64 {
+	if m.opts == nil {
+		return 0
+	}
+	return m.opts.degenerateSplits
+}
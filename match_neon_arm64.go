@@ -0,0 +1,38 @@
+// Copyright 2024 The Cockroach Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+//go:build swiss_neon
+
+package swiss
+
+// neonMatch is true if we were built with the "swiss_neon" build tag on
+// arm64. When true, the control bytes of a group are matched with NEON
+// instructions (see matchH2NEON) rather than the SWAR routines. Go does not
+// inline assembly, so each match costs a function call, which the NEON
+// comparison must win back for the tag to be worthwhile. Use BenchmarkMatchH2
+// and BenchmarkMapGetMiss with and without the tag to decide for a CPU.
+const neonMatch = true
+
+// matchH2NEON returns the set of control bytes in ctrls equal to h. The
+// control bytes are compared with VCMEQ, which never produces false positive
+// matches, and the high bit of each resulting 0xff byte forms the bitset.
+//
+//go:noescape
+func matchH2NEON(ctrls *ctrlGroup, h uintptr) bitset
+
+// matchEmptyOrDeletedNEON returns the set of control bytes in ctrls which
+// have their high bit set.
+//
+//go:noescape
+func matchEmptyOrDeletedNEON(ctrls *ctrlGroup) bitset
@@ -0,0 +1,41 @@
+// Copyright 2024 The Cockroach Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+//go:build swiss_neon
+
+#include "textflag.h"
+
+// func matchH2NEON(ctrls *ctrlGroup, h uintptr) bitset
+TEXT ·matchH2NEON(SB), NOSPLIT|NOFRAME, $0-24
+	MOVD  ctrls+0(FP), R0
+	MOVD  h+8(FP), R1
+	VLD1  (R0), [V0.B8]
+	VDUP  R1, V1.B8
+	VCMEQ V0.B8, V1.B8, V2.B8
+	VMOV  V2.D[0], R2
+	AND   $0x8080808080808080, R2
+	MOVD  R2, ret+16(FP)
+	RET
+
+// func matchEmptyOrDeletedNEON(ctrls *ctrlGroup) bitset
+TEXT ·matchEmptyOrDeletedNEON(SB), NOSPLIT|NOFRAME, $0-16
+	MOVD   ctrls+0(FP), R0
+	VLD1   (R0), [V0.B8]
+	MOVD   $0x80, R1
+	VDUP   R1, V1.B8
+	VCMTST V0.B8, V1.B8, V2.B8
+	VMOV   V2.D[0], R2
+	AND    $0x8080808080808080, R2
+	MOVD   R2, ret+8(FP)
+	RET
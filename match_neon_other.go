@@ -0,0 +1,25 @@
+// Copyright 2024 The Cockroach Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+//go:build !arm64 || !swiss_neon
+
+package swiss
+
+// neonMatch is true if we were built with the "swiss_neon" build tag on
+// arm64.
+const neonMatch = false
+
+func matchH2NEON(ctrls *ctrlGroup, h uintptr) bitset { return 0 }
+
+func matchEmptyOrDeletedNEON(ctrls *ctrlGroup) bitset { return 0 }
@@ -0,0 +1,200 @@
+// Copyright 2024 The Cockroach Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package swiss
+
+import (
+	"errors"
+	"unsafe"
+)
+
+// ErrMemoryLimit is returned by Map.PutErr when inserting an entry would grow
+// the map beyond the limit specified by WithMemoryLimit, even after invoking
+// the eviction callback.
+var ErrMemoryLimit = errors.New("memory limit exceeded")
+
+// memoryLimit is the state of the WithMemoryLimit option.
+type memoryLimit[K comparable, V any] struct {
+	limit int64
+	evict func(m *Map[K, V], need int64)
+	// evicting is true while the eviction callback is running and the
+	// insertion which invoked it is being completed. The limit is not
+	// enforced while evicting so that the callback is not invoked
+	// recursively.
+	evicting bool
+	// strict is true during a call to PutErr, and failed is set if the
+	// insertion was refused.
+	strict bool
+	failed bool
+}
+
+// SizeInBytes returns the number of bytes of memory used by the groups and
+// directory of the map, including the hashes cached for the slots of the
+// groups (see WithCachedHash). The memory referenced by the keys and values (e.g.
+// the bytes of a string) is not included. The groups shared with a snapshot
+// (see Map.Snapshot) are included in the size of both maps.
+func (m *Map[K, V]) SizeInBytes() int64 {
+	_, groups := m.OutstandingAllocations()
+	n := int64(groups) * m.groupBytes()
+	return n + m.directoryBytes()
+}
+
+// groupBytes returns the number of bytes of memory used by a group,
+// including the hashes cached for its slots.
+func (m *Map[K, V]) groupBytes() int64 {
+	n := int64(unsafe.Sizeof(Group[K, V]{}))
+	if m.cachedHash() {
+		n += groupSize * ptrSize
+	}
+	return n
+}
+
+// directoryBytes returns the size of the directory if it was allocated
+// separately from the map (i.e. does not consist of just bucket0).
+func (m *Map[K, V]) directoryBytes() int64 {
+	if m.globalShift == 0 && !m.indirectBucket0() {
+		return 0
+	}
+	return int64(m.bucketCount()) * int64(unsafe.Sizeof(bucket[K, V]{}))
+}
+
+// growthBytes returns the number of bytes by which the size of the map (see
+// SizeInBytes) would increase if b were rehashed to make room for another
+// entry. This mirrors the choice made by bucket.rehash between rehashing in
+// place, resizing, and splitting.
+func (b *bucket[K, V]) growthBytes(m *Map[K, V]) int64 {
+	if b.capacity > groupSize && b.tombstones() >= b.capacity/3 {
+		return 0
+	}
+	groupBytes := m.groupBytes()
+	newCapacity := m.grownCapacity(b.capacity)
+	if newCapacity <= m.maxBucketCapacity {
+		if newCapacity < groupSize {
+			newCapacity = groupSize
+		}
+		return int64(newCapacity-b.capacity) / groupSize * groupBytes
+	}
+	// Splitting replaces b with two buckets of the same capacity, and doubles
+	// the directory if b is the only bucket indexed by its entries.
+	n := int64(b.groupCount()) * groupBytes
+	if uint32(b.localDepth) == m.globalDepth() {
+		n += 2*int64(m.bucketCount())*int64(unsafe.Sizeof(bucket[K, V]{})) - m.directoryBytes()
+	}
+	return n
+}
+
+// memoryLimitExcess returns the number of bytes by which the map would exceed
+// its memory limit if b were rehashed to make room for another entry, or a
+// value <= 0 if the limit would not be exceeded (or is not being enforced).
+func (m *Map[K, V]) memoryLimitExcess(b *bucket[K, V]) int64 {
+	if m.memLimit().evicting {
+		return 0
+	}
+	return m.SizeInBytes() + b.growthBytes(m) - m.memLimit().limit
+}
+
+// insertionExcess is memoryLimitExcess for the insertion of key, which
+// requires rehashing a bucket only if the key is not present and there is
+// neither room left to grow in its bucket nor a deleted slot to reuse.
+func (m *Map[K, V]) insertionExcess(key K) int64 {
+	loc := m.find(key)
+	if loc.found || loc.b.growthLeft > 0 || loc.g.ctrls.Get(loc.i) == ctrlDeleted {
+		return 0
+	}
+	return m.SizeInBytes() + loc.b.growthBytes(m) - m.memLimit().limit
+}
+
+// evictFor invokes the eviction callback to make room for the insertion of
+// key, which would exceed the memory limit by need bytes. The callback is
+// invoked again for as long as the limit would still be exceeded and the
+// previous invocation deleted at least one entry. It returns false if the
+// insertion should be refused (see PutErr). The caller must set
+// memLimit.evicting beforehand, and reset it after completing the insertion.
+func (m *Map[K, V]) evictFor(key K, need int64) bool {
+	l := m.memLimit()
+	for need > 0 && l.evict != nil {
+		used := m.used
+		l.evict(m, need)
+		need = m.insertionExcess(key)
+		if m.used >= used {
+			break
+		}
+	}
+	if need > 0 && l.strict {
+		l.failed = true
+		return false
+	}
+	return true
+}
+
+// putEvicting completes a Put which would exceed the memory limit by need
+// bytes, after invoking the eviction callback. The callback may have mutated
+// the map, so the Put is restarted from the beginning.
+func (m *Map[K, V]) putEvicting(key K, value V, need int64) {
+	m.memLimit().evicting = true
+	defer func() { m.memLimit().evicting = false }()
+	if concurrentChecks {
+		// The callback and the restarted Put mutate the map themselves.
+		m.endWrite()
+		defer m.startWrite()
+	}
+	if !m.evictFor(key, need) {
+		return
+	}
+	// The Put has already been recorded by the op log.
+	opLog := m.opLog()
+	m.options().opLog = nil
+	defer func() { m.options().opLog = opLog }()
+	m.Put(key, value)
+}
+
+// insertEvicting completes an insert which would exceed the memory limit by
+// need bytes, after invoking the eviction callback. The callback may have
+// mutated the map, invalidating the location of the key, so the key is found
+// again (and may have been inserted by the callback).
+func (m *Map[K, V]) insertEvicting(key K, value V, need int64) *V {
+	m.memLimit().evicting = true
+	defer func() { m.memLimit().evicting = false }()
+	m.evictFor(key, need)
+	loc := m.find(key)
+	if loc.found {
+		v := m.mutableLocation(loc).value()
+		*v = value
+		if m.opLog() != nil {
+			m.opLog().put(m, key, value)
+		}
+		return v
+	}
+	return m.insert(loc, key, value)
+}
+
+// PutErr is Put for a map with a memory limit (see WithMemoryLimit). If
+// inserting the entry would grow the map beyond the limit even after invoking
+// the eviction callback, the entry is not inserted and ErrMemoryLimit is
+// returned. Overwriting the value of an existing entry never fails. PutErr is
+// equivalent to Put for a map without a memory limit.
+func (m *Map[K, V]) PutErr(key K, value V) error {
+	l := m.memLimit()
+	if l == nil || l.evicting {
+		m.Put(key, value)
+		return nil
+	}
+	l.strict, l.failed = true, false
+	defer func() { l.strict = false }()
+	m.Put(key, value)
+	if l.failed {
+		return ErrMemoryLimit
+	}
+	return nil
+}
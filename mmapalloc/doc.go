@@ -0,0 +1,36 @@
+// Copyright 2024 The Cockroach Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package mmapalloc provides a swiss.Allocator which allocates the memory
+// for a swiss.Map from a memory-mapped file. This allows a map to grow larger
+// than physical memory, relying on the OS to page the map's memory to and
+// from the file. The package is only supported on unix platforms.
+//
+// The memory returned by the allocator is not visible to the Go garbage
+// collector, so the key and value types of a map using the allocator must
+// not contain pointers. New returns an error if they do.
+//
+// Usage:
+//
+//	a, err := mmapalloc.New[uint64, uint64]("/path/to/file")
+//	if err != nil {
+//	  ...
+//	}
+//	m := swiss.New[uint64, uint64](0, swiss.WithAllocator[uint64, uint64](a))
+//	...
+//	m.Close()
+//	if err := a.Close(); err != nil {
+//	  ...
+//	}
+package mmapalloc
@@ -0,0 +1,296 @@
+// Copyright 2024 The Cockroach Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+//go:build unix
+
+package mmapalloc
+
+import (
+	"fmt"
+	"math/bits"
+	"os"
+	"reflect"
+	"syscall"
+	"unsafe"
+
+	"github.com/cockroachdb/swiss"
+)
+
+const (
+	// minChunkSize is the minimum size of the first region of the file
+	// mapped by an Allocator. Each subsequent region is twice the size of
+	// the previous one, up to maxChunkSize, so that the number of mappings
+	// grows logarithmically with the size of the file and stays far below
+	// the limit on the number of mappings of a process (vm.max_map_count on
+	// Linux).
+	minChunkSize = 1 << 20
+	maxChunkSize = 1 << 30
+)
+
+// Allocator is a swiss.Allocator which allocates groups from a
+// memory-mapped file. The file is grown (via ftruncate) and mapped in large
+// chunks, and allocations are carved out of the chunks by a buddy
+// allocator: an allocation of n groups is served by a block of the next
+// power of two groups, which is split from a larger free block if there is
+// no free block of that size. A freed block is coalesced with its buddy if
+// the buddy is also free, so the memory freed when a bucket is resized is
+// reused by allocations of any size. The file never shrinks.
+//
+// An Allocator is NOT goroutine-safe, and may only be used by a single Map.
+type Allocator[K comparable, V any] struct {
+	f *os.File
+	// size is the current size of the file.
+	size int64
+	// chunks holds the regions of the file which have been mapped.
+	chunks []*chunk
+	// nextChunkClass is the size class of the next chunk to be mapped, if
+	// the allocation which requires it is no larger.
+	nextChunkClass int
+	// free holds the free blocks of each size class, keyed by address:
+	// free[k] holds the free blocks of 1<<k groups.
+	free []map[unsafe.Pointer]*chunk
+	// allocated holds the blocks returned by Alloc which have not been
+	// freed, keyed by address.
+	allocated map[unsafe.Pointer]block
+}
+
+// chunk is a region of the file mapped by an Allocator, holding 1<<class
+// groups.
+type chunk struct {
+	data  []byte
+	class int
+}
+
+// block is an allocated block of 1<<class groups within a chunk.
+type block struct {
+	chunk *chunk
+	class int
+}
+
+var _ swiss.Allocator[int, int] = (*Allocator[int, int])(nil)
+
+// The Allocator sizes its mappings using the size of a Group, and relies on
+// a Group holding no pointers when its key and value types hold none, which
+// holds for both layout 1 and the parallel keys and values of layout 2 (see
+// the swiss_soa build tag). This will cause a constant overflow error if the
+// layout of a Group changes again.
+const _ = uint(2 - swiss.LayoutVersion)
+
+// New creates an Allocator backed by the file at path. The file is created
+// if it does not exist and truncated if it does. The file is not removed
+// when the Allocator is closed.
+func New[K comparable, V any](path string) (*Allocator[K, V], error) {
+	if t := reflect.TypeOf(swiss.Group[K, V]{}); hasPointers(t) {
+		return nil, fmt.Errorf("mmapalloc: key and value types must not contain pointers: %s", t)
+	}
+	f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return nil, err
+	}
+	a := &Allocator[K, V]{
+		f:         f,
+		allocated: make(map[unsafe.Pointer]block),
+	}
+	for a.chunkSize(a.nextChunkClass) < minChunkSize {
+		a.nextChunkClass++
+	}
+	return a, nil
+}
+
+// Alloc implements swiss.Allocator. Alloc panics if the file cannot be
+// grown or mapped.
+func (a *Allocator[K, V]) Alloc(n int) []swiss.Group[K, V] {
+	if a.f == nil {
+		panic("mmapalloc: Alloc called on closed allocator")
+	}
+	class := sizeClass(n)
+	j := class
+	for j < len(a.free) && len(a.free[j]) == 0 {
+		j++
+	}
+	if j >= len(a.free) {
+		j = a.mapChunk(class)
+	}
+	// Allocate the free block with the lowest address, which keeps the
+	// higher addresses free to be coalesced into large blocks.
+	var ptr unsafe.Pointer
+	var c *chunk
+	for p, pc := range a.free[j] {
+		if ptr == nil || uintptr(p) < uintptr(ptr) {
+			ptr, c = p, pc
+		}
+	}
+	delete(a.free[j], ptr)
+	// Split the block in halves until it is of the requested size class,
+	// freeing the upper half each time.
+	for j > class {
+		j--
+		a.free[j][unsafe.Add(ptr, a.blockSize(j))] = c
+	}
+	a.allocated[ptr] = block{chunk: c, class: class}
+
+	// A reused block must be zeroed like make([]Group, n). The memory of a
+	// newly mapped chunk is already zero, but tracking which blocks have
+	// been used is not worth the bookkeeping as the map initializes the
+	// control bytes of every group anyway.
+	groups := unsafe.Slice((*swiss.Group[K, V])(ptr), n)
+	clear(groups)
+	return groups
+}
+
+// mapChunk grows the file and maps a new chunk large enough to hold a block
+// of the size class, which it adds to the free blocks. It returns the size
+// class of the chunk.
+func (a *Allocator[K, V]) mapChunk(class int) int {
+	class = max(class, a.nextChunkClass)
+	size := a.chunkSize(class)
+
+	// Mapping offsets must be page aligned. We maintain the file size as a
+	// multiple of the page size so the end of the file is always aligned.
+	offset := a.size
+	if err := a.f.Truncate(offset + size); err != nil {
+		panic(fmt.Sprintf("mmapalloc: unable to grow %s: %v", a.f.Name(), err))
+	}
+	a.size = offset + size
+
+	data, err := syscall.Mmap(int(a.f.Fd()), offset, int(size),
+		syscall.PROT_READ|syscall.PROT_WRITE, syscall.MAP_SHARED)
+	if err != nil {
+		panic(fmt.Sprintf("mmapalloc: unable to map %s: %v", a.f.Name(), err))
+	}
+	c := &chunk{data: data, class: class}
+	a.chunks = append(a.chunks, c)
+	if class >= a.nextChunkClass && a.chunkSize(class+1) <= maxChunkSize {
+		a.nextChunkClass = class + 1
+	}
+	for len(a.free) <= class {
+		a.free = append(a.free, make(map[unsafe.Pointer]*chunk))
+	}
+	a.free[class][unsafe.Pointer(unsafe.SliceData(data))] = c
+	return class
+}
+
+// Free implements swiss.Allocator. The freed block is coalesced with its
+// buddy, and the result with its own buddy and so on, for as long as the
+// buddy is free, and retained for reuse by subsequent allocations. Free
+// panics if the memory was not allocated by the allocator or has already
+// been freed, as reusing it would hand the same memory out to two
+// allocations.
+func (a *Allocator[K, V]) Free(groups []swiss.Group[K, V]) {
+	ptr := unsafe.Pointer(unsafe.SliceData(groups))
+	b, ok := a.allocated[ptr]
+	if !ok {
+		if a.mapped(ptr) {
+			panic(fmt.Sprintf("mmapalloc: double free of memory %p", ptr))
+		}
+		panic(fmt.Sprintf("mmapalloc: freeing memory %p not allocated by this allocator", ptr))
+	}
+	delete(a.allocated, ptr)
+
+	base := unsafe.Pointer(unsafe.SliceData(b.chunk.data))
+	offset := uintptr(ptr) - uintptr(base)
+	class := b.class
+	for ; class < b.chunk.class; class++ {
+		buddy := unsafe.Add(base, offset^uintptr(a.blockSize(class)))
+		if _, ok := a.free[class][buddy]; !ok {
+			break
+		}
+		delete(a.free[class], buddy)
+		offset &^= uintptr(a.blockSize(class))
+	}
+	a.free[class][unsafe.Add(base, offset)] = b.chunk
+}
+
+// mapped returns true if ptr points into one of the chunks.
+func (a *Allocator[K, V]) mapped(ptr unsafe.Pointer) bool {
+	for _, c := range a.chunks {
+		base := uintptr(unsafe.Pointer(unsafe.SliceData(c.data)))
+		if uintptr(ptr) >= base && uintptr(ptr) < base+uintptr(len(c.data)) {
+			return true
+		}
+	}
+	return false
+}
+
+// blockSize returns the size in bytes of a block of the size class.
+func (a *Allocator[K, V]) blockSize(class int) int64 {
+	return int64(unsafe.Sizeof(swiss.Group[K, V]{})) << class
+}
+
+// chunkSize returns the size in bytes of a chunk of the size class, which
+// is rounded up to a multiple of the page size.
+func (a *Allocator[K, V]) chunkSize(class int) int64 {
+	pageSize := int64(os.Getpagesize())
+	return (a.blockSize(class) + pageSize - 1) &^ (pageSize - 1)
+}
+
+// sizeClass returns the size class of an allocation of n groups: the
+// smallest k such that n <= 1<<k.
+func sizeClass(n int) int {
+	if n <= 1 {
+		return 0
+	}
+	return bits.Len(uint(n - 1))
+}
+
+// Size returns the current size in bytes of the backing file.
+func (a *Allocator[K, V]) Size() int64 {
+	return a.size
+}
+
+// Close unmaps all of the memory allocated by the allocator and closes the
+// backing file. It is invalid to access a Map using the allocator after the
+// allocator has been closed. Close is idempotent.
+func (a *Allocator[K, V]) Close() error {
+	if a.f == nil {
+		return nil
+	}
+	var firstErr error
+	for _, c := range a.chunks {
+		if err := syscall.Munmap(c.data); err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	a.chunks = nil
+	a.free = nil
+	clear(a.allocated)
+	if err := a.f.Close(); err != nil && firstErr == nil {
+		firstErr = err
+	}
+	a.f = nil
+	return firstErr
+}
+
+// hasPointers returns true if values of type t contain pointers.
+func hasPointers(t reflect.Type) bool {
+	switch t.Kind() {
+	case reflect.Array:
+		return t.Len() > 0 && hasPointers(t.Elem())
+	case reflect.Struct:
+		for i := 0; i < t.NumField(); i++ {
+			if hasPointers(t.Field(i).Type) {
+				return true
+			}
+		}
+		return false
+	case reflect.Bool, reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr,
+		reflect.Float32, reflect.Float64, reflect.Complex64, reflect.Complex128:
+		return false
+	default:
+		// Pointers, strings, slices, maps, channels, funcs, interfaces, and
+		// unsafe pointers.
+		return true
+	}
+}
@@ -0,0 +1,179 @@
+// Copyright 2024 The Cockroach Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+//go:build unix
+
+package mmapalloc
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+	"unsafe"
+
+	"github.com/cockroachdb/swiss"
+	"github.com/stretchr/testify/require"
+)
+
+func TestAllocator(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "map")
+	a, err := New[uint64, [4]uint64](path)
+	require.NoError(t, err)
+
+	m := swiss.New[uint64, [4]uint64](0,
+		swiss.WithAllocator[uint64, [4]uint64](a),
+		swiss.WithMaxBucketCapacity[uint64, [4]uint64](1024))
+	const count = 100_000
+	for i := uint64(0); i < count; i++ {
+		m.Put(i, [4]uint64{i, i + 1, i + 2, i + 3})
+	}
+	for i := uint64(0); i < count; i += 2 {
+		m.Delete(i)
+	}
+	for i := uint64(0); i < count; i++ {
+		v, ok := m.Get(i)
+		if i%2 == 0 {
+			require.False(t, ok)
+		} else {
+			require.True(t, ok)
+			require.Equal(t, [4]uint64{i, i + 1, i + 2, i + 3}, v)
+		}
+	}
+
+	info, err := os.Stat(path)
+	require.NoError(t, err)
+	require.Equal(t, a.Size(), info.Size())
+	require.Greater(t, a.Size(), int64(count*8*5/2))
+
+	// Clearing and refilling the map reuses the existing allocations.
+	m.Clear()
+	size := a.Size()
+	for i := uint64(0); i < count/2; i++ {
+		m.Put(i, [4]uint64{i})
+	}
+	require.Equal(t, size, a.Size())
+
+	m.Close()
+	require.NoError(t, a.Close())
+	require.NoError(t, a.Close())
+}
+
+func TestAllocatorGrowShrink(t *testing.T) {
+	if invariantsExhaustive {
+		t.Skip("exhaustive invariants check the whole flat table on each operation")
+	}
+	a, err := New[uint64, uint64](filepath.Join(t.TempDir(), "map"))
+	require.NoError(t, err)
+	defer a.Close()
+
+	// Grow the map to a larger size in each round and shrink it back down.
+	// With a growth factor of 1.5 the table is resized to capacities which
+	// differ from round to round, and the memory freed by the resizing must
+	// be reused by allocations of other sizes. Rounding allocations up to a
+	// power of two and mapping the file in chunks means the file can be a
+	// few times larger than the memory in use, but no more.
+	m := swiss.New[uint64, uint64](0,
+		swiss.WithAllocator[uint64, uint64](a),
+		swiss.WithFlatTable[uint64, uint64](),
+		swiss.WithGrowthFactor[uint64, uint64](1.5))
+	var maxLive int64
+	for round := 0; round < 25; round++ {
+		n := 10_000 + round*3_989
+		for i := 0; i < n; i++ {
+			m.Put(uint64(i), uint64(i))
+		}
+		_, groups := m.OutstandingAllocations()
+		maxLive = max(maxLive, int64(groups)*int64(unsafe.Sizeof(swiss.Group[uint64, uint64]{})))
+		for i := n / 10; i < n; i++ {
+			m.Delete(uint64(i))
+		}
+		m.ShrinkToFit()
+	}
+	require.LessOrEqual(t, a.Size(), 4*maxLive)
+	m.Close()
+}
+
+func TestAllocatorReuseZeroes(t *testing.T) {
+	a, err := New[int64, int64](filepath.Join(t.TempDir(), "map"))
+	require.NoError(t, err)
+	defer a.Close()
+
+	// A map with an initial capacity of 28 uses a single allocation of 4
+	// groups (or 2 with the swiss_sse2 build tag). Fill it and then close it
+	// to release the allocation.
+	m := swiss.New[int64, int64](28, swiss.WithAllocator[int64, int64](a))
+	for i := int64(1); i <= 28; i++ {
+		m.Put(i, i)
+	}
+	m.Close()
+	size := a.Size()
+	layout, err := swiss.Describe[int64, int64](28)
+	require.NoError(t, err)
+	n := swiss.CtrlBytesFor(int(layout.BucketCapacity)) / swiss.CtrlBytesFor(1)
+
+	// The allocation is reused and must be zeroed like make([]Group, n).
+	groups := a.Alloc(n)
+	require.Equal(t, size, a.Size())
+	require.Equal(t, make([]swiss.Group[int64, int64], n), groups)
+	a.Free(groups)
+
+	require.Panics(t, func() {
+		a.Free(make([]swiss.Group[int64, int64], n))
+	})
+}
+
+func TestAllocatorDoubleFree(t *testing.T) {
+	a, err := New[int64, int64](filepath.Join(t.TempDir(), "map"))
+	require.NoError(t, err)
+	defer a.Close()
+
+	groups := a.Alloc(4)
+	a.Free(groups)
+	require.PanicsWithValue(t,
+		fmt.Sprintf("mmapalloc: double free of memory %p", unsafe.SliceData(groups)),
+		func() { a.Free(groups) })
+
+	// The memory is handed out once, after which it may be freed again.
+	require.True(t, unsafe.SliceData(groups) == unsafe.SliceData(a.Alloc(4)))
+	require.False(t, unsafe.SliceData(groups) == unsafe.SliceData(a.Alloc(4)))
+	a.Free(groups)
+}
+
+func TestPointersRejected(t *testing.T) {
+	dir := t.TempDir()
+	_, err := New[string, int](filepath.Join(dir, "a"))
+	require.Error(t, err)
+	_, err = New[int, *int](filepath.Join(dir, "b"))
+	require.Error(t, err)
+	_, err = New[int, struct {
+		a int
+		b []byte
+	}](filepath.Join(dir, "c"))
+	require.Error(t, err)
+
+	a, err := New[[16]byte, struct{ a, b int32 }](filepath.Join(dir, "d"))
+	require.NoError(t, err)
+	require.NoError(t, a.Close())
+
+	b, err := New[uintptr, uintptr](filepath.Join(dir, "e"))
+	require.NoError(t, err)
+	m := swiss.New[uintptr, uintptr](0, swiss.WithAllocator[uintptr, uintptr](b))
+	for i := uintptr(0); i < 100; i++ {
+		m.Put(i, i)
+	}
+	require.Equal(t, 100, m.Len())
+	m.Close()
+	require.NoError(t, b.Close())
+}
@@ -0,0 +1,188 @@
+// Copyright 2024 The Cockroach Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package swiss
+
+// maxPooledInnerMaps is the maximum number of empty inner maps retained by a
+// NestedMap for reuse.
+const maxPooledInnerMaps = 16
+
+// NestedMap is a map of maps, from an outer key of type K1 to an inner map
+// from keys of type K2 to values of type V. Unlike a Map[K1, *Map[K2, V]]
+// managed by hand, an inner map is removed as soon as its last entry is
+// deleted, so empty inner maps never accumulate. Removed inner maps are
+// cleared and retained in a small pool for reuse by the next outer key which
+// is inserted, avoiding an allocation per outer key for workloads which churn
+// through outer keys. Inner maps which are newly allocated are sized to hold
+// the mean number of entries per inner map.
+//
+// The zero value for a NestedMap is an empty map ready to use. Like Map, a
+// NestedMap is NOT goroutine-safe.
+type NestedMap[K1, K2 comparable, V any] struct {
+	outer Map[K1, *Map[K2, V]]
+	// options are the options the inner maps are constructed with.
+	options []Option[K2, V]
+	// pool holds empty inner maps available for reuse.
+	pool []*Map[K2, V]
+	// used is the number of entries across all of the inner maps.
+	used int
+}
+
+// NewNestedMap constructs a new, empty NestedMap whose inner maps are
+// constructed with the specified options.
+func NewNestedMap[K1, K2 comparable, V any](options ...Option[K2, V]) *NestedMap[K1, K2, V] {
+	return &NestedMap[K1, K2, V]{options: options}
+}
+
+// Put inserts an entry into the inner map for k1, creating the inner map if
+// it does not exist, overwriting an existing value if an entry with the same
+// key already exists.
+func (n *NestedMap[K1, K2, V]) Put(k1 K1, k2 K2, value V) {
+	var inner *Map[K2, V]
+	if loc := n.outer.find(k1); loc.found {
+		inner = *loc.value()
+	} else {
+		inner = n.newInner()
+		n.outer.insert(loc, k1, inner)
+	}
+	before := inner.Len()
+	inner.Put(k2, value)
+	n.used += inner.Len() - before
+}
+
+// Get retrieves the value for the specified keys, returning ok=false if
+// either key is not present.
+func (n *NestedMap[K1, K2, V]) Get(k1 K1, k2 K2) (value V, ok bool) {
+	inner, ok := n.outer.Get(k1)
+	if !ok {
+		return value, false
+	}
+	return inner.Get(k2)
+}
+
+// Delete deletes the entry for the specified keys, returning true if it was
+// present. The inner map for k1 is removed if the entry was its last.
+func (n *NestedMap[K1, K2, V]) Delete(k1 K1, k2 K2) bool {
+	loc := n.outer.find(k1)
+	if !loc.found {
+		return false
+	}
+	inner := *loc.value()
+	if !inner.Delete(k2) {
+		return false
+	}
+	n.used--
+	if inner.Len() == 0 {
+		n.outer.deleteAt(loc)
+		n.release(inner)
+	}
+	return true
+}
+
+// DeleteAll deletes all of the entries for k1, removing its inner map, and
+// returns the number of entries deleted.
+func (n *NestedMap[K1, K2, V]) DeleteAll(k1 K1) int {
+	inner, ok := n.outer.Pop(k1)
+	if !ok {
+		return 0
+	}
+	deleted := inner.Len()
+	n.used -= deleted
+	n.release(inner)
+	return deleted
+}
+
+// Len returns the number of entries across all of the inner maps.
+func (n *NestedMap[K1, K2, V]) Len() int {
+	return n.used
+}
+
+// OuterLen returns the number of outer keys, each of which has a non-empty
+// inner map.
+func (n *NestedMap[K1, K2, V]) OuterLen() int {
+	return n.outer.Len()
+}
+
+// InnerLen returns the number of entries in the inner map for k1.
+func (n *NestedMap[K1, K2, V]) InnerLen(k1 K1) int {
+	if inner, ok := n.outer.Get(k1); ok {
+		return inner.Len()
+	}
+	return 0
+}
+
+// All calls yield sequentially for each entry present in the map. If yield
+// returns false, the iteration stops. The map must not be mutated during
+// iteration.
+func (n *NestedMap[K1, K2, V]) All(yield func(k1 K1, k2 K2, value V) bool) {
+	n.outer.All(func(k1 K1, inner *Map[K2, V]) bool {
+		ok := true
+		inner.All(func(k2 K2, value V) bool {
+			ok = yield(k1, k2, value)
+			return ok
+		})
+		return ok
+	})
+}
+
+// AllInner calls yield sequentially for each entry present in the inner map
+// for k1 (see Map.All).
+func (n *NestedMap[K1, K2, V]) AllInner(k1 K1, yield func(k2 K2, value V) bool) {
+	if inner, ok := n.outer.Get(k1); ok {
+		inner.All(yield)
+	}
+}
+
+// Close closes all of the inner maps, including the pooled ones, and the
+// outer map (see Map.Close). Close is only necessary if the inner maps were
+// constructed with an Allocator which requires memory to be freed. It is
+// invalid to use a NestedMap after it has been closed.
+func (n *NestedMap[K1, K2, V]) Close() {
+	n.outer.All(func(_ K1, inner *Map[K2, V]) bool {
+		inner.Close()
+		return true
+	})
+	for _, inner := range n.pool {
+		inner.Close()
+	}
+	n.pool = nil
+	n.outer.Close()
+}
+
+// newInner returns an empty inner map, reusing a pooled map if one is
+// available.
+func (n *NestedMap[K1, K2, V]) newInner() *Map[K2, V] {
+	if k := len(n.pool); k > 0 {
+		inner := n.pool[k-1]
+		n.pool[k-1] = nil
+		n.pool = n.pool[:k-1]
+		return inner
+	}
+	var initialCapacity int
+	if c := n.outer.Len(); c > 0 {
+		initialCapacity = (n.used + c - 1) / c
+	}
+	return New[K2, V](initialCapacity, n.options...)
+}
+
+// release returns an inner map which was removed from the outer map to the
+// pool, or closes it if the pool is full.
+func (n *NestedMap[K1, K2, V]) release(inner *Map[K2, V]) {
+	if len(n.pool) >= maxPooledInnerMaps {
+		inner.Close()
+		return
+	}
+	inner.Clear()
+	n.pool = append(n.pool, inner)
+}
@@ -0,0 +1,199 @@
+// Copyright 2024 The Cockroach Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package swiss
+
+import (
+	"encoding/gob"
+	"errors"
+	"fmt"
+	"io"
+)
+
+// opLogOp identifies the operation of an opLogRecord.
+type opLogOp uint8
+
+const (
+	// opLogInit is the first record of an op log and holds the initial
+	// capacity and hash seed of the map.
+	opLogInit opLogOp = iota + 1
+	opLogPut
+	opLogGet
+	opLogDelete
+	// opLogClear holds the hash seed of the map after it was cleared.
+	opLogClear
+)
+
+// opLogRecord is a single record of an op log. Records are encoded with
+// encoding/gob, which omits fields holding their zero value, so a record
+// only contains the fields relevant to its operation.
+type opLogRecord[K comparable, V any] struct {
+	Op       opLogOp
+	Key      K
+	Value    V
+	Seed     uint64
+	Capacity int
+}
+
+// opLog records the operations performed on a map. See WithOpLog.
+type opLog[K comparable, V any] struct {
+	w   opLogWriter
+	enc *gob.Encoder
+	// stopped is set after the first error returned by w, after which no
+	// further records are written.
+	stopped bool
+	// reserved is set by ReserveKey, which returns a pointer through which
+	// the caller fills in the value of the key's entry after ReserveKey
+	// returns. The entry's value is recorded before the next record.
+	reserved    bool
+	reservedKey K
+}
+
+// opLogWriter wraps the writer of an op log in order to distinguish errors
+// returned by the writer from errors encoding a record.
+type opLogWriter struct {
+	w   io.Writer
+	err error
+}
+
+func (w *opLogWriter) Write(p []byte) (int, error) {
+	n, err := w.w.Write(p)
+	if err != nil && w.err == nil {
+		w.err = err
+	}
+	return n, err
+}
+
+func newOpLog[K comparable, V any](w io.Writer) *opLog[K, V] {
+	l := &opLog[K, V]{w: opLogWriter{w: w}}
+	l.enc = gob.NewEncoder(&l.w)
+	return l
+}
+
+func (l *opLog[K, V]) record(m *Map[K, V], rec opLogRecord[K, V]) {
+	if l.stopped {
+		return
+	}
+	if l.reserved {
+		l.flushReserved(m)
+	}
+	if err := l.enc.Encode(&rec); err != nil {
+		if l.w.err == nil {
+			// The record could not be encoded (e.g. K or V contains a type
+			// gob does not support), which is a programming error.
+			m.panicf("op log: %v", err)
+		}
+		l.stopped = true
+	}
+}
+
+// put records the insertion or overwrite of the entry for key with value.
+func (l *opLog[K, V]) put(m *Map[K, V], key K, value V) {
+	l.record(m, opLogRecord[K, V]{Op: opLogPut, Key: key, Value: value})
+}
+
+// delete records the deletion of the entry for key.
+func (l *opLog[K, V]) delete(m *Map[K, V], key K) {
+	l.record(m, opLogRecord[K, V]{Op: opLogDelete, Key: key})
+}
+
+// reserve notes that the value of the entry for key, returned by ReserveKey,
+// is to be recorded before the next record (see opLog.reserved).
+func (l *opLog[K, V]) reserve(m *Map[K, V], key K) {
+	l.flushReserved(m)
+	l.reserved, l.reservedKey = true, key
+}
+
+// flushReserved records the value of the entry returned by the last call to
+// ReserveKey, if it has not been recorded yet and is still present.
+func (l *opLog[K, V]) flushReserved(m *Map[K, V]) {
+	if !l.reserved {
+		return
+	}
+	l.reserved = false
+	if loc := m.find(l.reservedKey); loc.found {
+		l.put(m, l.reservedKey, *loc.value())
+	}
+}
+
+// Replay constructs a new Map by replaying the operations recorded by
+// WithOpLog and read from r. The map is constructed with the specified
+// options, which should match those of the recorded map, and the initial
+// capacity and hash seed of the recorded map. The entries of the replayed map
+// are the same as those of the recorded map (see WithOpLog for the value of
+// an entry returned by the last call to ReserveKey). If the recorded map was
+// only mutated by Put, Delete, and Clear, the layout of the buckets is also
+// the same provided the hash function is deterministic across processes,
+// which the default hash function is not (see WithHash). When built with the
+// swiss_invariants tag the invariants of the map are checked as each
+// operation is replayed, and Replay verifies the map (see Map.Validate)
+// before returning it.
+//
+// A map returned along with an error contains the operations replayed before
+// the error was encountered.
+func Replay[K comparable, V any](r io.Reader, options ...Option[K, V]) (*Map[K, V], error) {
+	dec := gob.NewDecoder(r)
+	var rec opLogRecord[K, V]
+	if err := dec.Decode(&rec); err != nil {
+		return nil, fmt.Errorf("reading op log header: %w", err)
+	}
+	if rec.Op != opLogInit {
+		return nil, fmt.Errorf("op log header has unexpected op %d", rec.Op)
+	}
+	options = append(options[:len(options):len(options)], seedOption[K, V]{nil, uintptr(rec.Seed)})
+	m, err := NewE[K, V](rec.Capacity, options...)
+	if err != nil {
+		return nil, err
+	}
+
+	for n := 1; ; n++ {
+		// NB: gob does not write zero fields, and does not zero the fields
+		// missing from a record when decoding.
+		rec = opLogRecord[K, V]{}
+		if err := dec.Decode(&rec); err != nil {
+			if errors.Is(err, io.EOF) {
+				break
+			}
+			return m, fmt.Errorf("reading op log record %d: %w", n, err)
+		}
+		switch rec.Op {
+		case opLogPut:
+			m.Put(rec.Key, rec.Value)
+		case opLogGet:
+			m.Get(rec.Key)
+		case opLogDelete:
+			m.Delete(rec.Key)
+		case opLogClear:
+			// Clear reseeds the map, so the seed of the recorded map is
+			// restored before the clear is recorded by m.
+			l := m.opLog()
+			m.options().opLog = nil
+			m.Clear()
+			m.seed = uintptr(rec.Seed)
+			m.options().opLog = l
+			if l != nil {
+				l.record(m, opLogRecord[K, V]{Op: opLogClear, Seed: rec.Seed})
+			}
+		default:
+			return m, fmt.Errorf("op log record %d has unexpected op %d", n, rec.Op)
+		}
+	}
+
+	if invariants {
+		if err := m.Validate(); err != nil {
+			m.panicf("invariant failed: %v", err)
+		}
+	}
+	return m, nil
+}
@@ -14,7 +14,10 @@
 
 package swiss
 
-import "unsafe"
+import (
+	"io"
+	"unsafe"
+)
 
 // Option provides an interface for passing configuration parameters for Map
 // initialization.
@@ -28,13 +31,58 @@ type hashOption[K comparable, V any] struct {
 
 func (op hashOption[K, V]) apply(m *Map[K, V]) {
 	m.hash = *(*hashFn)(noescape(unsafe.Pointer(&op.hash)))
+	m.options().customHash = true
 }
 
 // WithHash is an option to specify the hash function to use for a Map[K,V].
+// If so many keys share a hash that splitting the bucket holding them cannot
+// divide them, the bucket places its keys within its probe sequences by the
+// map's default hash function of the key instead, so that operations on
+// the bucket do not degrade to scanning every key with the same hash. Keys
+// compared by a function specified with WithKeyEqual have no such fallback.
 func WithHash[K comparable, V any](hash func(key *K, seed uintptr) uintptr) Option[K, V] {
 	return hashOption[K, V]{hash}
 }
 
+type keyEqualOption[K comparable, V any] struct {
+	equal func(a, b *K) bool
+}
+
+func (op keyEqualOption[K, V]) apply(m *Map[K, V]) {
+	m.options().equal = *(*equalFn)(noescape(unsafe.Pointer(&op.equal)))
+}
+
+// WithKeyEqual is an option to specify the function used to compare keys
+// for equality in place of ==, e.g. to treat strings which differ only in
+// case as the same key. It must be paired with WithHash, with a hash
+// function which hashes equal keys identically: NewE returns an error and
+// New panics if WithHash is not specified. The equality function is called
+// for every key whose control byte matches the key being looked up, and is
+// slower than == for most key types. See NewFunc for keys of types which are
+// not comparable.
+func WithKeyEqual[K comparable, V any](equal func(a, b *K) bool) Option[K, V] {
+	return keyEqualOption[K, V]{equal}
+}
+
+type deterministicHashOption[K comparable, V any] struct{}
+
+func (op deterministicHashOption[K, V]) apply(m *Map[K, V]) {
+	m.options().deterministicHash = true
+}
+
+// WithDeterministicHash is an option to hash keys with a hash function and
+// seed which are the same in every process and on every architecture, so
+// that the hash of a key (see Map.Hash) and the order in which AllByHash
+// yields the entries of a map depend only on the map's contents. It takes
+// precedence over WithHash. Keys must be strings, integers, or byte arrays
+// (or types defined as one of those); for other key types NewE returns an
+// error and New panics. Note that the seed of such a map is not changed when
+// it is cleared, so the map is not protected against an attacker choosing
+// keys whose hashes collide.
+func WithDeterministicHash[K comparable, V any]() Option[K, V] {
+	return deterministicHashOption[K, V]{}
+}
+
 type maxBucketCapacityOption[K comparable, V any] struct {
 	maxBucketCapacity uint32
 }
@@ -50,6 +98,360 @@ func WithMaxBucketCapacity[K comparable, V any](v uint32) Option[K, V] {
 	return maxBucketCapacityOption[K, V]{v}
 }
 
+type flatTableOption[K comparable, V any] struct{}
+
+func (op flatTableOption[K, V]) apply(m *Map[K, V]) {
+	m.options().flat = true
+}
+
+// WithFlatTable is an option to disable extendible hashing so that the map
+// is a single Swiss table which never splits and is instead resized all at
+// once (like Abseil's flat_hash_map). Operations on a map containing a single
+// bucket skip indexing the bucket directory, and growing the map avoids
+// splitting buckets, at the cost of a latency spike proportional to the size
+// of the map each time it is resized. WithFlatTable overrides
+// WithMaxBucketCapacity. See the impl=swissMapFlat benchmarks.
+func WithFlatTable[K comparable, V any]() Option[K, V] {
+	return flatTableOption[K, V]{}
+}
+
+type strictIterationSnapshotOption[K comparable, V any] struct{}
+
+func (op strictIterationSnapshotOption[K, V]) apply(m *Map[K, V]) {
+	m.options().strictIteration = true
+}
+
+// WithStrictIterationSnapshot is an option to make iteration (All, Keys, and
+// the methods built on them) yield exactly the entries present in the map
+// when iteration started, with the values they had at that time. Entries
+// inserted during iteration are never yielded, which algorithms that insert
+// into the map being scanned (e.g. computing the transitive closure of a
+// relation) rely on to terminate. AllLive additionally omits the entries
+// deleted during iteration. Each iteration takes a Snapshot of the map,
+// which allocates and takes time proportional to the number of buckets, and
+// the first mutation of each bucket during iteration copies the bucket.
+func WithStrictIterationSnapshot[K comparable, V any]() Option[K, V] {
+	return strictIterationSnapshotOption[K, V]{}
+}
+
+type moveToFrontOption[K comparable, V any] struct{}
+
+func (op moveToFrontOption[K, V]) apply(m *Map[K, V]) {
+	m.options().moveToFront = true
+}
+
+// WithMoveToFront is an experimental option to move the entry found by a Get
+// to the first slot of its group, which is the slot sharing a cache line
+// with the group's control bytes. The slot an entry occupies within a group
+// does not affect probing, so repeatedly accessed (hot) keys migrate to the
+// front of their groups, improving the locality of lookups for skewed access
+// patterns. Moving an entry adds a write to a lookup which would otherwise
+// only read the map, and hot keys sharing a group displace each other, so
+// the option is only beneficial for some large maps and workloads (see
+// BenchmarkMoveToFront). Note that with this option enabled, Get mutates the
+// map. Entries are not moved while the map is being iterated over or while
+// their bucket is shared with a snapshot (see Map.Snapshot).
+func WithMoveToFront[K comparable, V any]() Option[K, V] {
+	return moveToFrontOption[K, V]{}
+}
+
+type nameOption[K comparable, V any] struct {
+	name string
+}
+
+func (op nameOption[K, V]) apply(m *Map[K, V]) {
+	m.options().name = op.name
+}
+
+// WithName is an option to name the map for debugging. The name is included
+// in the message of a panic due to a violated invariant, in GoString, and in
+// Stats and StatsAppend, so that a map can be identified in a program which
+// has many maps. The name is inherited by snapshots and clones of the map.
+func WithName[K comparable, V any](name string) Option[K, V] {
+	return nameOption[K, V]{name: name}
+}
+
+type keyFormatterOption[K comparable, V any] struct {
+	format func(K) string
+}
+
+func (op keyFormatterOption[K, V]) apply(m *Map[K, V]) {
+	m.options().formatKey = op.format
+}
+
+// WithKeyFormatter is an option to specify how keys are formatted in
+// diagnostics, such as the messages of invariant failure panics and the
+// output of formatting the map with "%#v". By default keys are formatted
+// with "%v", which may expose sensitive keys or produce enormous messages
+// for large keys. The formatter can redact or truncate keys while keeping
+// the diagnostics useful.
+func WithKeyFormatter[K comparable, V any](format func(key K) string) Option[K, V] {
+	return keyFormatterOption[K, V]{format}
+}
+
+type growthFactorOption[K comparable, V any] struct {
+	growthFactor float64
+}
+
+func (op growthFactorOption[K, V]) apply(m *Map[K, V]) {
+	m.options().growthFactor = op.growthFactor
+}
+
+// WithGrowthFactor is an option to specify the factor by which a bucket's
+// capacity grows when it is resized, which defaults to 2. The grown capacity
+// is rounded up to a whole number of groups. A smaller growth factor (e.g.
+// 1.5) reduces the memory overshoot of resizing large buckets, at the cost of
+// resizing more often. Buckets whose number of groups is not a power of 2
+// probe within the next power of 2 and skip the groups which are not
+// present. A growth factor outside of the range (1, 2] is ignored (see NewE).
+func WithGrowthFactor[K comparable, V any](f float64) Option[K, V] {
+	return growthFactorOption[K, V]{f}
+}
+
+type negativeCacheOption[K comparable, V any] struct{}
+
+func (op negativeCacheOption[K, V]) apply(m *Map[K, V]) {
+	m.options().negCache = newNegativeCache()
+}
+
+// WithNegativeCache is an option to enable a small per-map cache of recent
+// lookups which did not find their key. A Get for a key in the cache returns
+// immediately without probing the map. The cache is invalidated as keys are
+// inserted, so it never causes a present key to be reported as missing. The
+// cache is beneficial for workloads where most lookups miss against a large
+// map, and costs an additional probe of the control bytes when a lookup
+// misses. Note that with a negative cache enabled, Get mutates the map.
+func WithNegativeCache[K comparable, V any]() Option[K, V] {
+	return negativeCacheOption[K, V]{}
+}
+
+type operationCountersOption[K comparable, V any] struct{}
+
+func (op operationCountersOption[K, V]) apply(m *Map[K, V]) {
+	m.options().counters = &opCounters{}
+}
+
+// WithOperationCounters is an option to count the entries inserted,
+// overwritten, and deleted since the map was created, which are reported by
+// Map.Stats. Counting is disabled by default to keep the increments off of
+// the mutation paths.
+func WithOperationCounters[K comparable, V any]() Option[K, V] {
+	return operationCountersOption[K, V]{}
+}
+
+type opLogOption[K comparable, V any] struct {
+	w io.Writer
+}
+
+func (op opLogOption[K, V]) apply(m *Map[K, V]) {
+	m.options().opLog = newOpLog[K, V](op.w)
+}
+
+// WithOpLog is an option to record the operations performed on a Map[K,V]
+// to w, in a compact binary form from which the map can be reconstructed
+// using Replay. This is intended for reproducing a bug observed in a map by
+// replaying its history under invariants checking. Put, Get, Delete, and
+// Clear are recorded as they are called. The other methods which mutate the
+// map (e.g. PutIfAbsent, Compute, DeleteFunc, or Batch.Commit) record each
+// entry they insert, overwrite, or delete as a Put or Delete, and the
+// methods which remove every entry (e.g. Reset) record a Clear. The value of
+// an entry returned by ReserveKey, which the caller fills in afterwards, is
+// recorded by the next operation performed on the map. Keys and values are
+// encoded with encoding/gob, and the map panics if K or V cannot be encoded.
+// Recording stops at the first error returned by w, which w should retain in
+// order to report it (as bufio.Writer does). Snapshots and clones of the map
+// are not recorded.
+func WithOpLog[K comparable, V any](w io.Writer) Option[K, V] {
+	return opLogOption[K, V]{w}
+}
+
+// seedOption specifies the hash seed of a map, and the hash function if it is
+// non-nil. It is used by Replay to construct a map with the seed of the
+// recorded map, and by NewConcurrentMap to hash the keys of every shard with
+// the hash function and seed of the first.
+type seedOption[K comparable, V any] struct {
+	hash hashFn
+	seed uintptr
+}
+
+func (op seedOption[K, V]) apply(m *Map[K, V]) {
+	if op.hash != nil {
+		m.hash = op.hash
+		m.options().customHash = true
+	}
+	m.seed = op.seed
+}
+
+type shardsOption[K comparable, V any] struct {
+	n int
+}
+
+func (op shardsOption[K, V]) apply(m *Map[K, V]) {}
+
+// WithShards is an option to specify the number of shards of a
+// ConcurrentMap, which is rounded up to a power of 2. It defaults to 4 times
+// GOMAXPROCS. More shards reduce contention between goroutines operating on
+// different keys, at the cost of the memory overhead of each shard's map.
+// WithShards has no effect on a Map.
+func WithShards[K comparable, V any](n int) Option[K, V] {
+	return shardsOption[K, V]{n}
+}
+
+type hashTimingOption[K comparable, V any] struct {
+	every uint32
+}
+
+func (op hashTimingOption[K, V]) apply(m *Map[K, V]) {
+	m.options().hashTiming = &hashTiming{every: op.every}
+}
+
+// WithHashTiming is an option to measure the time spent computing the hash
+// of keys, which is reported by Map.Stats. One out of every n hash
+// computations is timed (every computation if n <= 1), and the total time is
+// extrapolated from the samples. This is intended to determine whether
+// hashing or probing dominates the cost of operations on a map with a custom
+// hash function (see WithHash) or large keys such as long strings.
+func WithHashTiming[K comparable, V any](n uint32) Option[K, V] {
+	return hashTimingOption[K, V]{n}
+}
+
+type clockOption[K comparable, V any] struct {
+	clock func() int64
+}
+
+func (op clockOption[K, V]) apply(m *Map[K, V]) {
+	m.options().clock = op.clock
+}
+
+// WithClock is an option to specify the source of time used by the
+// time-dependent features of a map: the samples taken by WithHashTiming and
+// the expiration of the entries of an ExpiringMap. The clock returns a
+// monotonic time in nanoseconds. By default the runtime's monotonic clock is
+// used. A deterministic clock makes tests of these features reproducible,
+// while a coarse cached clock reduces their overhead for high-frequency
+// callers.
+func WithClock[K comparable, V any](clock func() int64) Option[K, V] {
+	return clockOption[K, V]{clock}
+}
+
+type memoryLimitOption[K comparable, V any] struct {
+	limit int64
+	evict func(m *Map[K, V], need int64)
+}
+
+func (op memoryLimitOption[K, V]) apply(m *Map[K, V]) {
+	m.options().memLimit = &memoryLimit[K, V]{limit: op.limit, evict: op.evict}
+}
+
+// WithMemoryLimit is an option to bound the memory used by the groups and
+// directory of a map (see Map.SizeInBytes) to limit bytes. When inserting an
+// entry would require growing the map beyond the limit, evict is invoked with
+// the map and the number of bytes by which the limit would be exceeded. The
+// callback may delete entries to make room, in which case it is invoked again
+// for as long as the insertion would still exceed the limit. Note that
+// deleting an entry only makes room for the insertion if it is in the same
+// bucket as the new key, or if enough entries are deleted from that bucket
+// for it to be rehashed in place. If the limit would still be exceeded, Put
+// grows the map anyway, while PutErr refuses the insertion. The limit is not
+// enforced for insertions performed by evict itself, and evict may be nil.
+func WithMemoryLimit[K comparable, V any](
+	limit int64, evict func(m *Map[K, V], need int64),
+) Option[K, V] {
+	return memoryLimitOption[K, V]{limit, evict}
+}
+
+type bucketLocksOption[K comparable, V any] struct {
+	stripes int
+}
+
+func (op bucketLocksOption[K, V]) apply(m *Map[K, V]) {
+	m.options().locks = newBucketLocks(op.stripes)
+}
+
+// WithBucketLocks is an option to make Get, Put, Delete, Len, and All safe
+// for concurrent use by multiple goroutines without external locking. Each
+// bucket is guarded by one of a power of 2 number of mutexes, selected by the
+// bucket's position in the directory, so operations on keys in different
+// buckets rarely contend. stripes specifies the number of mutexes, and
+// defaults to 4 times GOMAXPROCS if it is <= 0. Inserting into a bucket which
+// needs to be resized or split locks the whole map, as does All. The other
+// methods of Map are not safe for concurrent use. WithBucketLocks cannot be
+// combined with WithMoveToFront, WithNegativeCache, WithOperationCounters,
+// WithHashTiming, WithOpLog, WithMemoryLimit, WithLoadFactorWatch, or
+// WithCachedHash, and the map panics if it is.
+// Snapshots and clones of the map do not use bucket locks. See also
+// ConcurrentMap, which partitions the entries across independent maps.
+func WithBucketLocks[K comparable, V any](stripes int) Option[K, V] {
+	return bucketLocksOption[K, V]{stripes}
+}
+
+type cachedHashOption[K comparable, V any] struct{}
+
+func (op cachedHashOption[K, V]) apply(m *Map[K, V]) {
+	m.options().cachedHash = true
+}
+
+// WithCachedHash is an option to store the hash of the key of each entry
+// alongside the entry, so that resizing, splitting, or rehashing a bucket in
+// place (and merging buckets, see Map.TryMergeSiblings) moves the entries
+// without hashing their keys again. Hashing dominates the cost of those
+// operations for keys which are expensive to hash, such as long strings.
+// The hashes cost a word of memory per slot (see Map.SizeInBytes), and are
+// allocated along with the groups of slots, so WithCachedHash cannot be
+// combined with WithAllocator. WithCachedHash is ignored if both the key and
+// value types have a size of zero, and cannot be combined with
+// WithBucketLocks.
+func WithCachedHash[K comparable, V any]() Option[K, V] {
+	return cachedHashOption[K, V]{}
+}
+
+type loadFactorWatchOption[K comparable, V any] struct {
+	threshold float64
+	fn        func(bucket BucketStats)
+}
+
+func (op loadFactorWatchOption[K, V]) apply(m *Map[K, V]) {
+	m.options().loadWatch = &loadFactorWatch{threshold: op.threshold, fn: op.fn}
+}
+
+// WithLoadFactorWatch is an option to call fn whenever an insertion raises
+// the load factor of a bucket (the fraction of its slots holding entries) to
+// threshold or above from below it. fn is passed the statistics of the bucket
+// after the insertion, and is called again if the bucket later crosses the
+// threshold after being resized or split. It allows a capacity management
+// layer to grow the map ahead of demand (e.g. with Map.Reserve) rather than
+// having buckets resized or split by insertions during peak traffic. fn is
+// called before the inserting method returns and must not access the map;
+// growing the map is left to the caller once the method has returned. Note that a bucket is resized or split when
+// its load factor would exceed 7/8. A threshold outside of the range (0, 1]
+// is ignored (see NewE). WithLoadFactorWatch cannot be combined with
+// WithBucketLocks.
+func WithLoadFactorWatch[K comparable, V any](
+	threshold float64, fn func(bucket BucketStats),
+) Option[K, V] {
+	return loadFactorWatchOption[K, V]{threshold, fn}
+}
+
+type allocationLedgerOption[K comparable, V any] struct {
+	onMismatch func(error)
+}
+
+func (op allocationLedgerOption[K, V]) apply(m *Map[K, V]) {
+	m.options().ledger = newAllocLedger(op.onMismatch)
+}
+
+// WithAllocationLedger is an option to track every allocation a Map[K,V]
+// obtains from its Allocator and verify that each call to Allocator.Free
+// releases exactly one outstanding allocation. A mismatched Free (e.g. a
+// double free) is reported to onMismatch along with the index of the bucket
+// and the number of groups involved. If onMismatch is nil the map panics
+// instead. The ledger is always enabled when the map is built with
+// invariants checking, in which case mismatches panic unless this option is
+// specified.
+func WithAllocationLedger[K comparable, V any](onMismatch func(error)) Option[K, V] {
+	return allocationLedgerOption[K, V]{onMismatch}
+}
+
 // Allocator specifies an interface for allocating and releasing memory used
 // by a Map. The default allocator utilizes Go's builtin make() and allows the
 // GC to reclaim memory.
@@ -57,6 +459,10 @@ func WithMaxBucketCapacity[K comparable, V any](v uint32) Option[K, V] {
 // If the allocator is manually managing memory and requires that slots and
 // controls be freed then Map.Close must be called in order to ensure
 // FreeSlots and FreeControls are called.
+//
+// An allocator which computes the sizes of allocations or offsets within them
+// should use SlotSize and CtrlBytesFor rather than assuming the layout of a
+// Group, and assert the LayoutVersion it was written against.
 type Allocator[K comparable, V any] interface {
 	// Alloc should return a slice equivalent to make([]Group, n).
 	Alloc(n int) []Group[K, V]
@@ -80,10 +486,27 @@ type allocatorOption[K comparable, V any] struct {
 }
 
 func (op allocatorOption[K, V]) apply(m *Map[K, V]) {
-	m.allocator = op.allocator
+	m.options().allocator = op.allocator
 }
 
 // WithAllocator is an option for specifying the Allocator to use for a Map[K,V].
 func WithAllocator[K comparable, V any](allocator Allocator[K, V]) Option[K, V] {
 	return allocatorOption[K, V]{allocator}
 }
+
+type indirectBucket0Option[K comparable, V any] struct{}
+
+func (op indirectBucket0Option[K, V]) apply(m *Map[K, V]) {
+	m.options().indirectBucket0 = true
+}
+
+// WithIndirectBucket0 is an option to store the bucket of a map containing a
+// single bucket in a separately allocated directory of size 1, rather than
+// inlined in the Map. This costs an allocation per map, but means that bucket
+// structs are never copied into or out of the Map itself when the directory
+// grows and shrinks, and that splits use a separately allocated temporary
+// bucket. Lookups in a single bucket map load the bucket through the
+// directory rather than directly from the Map. See BenchmarkBucket0.
+func WithIndirectBucket0[K comparable, V any]() Option[K, V] {
+	return indirectBucket0Option[K, V]{}
+}
@@ -0,0 +1,27 @@
+// Copyright 2024 The Cockroach Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+#include "textflag.h"
+
+// func prefetchRange(addr unsafe.Pointer, n uintptr)
+TEXT ·prefetchRange(SB), NOSPLIT|NOFRAME, $0-16
+	MOVD addr+0(FP), R0
+	MOVD n+8(FP), R1
+	ADD  R0, R1, R1
+loop:
+	PRFM (R0), PLDL1KEEP
+	ADD  $64, R0
+	CMP  R1, R0
+	BLO  loop
+	RET
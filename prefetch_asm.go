@@ -0,0 +1,30 @@
+// Copyright 2024 The Cockroach Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+//go:build amd64 || arm64
+
+package swiss
+
+import "unsafe"
+
+// prefetchSupported is true if prefetchRange is implemented for the
+// architecture.
+const prefetchSupported = true
+
+// prefetchRange hints to the CPU that the n > 0 bytes starting at addr will
+// be read soon. It is implemented in assembly as Go does not expose prefetch
+// instructions.
+//
+//go:noescape
+func prefetchRange(addr unsafe.Pointer, n uintptr)
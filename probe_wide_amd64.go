@@ -0,0 +1,125 @@
+// Copyright 2024 The Cockroach Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+//go:build swiss_avx && !swiss_sse2
+
+package swiss
+
+import (
+	"math/bits"
+	"unsafe"
+
+	"golang.org/x/sys/cpu"
+)
+
+// wideProbe is true if we were built with the "swiss_avx" build tag on amd64.
+// When true, lookups in large buckets (see bucket.probeWide) scan the control
+// bytes of several groups of the probe sequence per step with AVX-512 or AVX2
+// instructions, as selected by wideProbeGroups.
+const wideProbe = true
+
+// wideProbeMinGroups is the minimum number of groups in a bucket for Get to
+// use findWide. Smaller buckets have short probe sequences, for which
+// gathering the control bytes of several groups mostly loads groups which
+// are never examined.
+const wideProbeMinGroups = 64
+
+// wideProbeGroups is the number of groups whose control bytes findWide scans
+// per step: 8 (64 control bytes) if the CPU supports AVX-512BW, 4 (32 control
+// bytes) if it supports AVX2, and otherwise 0, which disables findWide. It is
+// a variable so that the tests can exercise each width supported by the CPU.
+var wideProbeGroups = func() int {
+	switch {
+	case cpu.X86.HasAVX512F && cpu.X86.HasAVX512BW:
+		return 8
+	case cpu.X86.HasAVX2:
+		return 4
+	}
+	return 0
+}()
+
+// probeWide returns true if lookups in the bucket should use findWide.
+func (b *bucket[K, V]) probeWide() bool {
+	return wideProbeGroups > 0 && b.groupMask >= wideProbeMinGroups-1
+}
+
+// findWide locates key within the bucket like find, for use by Get, scanning
+// the control bytes of the next wideProbeGroups groups of the probe sequence
+// at once. The groups are then examined in probe order, exactly as find
+// would, so the result is the same. The probe sequence of a bucket with
+// fewer than wideProbeGroups groups wraps around, which is harmless as the
+// scan stops at the first group containing an empty slot.
+func (b *bucket[K, V]) findWide(key K, h uintptr, equal equalFn) (_ *Group[K, V], i uint32, found bool) {
+	stride := unsafe.Sizeof(Group[K, V]{})
+	var offsets [8]uintptr
+	var groups [8]*Group[K, V]
+	n := wideProbeGroups
+	v := bitsetLSB * uint64(h2(h))
+	seq := b.probe(h)
+
+	// Most probe sequences end at their first group (see the %fullgrp metric
+	// of BenchmarkMapGetMiss), so the first group is examined on its own and
+	// only the remainder of a longer probe sequence is scanned several groups
+	// at a time.
+	g := b.groups.At(uintptr(seq.offset))
+	for match := g.ctrls.matchH2(h2(h)); match != 0; match = match.removeFirst() {
+		if i := match.first(); keyEqual(equal, key, g.slots.Key(i)) {
+			return g, i, true
+		}
+	}
+	if g.ctrls.matchEmpty() != 0 {
+		return nil, 0, false
+	}
+	seq = seq.next()
+
+	for {
+		for k := 0; k < n; k++ {
+			offsets[k] = uintptr(seq.offset) * stride
+			groups[k] = b.groups.At(uintptr(seq.offset))
+			seq = seq.next()
+		}
+		var h2Mask, emptyMask uint64
+		if n == 8 {
+			h2Mask, emptyMask = matchGroupsAVX512(b.groups.ptr, &offsets, v)
+		} else {
+			h2Mask, emptyMask = matchGroupsAVX2(b.groups.ptr, &offsets, v)
+		}
+		// The masks hold a bit per control byte, 8 bits per group.
+		for k := 0; k < n; k++ {
+			g := groups[k]
+			for match := uint8(h2Mask >> (8 * k)); match != 0; match &= match - 1 {
+				i := uint32(bits.TrailingZeros8(match))
+				if keyEqual(equal, key, g.slots.Key(i)) {
+					return g, i, true
+				}
+			}
+			if uint8(emptyMask>>(8*k)) != 0 {
+				return nil, 0, false
+			}
+		}
+	}
+}
+
+// matchGroupsAVX2 gathers the control bytes of the 4 groups at the byte
+// offsets offsets[:4] from base, and returns the set of control bytes equal to
+// the low byte of v (which holds the byte repeated 8 times) and the set of
+// empty control bytes, with bit 8*k+j set for control byte j of group k.
+//
+//go:noescape
+func matchGroupsAVX2(base unsafe.Pointer, offsets *[8]uintptr, v uint64) (h2Mask, emptyMask uint64)
+
+// matchGroupsAVX512 is like matchGroupsAVX2 for the 8 groups at offsets.
+//
+//go:noescape
+func matchGroupsAVX512(base unsafe.Pointer, offsets *[8]uintptr, v uint64) (h2Mask, emptyMask uint64)
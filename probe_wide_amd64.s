@@ -0,0 +1,56 @@
+// Copyright 2024 The Cockroach Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+//go:build swiss_avx && !swiss_sse2
+
+#include "textflag.h"
+
+DATA ctrlEmptyBytes<>+0(SB)/8, $0x8080808080808080
+GLOBL ctrlEmptyBytes<>(SB), RODATA|NOPTR, $8
+
+// func matchGroupsAVX2(base unsafe.Pointer, offsets *[8]uintptr, v uint64) (h2Mask, emptyMask uint64)
+TEXT ·matchGroupsAVX2(SB), NOSPLIT|NOFRAME, $0-40
+	MOVQ         base+0(FP), AX
+	MOVQ         offsets+8(FP), BX
+	VMOVDQU      (BX), Y1
+	VPCMPEQQ     Y2, Y2, Y2
+	VPGATHERQQ   Y2, (AX)(Y1*1), Y0
+	VPBROADCASTQ v+16(FP), Y3
+	VPCMPEQB     Y0, Y3, Y3
+	VPMOVMSKB    Y3, CX
+	MOVQ         CX, h2Mask+24(FP)
+	VPBROADCASTQ ctrlEmptyBytes<>(SB), Y4
+	VPCMPEQB     Y0, Y4, Y4
+	VPMOVMSKB    Y4, CX
+	MOVQ         CX, emptyMask+32(FP)
+	VZEROUPPER
+	RET
+
+// func matchGroupsAVX512(base unsafe.Pointer, offsets *[8]uintptr, v uint64) (h2Mask, emptyMask uint64)
+TEXT ·matchGroupsAVX512(SB), NOSPLIT|NOFRAME, $0-40
+	MOVQ         base+0(FP), AX
+	MOVQ         offsets+8(FP), BX
+	VMOVDQU64    (BX), Z1
+	KXNORB       K1, K1, K1
+	VPGATHERQQ   (AX)(Z1*1), K1, Z0
+	VPBROADCASTQ v+16(FP), Z3
+	VPCMPEQB     Z0, Z3, K2
+	KMOVQ        K2, CX
+	MOVQ         CX, h2Mask+24(FP)
+	VPBROADCASTQ ctrlEmptyBytes<>(SB), Z4
+	VPCMPEQB     Z0, Z4, K3
+	KMOVQ        K3, CX
+	MOVQ         CX, emptyMask+32(FP)
+	VZEROUPPER
+	RET
@@ -0,0 +1,28 @@
+// Copyright 2024 The Cockroach Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+//go:build !amd64 || !swiss_avx || swiss_sse2
+
+package swiss
+
+// wideProbe is true if we were built with the "swiss_avx" build tag on amd64.
+const wideProbe = false
+
+var wideProbeGroups = 0
+
+func (b *bucket[K, V]) probeWide() bool { return false }
+
+func (b *bucket[K, V]) findWide(key K, h uintptr, equal equalFn) (_ *Group[K, V], i uint32, found bool) {
+	return nil, 0, false
+}
@@ -0,0 +1,133 @@
+// Copyright 2024 The Cockroach Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package swiss
+
+import (
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"unsafe"
+)
+
+// ReadMostlyMap is a map which is safe for concurrent use by multiple
+// goroutines, optimized for workloads dominated by reads such as caches.
+// Readers access an immutable published snapshot of the map (see
+// Map.Snapshot) without acquiring a lock. Writers are serialized by a mutex
+// and mutate a private map whose buckets are copied on their first mutation
+// after a snapshot is published, so the published snapshot is never
+// modified. Once the writer is done, a new snapshot is published atomically
+// and the previous snapshot is released to the garbage collector.
+//
+// Publishing a snapshot requires time proportional to the number of buckets,
+// and the first mutation of each bucket after a publish copies the bucket. A
+// batch of mutations should therefore be performed with a single call to
+// Update rather than individual calls to Put and Delete.
+//
+// A ReadMostlyMap must be constructed with NewReadMostlyMap.
+type ReadMostlyMap[K comparable, V any] struct {
+	published atomic.Pointer[Map[K, V]]
+	// mu serializes the writers, which mutate w and then publish a snapshot
+	// of it.
+	mu sync.Mutex
+	w  Map[K, V]
+}
+
+// NewReadMostlyMap constructs a new ReadMostlyMap with the specified initial
+// capacity (see New). The options which cause lookups to mutate the map
+// (WithMoveToFront, WithNegativeCache, and WithHashTiming) and WithAllocator
+// are not supported, and NewReadMostlyMap panics if one is specified.
+func NewReadMostlyMap[K comparable, V any](
+	initialCapacity int, options ...Option[K, V],
+) *ReadMostlyMap[K, V] {
+	for _, op := range options {
+		switch op.(type) {
+		case moveToFrontOption[K, V], negativeCacheOption[K, V],
+			hashTimingOption[K, V], allocatorOption[K, V]:
+			panic(fmt.Sprintf("option %T is not supported by ReadMostlyMap", op))
+		}
+	}
+	r := &ReadMostlyMap[K, V]{}
+	r.w.Init(initialCapacity, options...)
+	r.published.Store(r.w.Snapshot())
+	return r
+}
+
+// Get retrieves the value for the specified key from the published snapshot,
+// returning ok=false if the key is not present. Get does not block, and may
+// be called concurrently with other calls to Get and with writers.
+func (r *ReadMostlyMap[K, V]) Get(key K) (value V, ok bool) {
+	return r.published.Load().Get(key)
+}
+
+// Len returns the number of entries in the published snapshot. Like Get, Len
+// does not block.
+func (r *ReadMostlyMap[K, V]) Len() int {
+	return r.published.Load().Len()
+}
+
+// Update calls fn with the map, publishing the mutations performed by fn
+// atomically once it returns. Readers observe either none or all of the
+// mutations. Calls to Update are serialized, and fn must not retain the map
+// or call methods of the ReadMostlyMap other than Get and Len.
+func (r *ReadMostlyMap[K, V]) Update(fn func(m *Map[K, V])) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	fn(&r.w)
+	r.published.Swap(r.w.Snapshot()).retire()
+}
+
+// Put inserts an entry into the map, overwriting an existing value if an
+// entry with the same key already exists, and publishes the mutation.
+func (r *ReadMostlyMap[K, V]) Put(key K, value V) {
+	r.Update(func(m *Map[K, V]) {
+		m.Put(key, value)
+	})
+}
+
+// Delete deletes the entry with the specified key and publishes the
+// mutation, returning true if the key was present.
+func (r *ReadMostlyMap[K, V]) Delete(key K) bool {
+	var ok bool
+	r.Update(func(m *Map[K, V]) {
+		ok = m.Delete(key)
+	})
+	return ok
+}
+
+// All calls yield sequentially for each key and value present in the map
+// (see Map.All). Writers are blocked for the duration of the iteration, so
+// yield must not call Update, Put, or Delete. Readers are not blocked.
+func (r *ReadMostlyMap[K, V]) All(yield func(key K, value V) bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.w.All(yield)
+}
+
+// retire releases the references to the shared groups held by m, a snapshot
+// which is no longer published. Readers may still be accessing the snapshot,
+// so unlike Close the snapshot itself is not modified, and its groups are left
+// to the garbage collector (which is why ReadMostlyMap requires the default
+// allocator) rather than being freed.
+func (m *Map[K, V]) retire() {
+	globalDepth := m.globalDepth()
+	for i, n := uint32(0), m.bucketCount(); i < n; {
+		b := m.dir.At(uintptr(i))
+		if b.capacity > 0 {
+			groups := b.groups.Slice(0, uintptr(b.groupCount()))
+			m.shared().release(unsafe.Pointer(unsafe.SliceData(groups)))
+		}
+		i += bucketStep(globalDepth, uint32(b.localDepth))
+	}
+}
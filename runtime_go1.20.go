@@ -21,7 +21,8 @@
 // on go1.20, exclusive on go1.24).
 
 // The untested_go_version flag enables building on any go version, intended
-// to ease testing against Go at tip.
+// to ease testing against Go at tip. Go 1.24 and later otherwise use
+// hash/maphash (see runtime_go1.24.go).
 //go:build (go1.20 && !go1.24) || untested_go_version
 
 package swiss
@@ -31,8 +32,25 @@ import "unsafe"
 //go:linkname fastrand64 runtime.fastrand64
 func fastrand64() uint64
 
+//go:linkname nanotime runtime.nanotime
+func nanotime() int64
+
 type hashFn func(key unsafe.Pointer, seed uintptr) uintptr
 
+// hashSeed is the seed of a map (see getHasher). Maps are seeded
+// independently, and Map.Clear makes a new seed.
+type hashSeed uintptr
+
+func newHashSeed() hashSeed {
+	return hashSeed(fastrand64())
+}
+
+// seedBits returns the integer seed of a map which is derived from s. The
+// runtime's hash function takes the integer seed directly.
+func seedBits(s hashSeed) uintptr {
+	return uintptr(s)
+}
+
 // getRuntimeHasher peeks inside the internals of map[K]struct{} and extracts
 // the function the runtime generated for hashing type K. This is a bit hacky,
 // but we can't use hash/maphash as that hashes only bytes and strings. While
@@ -47,7 +65,10 @@ type hashFn func(key unsafe.Pointer, seed uintptr) uintptr
 //
 // https://github.com/dolthub/maphash provided the inspiration and general
 // implementation technique.
-func getRuntimeHasher[K comparable]() hashFn {
+//
+// The returned hash function takes the seed as an argument, so it is not
+// bound to s.
+func getRuntimeHasher[K comparable](s hashSeed) hashFn {
 	a := any((map[K]struct{})(nil))
 	return (*rtEface)(unsafe.Pointer(&a)).typ.Hasher
 }
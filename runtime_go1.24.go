@@ -0,0 +1,106 @@
+// Copyright 2024 The Cockroach Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// On go1.24 and later keys are hashed with hash/maphash.Comparable, which
+// hashes any comparable value with the runtime's hasher for its type, so the
+// package does not depend on the runtime's internals. Building with the
+// untested_go_version build tag instead selects the introspection of the
+// runtime's map type in runtime_go1.20.go.
+//go:build go1.24 && !untested_go_version
+
+package swiss
+
+import (
+	"hash/maphash"
+	"math/rand/v2"
+	"time"
+	"unsafe"
+)
+
+func fastrand64() uint64 {
+	return rand.Uint64()
+}
+
+// nanotimeStart is the reference point of nanotime.
+var nanotimeStart = time.Now()
+
+// nanotime returns the time of the monotonic clock in nanoseconds, relative to
+// an arbitrary point in the past.
+func nanotime() int64 {
+	return int64(time.Since(nanotimeStart))
+}
+
+type hashFn func(key unsafe.Pointer, seed uintptr) uintptr
+
+// hashSeed is the seed to which the default hash function of a map is bound
+// (see getHasher). Maps are seeded independently, and Map.Clear makes a new
+// seed.
+type hashSeed = maphash.Seed
+
+func newHashSeed() hashSeed {
+	return maphash.MakeSeed()
+}
+
+// seedBits returns the integer seed of a map which is derived from s. The
+// hash functions bound to s ignore the integer seed passed to them, but it
+// is still used to seed the hashing of keys by the specialized hash
+// functions (see getHasher) and by WithHash.
+func seedBits(s hashSeed) uintptr {
+	return uintptr(maphash.String(s, ""))
+}
+
+// getRuntimeHasher returns the runtime's hash function for type K, as exposed
+// by maphash.Comparable, bound to seed s. A generic instantiation of
+// maphash.Comparable looks up the hash function of its type argument on each
+// call, so the common key types are hashed by instantiations with a concrete
+// type argument.
+func getRuntimeHasher[K comparable](s hashSeed) hashFn {
+	switch any((*K)(nil)).(type) {
+	case *int:
+		return func(key unsafe.Pointer, _ uintptr) uintptr {
+			return uintptr(maphash.Comparable(s, *(*int)(key)))
+		}
+	case *int32:
+		return func(key unsafe.Pointer, _ uintptr) uintptr {
+			return uintptr(maphash.Comparable(s, *(*int32)(key)))
+		}
+	case *int64:
+		return func(key unsafe.Pointer, _ uintptr) uintptr {
+			return uintptr(maphash.Comparable(s, *(*int64)(key)))
+		}
+	case *uint:
+		return func(key unsafe.Pointer, _ uintptr) uintptr {
+			return uintptr(maphash.Comparable(s, *(*uint)(key)))
+		}
+	case *uint32:
+		return func(key unsafe.Pointer, _ uintptr) uintptr {
+			return uintptr(maphash.Comparable(s, *(*uint32)(key)))
+		}
+	case *uint64:
+		return func(key unsafe.Pointer, _ uintptr) uintptr {
+			return uintptr(maphash.Comparable(s, *(*uint64)(key)))
+		}
+	case *uintptr:
+		return func(key unsafe.Pointer, _ uintptr) uintptr {
+			return uintptr(maphash.Comparable(s, *(*uintptr)(key)))
+		}
+	case *string:
+		return func(key unsafe.Pointer, _ uintptr) uintptr {
+			return uintptr(maphash.Comparable(s, *(*string)(key)))
+		}
+	}
+	return func(key unsafe.Pointer, _ uintptr) uintptr {
+		return uintptr(maphash.Comparable(s, *(*K)(key)))
+	}
+}
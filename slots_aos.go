@@ -0,0 +1,98 @@
+// Copyright 2024 The Cockroach Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+//go:build !swiss_soa
+
+package swiss
+
+import "unsafe"
+
+// LayoutVersion identifies the memory layout of a Group. A Group currently
+// holds 8 control bytes, one per slot, followed by 8 slots each holding a key
+// and its value (16 of each with the "swiss_sse2" build tag, see
+// CtrlBytesFor(1) for the number of slots). The version is incremented whenever the layout changes (e.g.
+// additional metadata bytes), so that an Allocator which computes sizes or
+// offsets within the memory it manages can assert the layout it was written
+// against at compile time:
+//
+//	var _ [0]struct{} = [swiss.LayoutVersion - 1]struct{}{}
+//
+// Building with the "swiss_soa" build tag selects layout 2, in which the keys
+// and values of a Group are stored in separate arrays (see slotGroup).
+const LayoutVersion = 1
+
+// Don't change the layout of a Group without incrementing LayoutVersion.
+// This will cause a type error if the size of a Group changes.
+var _ [0]struct{} = [unsafe.Sizeof(Group[int64, int64]{}) - groupSize*(1+16)]struct{}{}
+
+// SlotSize returns the size in bytes of a slot of a Map[K, V], which holds a
+// key and its value.
+func SlotSize[K comparable, V any]() uintptr {
+	return unsafe.Sizeof(slot[K, V]{})
+}
+
+// slotGroup is a fixed size array of groupSize slots.
+//
+// The keys and values are stored interleaved in slots with a memory layout
+// that looks like K/V/K/V/K/V/K/V.../K/V. An alternate layout would be have
+// parallel arrays of keys and values: K/K/K/K.../K/V/V/V/V.../V. The latter
+// has better space utilization if you have something like uint64 keys and
+// bool values, but it is measurably slower at large map sizes. Below shows
+// this perf hit with a Map[uint64,uint64]. The problem is due to the key and
+// value being stored in separate cache lines.
+//
+// MapGetHit/swissMap/Int64/262144-10    9.31ns ± 3%  10.04ns ± 3%   +7.81%  (p=0.008 n=5+5)
+// MapGetHit/swissMap/Int64/524288-10    16.7ns ± 1%   18.2ns ± 3%   +8.98%  (p=0.008 n=5+5)
+// MapGetHit/swissMap/Int64/1048576-10   24.7ns ± 2%   27.6ns ± 0%  +11.74%  (p=0.008 n=5+5)
+// MapGetHit/swissMap/Int64/2097152-10   33.3ns ± 1%   37.7ns ± 1%  +13.12%  (p=0.008 n=5+5)
+// MapGetHit/swissMap/Int64/4194304-10   36.6ns ± 0%   43.0ns ± 1%  +17.37%  (p=0.008 n=5+5)
+//
+// The parallel layout is available with the "swiss_soa" build tag, for
+// value types large enough that not reading them while probing outweighs the
+// extra cache line touched by a hit.
+type slotGroup[K comparable, V any] struct {
+	slots [groupSize]slot[K, V]
+}
+
+func (g *slotGroup[K, V]) at(i uint32) *slot[K, V] {
+	return (*slot[K, V])(unsafe.Add(unsafe.Pointer(&g.slots[0]), uintptr(i)*unsafe.Sizeof(g.slots[0])))
+}
+
+// Key returns the key in slot i.
+func (g *slotGroup[K, V]) Key(i uint32) *K {
+	return &g.at(i).key
+}
+
+// Value returns the value in slot i.
+func (g *slotGroup[K, V]) Value(i uint32) *V {
+	return &g.at(i).value
+}
+
+// Set stores key and value in slot i.
+func (g *slotGroup[K, V]) Set(i uint32, key K, value V) {
+	s := g.at(i)
+	s.key = key
+	s.value = value
+}
+
+// Clear zeroes slot i so that the GC does not retain its key and value.
+func (g *slotGroup[K, V]) Clear(i uint32) {
+	*g.at(i) = slot[K, V]{}
+}
+
+// Swap exchanges the contents of slot i with slot j of o.
+func (g *slotGroup[K, V]) Swap(i uint32, o *slotGroup[K, V], j uint32) {
+	s, t := g.at(i), o.at(j)
+	*s, *t = *t, *s
+}
@@ -0,0 +1,89 @@
+// Copyright 2024 The Cockroach Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+//go:build swiss_soa
+
+package swiss
+
+import "unsafe"
+
+// LayoutVersion identifies the memory layout of a Group. As we were built
+// with the "swiss_soa" build tag, a Group holds 8 control bytes, one per
+// slot, followed by an array of the 8 keys of its slots and then an array of
+// their 8 values (16 of each with the "swiss_sse2" build tag). See the non-swiss_soa definition for how an Allocator
+// should use LayoutVersion.
+const LayoutVersion = 2
+
+// Don't change the layout of a Group without incrementing LayoutVersion.
+// This will cause a type error if the size of a Group changes.
+var _ [0]struct{} = [unsafe.Sizeof(Group[int8, int64]{}) - groupSize*(1+1+8)]struct{}{}
+
+// SlotSize returns the size in bytes of a slot of a Map[K, V], which holds a
+// key and its value. With the parallel layout a slot has no representation
+// of its own, so this is the size of the slots of a Group divided by the
+// number of slots. The arrays of keys and values need no padding, except
+// that the compiler pads a Group whose value type has size zero (so that a
+// pointer to its last value does not point past the Group). The padding is
+// the size of a pointer, so it is included in the result on 64-bit platforms
+// with 8 slot groups, and otherwise it is not a multiple of the number of
+// slots and is excluded.
+func SlotSize[K comparable, V any]() uintptr {
+	var g Group[K, V]
+	return (unsafe.Sizeof(g) - unsafe.Offsetof(g.slots)) / groupSize
+}
+
+// slotGroup is a fixed size array of groupSize slots, stored as parallel
+// arrays of keys and values: K/K/K/K.../K/V/V/V/V.../V. Lookups only read
+// the keys until a key matches, and iterating over only the keys (see
+// Map.Keys) never reads the values, which for large value types avoids
+// pulling the cache lines holding them into memory. The keys immediately
+// follow the control bytes, so the first keys of a group share a cache line
+// with its control bytes, as with the interleaved layout. A hit reads the
+// value from a separate cache line, which makes lookups of small entries
+// slower at large map sizes (see the non-swiss_soa definition).
+type slotGroup[K comparable, V any] struct {
+	keys   [groupSize]K
+	values [groupSize]V
+}
+
+// Key returns the key in slot i.
+func (g *slotGroup[K, V]) Key(i uint32) *K {
+	return (*K)(unsafe.Add(unsafe.Pointer(&g.keys), uintptr(i)*unsafe.Sizeof(g.keys[0])))
+}
+
+// Value returns the value in slot i.
+func (g *slotGroup[K, V]) Value(i uint32) *V {
+	return (*V)(unsafe.Add(unsafe.Pointer(&g.values), uintptr(i)*unsafe.Sizeof(g.values[0])))
+}
+
+// Set stores key and value in slot i.
+func (g *slotGroup[K, V]) Set(i uint32, key K, value V) {
+	*g.Key(i) = key
+	*g.Value(i) = value
+}
+
+// Clear zeroes slot i so that the GC does not retain its key and value.
+func (g *slotGroup[K, V]) Clear(i uint32) {
+	var key K
+	var value V
+	g.Set(i, key, value)
+}
+
+// Swap exchanges the contents of slot i with slot j of o.
+func (g *slotGroup[K, V]) Swap(i uint32, o *slotGroup[K, V], j uint32) {
+	k, ok := g.Key(i), o.Key(j)
+	*k, *ok = *ok, *k
+	v, ov := g.Value(i), o.Value(j)
+	*v, *ov = *ov, *v
+}
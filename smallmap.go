@@ -0,0 +1,143 @@
+// Copyright 2024 The Cockroach Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package swiss
+
+import "unsafe"
+
+// SmallMap is a map from keys to values for embedding by value in other
+// structures when there are many thousands of them, each holding few
+// entries. It is a single Swiss table bucket without the extendible hashing
+// of Map: there is no directory, so locating the bucket of a key never
+// branches on the directory's depth, and the header is 48 bytes (on 64-bit
+// architectures) rather than the several hundred bytes of a Map. The bucket
+// code (probing, insertion, deletion, and rehashing) is shared with Map.
+//
+// A SmallMap uses the default hash function and allocates its groups with
+// make, and does not support the options of a Map. Its capacity doubles as
+// it grows without bound, so a SmallMap which grows large incurs the latency
+// of rehashing all of its entries at once (which Map avoids by splitting
+// buckets).
+//
+// The zero value for a SmallMap is an empty map ready to use. Like Map, a
+// SmallMap is NOT goroutine-safe.
+type SmallMap[K comparable, V any] struct {
+	_    noCopy
+	hash hashFn
+	seed uintptr
+	b    bucket[K, V]
+}
+
+// Don't add fields to SmallMap unnecessarily: its size is its reason to
+// exist. This will cause a type error if the size of a SmallMap changes.
+var _ [0]struct{} = [unsafe.Sizeof(SmallMap[int, int]{}) - (2*ptrSize + expectedBucketSize)]struct{}{}
+
+// init initializes a zero value SmallMap on first insertion.
+func (s *SmallMap[K, V]) init() {
+	s.hash, s.seed = newHasher[K]()
+}
+
+// Get retrieves the value from the map for the specified key, returning
+// ok=false if the key is not present.
+func (s *SmallMap[K, V]) Get(key K) (value V, ok bool) {
+	if s.b.used == 0 {
+		return value, false
+	}
+	h := s.hash(noescape(unsafe.Pointer(&key)), s.seed)
+	if v := s.b.lookup(key, h, nil); v != nil {
+		return *v, true
+	}
+	return value, false
+}
+
+// Put inserts an entry into the map, overwriting an existing value if an
+// entry with the same key already exists.
+func (s *SmallMap[K, V]) Put(key K, value V) {
+	if s.hash == nil {
+		s.init()
+	}
+	h := s.hash(noescape(unsafe.Pointer(&key)), s.seed)
+	if s.b.capacity == 0 {
+		s.grow()
+	}
+	g, _, i, found := s.b.find(key, h, nil)
+	if found {
+		*g.slots.Value(i) = value
+		return
+	}
+	if s.b.growthLeft > 0 || g.ctrls.Get(i) == ctrlDeleted {
+		s.b.setSlot(g, i, h, key, value)
+	} else {
+		s.grow()
+		s.b.placeNew(h, key, value)
+	}
+	s.b.used++
+}
+
+// Delete deletes the entry corresponding to the specified key from the map,
+// returning true if the key was present.
+func (s *SmallMap[K, V]) Delete(key K) bool {
+	if s.b.used == 0 {
+		return false
+	}
+	h := s.hash(noescape(unsafe.Pointer(&key)), s.seed)
+	g, _, i, found := s.b.find(key, h, nil)
+	if found {
+		s.b.deleteSlot(g, i)
+	}
+	return found
+}
+
+// grow resizes the bucket to make room for at least one more entry,
+// doubling its capacity unless dropping its tombstones reclaims at least a
+// third of it.
+func (s *SmallMap[K, V]) grow() {
+	newCapacity := 2 * s.b.capacity
+	switch {
+	case s.b.capacity == 0:
+		newCapacity = groupSize
+	case s.b.capacity > groupSize && s.b.tombstones() >= s.b.capacity/3:
+		newCapacity = s.b.capacity
+	}
+	oldGroups, oldGroupCount := s.b.groups, s.b.groupCount()
+	s.b.setGroups(make([]Group[K, V], newCapacity/groupSize))
+	s.b.reinsert(oldGroups, oldGroupCount, s.hash, s.seed)
+}
+
+// Len returns the number of entries in the map.
+func (s *SmallMap[K, V]) Len() int {
+	return int(s.b.used)
+}
+
+// Clear deletes all entries from the map, retaining its capacity.
+func (s *SmallMap[K, V]) Clear() {
+	if s.b.capacity > 0 {
+		s.b.clear()
+	}
+}
+
+// All calls yield sequentially for each key and value present in the map,
+// in an unspecified order. If yield returns false, iteration stops. The map
+// must not be mutated during iteration.
+func (s *SmallMap[K, V]) All(yield func(key K, value V) bool) {
+	for i, n := uint32(0), s.b.groupCount(); i < n; i++ {
+		g := s.b.groups.At(uintptr(i))
+		for match := g.ctrls.matchFull(); match != 0; match = match.removeFirst() {
+			j := match.first()
+			if !yield(*g.slots.Key(j), *g.slots.Value(j)) {
+				return
+			}
+		}
+	}
+}
@@ -0,0 +1,160 @@
+// Copyright 2024 The Cockroach Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+//go:build go1.24
+
+package swiss
+
+import (
+	"runtime"
+	"sync"
+	"weak"
+)
+
+// weakEntry is the value stored in the Map underlying a WeakMap.
+type weakEntry[V any] struct {
+	value V
+	// cleanup removes the entry once its key becomes unreachable. It is
+	// stopped when the entry is deleted.
+	cleanup runtime.Cleanup
+}
+
+// weakQueue holds the keys of a WeakMap which have become unreachable. The
+// cleanups registered by a WeakMap run on a separate goroutine, so they
+// enqueue the keys to be deleted by the next operation on the map rather
+// than mutating the map.
+type weakQueue[T any] struct {
+	mu   sync.Mutex
+	keys []weak.Pointer[T]
+}
+
+func (q *weakQueue[T]) push(key weak.Pointer[T]) {
+	q.mu.Lock()
+	q.keys = append(q.keys, key)
+	q.mu.Unlock()
+}
+
+// WeakMap is a map keyed by the identity of objects of type T which does not
+// keep its keys reachable. The entry for a key is removed automatically once
+// the object it points to becomes unreachable, making a WeakMap suitable for
+// caching data associated with objects without leaking it. A WeakMap is
+// composed of a Map from weak pointers (see the weak package) to values, and
+// a cleanup (see runtime.AddCleanup) registered for each key. Entries whose
+// keys have been reclaimed by the garbage collector are not visible to Get or
+// All, and are deleted from the map by the next call to Put, Delete, or Len
+// after their cleanups have run.
+//
+// The value for a key must not reference the key, otherwise the key never
+// becomes unreachable and its entry is never removed. As with
+// runtime.AddCleanup, the entry for a key which shares its allocation with
+// other objects (e.g. a tiny object without pointers) may not be removed
+// until all of them are unreachable.
+//
+// The zero value for a WeakMap is an empty map ready to use. Like Map, a
+// WeakMap is NOT goroutine-safe. WeakMap requires Go 1.24 or later.
+type WeakMap[T, V any] struct {
+	m Map[weak.Pointer[T], weakEntry[V]]
+	// dead holds the keys which have become unreachable but have not yet
+	// been deleted from m. It is allocated on first use so that the cleanups
+	// do not reference the WeakMap.
+	dead *weakQueue[T]
+}
+
+// NewWeakMap constructs a new WeakMap with the specified initial capacity
+// (see New).
+func NewWeakMap[T, V any](initialCapacity int) *WeakMap[T, V] {
+	wm := &WeakMap[T, V]{}
+	wm.m.Init(initialCapacity)
+	return wm
+}
+
+// Put inserts an entry into the map, overwriting an existing value if an
+// entry with the same key already exists. Put panics if key is nil.
+func (wm *WeakMap[T, V]) Put(key *T, value V) {
+	if key == nil {
+		panic("WeakMap key must not be nil")
+	}
+	wm.reap()
+	if wm.dead == nil {
+		wm.dead = &weakQueue[T]{}
+	}
+	wp := weak.Make(key)
+	loc := wm.m.find(wp)
+	if loc.found {
+		wm.m.mutableLocation(loc).value().value = value
+		return
+	}
+	e := weakEntry[V]{value: value}
+	e.cleanup = runtime.AddCleanup(key, wm.dead.push, wp)
+	wm.m.insert(loc, wp, e)
+}
+
+// Get retrieves the value for the specified key, returning ok=false if the
+// key is not present.
+func (wm *WeakMap[T, V]) Get(key *T) (value V, ok bool) {
+	if key == nil {
+		return value, false
+	}
+	e, ok := wm.m.Get(weak.Make(key))
+	return e.value, ok
+}
+
+// Delete deletes the entry with the specified key, returning true if the key
+// was present.
+func (wm *WeakMap[T, V]) Delete(key *T) bool {
+	wm.reap()
+	if key == nil {
+		return false
+	}
+	e, ok := wm.m.Pop(weak.Make(key))
+	if ok {
+		e.cleanup.Stop()
+	}
+	return ok
+}
+
+// Len returns the number of entries in the map, excluding those whose keys
+// have been reclaimed by the garbage collector and whose cleanups have run.
+func (wm *WeakMap[T, V]) Len() int {
+	wm.reap()
+	return wm.m.Len()
+}
+
+// All calls yield sequentially for each key and value present in the map
+// (see Map.All). Entries whose keys have been reclaimed by the garbage
+// collector are skipped.
+func (wm *WeakMap[T, V]) All(yield func(key *T, value V) bool) {
+	wm.m.All(func(wp weak.Pointer[T], e weakEntry[V]) bool {
+		key := wp.Value()
+		if key == nil {
+			return true
+		}
+		return yield(key, e.value)
+	})
+}
+
+// reap deletes the entries whose keys have become unreachable.
+func (wm *WeakMap[T, V]) reap() {
+	if wm.dead == nil {
+		return
+	}
+	q := wm.dead
+	q.mu.Lock()
+	keys := q.keys
+	q.keys = nil
+	q.mu.Unlock()
+	for _, wp := range keys {
+		wm.m.Delete(wp)
+	}
+}
@@ -0,0 +1,79 @@
+// Copyright 2024 The Cockroach Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+//go:build go1.24
+
+package swiss
+
+import (
+	"runtime"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+// weakKey is large enough to be allocated on its own rather than combined
+// with other tiny objects, so that it is reclaimed as soon as it becomes
+// unreachable.
+type weakKey struct {
+	id  int
+	pad [32]byte
+}
+
+func TestWeakMap(t *testing.T) {
+	var wm WeakMap[weakKey, int]
+	keys := make([]*weakKey, 100)
+	for i := range keys {
+		keys[i] = &weakKey{id: i}
+		wm.Put(keys[i], i)
+	}
+	wm.Put(keys[0], -1)
+	require.Equal(t, 100, wm.Len())
+	v, ok := wm.Get(keys[0])
+	require.True(t, ok)
+	require.Equal(t, -1, v)
+	_, ok = wm.Get(&weakKey{id: 1})
+	require.False(t, ok)
+
+	require.True(t, wm.Delete(keys[1]))
+	require.False(t, wm.Delete(keys[1]))
+	require.False(t, wm.Delete(nil))
+	require.Equal(t, 99, wm.Len())
+
+	// Drop the references to the odd keys. Their entries are removed once the
+	// keys are reclaimed and their cleanups have run.
+	for i := 1; i < len(keys); i += 2 {
+		keys[i] = nil
+	}
+	deadline := time.Now().Add(10 * time.Second)
+	for wm.Len() > 50 {
+		require.True(t, time.Now().Before(deadline), "entries not removed: %d", wm.Len())
+		runtime.GC()
+		time.Sleep(time.Millisecond)
+	}
+	require.Equal(t, 50, wm.Len())
+	count := 0
+	wm.All(func(key *weakKey, value int) bool {
+		require.Zero(t, key.id%2)
+		require.Same(t, keys[key.id], key)
+		count++
+		return true
+	})
+	require.Equal(t, 50, count)
+	require.NoError(t, wm.m.Validate())
+	runtime.KeepAlive(keys)
+
+	require.Panics(t, func() { wm.Put(nil, 0) })
+}